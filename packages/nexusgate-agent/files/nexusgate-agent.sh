@@ -6,6 +6,13 @@
 
 CONFIG_FILE="/etc/config/nexusgate"
 AGENT_ID_FILE="/etc/nexusgate/agent_id"
+TUNNEL_KEY="/etc/nexusgate/tunnel_key"
+TUNNEL_PID="/var/run/nexusgate_tunnel.pid"
+
+# Agent protocol (see GET /api/v1/protocol on the server)
+AGENT_VERSION="1.1.0"
+PROTOCOL_VERSION=1
+CAPABILITIES='"heartbeat.details","config.ack","config.confirm","upgrade.ack","upgrade.progress","command.reboot","command.upgrade","command.confirm_config","rpc","command.ping","command.system_info","command.logread","command.syslog_forward","command.uci_export"'
 
 get_config() {
     config_load nexusgate
@@ -56,6 +63,10 @@ register() {
     model=$(get_model)
     firmware=$(get_firmware)
 
+    local tunnel_key tunnel_caps=""
+    tunnel_key=$(tunnel_public_key)
+    [ -n "$tunnel_key" ] && tunnel_caps=',"tunnel","command.tunnel_open","command.tunnel_close"'
+
     local payload
     payload=$(cat <<EOF
 {
@@ -63,7 +74,11 @@ register() {
     "mac": "$mac",
     "ip_address": "$(ip -4 addr show br-lan 2>/dev/null | grep -oP 'inet \K[\d.]+')",
     "model": "$model",
-    "firmware": "$firmware"
+    "firmware": "$firmware",
+    "agent_version": "$AGENT_VERSION",
+    "protocol_version": $PROTOCOL_VERSION,
+    "capabilities": [$CAPABILITIES,$(diagnostic_capabilities)$tunnel_caps],
+    "tunnel_key": "$tunnel_key"
 }
 EOF
 )
@@ -73,16 +88,85 @@ EOF
         "${SERVER_URL}/api/v1/devices/register" > /dev/null 2>&1
 }
 
+# Per-interface kernel counters as a JSON array (loopback excluded)
+collect_interfaces() {
+    local dir name up speed sep=""
+    printf '['
+    for dir in /sys/class/net/*; do
+        name=${dir##*/}
+        [ "$name" = "lo" ] && continue
+        [ -d "$dir/statistics" ] || continue
+        up=false
+        [ "$(cat "$dir/operstate" 2>/dev/null)" = "up" ] && up=true
+        speed=$(cat "$dir/speed" 2>/dev/null || echo -1)
+        printf '%s{"name":"%s","rx_bytes":%s,"tx_bytes":%s,"rx_packets":%s,"tx_packets":%s,"rx_errors":%s,"tx_errors":%s,"up":%s,"speed":%s}' \
+            "$sep" "$name" \
+            "$(cat "$dir/statistics/rx_bytes")" "$(cat "$dir/statistics/tx_bytes")" \
+            "$(cat "$dir/statistics/rx_packets")" "$(cat "$dir/statistics/tx_packets")" \
+            "$(cat "$dir/statistics/rx_errors")" "$(cat "$dir/statistics/tx_errors")" \
+            "$up" "${speed:--1}"
+        sep=","
+    done
+    printf ']'
+}
+
+# Usage of the overlay and tmp filesystems in KiB
+collect_filesystems() {
+    df -k /overlay /tmp 2>/dev/null | awk '
+        NR > 1 && !seen[$6]++ {
+            printf "%s{\"mount\":\"%s\",\"total_kb\":%d,\"used_kb\":%d}", sep, $6, $2, $3
+            sep = ","
+        }
+        BEGIN { printf "[" }
+        END { printf "]" }'
+}
+
+# Thermal zone temperatures in millidegrees Celsius
+collect_thermal() {
+    local dir zone temp sep=""
+    printf '['
+    for dir in /sys/class/thermal/thermal_zone*; do
+        [ -r "$dir/temp" ] || continue
+        temp=$(cat "$dir/temp" 2>/dev/null) || continue
+        zone=$(cat "$dir/type" 2>/dev/null || echo "${dir##*/}")
+        printf '%s{"zone":"%s","temp":%s}' "$sep" "$zone" "$temp"
+        sep=","
+    done
+    printf ']'
+}
+
+# Associated client count per wireless interface
+collect_wireless() {
+    local iface radio ssid clients sep=""
+    printf '['
+    for iface in $(iw dev 2>/dev/null | awk '$1 == "Interface" {print $2}'); do
+        radio=$(cat "/sys/class/net/$iface/phy80211/name" 2>/dev/null)
+        ssid=$(iw dev "$iface" info 2>/dev/null | awk '$1 == "ssid" {sub(/^[ \t]*ssid /, ""); print; exit}' | sed 's/["\\]/\\&/g')
+        clients=$(iw dev "$iface" station dump 2>/dev/null | grep -c '^Station')
+        printf '%s{"radio":"%s","interface":"%s","ssid":"%s","clients":%s}' "$sep" "$radio" "$iface" "$ssid" "${clients:-0}"
+        sep=","
+    done
+    printf ']'
+}
+
+# Device of the wan interface, for the top-level rx/tx counters
+get_wan_device() {
+    local dev
+    dev=$(ubus call network.interface.wan status 2>/dev/null | jsonfilter -e '@.l3_device' 2>/dev/null)
+    echo "${dev:-eth0}"
+}
+
 # Collect and publish system metrics
 publish_heartbeat() {
     local mac cpu_usage mem_total mem_free mem_usage uptime_secs load_avg
-    local rx_bytes tx_bytes conntrack
+    local rx_bytes tx_bytes conntrack wan_dev
 
     mac=$(get_mac)
 
     # CPU usage (1s sample)
-    cpu_usage=$(awk '{u=$2+$4; t=$2+$4+$5; if(NR==1){pu=u;pt=t} else {printf "%.1f", (u-pu)*100/(t-pt)}}' \
-        <(grep 'cpu ' /proc/stat; sleep 1; grep 'cpu ' /proc/stat) 2>/dev/null || echo "0")
+    cpu_usage=$( (grep 'cpu ' /proc/stat; sleep 1; grep 'cpu ' /proc/stat) | \
+        awk '{u=$2+$4; t=$2+$4+$5; if(NR==1){pu=u;pt=t} else {printf "%.1f", (t>pt) ? (u-pu)*100/(t-pt) : 0}}')
+    [ -n "$cpu_usage" ] || cpu_usage=0
 
     # Memory
     mem_total=$(awk '/MemTotal/{print $2}' /proc/meminfo)
@@ -96,8 +180,9 @@ publish_heartbeat() {
     load_avg=$(cat /proc/loadavg | cut -d' ' -f1-3)
 
     # Network (wan interface)
-    rx_bytes=$(cat /sys/class/net/eth0/statistics/rx_bytes 2>/dev/null || echo 0)
-    tx_bytes=$(cat /sys/class/net/eth0/statistics/tx_bytes 2>/dev/null || echo 0)
+    wan_dev=$(get_wan_device)
+    rx_bytes=$(cat "/sys/class/net/$wan_dev/statistics/rx_bytes" 2>/dev/null || echo 0)
+    tx_bytes=$(cat "/sys/class/net/$wan_dev/statistics/tx_bytes" 2>/dev/null || echo 0)
 
     # Conntrack
     conntrack=$(cat /proc/sys/net/netfilter/nf_conntrack_count 2>/dev/null || echo 0)
@@ -105,7 +190,7 @@ publish_heartbeat() {
     local topic="nexusgate/devices/${mac}/status"
     local payload
     payload=$(cat <<EOF
-{"mac":"$mac","cpu_usage":$cpu_usage,"mem_usage":$mem_usage,"mem_total":$mem_total,"mem_free":$mem_free,"rx_bytes":$rx_bytes,"tx_bytes":$tx_bytes,"conntrack":$conntrack,"uptime_secs":$uptime_secs,"load_avg":"$load_avg"}
+{"v":$PROTOCOL_VERSION,"mac":"$mac","cpu_usage":$cpu_usage,"mem_usage":$mem_usage,"mem_total":$mem_total,"mem_free":$mem_free,"rx_bytes":$rx_bytes,"tx_bytes":$tx_bytes,"conntrack":$conntrack,"uptime_secs":$uptime_secs,"load_avg":"$load_avg","interfaces":$(collect_interfaces),"filesystems":$(collect_filesystems),"thermal":$(collect_thermal),"wireless":$(collect_wireless)}
 EOF
 )
     mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
@@ -113,12 +198,27 @@ EOF
         -t "$topic" -m "$payload" -q 1
 }
 
-# Firmware upgrade: download, verify SHA256, and flash
+# Publish an upgrade ACK: upgrade_ack <upgrade_id> <status> [progress] [error]
+upgrade_ack() {
+    local mac progress=""
+    mac=$(get_mac)
+    [ -n "$1" ] || return 0
+    [ -n "$3" ] && progress=",\"progress\":$3"
+    mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
+        -t "nexusgate/devices/${mac}/upgrade/ack" \
+        -m "{\"v\":$PROTOCOL_VERSION,\"upgrade_id\":$1,\"status\":\"$2\"$progress,\"error\":\"$4\"}" -q 1
+}
+
+# Firmware upgrade: download, verify SHA256, and flash. When the server asked
+# for progress reports, each stage is acknowledged with a progress percentage.
 sysupgrade_url() {
     local url="$1"
     local expected_sha256="$2"
+    local upgrade_id="$3"
+    local report_progress="$4"
     local firmware_path="/tmp/firmware.bin"
 
+    [ "$report_progress" = "true" ] && upgrade_ack "$upgrade_id" downloading 0
     logger -t nexusgate "Downloading firmware from $url"
     wget -q -O "$firmware_path" "$url" 2>/dev/null
     if [ $? -ne 0 ]; then
@@ -127,6 +227,7 @@ sysupgrade_url() {
     fi
 
     # Verify SHA256 if provided
+    [ "$report_progress" = "true" ] && upgrade_ack "$upgrade_id" verifying 60
     if [ -n "$expected_sha256" ]; then
         local actual_sha256
         actual_sha256=$(sha256sum "$firmware_path" | cut -d' ' -f1)
@@ -138,10 +239,232 @@ sysupgrade_url() {
         logger -t nexusgate "SHA256 verified OK"
     fi
 
+    [ "$report_progress" = "true" ] && upgrade_ack "$upgrade_id" upgrading 90
     logger -t nexusgate "Starting sysupgrade..."
     sysupgrade "$firmware_path"
 }
 
+# Publish an RPC reply: rpc_reply <request_id> <result JSON>
+rpc_reply() {
+    mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
+        -t "nexusgate/devices/$(get_mac)/rpc/response" \
+        -m "{\"v\":$PROTOCOL_VERSION,\"request_id\":\"$1\",\"result\":$2}" -q 1
+}
+
+# Publish an RPC error: rpc_error <request_id> <code> <message>
+rpc_error() {
+    mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
+        -t "nexusgate/devices/$(get_mac)/rpc/response" \
+        -m "{\"v\":$PROTOCOL_VERSION,\"request_id\":\"$1\",\"error\":{\"code\":\"$2\",\"message\":\"$3\"}}" -q 1
+}
+
+# Diagnostic tools installed on this device, as capabilities
+diagnostic_capabilities() {
+    local caps='"command.diagnostic","diagnostic.ping","diagnostic.traceroute","diagnostic.nslookup","diagnostic.wget"'
+    command -v mtr >/dev/null 2>&1 && caps="$caps,\"diagnostic.mtr\""
+    command -v iperf3 >/dev/null 2>&1 && caps="$caps,\"diagnostic.iperf3\""
+    echo "$caps"
+}
+
+# Stream one line of diagnostic output: diagnostic_progress <diagnostic_id> <line>
+diagnostic_progress() {
+    mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
+        -t "nexusgate/devices/$(get_mac)/diagnostic/progress" \
+        -m "$(jq -cn --argjson v "$PROTOCOL_VERSION" --argjson id "$1" --arg line "$2" '{v:$v,diagnostic_id:$id,line:$line}')" -q 1
+}
+
+# Time a download (at most 100 MB): speedtest <url>
+speedtest() {
+    local start end bytes
+    start=$(cut -d' ' -f1 /proc/uptime)
+    bytes=$(wget -q -T 30 -O - "$1" 2>/dev/null | head -c 104857600 | wc -c)
+    end=$(cut -d' ' -f1 /proc/uptime)
+    echo "bytes=$bytes seconds=$(awk "BEGIN{printf \"%.2f\", $end-$start}")"
+    [ "$bytes" -gt 0 ]
+}
+
+# Run a diagnostic RPC: run_diagnostic <request_id> <message>
+# Output lines are streamed on diagnostic/progress as they appear (except for
+# iperf3, whose JSON report is only complete at the end); the full output
+# (at most 64 KB) and exit code are the RPC result. The server parses it.
+run_diagnostic() {
+    local id="$1" msg="$2" out="/tmp/nexusgate_diag_$1" diag_id action target count server port duration url rtype rc
+    diag_id=$(echo "$msg" | jsonfilter -e '@.params.diagnostic_id' 2>/dev/null)
+    action=$(echo "$msg" | jsonfilter -e '@.params.action' 2>/dev/null)
+    target=$(echo "$msg" | jsonfilter -e '@.params.target' 2>/dev/null)
+    count=$(echo "$msg" | jsonfilter -e '@.params.count' 2>/dev/null)
+    server=$(echo "$msg" | jsonfilter -e '@.params.server' 2>/dev/null)
+    port=$(echo "$msg" | jsonfilter -e '@.params.port' 2>/dev/null)
+    duration=$(echo "$msg" | jsonfilter -e '@.params.duration' 2>/dev/null)
+    url=$(echo "$msg" | jsonfilter -e '@.params.url' 2>/dev/null)
+    rtype=$(echo "$msg" | jsonfilter -e '@.params.record_type' 2>/dev/null)
+
+    case "$action" in
+        ping)       set -- ping -c "${count:-4}" "$target" ;;
+        traceroute) set -- traceroute -n -w 2 -q 2 -m 20 "$target" ;;
+        nslookup)   set -- nslookup ${rtype:+-type=$rtype} "$target" $server ;;
+        mtr)        set -- mtr -r -n -w -c "${count:-10}" "$target" ;;
+        iperf3)
+            set -- iperf3 -J -c "$server" -p "${port:-5201}" -t "${duration:-10}"
+            [ "$(echo "$msg" | jsonfilter -e '@.params.reverse' 2>/dev/null)" = "true" ] && set -- "$@" -R
+            ;;
+        wget)       set -- speedtest "$url" ;;
+        *)
+            rpc_error "$id" invalid_params "unknown diagnostic: $action"
+            return 0
+            ;;
+    esac
+
+    logger -t nexusgate "Running diagnostic $diag_id: $*"
+    : > "$out"
+    { "$@" 2>&1; echo "$?" > "$out.rc"; } | head -c 65536 | while IFS= read -r line; do
+        echo "$line" >> "$out"
+        [ "$action" != iperf3 ] && [ -n "$diag_id" ] && diagnostic_progress "$diag_id" "$line"
+    done
+    rc=$(cat "$out.rc" 2>/dev/null)
+    rpc_reply "$id" "$(jq -cn --rawfile output "$out" --argjson rc "${rc:-1}" '{output:$output,exit_code:$rc}')"
+    rm -f "$out" "$out.rc"
+}
+
+# Return the last lines of the log buffer: run_logread <request_id> <message>
+# The tag narrows logread's own filter; the server matches the tag exactly.
+run_logread() {
+    local id="$1" out="/tmp/nexusgate_logread_$1" lines tag
+    lines=$(echo "$2" | jsonfilter -e '@.params.lines' 2>/dev/null)
+    tag=$(echo "$2" | jsonfilter -e '@.params.tag' 2>/dev/null)
+    if [ -n "$tag" ]; then
+        logread -l "${lines:-200}" -e "$tag" 2>/dev/null | head -c 1048576 > "$out"
+    else
+        logread -l "${lines:-200}" 2>/dev/null | head -c 1048576 > "$out"
+    fi
+    rpc_reply "$id" "$(jq -cn --rawfile output "$out" '{output:$output}')"
+    rm -f "$out"
+}
+
+# Print the configuration the server imports: run_uci_export <request_id> <message>
+# Only the packages the server manages are exported; missing ones are skipped.
+run_uci_export() {
+    local id="$1" out="/tmp/nexusgate_uci_$1" packages pkg
+    packages=$(echo "$2" | jsonfilter -e '@.params.packages[*]' 2>/dev/null)
+    : > "$out"
+    for pkg in ${packages:-firewall network dhcp mwan3}; do
+        case "$pkg" in
+            firewall|network|dhcp|mwan3)
+                uci export "$pkg" >> "$out" 2>/dev/null
+                ;;
+        esac
+    done
+    rpc_reply "$id" "$(jq -cn --rawfile output "$out" '{output:$output}')"
+    rm -f "$out"
+}
+
+# Turn remote syslog forwarding (logd log_ip/log_port/log_proto) on or off:
+# set_syslog_forward <request_id> <message>
+set_syslog_forward() {
+    local id="$1" enabled host port proto
+    enabled=$(echo "$2" | jsonfilter -e '@.params.enabled' 2>/dev/null)
+    if [ "$enabled" = "true" ]; then
+        host=$(echo "$2" | jsonfilter -e '@.params.host' 2>/dev/null)
+        port=$(echo "$2" | jsonfilter -e '@.params.port' 2>/dev/null)
+        proto=$(echo "$2" | jsonfilter -e '@.params.proto' 2>/dev/null)
+        uci set system.@system[0].log_ip="$host"
+        uci set system.@system[0].log_port="${port:-514}"
+        uci set system.@system[0].log_proto="${proto:-udp}"
+    else
+        uci -q delete system.@system[0].log_ip
+        uci -q delete system.@system[0].log_port
+        uci -q delete system.@system[0].log_proto
+    fi
+    if uci commit system && /etc/init.d/log restart >/dev/null 2>&1; then
+        logger -t nexusgate "Syslog forwarding ${enabled:-false} ${host:+to $host:$port/$proto}"
+        rpc_reply "$id" "{\"enabled\":${enabled:-false}}"
+    else
+        rpc_error "$id" apply_failed "failed to restart logd"
+    fi
+}
+
+# Public key of the reverse tunnel, generated on first use. Empty without
+# dropbear's dbclient and dropbearkey.
+tunnel_public_key() {
+    command -v dbclient >/dev/null 2>&1 && command -v dropbearkey >/dev/null 2>&1 || return 0
+    if [ ! -f "$TUNNEL_KEY" ]; then
+        mkdir -p "$(dirname "$TUNNEL_KEY")"
+        dropbearkey -t ed25519 -f "$TUNNEL_KEY" >/dev/null 2>&1 || return 0
+    fi
+    dropbearkey -y -f "$TUNNEL_KEY" 2>/dev/null | grep '^ssh-'
+}
+
+# Dial the server's reverse tunnel endpoint, forwarding the requested
+# device-local ports: open_tunnel <message>. A running tunnel is reused; the
+# server closes idle tunnels, which ends dbclient.
+open_tunnel() {
+    local host port user fwd forwards=""
+    if [ -f "$TUNNEL_PID" ] && kill -0 "$(cat "$TUNNEL_PID")" 2>/dev/null; then
+        return 0
+    fi
+    host=$(echo "$1" | jsonfilter -e '@.host' 2>/dev/null)
+    port=$(echo "$1" | jsonfilter -e '@.port' 2>/dev/null)
+    user=$(echo "$1" | jsonfilter -e '@.user' 2>/dev/null)
+    for fwd in $(echo "$1" | jsonfilter -e '@.forwards[*]' 2>/dev/null); do
+        case "$fwd" in
+            ''|*[!0-9]*) continue ;;
+        esac
+        forwards="$forwards -R $fwd:127.0.0.1:$fwd"
+    done
+    if [ -z "$host" ] || [ -z "$user" ] || [ -z "$forwards" ]; then
+        logger -t nexusgate "Ignoring incomplete tunnel_open command"
+        return 1
+    fi
+    logger -t nexusgate "Opening reverse tunnel to $host:${port:-2222}"
+    # -y trusts the server's host key on first use
+    dbclient -y -N -K 30 -i "$TUNNEL_KEY" -p "${port:-2222}" $forwards "$user@$host" \
+        </dev/null >/dev/null 2>&1 &
+    echo $! > "$TUNNEL_PID"
+}
+
+# Stop the reverse tunnel client, if it is running.
+close_tunnel() {
+    if [ -f "$TUNNEL_PID" ]; then
+        logger -t nexusgate "Closing reverse tunnel"
+        kill "$(cat "$TUNNEL_PID")" 2>/dev/null
+        rm -f "$TUNNEL_PID"
+    fi
+}
+
+# Answer an RPC request: rpc_call <request_id> <method> <deadline> <message>
+# Requests whose deadline has passed are dropped; the server stopped waiting.
+rpc_call() {
+    local id="$1" method="$2" deadline="$3" result
+    if [ -n "$deadline" ] && [ "$(date +%s)" -gt "$deadline" ]; then
+        logger -t nexusgate "Dropping expired RPC $method ($id)"
+        return 0
+    fi
+    case "$method" in
+        ping)
+            rpc_reply "$id" "{\"pong\":true,\"time\":$(date +%s)}"
+            ;;
+        diagnostic)
+            run_diagnostic "$id" "$4"
+            ;;
+        logread)
+            run_logread "$id" "$4"
+            ;;
+        syslog_forward)
+            set_syslog_forward "$id" "$4"
+            ;;
+        uci_export)
+            run_uci_export "$id" "$4"
+            ;;
+        system_info)
+            result="{\"board\":$(ubus call system board 2>/dev/null || echo null),\"info\":$(ubus call system info 2>/dev/null || echo null)}"
+            rpc_reply "$id" "$(echo "$result" | tr -d '\n')"
+            ;;
+        *)
+            rpc_error "$id" method_not_found "unknown method: $method"
+            ;;
+    esac
+}
+
 # Subscribe to commands from server
 subscribe_commands() {
     local mac topic client_id
@@ -154,6 +477,14 @@ subscribe_commands() {
         local action
         action=$(echo "$msg" | jsonfilter -e '@.action' 2>/dev/null)
 
+        # RPC requests carry a request_id and are answered on rpc/response
+        local request_id
+        request_id=$(echo "$msg" | jsonfilter -e '@.request_id' 2>/dev/null)
+        if [ -n "$request_id" ]; then
+            rpc_call "$request_id" "$action" "$(echo "$msg" | jsonfilter -e '@.deadline' 2>/dev/null)" "$msg" &
+            continue
+        fi
+
         case "$action" in
             reboot)
                 logger -t nexusgate "Received reboot command"
@@ -164,24 +495,32 @@ subscribe_commands() {
                 # Config content arrives on the config topic
                 ;;
             upgrade)
-                local url sha256 upgrade_id
+                local url sha256 upgrade_id report_progress
                 url=$(echo "$msg" | jsonfilter -e '@.url' 2>/dev/null)
                 sha256=$(echo "$msg" | jsonfilter -e '@.sha256' 2>/dev/null)
                 upgrade_id=$(echo "$msg" | jsonfilter -e '@.upgrade_id' 2>/dev/null)
+                report_progress=$(echo "$msg" | jsonfilter -e '@.report_progress' 2>/dev/null)
                 if [ -n "$url" ]; then
                     logger -t nexusgate "Starting firmware upgrade from $url"
-                    if sysupgrade_url "$url" "$sha256"; then
+                    if sysupgrade_url "$url" "$sha256" "$upgrade_id" "$report_progress"; then
                         # ACK success (this won't run if sysupgrade reboots — that's OK)
-                        mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
-                            -t "nexusgate/devices/${mac}/upgrade/ack" \
-                            -m "{\"upgrade_id\":$upgrade_id,\"status\":\"success\"}" -q 1
+                        upgrade_ack "$upgrade_id" success
                     else
-                        mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
-                            -t "nexusgate/devices/${mac}/upgrade/ack" \
-                            -m "{\"upgrade_id\":$upgrade_id,\"status\":\"failed\",\"error\":\"download or verification failed\"}" -q 1
+                        upgrade_ack "$upgrade_id" failed "" "download or verification failed"
                     fi
                 fi
                 ;;
+            tunnel_open)
+                open_tunnel "$msg"
+                ;;
+            tunnel_close)
+                close_tunnel
+                ;;
+            confirm_config)
+                local config_id
+                config_id=$(echo "$msg" | jsonfilter -e '@.config_id' 2>/dev/null)
+                [ -n "$config_id" ] && touch "/tmp/nexusgate_confirm_${config_id}"
+                ;;
             *)
                 logger -t nexusgate "Unknown command: $action"
                 ;;
@@ -198,9 +537,10 @@ subscribe_config() {
 
     mosquitto_sub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
         -i "$client_id" -q 1 -t "$topic" | while read -r msg; do
-        local config_id content
+        local config_id content confirm_timeout
         config_id=$(echo "$msg" | jsonfilter -e '@.config_id' 2>/dev/null)
         content=$(echo "$msg" | jsonfilter -e '@.content' 2>/dev/null)
+        confirm_timeout=$(echo "$msg" | jsonfilter -e '@.confirm_timeout' 2>/dev/null)
 
         if [ -z "$content" ]; then
             # Legacy: raw UCI text without envelope
@@ -211,26 +551,60 @@ subscribe_config() {
 
         local status="applied"
         local error_msg=""
+        # Commit-confirm: keep a backup to roll back to if the server does
+        # not confirm that it can still reach us
+        [ -n "$confirm_timeout" ] && tar -czf /tmp/nexusgate_rollback.tgz /etc/config 2>/dev/null
         echo "$content" | uci import 2>/tmp/nexusgate_uci_err
         if [ $? -ne 0 ]; then
             status="failed"
-            error_msg=$(cat /tmp/nexusgate_uci_err 2>/dev/null)
+            error_msg=$(cat /tmp/nexusgate_uci_err 2>/dev/null | tr -d '"\\' | tr '\n' ' ')
             logger -t nexusgate "ERROR: uci import failed: $error_msg"
         else
             uci commit
             /etc/init.d/network reload 2>/dev/null
             logger -t nexusgate "Configuration applied successfully"
+            [ -n "$confirm_timeout" ] && status="pending_confirm"
         fi
 
         # Send ACK if we have a config_id
         if [ -n "$config_id" ] && [ "$config_id" != "0" ]; then
-            mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
-                -t "nexusgate/devices/${mac}/config/ack" \
-                -m "{\"config_id\":$config_id,\"status\":\"$status\",\"error\":\"$error_msg\"}" -q 1
+            config_ack "$config_id" "$status" "$error_msg"
+            if [ "$status" = "pending_confirm" ]; then
+                if wait_config_confirm "$config_id" "$confirm_timeout"; then
+                    config_ack "$config_id" applied ""
+                else
+                    logger -t nexusgate "Config $config_id not confirmed within ${confirm_timeout}s, rolling back"
+                    tar -xzf /tmp/nexusgate_rollback.tgz -C / 2>/dev/null
+                    /etc/init.d/network reload 2>/dev/null
+                    config_ack "$config_id" rolled_back "not confirmed within ${confirm_timeout}s"
+                fi
+            fi
         fi
+        rm -f /tmp/nexusgate_rollback.tgz
     done &
 }
 
+# Publish a config ACK: config_ack <config_id> <status> <error>
+config_ack() {
+    mosquitto_pub -h "$MQTT_BROKER" -p "$MQTT_PORT" \
+        -t "nexusgate/devices/$(get_mac)/config/ack" \
+        -m "{\"v\":$PROTOCOL_VERSION,\"config_id\":$1,\"status\":\"$2\",\"error\":\"$3\"}" -q 1
+}
+
+# Wait for the confirm_config command of a config: wait_config_confirm <config_id> <timeout>
+wait_config_confirm() {
+    local flag="/tmp/nexusgate_confirm_$1" waited=0
+    while [ "$waited" -lt "$2" ]; do
+        if [ -f "$flag" ]; then
+            rm -f "$flag"
+            return 0
+        fi
+        sleep 2
+        waited=$((waited + 2))
+    done
+    return 1
+}
+
 # Main loop
 main() {
     get_config
@@ -0,0 +1,169 @@
+// Command ingest-bench load-tests heartbeat ingestion by publishing status
+// messages for a simulated fleet over MQTT, spread evenly over the interval
+// like real agents. Watch nexusgate_ingest_* on the server's /metrics, or
+// pass -metrics to print them when the run ends.
+//
+//	go run ./cmd/ingest-bench -devices 10000 -interval 30s -duration 5m \
+//	    -seed -dsn "host=localhost user=nexusgate password=nexusgate dbname=nexusgate sslmode=disable"
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func main() {
+	broker := flag.String("broker", "tcp://localhost:1883", "MQTT broker")
+	devices := flag.Int("devices", 10000, "number of simulated devices")
+	interval := flag.Duration("interval", 30*time.Second, "heartbeat interval per device")
+	duration := flag.Duration("duration", 5*time.Minute, "how long to publish")
+	seed := flag.Bool("seed", false, "register the simulated devices in the database first (requires -dsn)")
+	dsn := flag.String("dsn", "", "PostgreSQL DSN used by -seed")
+	metricsURL := flag.String("metrics", "", "server /metrics URL to print ingestion metrics from at the end")
+	flag.Parse()
+
+	if *seed {
+		if err := seedDevices(*dsn, *devices); err != nil {
+			log.Fatalf("seed failed: %v", err)
+		}
+	}
+
+	opts := pahomqtt.NewClientOptions().AddBroker(*broker).
+		SetClientID(fmt.Sprintf("nexusgate-bench-%d", time.Now().UnixNano()))
+	client := pahomqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+		log.Fatalf("MQTT connect failed: %v", token.Error())
+	}
+	defer client.Disconnect(1000)
+
+	var published, failed atomic.Int64
+	spacing := *interval / time.Duration(*devices)
+	if spacing <= 0 {
+		spacing = time.Microsecond
+	}
+	log.Printf("publishing %d devices every %s (%.0f msg/s) for %s",
+		*devices, *interval, float64(*devices)/interval.Seconds(), *duration)
+
+	done := time.After(*duration)
+	report := time.NewTicker(10 * time.Second)
+	defer report.Stop()
+	ticker := time.NewTicker(spacing)
+	defer ticker.Stop()
+
+	start := time.Now()
+	next := 0
+	for {
+		select {
+		case <-done:
+			elapsed := time.Since(start)
+			log.Printf("done: %d published, %d failed, %.0f msg/s", published.Load(), failed.Load(),
+				float64(published.Load())/elapsed.Seconds())
+			if *metricsURL != "" {
+				printIngestMetrics(*metricsURL)
+			}
+			return
+		case <-report.C:
+			log.Printf("%d published, %d failed, %.0f msg/s", published.Load(), failed.Load(),
+				float64(published.Load())/time.Since(start).Seconds())
+		case <-ticker.C:
+			mac := benchMAC(next)
+			next = (next + 1) % *devices
+			payload, _ := json.Marshal(map[string]any{
+				"v":           1,
+				"mac":         mac,
+				"cpu_usage":   rand.Float64() * 60,
+				"mem_usage":   20 + rand.Float64()*50,
+				"mem_total":   268435456,
+				"mem_free":    134217728,
+				"rx_bytes":    time.Since(start).Milliseconds() * 1000,
+				"tx_bytes":    time.Since(start).Milliseconds() * 500,
+				"conntrack":   rand.Intn(5000),
+				"uptime_secs": int64(time.Since(start).Seconds()),
+				"load_avg":    "0.10 0.20 0.30",
+				"interfaces": []map[string]any{
+					{"name": "eth0", "rx_bytes": time.Since(start).Milliseconds() * 1000, "tx_bytes": time.Since(start).Milliseconds() * 500, "up": true, "speed": 1000},
+					{"name": "br-lan", "rx_bytes": time.Since(start).Milliseconds() * 400, "tx_bytes": time.Since(start).Milliseconds() * 900, "up": true, "speed": -1},
+				},
+				"filesystems": []map[string]any{{"mount": "/overlay", "total_kb": 12288, "used_kb": 1544}},
+				"thermal":     []map[string]any{{"zone": "cpu-thermal", "temp": 45000 + rand.Intn(10000)}},
+				"wireless":    []map[string]any{{"radio": "phy0", "interface": "phy0-ap0", "ssid": "bench", "clients": rand.Intn(30)}},
+			})
+			token := client.Publish("nexusgate/devices/"+mac+"/status", 1, false, payload)
+			go func() {
+				if token.WaitTimeout(5*time.Second) && token.Error() == nil {
+					published.Add(1)
+				} else {
+					failed.Add(1)
+				}
+			}()
+		}
+	}
+}
+
+// benchMAC returns a locally administered MAC for simulated device i.
+func benchMAC(i int) string {
+	return fmt.Sprintf("02:BE:00:%02X:%02X:%02X", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+func seedDevices(dsn string, n int) error {
+	if dsn == "" {
+		return fmt.Errorf("-dsn is required")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		return err
+	}
+	devices := make([]model.Device, 0, n)
+	for i := 0; i < n; i++ {
+		devices = append(devices, model.Device{
+			Name:   fmt.Sprintf("bench-%05d", i),
+			MAC:    benchMAC(i),
+			Model:  "bench",
+			Group:  fmt.Sprintf("bench-%d", i%20),
+			Status: model.StatusUnknown,
+		})
+	}
+	var existing int64
+	db.Model(&model.Device{}).Where("mac LIKE ?", "02:BE:00:%").Count(&existing)
+	if existing >= int64(n) {
+		log.Printf("%d simulated devices already registered", existing)
+		return nil
+	}
+	if err := db.Where("mac LIKE ?", "02:BE:00:%").Unscoped().Delete(&model.Device{}).Error; err != nil {
+		return err
+	}
+	if err := db.CreateInBatches(devices, 1000).Error; err != nil {
+		return err
+	}
+	log.Printf("registered %d simulated devices", n)
+	return nil
+}
+
+func printIngestMetrics(url string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Printf("metrics scrape failed: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "nexusgate_ingest_") {
+			fmt.Println(line)
+		}
+	}
+}
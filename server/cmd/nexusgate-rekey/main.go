@@ -0,0 +1,59 @@
+// Command nexusgate-rekey re-encrypts every secret stored in the database
+// under the current master key, each with a new data key. It reads the same
+// environment as the server. To replace a master key kept in a file, stop
+// the server, move the file aside so a new key is generated in its place and
+// pass the old one as a previous key:
+//
+//	mv data/master.key data/master.key.old
+//	SECRETS_PREVIOUS_KEYS=$(cat data/master.key.old) nexusgate-rekey
+//
+// Once it succeeds the old key is no longer needed. A key passed in
+// SECRETS_MASTER_KEY is replaced the same way; -generate prints a new one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/nexusgate/nexusgate/internal/config"
+	"github.com/nexusgate/nexusgate/internal/secret"
+	"github.com/nexusgate/nexusgate/internal/store"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func main() {
+	generate := flag.Bool("generate", false, "print a new base64 master key and exit")
+	flag.Parse()
+
+	if *generate {
+		key, err := secret.GenerateKey()
+		if err != nil {
+			log.Fatalf("failed to generate key: %v", err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	kms, err := secret.LoadLocalKMS(cfg.SecretsKey, cfg.SecretsKeyFile, cfg.SecretsPreviousKeys)
+	if err != nil {
+		log.Fatalf("failed to load secrets master key: %v", err)
+	}
+	secret.SetKMS(kms)
+
+	db, err := store.InitDB(cfg)
+	if err != nil {
+		log.Fatalf("failed to connect database: %v", err)
+	}
+	db = db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Warn)})
+	n, err := store.SealSecrets(db, true)
+	if err != nil {
+		log.Fatalf("re-encryption stopped after %d values: %v", n, err)
+	}
+	log.Printf("re-encrypted %d secrets with master key %s", n, kms.KeyID())
+}
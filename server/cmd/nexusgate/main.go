@@ -11,10 +11,17 @@ import (
 
 	"github.com/nexusgate/nexusgate/internal/config"
 	"github.com/nexusgate/nexusgate/internal/handler"
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
+	"github.com/nexusgate/nexusgate/internal/ingest"
 	"github.com/nexusgate/nexusgate/internal/jobs"
 	"github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/secret"
+	"github.com/nexusgate/nexusgate/internal/ssh"
 	"github.com/nexusgate/nexusgate/internal/store"
+	"github.com/nexusgate/nexusgate/internal/syslog"
+	"github.com/nexusgate/nexusgate/internal/tunnel"
 	"github.com/nexusgate/nexusgate/internal/ws"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
@@ -23,16 +30,30 @@ func main() {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
+	kms, err := secret.LoadLocalKMS(cfg.SecretsKey, cfg.SecretsKeyFile, cfg.SecretsPreviousKeys)
+	if err != nil {
+		log.Fatalf("failed to load secrets master key: %v", err)
+	}
+	secret.SetKMS(kms)
+
 	db, err := store.InitDB(cfg)
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
-	if err := store.AutoMigrate(db); err != nil {
+	caps, err := store.AutoMigrate(db, cfg.DBTimescale)
+	if err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+	if n, err := store.SealSecrets(db, false); err != nil {
+		log.Fatalf("failed to encrypt stored secrets: %v", err)
+	} else if n > 0 {
+		log.Printf("encrypted %d stored secrets with master key %s", n, kms.KeyID())
+	}
 
 	store.SeedAdminUser(db)
+	handler.AbandonOnboardingJobs(db)
+	handler.AbandonKeyRotations(db)
 
 	mqttClient, err := mqtt.NewClient(cfg)
 	if err != nil {
@@ -40,19 +61,79 @@ func main() {
 	}
 
 	wsHub := ws.NewHub(cfg.JWTSecret)
-
+	heartbeats := heartbeat.NewCache()
+	if err := heartbeats.LoadDevices(db); err != nil {
+		log.Fatalf("failed to load devices: %v", err)
+	}
+	pipeline := ingest.NewPipeline(db, wsHub, heartbeats, ingest.Options{
+		QueueSize:     cfg.IngestQueueSize,
+		Workers:       cfg.IngestWorkers,
+		BatchSize:     cfg.IngestBatchSize,
+		FlushInterval: cfg.IngestFlushInterval,
+	})
+	pipeline.Start()
+
+	var rpc *mqtt.RPC
 	if mqttClient != nil {
-		mqtt.SubscribeDeviceStatus(mqttClient, db, wsHub)
+		rpc = mqtt.NewRPC(mqttClient)
+		mqtt.SubscribeDeviceStatus(mqttClient, pipeline)
 		mqtt.SubscribeConfigACK(mqttClient, db, wsHub)
 		mqtt.SubscribeUpgradeACK(mqttClient, db, wsHub)
+		mqtt.SubscribeDiagnosticProgress(mqttClient, db, wsHub)
 	}
 
 	// Start background jobs
-	jobs.StartOfflineDetector(db, wsHub)
-	jobs.StartMetricsCleanup(db)
+	jobs.StartOfflineDetector(db, wsHub, heartbeats)
+	jobs.StartMetricsCleanup(db, caps)
+	if !caps.Timescale {
+		// TimescaleDB maintains rollups as continuous aggregates
+		jobs.StartMetricsRollup(db)
+	}
 	jobs.StartAutoUpgradeChecker(db, mqttClient)
+	jobs.StartEscalationJob(db, wsHub)
+	jobs.StartSilenceJob(db)
+	jobs.StartIncidentNotifier(db)
+	jobs.StartAlertmanagerResend(db)
+	handler.StartWireGuardKeyRotation(db, mqttClient)
+
+	collectors := append([]prometheus.Collector{pipeline}, mqtt.Collectors()...)
+
+	var syslogReceiver *syslog.Receiver
+	if cfg.SyslogUDPAddr != "" || cfg.SyslogTCPAddr != "" {
+		syslogReceiver = syslog.NewReceiver(db, syslog.Options{UDPAddr: cfg.SyslogUDPAddr, TCPAddr: cfg.SyslogTCPAddr})
+		if err := syslogReceiver.Start(); err != nil {
+			log.Fatalf("failed to start syslog receiver: %v", err)
+		}
+		collectors = append(collectors, syslogReceiver)
+	}
 
-	r := handler.SetupRouter(db, mqttClient, cfg, wsHub)
+	var tunnels *tunnel.Server
+	if cfg.TunnelAddr != "" {
+		tunnels, err = tunnel.NewServer(db, tunnel.Options{
+			Addr:        cfg.TunnelAddr,
+			PublicAddr:  cfg.TunnelPublicAddr,
+			HostKeyFile: cfg.TunnelHostKeyFile,
+
+			SessionPortMin:  cfg.TunnelSessionPortMin,
+			SessionPortMax:  cfg.TunnelSessionPortMax,
+			SessionBindAddr: cfg.TunnelSessionBindAddr,
+		})
+		if err != nil {
+			log.Fatalf("failed to create tunnel server: %v", err)
+		}
+		if err := tunnels.Start(); err != nil {
+			log.Fatalf("failed to start tunnel server: %v", err)
+		}
+		collectors = append(collectors, tunnels)
+	}
+
+	sshKey, err := ssh.LoadOrGenerateKey(cfg.SSHKeyFile, "nexusgate")
+	if err != nil {
+		log.Fatalf("failed to load SSH key: %v", err)
+	}
+	sshManager := ssh.NewManager(sshKey, 5*time.Minute)
+
+	r := handler.SetupRouter(db, mqttClient, cfg, wsHub, heartbeats, caps, rpc, tunnels, sshManager, collectors...)
 
 	srv := &http.Server{
 		Addr:    cfg.ListenAddr,
@@ -81,10 +162,18 @@ func main() {
 		log.Printf("server forced to shutdown: %v", err)
 	}
 
-	// Close MQTT connection
+	// Close MQTT connection, then flush queued heartbeats
 	if mqttClient != nil && mqttClient.IsConnected() {
 		mqttClient.Disconnect(1000)
 	}
+	pipeline.Stop()
+	if syslogReceiver != nil {
+		syslogReceiver.Stop()
+	}
+	sshManager.Close()
+	if tunnels != nil {
+		tunnels.Stop()
+	}
 
 	// Close database connection
 	if sqlDB, err := db.DB(); err == nil {
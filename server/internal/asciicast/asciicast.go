@@ -0,0 +1,109 @@
+// Package asciicast writes terminal session recordings in the asciicast v2
+// format (https://docs.asciinema.org/manual/asciicast/v2/), playable with
+// asciinema or asciinema-player.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ContentType is the media type of a recording.
+const ContentType = "application/x-asciicast"
+
+// Header is the first line of a recording.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder appends events to a recording file. It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending []byte // incomplete UTF-8 sequence held back from the last output
+}
+
+// Create starts a recording at path with the terminal size and title.
+func Create(path string, width, height int, title string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{file: f, w: bufio.NewWriter(f), start: time.Now()}
+	header, _ := json.Marshal(Header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	r.w.Write(header)
+	r.w.WriteByte('\n')
+	return r, nil
+}
+
+// Output records terminal output. Events are strings, so a multi-byte
+// character split across reads is completed by the next call.
+func (r *Recorder) Output(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending, p...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return nil
+	}
+	return r.event("o", string(data[:cut]))
+}
+
+// Resize records a terminal size change.
+func (r *Recorder) Resize(width, height int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *Recorder) event(code, data string) error {
+	line, err := json.Marshal([]any{time.Since(r.start).Seconds(), code, data})
+	if err != nil {
+		return err
+	}
+	r.w.Write(line)
+	return r.w.WriteByte('\n')
+}
+
+// Close flushes and closes the recording.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
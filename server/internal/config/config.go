@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -14,22 +16,150 @@ type Config struct {
 	DBPassword  string
 	DBName      string
 	DBSSLMode   string
+	DBTimescale string // auto, off
 	MQTTBroker  string
 	JWTSecret   string
 	CORSOrigins []string
+
+	// AlertmanagerWebhookToken authenticates the inbound Alertmanager webhook.
+	// The endpoint is disabled when empty.
+	AlertmanagerWebhookToken string
+
+	// Per-device Prometheus metrics: DeviceMetricsMode is "inline" (served on
+	// /metrics), "separate" (served on /metrics/devices) or "off".
+	DeviceMetricsMode      string
+	DeviceMetricsLabels    []string
+	DeviceMetricsMaxSeries int
+
+	// Heartbeat ingestion pipeline
+	IngestQueueSize     int
+	IngestWorkers       int
+	IngestBatchSize     int
+	IngestFlushInterval time.Duration
+
+	// Syslog receiver listen addresses, e.g. ":514"; empty disables each.
+	SyslogUDPAddr string
+	SyslogTCPAddr string
+
+	// Reverse tunnel SSH endpoint for agents behind NAT; empty disables it.
+	// TunnelPublicAddr is the host:port agents dial to reach it.
+	TunnelAddr        string
+	TunnelPublicAddr  string
+	TunnelHostKeyFile string
+
+	// Server ports handed out to tunnel sessions ("min-max") and the
+	// address they listen on
+	TunnelSessionPortMin  int
+	TunnelSessionPortMax  int
+	TunnelSessionBindAddr string
+
+	// Directory of web terminal recordings (asciicast)
+	ShellRecordingsDir string
+
+	// Private key the server logs in to devices with (ed25519, generated
+	// on first start)
+	SSHKeyFile string
+
+	// Master key that encrypts secrets stored in the database (base64, 32
+	// bytes). When SecretsKey is empty it is read from SecretsKeyFile,
+	// generated on first start. SecretsPreviousKeys are retired master keys
+	// still accepted for decryption while values are re-encrypted.
+	SecretsKey          string
+	SecretsKeyFile      string
+	SecretsPreviousKeys []string
 }
 
 func Load() (*Config, error) {
 	cfg := &Config{
-		ListenAddr: getEnv("LISTEN_ADDR", ":8080"),
-		DBHost:     getEnv("DB_HOST", "localhost"),
-		DBPort:     getEnv("DB_PORT", "5432"),
-		DBUser:     getEnv("DB_USER", "nexusgate"),
-		DBPassword: getEnv("DB_PASSWORD", "nexusgate"),
-		DBName:     getEnv("DB_NAME", "nexusgate"),
-		DBSSLMode:  getEnv("DB_SSLMODE", "disable"),
-		MQTTBroker: getEnv("MQTT_BROKER", "tcp://localhost:1883"),
-		JWTSecret:  getEnv("JWT_SECRET", ""),
+		ListenAddr:  getEnv("LISTEN_ADDR", ":8080"),
+		DBHost:      getEnv("DB_HOST", "localhost"),
+		DBPort:      getEnv("DB_PORT", "5432"),
+		DBUser:      getEnv("DB_USER", "nexusgate"),
+		DBPassword:  getEnv("DB_PASSWORD", "nexusgate"),
+		DBName:      getEnv("DB_NAME", "nexusgate"),
+		DBSSLMode:   getEnv("DB_SSLMODE", "disable"),
+		DBTimescale: getEnv("DB_TIMESCALE", "auto"),
+		MQTTBroker:  getEnv("MQTT_BROKER", "tcp://localhost:1883"),
+		JWTSecret:   getEnv("JWT_SECRET", ""),
+
+		AlertmanagerWebhookToken: getEnv("ALERTMANAGER_WEBHOOK_TOKEN", ""),
+
+		DeviceMetricsMode: getEnv("DEVICE_METRICS", "inline"),
+
+		SyslogUDPAddr: getEnv("SYSLOG_UDP_ADDR", ""),
+		SyslogTCPAddr: getEnv("SYSLOG_TCP_ADDR", ""),
+
+		TunnelAddr:        getEnv("TUNNEL_ADDR", ""),
+		TunnelPublicAddr:  getEnv("TUNNEL_PUBLIC_ADDR", ""),
+		TunnelHostKeyFile: getEnv("TUNNEL_HOST_KEY_FILE", "./data/tunnel_host_ed25519"),
+
+		TunnelSessionBindAddr: getEnv("TUNNEL_SESSION_BIND_ADDR", ""),
+
+		ShellRecordingsDir: getEnv("SHELL_RECORDINGS_DIR", "./recordings"),
+		SSHKeyFile:         getEnv("SSH_KEY_FILE", "./data/ssh_ed25519"),
+
+		SecretsKey:     getEnv("SECRETS_MASTER_KEY", ""),
+		SecretsKeyFile: getEnv("SECRETS_MASTER_KEY_FILE", "./data/master.key"),
+	}
+
+	for _, k := range strings.Split(getEnv("SECRETS_PREVIOUS_KEYS", ""), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			cfg.SecretsPreviousKeys = append(cfg.SecretsPreviousKeys, k)
+		}
+	}
+
+	// Labels attached to per-device series (comma-separated allowlist)
+	for _, l := range strings.Split(getEnv("DEVICE_METRICS_LABELS", "device,mac,group,model"), ",") {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			cfg.DeviceMetricsLabels = append(cfg.DeviceMetricsLabels, l)
+		}
+	}
+
+	maxSeries, err := strconv.Atoi(getEnv("DEVICE_METRICS_MAX_SERIES", "50000"))
+	if err != nil || maxSeries < 0 {
+		return nil, fmt.Errorf("DEVICE_METRICS_MAX_SERIES must be a non-negative integer")
+	}
+	cfg.DeviceMetricsMaxSeries = maxSeries
+
+	for _, v := range []struct {
+		env      string
+		fallback string
+		target   *int
+	}{
+		{"INGEST_QUEUE_SIZE", "20000", &cfg.IngestQueueSize},
+		{"INGEST_WORKERS", "4", &cfg.IngestWorkers},
+		{"INGEST_BATCH_SIZE", "500", &cfg.IngestBatchSize},
+	} {
+		n, err := strconv.Atoi(getEnv(v.env, v.fallback))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s must be a positive integer", v.env)
+		}
+		*v.target = n
+	}
+	flush, err := time.ParseDuration(getEnv("INGEST_FLUSH_INTERVAL", "1s"))
+	if err != nil || flush <= 0 {
+		return nil, fmt.Errorf("INGEST_FLUSH_INTERVAL must be a positive duration")
+	}
+	cfg.IngestFlushInterval = flush
+
+	switch cfg.DeviceMetricsMode {
+	case "inline", "separate", "off":
+	default:
+		return nil, fmt.Errorf("DEVICE_METRICS must be one of inline, separate, off")
+	}
+	identified := false
+	for _, l := range cfg.DeviceMetricsLabels {
+		switch l {
+		case "device", "mac":
+			identified = true
+		case "group", "model":
+		default:
+			return nil, fmt.Errorf("DEVICE_METRICS_LABELS: unsupported label %q", l)
+		}
+	}
+	if !identified {
+		return nil, fmt.Errorf("DEVICE_METRICS_LABELS must include device or mac")
 	}
 
 	// Parse CORS origins (comma-separated)
@@ -42,6 +172,19 @@ func Load() (*Config, error) {
 		}
 	}
 
+	if cfg.TunnelAddr != "" && cfg.TunnelPublicAddr == "" {
+		return nil, fmt.Errorf("TUNNEL_PUBLIC_ADDR is required when TUNNEL_ADDR is set")
+	}
+	ports := getEnv("TUNNEL_SESSION_PORTS", "20000-20099")
+	lo, hi, _ := strings.Cut(ports, "-")
+	cfg.TunnelSessionPortMin, err = strconv.Atoi(strings.TrimSpace(lo))
+	if err == nil {
+		cfg.TunnelSessionPortMax, err = strconv.Atoi(strings.TrimSpace(hi))
+	}
+	if err != nil || cfg.TunnelSessionPortMin < 1 || cfg.TunnelSessionPortMax > 65535 || cfg.TunnelSessionPortMax < cfg.TunnelSessionPortMin {
+		return nil, fmt.Errorf("TUNNEL_SESSION_PORTS must be a port range like 20000-20099")
+	}
+
 	if cfg.JWTSecret == "" {
 		return nil, fmt.Errorf("JWT_SECRET environment variable is required")
 	}
@@ -0,0 +1,135 @@
+// Package diagnostics describes the network diagnostics an agent can run on
+// behalf of the server (ping, traceroute, nslookup, mtr, iperf3 and a wget
+// speed test) and turns their textual output into structured results.
+package diagnostics
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Actions supported by the diagnostic RPC.
+const (
+	ActionPing       = "ping"
+	ActionTraceroute = "traceroute"
+	ActionNslookup   = "nslookup"
+	ActionMTR        = "mtr"
+	ActionIperf3     = "iperf3"
+	ActionSpeedtest  = "wget"
+)
+
+// Actions lists the supported actions in display order.
+var Actions = []string{ActionPing, ActionTraceroute, ActionNslookup, ActionMTR, ActionIperf3, ActionSpeedtest}
+
+// Request is a diagnostic run as sent to the agent in the params of the
+// "diagnostic" RPC. Fields that do not apply to the action are ignored.
+type Request struct {
+	Action     string `json:"action"`
+	Target     string `json:"target,omitempty"`      // host for ping, traceroute, nslookup and mtr
+	Count      int    `json:"count,omitempty"`       // probes for ping and mtr
+	Server     string `json:"server,omitempty"`      // iperf3 server, or DNS server for nslookup
+	Port       int    `json:"port,omitempty"`        // iperf3 server port
+	Duration   int    `json:"duration,omitempty"`    // iperf3 seconds
+	Reverse    bool   `json:"reverse,omitempty"`     // iperf3 download instead of upload
+	URL        string `json:"url,omitempty"`         // wget speed test download
+	RecordType string `json:"record_type,omitempty"` // nslookup query type
+}
+
+var (
+	hostPattern       = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.:_-]*[A-Za-z0-9])?$`)
+	recordTypePattern = regexp.MustCompile(`^(A|AAAA|CNAME|MX|NS|PTR|SOA|SRV|TXT)$`)
+)
+
+// validHost accepts hostnames and IPv4/IPv6 addresses. The agent hands
+// these to shell commands, so anything else (notably a leading "-", which
+// would be taken as an option) is rejected.
+func validHost(h string) bool {
+	return len(h) <= 253 && hostPattern.MatchString(h)
+}
+
+// Normalize validates the request and fills in defaults.
+func (r *Request) Normalize() error {
+	switch r.Action {
+	case ActionPing, ActionTraceroute, ActionNslookup, ActionMTR:
+		if !validHost(r.Target) {
+			return errors.New("target must be a hostname or IP address")
+		}
+	case ActionIperf3:
+		if !validHost(r.Server) {
+			return errors.New("iperf3 requires a server hostname or IP address")
+		}
+		if r.Port == 0 {
+			r.Port = 5201
+		}
+		if r.Port < 1 || r.Port > 65535 {
+			return errors.New("port must be between 1 and 65535")
+		}
+		if r.Duration == 0 {
+			r.Duration = 10
+		}
+		if r.Duration < 1 || r.Duration > 60 {
+			return errors.New("duration must be between 1 and 60 seconds")
+		}
+	case ActionSpeedtest:
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			strings.ContainsAny(r.URL, " '\"`$\\;|&<>") {
+			return errors.New("url must be a plain http(s) URL")
+		}
+	default:
+		return fmt.Errorf("unknown action %q (supported: %s)", r.Action, strings.Join(Actions, ", "))
+	}
+
+	switch r.Action {
+	case ActionPing, ActionMTR:
+		if r.Count == 0 {
+			r.Count = map[string]int{ActionPing: 4, ActionMTR: 10}[r.Action]
+		}
+		if r.Count < 1 || r.Count > 100 {
+			return errors.New("count must be between 1 and 100")
+		}
+	case ActionNslookup:
+		r.RecordType = strings.ToUpper(r.RecordType)
+		if r.RecordType != "" && !recordTypePattern.MatchString(r.RecordType) {
+			return fmt.Errorf("unsupported record type %q", r.RecordType)
+		}
+		if r.Server != "" && !validHost(r.Server) {
+			return errors.New("server must be a hostname or IP address")
+		}
+	}
+	return nil
+}
+
+// Timeout is how long the server waits for the agent to finish the run.
+func (r Request) Timeout() time.Duration {
+	switch r.Action {
+	case ActionPing:
+		return time.Duration(r.Count+15) * time.Second
+	case ActionTraceroute:
+		return 90 * time.Second
+	case ActionMTR:
+		return time.Duration(r.Count+30) * time.Second
+	case ActionIperf3:
+		return time.Duration(r.Duration+20) * time.Second
+	case ActionSpeedtest:
+		return 75 * time.Second
+	default:
+		return 20 * time.Second
+	}
+}
+
+// Subject is the host or URL a request is about, for history and audit.
+func (r Request) Subject() string {
+	switch r.Action {
+	case ActionIperf3:
+		return fmt.Sprintf("%s:%d", r.Server, r.Port)
+	case ActionSpeedtest:
+		return r.URL
+	default:
+		return r.Target
+	}
+}
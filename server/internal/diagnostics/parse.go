@@ -0,0 +1,312 @@
+package diagnostics
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PingReply is one echo reply.
+type PingReply struct {
+	Seq   int     `json:"seq"`
+	TTL   int     `json:"ttl"`
+	RTTMs float64 `json:"rtt_ms"`
+}
+
+// PingResult summarises a ping run.
+type PingResult struct {
+	Transmitted int         `json:"transmitted"`
+	Received    int         `json:"received"`
+	LossPercent float64     `json:"loss_percent"`
+	MinMs       float64     `json:"min_ms"`
+	AvgMs       float64     `json:"avg_ms"`
+	MaxMs       float64     `json:"max_ms"`
+	Replies     []PingReply `json:"replies"`
+}
+
+// Hop is one traceroute hop. Probes holds the RTTs of answered probes;
+// Timeouts counts the unanswered ones ("*").
+type Hop struct {
+	Hop      int       `json:"hop"`
+	Address  string    `json:"address,omitempty"`
+	ProbesMs []float64 `json:"probes_ms"`
+	Timeouts int       `json:"timeouts"`
+}
+
+// TracerouteResult lists the hops towards the target.
+type TracerouteResult struct {
+	Hops []Hop `json:"hops"`
+}
+
+// MTRHop is one line of an mtr report.
+type MTRHop struct {
+	Hop         int     `json:"hop"`
+	Address     string  `json:"address"`
+	LossPercent float64 `json:"loss_percent"`
+	Sent        int     `json:"sent"`
+	LastMs      float64 `json:"last_ms"`
+	AvgMs       float64 `json:"avg_ms"`
+	BestMs      float64 `json:"best_ms"`
+	WorstMs     float64 `json:"worst_ms"`
+	StdevMs     float64 `json:"stdev_ms"`
+}
+
+// MTRResult holds per-hop loss and latency statistics.
+type MTRResult struct {
+	Hops []MTRHop `json:"hops"`
+}
+
+// NslookupResult holds the resolved addresses of a name.
+type NslookupResult struct {
+	Server    string   `json:"server,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// ThroughputResult is the outcome of an iperf3 or wget speed test.
+type ThroughputResult struct {
+	Bytes       int64   `json:"bytes,omitempty"`
+	Seconds     float64 `json:"seconds"`
+	Mbps        float64 `json:"mbps"`
+	SentMbps    float64 `json:"sent_mbps,omitempty"`
+	Retransmits int     `json:"retransmits,omitempty"`
+}
+
+var (
+	// busybox "seq=0 ttl=57 time=10.1 ms", iputils "icmp_seq=1 ttl=57 time=10.1 ms"
+	pingReplyPattern = regexp.MustCompile(`(?:icmp_)?seq=(\d+)\s+ttl=(\d+)\s+time=([\d.]+)\s*ms`)
+	pingStatsPattern = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received.*?([\d.]+)% packet loss`)
+	pingRTTPattern   = regexp.MustCompile(`min/avg/max(?:/mdev)? = ([\d.]+)/([\d.]+)/([\d.]+)`)
+	hopLinePattern   = regexp.MustCompile(`^\s*(\d+)\s+(.*)$`)
+	mtrLinePattern   = regexp.MustCompile(`^\s*(\d+)\.\|--\s+(\S+)\s+([\d.]+)%?\s+(\d+)\s+([\d.]+)\s+([\d.]+)\s+([\d.]+)\s+([\d.]+)\s+([\d.]+)`)
+	speedtestPattern = regexp.MustCompile(`bytes=(\d+)\s+seconds=([\d.]+)`)
+)
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func atof(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// Parse turns the output of an action into its structured result.
+func Parse(action, output string) (any, error) {
+	switch action {
+	case ActionPing:
+		return parsePing(output)
+	case ActionTraceroute:
+		return parseTraceroute(output)
+	case ActionMTR:
+		return parseMTR(output)
+	case ActionNslookup:
+		return parseNslookup(output)
+	case ActionIperf3:
+		return parseIperf3(output)
+	case ActionSpeedtest:
+		return parseSpeedtest(output)
+	}
+	return nil, errors.New("unknown action")
+}
+
+// ParseLine parses a single line of progressive output, returning nil for
+// lines that carry no data (headers, summaries).
+func ParseLine(action, line string) any {
+	switch action {
+	case ActionPing:
+		if m := pingReplyPattern.FindStringSubmatch(line); m != nil {
+			return PingReply{Seq: atoi(m[1]), TTL: atoi(m[2]), RTTMs: atof(m[3])}
+		}
+	case ActionTraceroute:
+		if hop, ok := parseHop(line); ok {
+			return hop
+		}
+	case ActionMTR:
+		if hop, ok := parseMTRLine(line); ok {
+			return hop
+		}
+	}
+	return nil
+}
+
+func parsePing(output string) (PingResult, error) {
+	res := PingResult{Replies: []PingReply{}}
+	for _, line := range lines(output) {
+		if m := pingReplyPattern.FindStringSubmatch(line); m != nil {
+			res.Replies = append(res.Replies, PingReply{Seq: atoi(m[1]), TTL: atoi(m[2]), RTTMs: atof(m[3])})
+		} else if m := pingStatsPattern.FindStringSubmatch(line); m != nil {
+			res.Transmitted, res.Received, res.LossPercent = atoi(m[1]), atoi(m[2]), atof(m[3])
+		} else if m := pingRTTPattern.FindStringSubmatch(line); m != nil {
+			res.MinMs, res.AvgMs, res.MaxMs = atof(m[1]), atof(m[2]), atof(m[3])
+		}
+	}
+	if res.Transmitted == 0 {
+		return res, errors.New("no ping statistics in output")
+	}
+	return res, nil
+}
+
+// parseHop parses a traceroute line such as
+// " 3  10.0.0.1  5.1 ms  10.0.0.2  5.3 ms  *". Address is the first
+// responder.
+func parseHop(line string) (Hop, bool) {
+	m := hopLinePattern.FindStringSubmatch(line)
+	if m == nil {
+		return Hop{}, false
+	}
+	hop := Hop{Hop: atoi(m[1]), ProbesMs: []float64{}}
+	fields := strings.Fields(m[2])
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case f == "*":
+			hop.Timeouts++
+		case i+1 < len(fields) && fields[i+1] == "ms":
+			hop.ProbesMs = append(hop.ProbesMs, atof(f))
+			i++
+		case strings.HasPrefix(f, "("):
+			// the address of the name before it, when not run with -n
+			if i > 0 && fields[i-1] == hop.Address {
+				hop.Address = strings.Trim(f, "()")
+			}
+		case strings.HasPrefix(f, "!"):
+			// ICMP annotation like !H
+		case hop.Address == "":
+			hop.Address = f
+		}
+	}
+	return hop, true
+}
+
+func parseTraceroute(output string) (TracerouteResult, error) {
+	res := TracerouteResult{Hops: []Hop{}}
+	for _, line := range lines(output) {
+		if hop, ok := parseHop(line); ok {
+			res.Hops = append(res.Hops, hop)
+		}
+	}
+	if len(res.Hops) == 0 {
+		return res, errors.New("no hops in output")
+	}
+	return res, nil
+}
+
+func parseMTRLine(line string) (MTRHop, bool) {
+	m := mtrLinePattern.FindStringSubmatch(line)
+	if m == nil {
+		return MTRHop{}, false
+	}
+	return MTRHop{
+		Hop: atoi(m[1]), Address: m[2], LossPercent: atof(m[3]), Sent: atoi(m[4]),
+		LastMs: atof(m[5]), AvgMs: atof(m[6]), BestMs: atof(m[7]), WorstMs: atof(m[8]), StdevMs: atof(m[9]),
+	}, true
+}
+
+func parseMTR(output string) (MTRResult, error) {
+	res := MTRResult{Hops: []MTRHop{}}
+	for _, line := range lines(output) {
+		if hop, ok := parseMTRLine(line); ok {
+			res.Hops = append(res.Hops, hop)
+		}
+	}
+	if len(res.Hops) == 0 {
+		return res, errors.New("no hops in output")
+	}
+	return res, nil
+}
+
+// parseNslookup handles both busybox formats ("Address: 1.2.3.4" and
+// "Address 1: 1.2.3.4 name") and glibc-style output.
+func parseNslookup(output string) (NslookupResult, error) {
+	res := NslookupResult{Addresses: []string{}}
+	inAnswer := false
+	for _, line := range lines(output) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			if strings.Contains(line, "can't find") || strings.Contains(line, "NXDOMAIN") {
+				return res, errors.New(strings.TrimSpace(line))
+			}
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case key == "Server" && res.Server == "":
+			res.Server = value
+		case key == "Name":
+			res.Name = value
+			inAnswer = true
+		case strings.HasPrefix(key, "Address") && inAnswer:
+			if fields := strings.Fields(value); len(fields) > 0 {
+				res.Addresses = append(res.Addresses, fields[0])
+			}
+		case strings.Contains(line, "can't find"):
+			return res, errors.New(strings.TrimSpace(line))
+		}
+	}
+	if len(res.Addresses) == 0 {
+		return res, errors.New("no addresses in output")
+	}
+	return res, nil
+}
+
+func parseIperf3(output string) (ThroughputResult, error) {
+	var report struct {
+		Error string `json:"error"`
+		End   struct {
+			SumSent struct {
+				Bytes         int64   `json:"bytes"`
+				Seconds       float64 `json:"seconds"`
+				BitsPerSecond float64 `json:"bits_per_second"`
+				Retransmits   int     `json:"retransmits"`
+			} `json:"sum_sent"`
+			SumReceived struct {
+				Bytes         int64   `json:"bytes"`
+				Seconds       float64 `json:"seconds"`
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"sum_received"`
+		} `json:"end"`
+	}
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		return ThroughputResult{}, errors.New("iperf3 output is not JSON")
+	}
+	if report.Error != "" {
+		return ThroughputResult{}, errors.New(report.Error)
+	}
+	recv := report.End.SumReceived
+	return ThroughputResult{
+		Bytes:       recv.Bytes,
+		Seconds:     recv.Seconds,
+		Mbps:        recv.BitsPerSecond / 1e6,
+		SentMbps:    report.End.SumSent.BitsPerSecond / 1e6,
+		Retransmits: report.End.SumSent.Retransmits,
+	}, nil
+}
+
+// parseSpeedtest reads the "bytes=<n> seconds=<s>" line the agent prints
+// after timing the download.
+func parseSpeedtest(output string) (ThroughputResult, error) {
+	m := speedtestPattern.FindStringSubmatch(output)
+	if m == nil {
+		return ThroughputResult{}, errors.New("no transfer statistics in output")
+	}
+	res := ThroughputResult{Bytes: int64(atoi(m[1])), Seconds: atof(m[2])}
+	if res.Seconds > 0 {
+		res.Mbps = float64(res.Bytes) * 8 / res.Seconds / 1e6
+	}
+	return res, nil
+}
+
+func lines(output string) []string {
+	var out []string
+	sc := bufio.NewScanner(strings.NewReader(output))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		out = append(out, sc.Text())
+	}
+	return out
+}
@@ -0,0 +1,158 @@
+package diagnostics
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParsePing(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    PingResult
+		wantErr bool
+	}{
+		{fixture: "ping_busybox.txt", want: PingResult{
+			Transmitted: 4, Received: 4, LossPercent: 0, MinMs: 9.547, AvgMs: 9.748, MaxMs: 10.034,
+			Replies: []PingReply{{0, 117, 9.812}, {1, 117, 9.547}, {2, 117, 10.034}, {3, 117, 9.601}},
+		}},
+		{fixture: "ping_busybox_loss.txt", want: PingResult{
+			Transmitted: 4, Received: 3, LossPercent: 25, MinMs: 181.996, AvgMs: 522.651, MaxMs: 1203.55,
+			Replies: []PingReply{{0, 52, 182.407}, {2, 52, 181.996}, {3, 52, 1203.55}},
+		}},
+		{fixture: "ping_busybox_dup.txt", want: PingResult{
+			Transmitted: 2, Received: 2, LossPercent: 0, MinMs: 0.181, AvgMs: 0.755, MaxMs: 1.882,
+			Replies: []PingReply{{0, 64, 0.181}, {0, 64, 1.882}, {1, 64, 0.203}},
+		}},
+		{fixture: "ping_busybox_unreachable.txt", want: PingResult{
+			Transmitted: 4, Received: 0, LossPercent: 100, Replies: []PingReply{},
+		}},
+		{fixture: "ping_busybox_bad_address.txt", wantErr: true},
+		{fixture: "ping_iputils.txt", want: PingResult{
+			Transmitted: 3, Received: 2, LossPercent: 33.3333, MinMs: 3.42, AvgMs: 3.465, MaxMs: 3.51,
+			Replies: []PingReply{{1, 58, 3.42}, {2, 58, 3.51}},
+		}},
+		{fixture: "ping6_busybox.txt", want: PingResult{
+			Transmitted: 2, Received: 2, LossPercent: 0, MinMs: 10.893, AvgMs: 11.05, MaxMs: 11.207,
+			Replies: []PingReply{{0, 118, 11.207}, {1, 118, 10.893}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got, err := Parse(ActionPing, readFixture(t, tt.fixture))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraceroute(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []Hop
+	}{
+		{"traceroute_busybox.txt", []Hop{
+			{Hop: 1, Address: "192.168.1.1", ProbesMs: []float64{0.602, 0.412}},
+			{Hop: 2, ProbesMs: []float64{}, Timeouts: 2},
+			{Hop: 3, Address: "100.72.0.1", ProbesMs: []float64{8.212, 7.981}},
+			{Hop: 4, Address: "72.14.215.85", ProbesMs: []float64{9.813, 10.122}},
+			{Hop: 5, Address: "142.250.56.125", ProbesMs: []float64{10.204, 11.017}},
+			{Hop: 6, Address: "8.8.8.8", ProbesMs: []float64{9.612, 9.54}},
+		}},
+		{"traceroute_busybox_resolved.txt", []Hop{
+			{Hop: 1, Address: "192.168.1.1", ProbesMs: []float64{0.512, 0.398, 0.371}},
+			{Hop: 2, Address: "10.10.0.1", ProbesMs: []float64{4.102}, Timeouts: 2},
+			{Hop: 3, Address: "10.0.0.1", ProbesMs: []float64{3.101, 3.044}, Timeouts: 1},
+		}},
+		{"traceroute_openwrt.txt", []Hop{
+			{Hop: 1, Address: "192.168.1.1", ProbesMs: []float64{0.433, 0.391}},
+			{Hop: 2, ProbesMs: []float64{}, Timeouts: 2},
+			{Hop: 3, Address: "84.116.130.114", ProbesMs: []float64{12.56, 12.331}},
+			{Hop: 4, Address: "149.112.112.112", ProbesMs: []float64{13.017, 12.902}},
+			{Hop: 5, Address: "9.9.9.9", ProbesMs: []float64{12.884, 12.771}},
+		}},
+		{"traceroute6_busybox.txt", []Hop{
+			{Hop: 1, Address: "fd00::1", ProbesMs: []float64{0.711, 0.545}},
+			{Hop: 2, Address: "2a02:8108::1", ProbesMs: []float64{9.134, 8.88}},
+			{Hop: 3, Address: "2001:4860:4860::8888", ProbesMs: []float64{11.32, 11.102}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got, err := Parse(ActionTraceroute, readFixture(t, tt.fixture))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, TracerouteResult{Hops: tt.want}) {
+				t.Errorf("Parse() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := Parse(ActionTraceroute, "traceroute: bad address 'does-not-exist.invalid'\n"); err == nil {
+		t.Error("Parse() of output without hops succeeded")
+	}
+}
+
+// TestParseLine feeds the fixtures line by line, as progress arrives, and
+// checks that only replies and hops are reported and that they match the
+// full parse.
+func TestParseLine(t *testing.T) {
+	for _, tt := range []struct{ action, fixture string }{
+		{ActionPing, "ping_busybox.txt"},
+		{ActionPing, "ping_busybox_dup.txt"},
+		{ActionPing, "ping_iputils.txt"},
+		{ActionTraceroute, "traceroute_busybox.txt"},
+		{ActionTraceroute, "traceroute_busybox_resolved.txt"},
+		{ActionTraceroute, "traceroute_openwrt.txt"},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			output := readFixture(t, tt.fixture)
+			var lines []any
+			for _, line := range strings.Split(output, "\n") {
+				if v := ParseLine(tt.action, line); v != nil {
+					lines = append(lines, v)
+				}
+			}
+			full, err := Parse(tt.action, output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []any
+			switch r := full.(type) {
+			case PingResult:
+				for _, reply := range r.Replies {
+					want = append(want, reply)
+				}
+			case TracerouteResult:
+				for _, hop := range r.Hops {
+					want = append(want, hop)
+				}
+			}
+			if !reflect.DeepEqual(lines, want) {
+				t.Errorf("ParseLine() reported\n%+v\nwant\n%+v", lines, want)
+			}
+		})
+	}
+}
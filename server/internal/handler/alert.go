@@ -1,17 +1,23 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/jobs"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
 	"gorm.io/gorm"
 )
 
 type AlertHandler struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	Hub *ws.Hub
 }
 
 func (h *AlertHandler) List(c *gin.Context) {
@@ -35,6 +41,16 @@ func (h *AlertHandler) List(c *gin.Context) {
 			return
 		}
 	}
+	if acked := c.Query("acknowledged"); acked == "false" {
+		query = query.Where("acknowledged = false")
+	} else if acked == "true" {
+		query = query.Where("acknowledged = true")
+	}
+	if silenced := c.Query("silenced"); silenced == "false" {
+		query = query.Where("silenced = false")
+	} else if silenced == "true" {
+		query = query.Where("silenced = true")
+	}
 
 	// Pagination
 	page := 1
@@ -62,22 +78,179 @@ func (h *AlertHandler) Resolve(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
 		return
 	}
-	now := time.Now()
-	h.DB.Model(&alert).Updates(map[string]any{"resolved": true, "resolved_at": &now})
+	jobs.ResolveAlerts(h.DB, h.Hub, []model.Alert{alert})
+	writeAudit(h.DB, c, "resolve", "alert", fmt.Sprintf("resolved %s alert on %s (id=%d)", alert.Metric, alert.DeviceName, alert.ID))
 	c.JSON(http.StatusOK, gin.H{"message": "resolved"})
 }
 
+// Acknowledge marks an alert as being handled without resolving it.
+func (h *AlertHandler) Acknowledge(c *gin.Context) {
+	var alert model.Alert
+	if err := h.DB.First(&alert, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "alert not found"})
+		return
+	}
+	if alert.Resolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "alert already resolved"})
+		return
+	}
+
+	// The comment is optional, so an empty body is accepted
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username, _ := c.Get("username")
+	uname, _ := username.(string)
+	now := time.Now()
+	if err := h.DB.Model(&alert).Updates(map[string]any{
+		"acknowledged": true,
+		"acked_by":     uname,
+		"ack_comment":  req.Comment,
+		"acked_at":     &now,
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "acknowledge", "alert", fmt.Sprintf("acknowledged %s alert on %s (id=%d): %s", alert.Metric, alert.DeviceName, alert.ID, req.Comment))
+
+	if h.Hub != nil {
+		h.Hub.Broadcast("alert_ack", map[string]any{
+			"id":          alert.ID,
+			"device_id":   alert.DeviceID,
+			"acked_by":    uname,
+			"ack_comment": req.Comment,
+		})
+	}
+	c.JSON(http.StatusOK, alert)
+}
+
 func (h *AlertHandler) Summary(c *gin.Context) {
-	var total, unresolved, warning, critical int64
+	var total, unresolved, warning, critical, acknowledged, silenced int64
 	h.DB.Model(&model.Alert{}).Count(&total)
 	h.DB.Model(&model.Alert{}).Where("resolved = false").Count(&unresolved)
 	h.DB.Model(&model.Alert{}).Where("resolved = false AND severity = ?", model.SeverityWarning).Count(&warning)
 	h.DB.Model(&model.Alert{}).Where("resolved = false AND severity = ?", model.SeverityCritical).Count(&critical)
+	h.DB.Model(&model.Alert{}).Where("resolved = false AND acknowledged = true").Count(&acknowledged)
+	h.DB.Model(&model.Alert{}).Where("resolved = false AND silenced = true").Count(&silenced)
 
 	c.JSON(http.StatusOK, gin.H{
-		"total":      total,
-		"unresolved": unresolved,
-		"warning":    warning,
-		"critical":   critical,
+		"total":        total,
+		"unresolved":   unresolved,
+		"warning":      warning,
+		"critical":     critical,
+		"acknowledged": acknowledged,
+		"silenced":     silenced,
 	})
 }
+
+// --- Silences ---
+
+func (h *AlertHandler) ListSilences(c *gin.Context) {
+	var silences []model.AlertSilence
+	query := h.DB
+	if c.Query("active") == "true" {
+		now := time.Now()
+		query = query.Where("expires_at > ?", now)
+	}
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	query.Order("starts_at DESC").Limit(500).Find(&silences)
+	c.JSON(http.StatusOK, silences)
+}
+
+// CreateSilence mutes alerts matching the given device/group/metric/severity
+// until expires_at. A future starts_at schedules a maintenance window.
+func (h *AlertHandler) CreateSilence(c *gin.Context) {
+	var req struct {
+		DeviceID  uint                `json:"device_id"`
+		Group     string              `json:"group"`
+		Metric    string              `json:"metric"`
+		Severity  model.AlertSeverity `json:"severity"`
+		Kind      string              `json:"kind"`
+		Comment   string              `json:"comment"`
+		StartsAt  *time.Time          `json:"starts_at"`
+		ExpiresAt time.Time           `json:"expires_at" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DeviceID == 0 && req.Group == "" && req.Metric == "" && req.Severity == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one matcher (device_id, group, metric, severity) is required"})
+		return
+	}
+	if req.Severity != "" {
+		if err := validateOneOf("severity", string(req.Severity), []string{string(model.SeverityWarning), string(model.SeverityCritical)}); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Kind == "" {
+		req.Kind = "silence"
+	}
+	if err := validateOneOf("kind", req.Kind, []string{"silence", "maintenance"}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	startsAt := now
+	if req.StartsAt != nil {
+		startsAt = *req.StartsAt
+	}
+	if !req.ExpiresAt.After(startsAt) || !req.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future and after starts_at"})
+		return
+	}
+
+	username, _ := c.Get("username")
+	uname, _ := username.(string)
+	silence := model.AlertSilence{
+		DeviceID:  req.DeviceID,
+		Group:     req.Group,
+		Metric:    req.Metric,
+		Severity:  req.Severity,
+		Kind:      req.Kind,
+		Comment:   req.Comment,
+		CreatedBy: uname,
+		StartsAt:  startsAt,
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := h.DB.Create(&silence).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Mark already-open alerts covered by an immediately active silence; a
+	// scheduled one is applied by the silence job when its window begins
+	if !startsAt.After(now) {
+		jobs.ApplySilence(h.DB, silence)
+	}
+
+	writeAudit(h.DB, c, "create", "alert_silence", fmt.Sprintf("created %s id=%d (device_id=%d group=%q metric=%q severity=%q) until %s: %s",
+		silence.Kind, silence.ID, silence.DeviceID, silence.Group, silence.Metric, silence.Severity,
+		silence.ExpiresAt.Format(time.RFC3339), silence.Comment))
+	c.JSON(http.StatusCreated, silence)
+}
+
+// ExpireSilence ends a silence immediately. The record is kept for history.
+func (h *AlertHandler) ExpireSilence(c *gin.Context) {
+	var silence model.AlertSilence
+	if err := h.DB.First(&silence, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "silence not found"})
+		return
+	}
+	now := time.Now()
+	if silence.ExpiresAt.After(now) {
+		h.DB.Model(&silence).Update("expires_at", now)
+		jobs.ReleaseEndedSilences(h.DB, now)
+	}
+	writeAudit(h.DB, c, "expire", "alert_silence", fmt.Sprintf("expired %s id=%d", silence.Kind, silence.ID))
+	c.JSON(http.StatusOK, gin.H{"message": "expired"})
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+// alertmanagerWebhook is the Alertmanager webhook_config payload (version 4).
+type alertmanagerWebhook struct {
+	Version  string `json:"version"`
+	GroupKey string `json:"groupKey"`
+	Status   string `json:"status"`
+	Receiver string `json:"receiver"`
+	Alerts   []struct {
+		Status       string            `json:"status"` // firing, resolved
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		EndsAt       time.Time         `json:"endsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
+	} `json:"alerts"`
+}
+
+type AlertmanagerHandler struct {
+	DB    *gorm.DB
+	Hub   *ws.Hub
+	Token string
+}
+
+// Webhook receives Alertmanager notifications and mirrors them into /alerts,
+// attaching each alert to a device by its "mac", "device" or "name" label.
+// Alertmanager must send "Authorization: Bearer <ALERTMANAGER_WEBHOOK_TOKEN>".
+func (h *AlertmanagerHandler) Webhook(c *gin.Context) {
+	if h.Token == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "alertmanager webhook is disabled"})
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
+	}
+
+	var payload alertmanagerWebhook
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var created, updated, resolved, unmatched, ignored int
+	for _, a := range payload.Alerts {
+		// Alerts NexusGate forwarded itself already exist here
+		if a.Labels["source"] == "nexusgate" {
+			ignored++
+			continue
+		}
+		if a.Fingerprint == "" {
+			unmatched++
+			continue
+		}
+		var existing model.Alert
+		found := h.DB.Where("fingerprint = ? AND source = ? AND resolved = false", a.Fingerprint, jobs.AlertSourceAlertmanager).
+			First(&existing).Error == nil
+
+		if a.Status == "resolved" {
+			if found {
+				jobs.ResolveAlerts(h.DB, h.Hub, []model.Alert{existing})
+				resolved++
+			}
+			continue
+		}
+
+		value, _ := strconv.ParseFloat(a.Annotations["value"], 64)
+		if found {
+			h.DB.Model(&existing).Updates(map[string]any{"value": value, "description": alertmanagerDescription(a.Annotations)})
+			updated++
+			continue
+		}
+
+		device, ok := h.matchDevice(a.Labels)
+		if !ok {
+			unmatched++
+			continue
+		}
+		alert := model.Alert{
+			Source:      jobs.AlertSourceAlertmanager,
+			Fingerprint: a.Fingerprint,
+			DeviceID:    device.ID,
+			DeviceName:  device.Name,
+			Metric:      a.Labels["alertname"],
+			Value:       value,
+			Severity:    model.SeverityWarning,
+			Description: alertmanagerDescription(a.Annotations),
+		}
+		if strings.EqualFold(a.Labels["severity"], string(model.SeverityCritical)) {
+			alert.Severity = model.SeverityCritical
+		}
+		if !a.StartsAt.IsZero() {
+			alert.CreatedAt = a.StartsAt
+		}
+		if err := h.DB.Create(&alert).Error; err != nil {
+			log.Printf("failed to store alertmanager alert %s: %v", a.Fingerprint, err)
+			continue
+		}
+		created++
+
+		if h.Hub != nil {
+			h.Hub.Broadcast("alert", map[string]any{
+				"id":          alert.ID,
+				"device_id":   alert.DeviceID,
+				"device_name": alert.DeviceName,
+				"metric":      alert.Metric,
+				"value":       alert.Value,
+				"severity":    alert.Severity,
+				"source":      alert.Source,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"created":   created,
+		"updated":   updated,
+		"resolved":  resolved,
+		"unmatched": unmatched,
+		"ignored":   ignored,
+	})
+}
+
+// matchDevice finds the device an Alertmanager alert refers to, by MAC first
+// and then by name.
+func (h *AlertmanagerHandler) matchDevice(labels map[string]string) (model.Device, bool) {
+	var device model.Device
+	if mac := labels["mac"]; mac != "" {
+		if err := h.DB.Where("UPPER(mac) = ?", strings.ToUpper(mac)).First(&device).Error; err == nil {
+			return device, true
+		}
+	}
+	for _, key := range []string{"device", "name"} {
+		if name := labels[key]; name != "" {
+			if err := h.DB.Where("name = ?", name).First(&device).Error; err == nil {
+				return device, true
+			}
+		}
+	}
+	return device, false
+}
+
+func alertmanagerDescription(annotations map[string]string) string {
+	if s := annotations["summary"]; s != "" {
+		return s
+	}
+	if s := annotations["description"]; s != "" {
+		return s
+	}
+	return fmt.Sprintf("%v", annotations)
+}
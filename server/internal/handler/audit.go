@@ -24,6 +24,16 @@ func writeAudit(db *gorm.DB, c *gin.Context, action, resource, detail string) {
 	})
 }
 
+// writeSystemAudit records an action a background job took on its own.
+func writeSystemAudit(db *gorm.DB, action, resource, detail string) {
+	db.Create(&model.AuditLog{
+		Username: "system",
+		Action:   action,
+		Resource: resource,
+		Detail:   detail,
+	})
+}
+
 // writeLoginAudit creates an audit log for login events (before JWT context is set).
 func writeLoginAudit(db *gorm.DB, c *gin.Context, userID uint, username, detail string) {
 	db.Create(&model.AuditLog{
@@ -2,32 +2,53 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
 	"gorm.io/gorm"
 )
 
-const mqttPublishTimeout = 5 * time.Second
+const mqttPublishTimeout = protocol.PublishTimeout
+
+// configConfirmTimeout is how long agents with commit-confirm wait for the
+// server's confirmation before rolling a pushed config back.
+const configConfirmTimeout = 120
 
 // configEnvelope wraps UCI config content with an ID so the agent can ACK.
 type configEnvelope struct {
-	ConfigID uint   `json:"config_id"`
-	Content  string `json:"content"`
+	Version        int    `json:"v"`
+	ConfigID       uint   `json:"config_id"`
+	Content        string `json:"content"`
+	ConfirmTimeout int    `json:"confirm_timeout,omitempty"`
 }
 
-// publishConfig sends a config envelope via MQTT. Returns an error if publish fails.
-func publishConfig(mqttClient mqtt.Client, mac string, configID uint, content string) error {
+// commandErrorStatus maps a protocol.PublishCommand error to an HTTP status:
+// 409 when the agent lacks the capability, 503 when MQTT is unavailable.
+func commandErrorStatus(err error) int {
+	if errors.Is(err, protocol.ErrUnsupported) {
+		return http.StatusConflict
+	}
+	return http.StatusServiceUnavailable
+}
+
+// publishConfig sends a config envelope via MQTT. Returns an error if publish
+// fails. Devices supporting commit-confirm are asked to roll back unless the
+// server confirms the config within configConfirmTimeout seconds.
+func publishConfig(mqttClient mqtt.Client, device model.Device, configID uint, content string) error {
 	if mqttClient == nil || !mqttClient.IsConnected() {
 		return fmt.Errorf("MQTT not connected")
 	}
-	envelope := configEnvelope{ConfigID: configID, Content: content}
+	envelope := configEnvelope{Version: protocol.Version, ConfigID: configID, Content: content}
+	if protocol.Supports(device, protocol.CapConfigConfirm) {
+		envelope.ConfirmTimeout = configConfirmTimeout
+	}
 	payload, _ := json.Marshal(envelope)
-	topic := fmt.Sprintf("nexusgate/devices/%s/config", mac)
+	topic := fmt.Sprintf("nexusgate/devices/%s/config", device.MAC)
 	token := mqttClient.Publish(topic, 1, false, payload)
 	if !token.WaitTimeout(mqttPublishTimeout) {
 		return fmt.Errorf("MQTT publish timed out")
@@ -140,7 +161,7 @@ func (h *ConfigHandler) PushConfig(c *gin.Context) {
 		return
 	}
 
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, content); err != nil {
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
 		return
 	}
@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/uci"
+	"gorm.io/gorm"
+)
+
+// importPackages are the UCI packages ImportHandler reads.
+var importPackages = []string{"firewall", "network", "dhcp", "mwan3"}
+
+const uciExportTimeout = 30 * time.Second
+
+// ImportHandler reads the configuration a device already has into the
+// firewall, VPN and network models, so that applying them later does not
+// wipe it.
+type ImportHandler struct {
+	DB  *gorm.DB
+	RPC *agentmqtt.RPC
+	SSH *deviceSSH
+}
+
+// importItem is what importing one record does.
+type importItem struct {
+	Kind     string   `json:"kind"` // audit resource name: firewall_zone, vpn_peer, ...
+	Key      string   `json:"key"`  // what it is matched on: name, public key, MAC, VLAN ID
+	Action   string   `json:"action"`
+	Changes  []string `json:"changes,omitempty"`  // fields that differ from the existing record
+	Record   any      `json:"record"`             // as imported
+	Existing any      `json:"existing,omitempty"` // the record with the same key
+}
+
+// Import actions. A record whose key is taken by a different one is a
+// conflict unless overwrite is set, in which case it is updated.
+const (
+	importCreate    = "create"
+	importUpdate    = "update"
+	importUnchanged = "unchanged"
+	importConflict  = "conflict"
+)
+
+type importReport struct {
+	DryRun   bool           `json:"dry_run"`
+	Source   string         `json:"source"` // content, agent, ssh
+	Summary  map[string]int `json:"summary"`
+	Items    []importItem   `json:"items"`
+	Warnings []string       `json:"warnings"`
+}
+
+// Import reads the device's firewall, network, dhcp and mwan3 configuration
+// from pasted `uci export` output, the agent or an SSH login (in that
+// order) and imports it. With dry_run nothing is written and the report
+// shows what would be; records conflicting with existing ones are left
+// alone unless overwrite is set.
+func (h *ImportHandler) Import(c *gin.Context) {
+	var req struct {
+		Content   string   `json:"content"`
+		Packages  []string `json:"packages"`
+		DryRun    bool     `json:"dry_run"`
+		Overwrite bool     `json:"overwrite"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Packages) == 0 {
+		req.Packages = importPackages
+	}
+	for _, p := range req.Packages {
+		if !contains(importPackages, p) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "packages must be among " + strings.Join(importPackages, ", ")})
+			return
+		}
+	}
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	report := &importReport{DryRun: req.DryRun, Source: "content", Summary: map[string]int{}, Items: []importItem{}}
+	content := req.Content
+	if content == "" {
+		var ok bool
+		content, report.Source, ok = h.export(c, device, req.Packages)
+		if !ok {
+			return
+		}
+	}
+	pkgs, err := uci.Parse(strings.NewReader(content))
+	if err != nil {
+		status := http.StatusBadRequest
+		if report.Source != "content" {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	var wanted []*uci.Package
+	for _, p := range pkgs {
+		if contains(req.Packages, p.Name) {
+			wanted = append(wanted, p)
+		}
+	}
+
+	imp := importUCI(device.ID, wanted)
+	report.Warnings = imp.Warnings
+	if report.Warnings == nil {
+		report.Warnings = []string{}
+	}
+	run := func(tx *gorm.DB) error {
+		return imp.apply(tx, report, device.ID, !req.DryRun, req.Overwrite)
+	}
+	if req.DryRun {
+		err = run(h.DB)
+	} else {
+		err = h.DB.Transaction(run)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "import failed: " + err.Error()})
+		return
+	}
+
+	if !req.DryRun {
+		writeAudit(h.DB, c, "import", "config", fmt.Sprintf("imported configuration of device %s from %s: %d created, %d updated, %d conflicts",
+			device.Name, report.Source, report.Summary[importCreate], report.Summary[importUpdate], report.Summary[importConflict]))
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// export reads the packages from the device, through the agent when it
+// supports uci_export and over SSH otherwise. On failure it writes the
+// error response and returns ok=false.
+func (h *ImportHandler) export(c *gin.Context, device model.Device, packages []string) (content, source string, ok bool) {
+	if protocol.RequireRPC(device, "uci_export") == nil {
+		_, result, ok := callAgent(c, h.DB, h.RPC, "uci_export", gin.H{"packages": packages}, uciExportTimeout)
+		if !ok {
+			return "", "", false
+		}
+		var reply struct {
+			Output string `json:"output"`
+		}
+		if err := json.Unmarshal(result, &reply); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "invalid uci_export reply"})
+			return "", "", false
+		}
+		return reply.Output, "agent", true
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), uciExportTimeout)
+	defer cancel()
+	conn, release, err := h.SSH.pooled(ctx, device)
+	if err != nil {
+		if errors.Is(err, errNoCredential) {
+			c.JSON(http.StatusConflict, gin.H{"error": "the agent cannot export its configuration and no SSH credentials are stored; pass the uci export output as content"})
+			return "", "", false
+		}
+		sshError(c, err)
+		return "", "", false
+	}
+	defer release()
+	// Packages that are not installed (mwan3) are left out.
+	var command strings.Builder
+	for _, p := range packages {
+		fmt.Fprintf(&command, "uci export %s 2>/dev/null; ", p)
+	}
+	command.WriteString("exit 0")
+	out, err := ssh.Exec(ctx, conn, command.String(), uci.MaxInput)
+	if err != nil {
+		sshError(c, err)
+		return "", "", false
+	}
+	return out, "ssh", true
+}
+
+// apply plans the import of every record, and with write set performs it.
+func (imp *importedConfig) apply(tx *gorm.DB, report *importReport, deviceID uint, write, overwrite bool) error {
+	device := func(db *gorm.DB) *gorm.DB { return db.Where("device_id = ?", deviceID) }
+
+	if err := importRecords(tx, report, "firewall_zone", imp.Zones, device, write, overwrite,
+		func(z *model.FirewallZone) string { return z.Name },
+		func(o, n *model.FirewallZone) []string {
+			return changes("input", o.Input, n.Input, "output", o.Output, n.Output, "forward", o.Forward, n.Forward,
+				"masq", o.Masq, n.Masq, "networks", o.Networks, n.Networks)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "firewall_rule", imp.Rules, device, write, overwrite,
+		func(r *model.FirewallRule) string { return r.Name },
+		func(o, n *model.FirewallRule) []string {
+			return changes("src", o.Src, n.Src, "dest", o.Dest, n.Dest, "proto", o.Proto, n.Proto,
+				"src_ip", o.SrcIP, n.SrcIP, "dest_ip", o.DestIP, n.DestIP, "dest_port", o.DestPort, n.DestPort,
+				"target", o.Target, n.Target, "enabled", o.Enabled, n.Enabled, "position", o.Position, n.Position)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "vpn_interface", imp.Interfaces, device, write, overwrite,
+		func(i *model.WireGuardInterface) string { return i.Name },
+		func(o, n *model.WireGuardInterface) []string {
+			return changes("private_key", o.PrivateKey, n.PrivateKey, "public_key", o.PublicKey, n.PublicKey,
+				"address", o.Address, n.Address, "listen_port", o.ListenPort, n.ListenPort, "enabled", o.Enabled, n.Enabled)
+		}); err != nil {
+		return err
+	}
+
+	// Peers belong to the interface of the same name; in a dry run a new
+	// interface has no ID yet, so all its peers are new.
+	for _, iface := range imp.Interfaces {
+		var existing model.WireGuardInterface
+		if err := tx.Select("id").Where("device_id = ? AND name = ?", deviceID, iface.Name).Limit(1).Find(&existing).Error; err != nil {
+			return err
+		}
+		peers := imp.Peers[iface.Name]
+		for i := range peers {
+			peers[i].InterfaceID = existing.ID
+		}
+		if err := importRecords(tx, report, "vpn_peer", peers,
+			func(db *gorm.DB) *gorm.DB { return db.Where("interface_id = ?", existing.ID) }, write, overwrite,
+			func(p *model.WireGuardPeer) string { return p.PublicKey },
+			func(o, n *model.WireGuardPeer) []string {
+				return changes("description", o.Description, n.Description, "preshared_key", o.PresharedKey, n.PresharedKey,
+					"allowed_ips", o.AllowedIPs, n.AllowedIPs, "endpoint", o.Endpoint, n.Endpoint,
+					"keepalive", o.Keepalive, n.Keepalive, "enabled", o.Enabled, n.Enabled)
+			}, "last_handshake", "tx_bytes", "rx_bytes"); err != nil {
+			return err
+		}
+	}
+
+	if err := importRecords(tx, report, "dhcp_pool", imp.Pools, device, write, overwrite,
+		func(p *model.DHCPPool) string { return p.Interface },
+		func(o, n *model.DHCPPool) []string {
+			return changes("start", o.Start, n.Start, "limit", o.Limit, n.Limit, "lease_time", o.LeaseTime, n.LeaseTime,
+				"dns", o.DNS, n.DNS, "gateway", o.Gateway, n.Gateway, "enabled", o.Enabled, n.Enabled)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "static_lease", imp.Leases, device, write, overwrite,
+		func(l *model.StaticLease) string { return strings.ToLower(l.MAC) },
+		func(o, n *model.StaticLease) []string {
+			return changes("name", o.Name, n.Name, "ip", o.IP, n.IP)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "vlan", imp.VLANs, device, write, overwrite,
+		func(v *model.VLAN) string { return strconv.Itoa(v.VID) },
+		func(o, n *model.VLAN) []string {
+			return changes("name", o.Name, n.Name, "interface", o.Interface, n.Interface, "ip_addr", o.IPAddr, n.IPAddr,
+				"netmask", o.Netmask, n.Netmask, "isolated", o.Isolated, n.Isolated)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "wan_interface", imp.WANs, device, write, overwrite,
+		func(w *model.WANInterface) string { return w.Name },
+		func(o, n *model.WANInterface) []string {
+			return changes("interface", o.Interface, n.Interface, "enabled", o.Enabled, n.Enabled, "weight", o.Weight, n.Weight,
+				"track_ips", o.TrackIPs, n.TrackIPs, "reliability", o.Reliability, n.Reliability,
+				"interval", o.Interval, n.Interval, "down", o.Down, n.Down, "up", o.Up, n.Up)
+		}); err != nil {
+		return err
+	}
+	if err := importRecords(tx, report, "mwan_policy", imp.Policies, device, write, overwrite,
+		func(p *model.MWANPolicy) string { return p.Name },
+		func(o, n *model.MWANPolicy) []string {
+			return changes("members", o.Members, n.Members, "last_resort", o.LastResort, n.LastResort)
+		}); err != nil {
+		return err
+	}
+	return importRecords(tx, report, "mwan_rule", imp.MWANRules, device, write, overwrite,
+		func(r *model.MWANRule) string { return r.Name },
+		func(o, n *model.MWANRule) []string {
+			return changes("src_ip", o.SrcIP, n.SrcIP, "dest_ip", o.DestIP, n.DestIP, "proto", o.Proto, n.Proto,
+				"src_port", o.SrcPort, n.SrcPort, "dest_port", o.DestPort, n.DestPort, "policy", o.Policy, n.Policy,
+				"enabled", o.Enabled, n.Enabled, "position", o.Position, n.Position)
+		})
+}
+
+// importRecords matches records to the existing ones in scope by key and
+// adds what importing each does to the report; with write set it does it.
+// Soft-deleted records are matched too, since the unique indexes still
+// cover them, and are restored in place of a create. omit names columns
+// an update keeps, such as counters.
+func importRecords[T any](tx *gorm.DB, report *importReport, kind string, records []T, scope func(*gorm.DB) *gorm.DB,
+	write, overwrite bool, key func(*T) string, diff func(old, new *T) []string, omit ...string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var live, deleted []T
+	if err := scope(tx).Find(&live).Error; err != nil {
+		return err
+	}
+	if err := scope(tx.Unscoped()).Where("deleted_at IS NOT NULL").Find(&deleted).Error; err != nil {
+		return err
+	}
+	existing := make(map[string]*T, len(live))
+	for i := range live {
+		existing[key(&live[i])] = &live[i]
+	}
+	gone := make(map[string]*T, len(deleted))
+	for i := range deleted {
+		gone[key(&deleted[i])] = &deleted[i]
+	}
+	omit = append(omit, "id", "created_at")
+
+	for i := range records {
+		rec := &records[i]
+		item := importItem{Kind: kind, Key: key(rec), Action: importCreate, Record: rec}
+		if old := existing[item.Key]; old != nil {
+			item.Existing = old
+			item.Changes = diff(old, rec)
+			switch {
+			case len(item.Changes) == 0:
+				item.Action = importUnchanged
+			case overwrite:
+				item.Action = importUpdate
+			default:
+				item.Action = importConflict
+			}
+		}
+		report.Items = append(report.Items, item)
+		report.Summary[item.Action]++
+		if !write {
+			continue
+		}
+
+		var err error
+		switch {
+		case item.Action == importUpdate:
+			err = tx.Model(existing[item.Key]).Select("*").Omit(omit...).Updates(rec).Error
+		case item.Action == importCreate && gone[item.Key] != nil:
+			err = tx.Unscoped().Model(gone[item.Key]).Select("*").Omit(omit...).Updates(rec).Error
+		case item.Action == importCreate:
+			// Create replaces zero values with the column defaults
+			// (enabled false, keepalive 0); write the imported ones back.
+			created := *rec
+			err = tx.Create(&created).Error
+			if err == nil {
+				err = tx.Model(&created).Select("*").Omit(omit...).Updates(rec).Error
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", kind, item.Key, err)
+		}
+	}
+	return nil
+}
+
+// changes names the fields that differ, given (name, old, new) triples.
+func changes(triples ...any) []string {
+	var out []string
+	for i := 0; i+2 < len(triples); i += 3 {
+		if triples[i+1] != triples[i+2] {
+			out = append(out, triples[i].(string))
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
+	"gorm.io/gorm"
+)
+
+// secretOptions are UCI options previews never show. The models hide them
+// from the API too (json:"-").
+var secretOptions = map[string]bool{"private_key": true, "preshared_key": true}
+
+const redacted = "<redacted>"
+
+// configPreview is what an Apply handler would push, compared with what the
+// device last applied from the same source.
+type configPreview struct {
+	DeviceID        uint          `json:"device_id"`
+	Source          string        `json:"source"`                     // firewall, vpn, mwan, dhcp, vlan
+	Content         string        `json:"content"`                    // secrets redacted
+	ValidationError string        `json:"validation_error,omitempty"` // apply would be rejected with 400
+	BaseConfigID    *uint         `json:"base_config_id"`             // last applied record; null if none
+	Changes         []uci.Change  `json:"changes"`
+	Issues          []configIssue `json:"issues"` // apply is rejected with 422 while any is an error
+}
+
+// previewConfig checks the device and diffs pkg against the last config
+// from source the device reported applied. It neither records nor
+// publishes anything.
+func previewConfig(db *gorm.DB, device model.Device, source string, pkg *uci.Package) (configPreview, error) {
+	issues, err := checkDevice(db, device.ID)
+	if err != nil {
+		return configPreview{}, err
+	}
+	preview := configPreview{DeviceID: device.ID, Source: source, Issues: issuesFor(issues, source)}
+	if err := pkg.Validate(); err != nil {
+		preview.ValidationError = err.Error()
+	}
+
+	var base *uci.Package
+	var last model.DeviceConfig
+	if err := db.Where("device_id = ? AND source = ? AND status = ?", device.ID, source, "applied").
+		Order("id DESC").First(&last).Error; err == nil {
+		preview.BaseConfigID = &last.ID
+		pkgs, err := uci.Parse(strings.NewReader(last.Content))
+		if err != nil {
+			preview.Issues = append(preview.Issues, configIssue{
+				Severity: issueWarning, Resource: "device_config", ID: last.ID,
+				Message: "last applied config cannot be parsed, diffing against an empty package: " + err.Error(),
+			})
+		} else {
+			base = uci.Find(pkgs, pkg.Name)
+		}
+	}
+
+	preview.Changes = uci.Diff(base, pkg)
+	for i, ch := range preview.Changes {
+		if secretOptions[ch.Option] {
+			preview.Changes[i].Old = redactValues(ch.Old)
+			preview.Changes[i].New = redactValues(ch.New)
+		}
+	}
+	for _, s := range pkg.Sections {
+		for _, o := range s.Options {
+			if secretOptions[o.Name] {
+				o.Values = redactValues(o.Values)
+			}
+		}
+	}
+	preview.Content = pkg.Export()
+
+	if preview.Changes == nil {
+		preview.Changes = []uci.Change{}
+	}
+	return preview, nil
+}
+
+func redactValues(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	out := make([]string, len(values))
+	for i := range out {
+		out[i] = redacted
+	}
+	return out
+}
@@ -0,0 +1,570 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+)
+
+// Issue severities. Errors block applies and writes that introduce them;
+// warnings are only reported.
+const (
+	issueError   = "error"
+	issueWarning = "warning"
+)
+
+// configIssue is one problem found by checking a device's configuration
+// as a whole: references between records and address consistency.
+type configIssue struct {
+	Severity string `json:"severity"`
+	Resource string `json:"resource"` // audit resource name: firewall_rule, mwan_policy, ...
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Field    string `json:"field"` // JSON field of the record: src, members[1].iface; empty for the record
+	Message  string `json:"message"`
+}
+
+func (i configIssue) String() string {
+	s := i.Resource + " " + i.Name
+	if i.Field != "" {
+		s += ": " + i.Field
+	}
+	return s + ": " + i.Message
+}
+
+// key identifies an issue across two checks. It leaves out the record's
+// name so that renaming a record does not make its issues new.
+func (i configIssue) key() string {
+	return fmt.Sprintf("%s|%s|%d|%s|%s", i.Severity, i.Resource, i.ID, i.Field, i.Message)
+}
+
+// issueSources maps resources to the Apply handler (DeviceConfig.Source)
+// that pushes them.
+var issueSources = map[string]string{
+	"firewall_zone": "firewall",
+	"firewall_rule": "firewall",
+	"vpn_interface": "vpn",
+	"vpn_peer":      "vpn",
+	"wan_interface": "mwan",
+	"mwan_policy":   "mwan",
+	"mwan_rule":     "mwan",
+	"dhcp_pool":     "dhcp",
+	"static_lease":  "dhcp",
+	"vlan":          "vlan",
+}
+
+// deviceNetwork is what the checks look at for one device, disabled
+// records included.
+type deviceNetwork struct {
+	Zones     []model.FirewallZone
+	Rules     []model.FirewallRule
+	WANs      []model.WANInterface
+	Policies  []model.MWANPolicy
+	MWANRules []model.MWANRule
+	Pools     []model.DHCPPool
+	Leases    []model.StaticLease
+	VLANs     []model.VLAN
+	Ifaces    []model.WireGuardInterface
+	Peers     []model.WireGuardPeer
+
+	issues []configIssue
+}
+
+// checkDevice checks the network configuration of a device.
+func checkDevice(db *gorm.DB, deviceID uint) ([]configIssue, error) {
+	n := &deviceNetwork{}
+	for _, dest := range []any{&n.Zones, &n.WANs, &n.Policies, &n.Pools, &n.Leases, &n.Ifaces} {
+		if err := db.Where("device_id = ?", deviceID).Order("id").Find(dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, dest := range []any{&n.Rules, &n.MWANRules} {
+		if err := db.Where("device_id = ?", deviceID).Order("position, id").Find(dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := db.Where("device_id = ?", deviceID).Order("vid").Find(&n.VLANs).Error; err != nil {
+		return nil, err
+	}
+	if len(n.Ifaces) > 0 {
+		ids := make([]uint, len(n.Ifaces))
+		for i, iface := range n.Ifaces {
+			ids[i] = iface.ID
+		}
+		if err := db.Where("interface_id IN ?", ids).Order("id").Find(&n.Peers).Error; err != nil {
+			return nil, err
+		}
+	}
+	return n.check(), nil
+}
+
+func (n *deviceNetwork) check() []configIssue {
+	n.issues = nil
+	subnets := n.checkVLANs()
+	n.checkFirewall()
+	n.checkMWAN()
+	n.checkDHCP(subnets)
+	n.checkWireGuard()
+	return n.issues
+}
+
+func (n *deviceNetwork) add(severity, resource string, id uint, name, field, format string, args ...any) {
+	n.issues = append(n.issues, configIssue{
+		Severity: severity, Resource: resource, ID: id, Name: name, Field: field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// severity makes problems of disabled records warnings: they are not
+// pushed until enabled.
+func severity(enabled bool) string {
+	if enabled {
+		return issueError
+	}
+	return issueWarning
+}
+
+// --- firewall ---
+
+func (n *deviceNetwork) checkFirewall() {
+	zones := map[string]bool{"*": true}
+	for _, z := range n.Zones {
+		zones[z.Name] = true
+		if strings.Trim(z.Networks, ", ") == "" {
+			n.add(issueWarning, "firewall_zone", z.ID, z.Name, "networks", "zone covers no network")
+		}
+	}
+	for _, r := range n.Rules {
+		for _, ref := range []struct{ field, zone string }{{"src", r.Src}, {"dest", r.Dest}} {
+			if ref.zone != "" && !zones[ref.zone] {
+				n.add(severity(r.Enabled), "firewall_rule", r.ID, r.Name, ref.field, "zone %s does not exist", ref.zone)
+			}
+		}
+	}
+}
+
+// --- mwan3 ---
+
+func (n *deviceNetwork) checkMWAN() {
+	wans := map[string]model.WANInterface{}
+	for _, w := range n.WANs {
+		wans[w.Name] = w
+		if w.Enabled && strings.Trim(w.TrackIPs, ", ") == "" {
+			n.add(issueWarning, "wan_interface", w.ID, w.Name, "track_ips", "no track IPs, mwan3 cannot tell when the link is down")
+		}
+	}
+
+	// "default" routes by the main table.
+	policies := map[string]bool{"default": true}
+	for _, p := range n.Policies {
+		policies[p.Name] = true
+		var members []mwanMember
+		if p.Members != "" {
+			if err := json.Unmarshal([]byte(p.Members), &members); err != nil {
+				n.add(issueError, "mwan_policy", p.ID, p.Name, "members", "not valid JSON: %v", err)
+				continue
+			}
+		}
+		if len(members) == 0 {
+			n.add(issueWarning, "mwan_policy", p.ID, p.Name, "members", "policy has no members")
+		}
+		for i, m := range members {
+			field := fmt.Sprintf("members[%d].iface", i)
+			w, ok := wans[m.Iface]
+			switch {
+			case !ok:
+				n.add(issueError, "mwan_policy", p.ID, p.Name, field, "WAN %s does not exist", m.Iface)
+			case !w.Enabled:
+				n.add(issueWarning, "mwan_policy", p.ID, p.Name, field, "WAN %s is disabled", m.Iface)
+			}
+		}
+	}
+
+	for _, r := range n.MWANRules {
+		if !policies[r.Policy] {
+			n.add(severity(r.Enabled), "mwan_rule", r.ID, r.Name, "policy", "policy %s does not exist", r.Policy)
+		}
+	}
+}
+
+// --- VLAN ---
+
+// vlanInterface is the network interface generateVLANUCI names a VLAN's
+// subnet after.
+func vlanInterface(v model.VLAN) string {
+	if v.Name != "" {
+		return v.Name
+	}
+	return fmt.Sprintf("vlan%d", v.VID)
+}
+
+// vlanSubnet is the subnet of a VLAN, nil if it has no (valid) address.
+func vlanSubnet(v model.VLAN) *net.IPNet {
+	ip := net.ParseIP(v.IPAddr).To4()
+	mask := net.ParseIP(v.Netmask).To4()
+	if ip == nil || mask == nil {
+		return nil
+	}
+	m := net.IPMask(mask)
+	if ones, bits := m.Size(); bits == 0 || ones == 0 {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// checkVLANs returns the subnets of the VLAN interfaces by name.
+func (n *deviceNetwork) checkVLANs() map[string]*net.IPNet {
+	subnets := map[string]*net.IPNet{}
+	var checked []model.VLAN // with a subnet, in VID order
+	owner := map[string]model.VLAN{}
+	covered := map[string]bool{}
+	for _, z := range n.Zones {
+		for _, network := range strings.Split(z.Networks, ",") {
+			covered[strings.TrimSpace(network)] = true
+		}
+	}
+
+	for _, v := range n.VLANs {
+		ifName := vlanInterface(v)
+		if other, ok := owner[ifName]; ok {
+			n.add(issueError, "vlan", v.ID, v.Name, "name", "interface %s is also VLAN %d", ifName, other.VID)
+			continue
+		}
+		owner[ifName] = v
+		if !v.Isolated && !covered[ifName] {
+			n.add(issueWarning, "vlan", v.ID, v.Name, "name", "interface %s is in no firewall zone", ifName)
+		}
+		if v.IPAddr == "" {
+			continue
+		}
+		subnet := vlanSubnet(v)
+		if subnet == nil {
+			n.add(issueError, "vlan", v.ID, v.Name, "netmask", "%s/%s is not an IPv4 address and netmask", v.IPAddr, v.Netmask)
+			continue
+		}
+		if ip := net.ParseIP(v.IPAddr).To4(); ip.Equal(subnet.IP) || ip.Equal(broadcast(subnet)) {
+			n.add(issueError, "vlan", v.ID, v.Name, "ip_addr", "%s is the network or broadcast address of %s", v.IPAddr, subnet)
+		}
+		for _, other := range checked {
+			if os := subnets[vlanInterface(other)]; overlaps(subnet, os) {
+				n.add(issueError, "vlan", v.ID, v.Name, "ip_addr", "subnet %s overlaps %s of VLAN %d", subnet, os, other.VID)
+			}
+		}
+		subnets[ifName] = subnet
+		checked = append(checked, v)
+	}
+	return subnets
+}
+
+func broadcast(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	for i := range ip {
+		ip[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return ip
+}
+
+// hostAddress is the address offset hosts into subnet, as dnsmasq counts
+// DHCP start and limit.
+func hostAddress(subnet *net.IPNet, offset int) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		sum := int(ip[i]) + offset
+		ip[i] = byte(sum)
+		offset = sum >> 8
+	}
+	return ip
+}
+
+// --- DHCP ---
+
+// checkDHCP checks pools against the subnet of their interface, known for
+// VLAN interfaces, and static leases against the pools.
+func (n *deviceNetwork) checkDHCP(subnets map[string]*net.IPNet) {
+	unknown := false
+	var known []*net.IPNet
+	for _, p := range n.Pools {
+		subnet := subnets[p.Interface]
+		if subnet == nil {
+			unknown = unknown || p.Enabled
+			continue
+		}
+		if p.Enabled {
+			known = append(known, subnet)
+		}
+		ones, bits := subnet.Mask.Size()
+		hosts := 1<<(bits-ones) - 2
+		if p.Start < 1 || p.Limit < 1 || p.Start+p.Limit-1 > hosts {
+			n.add(severity(p.Enabled), "dhcp_pool", p.ID, p.Interface, "limit", "range %s-%s (start %d, limit %d) does not fit in %s",
+				hostAddress(subnet, p.Start), hostAddress(subnet, p.Start+p.Limit-1), p.Start, p.Limit, subnet)
+		}
+		if gw := net.ParseIP(p.Gateway); gw != nil && !subnet.Contains(gw) {
+			n.add(severity(p.Enabled), "dhcp_pool", p.ID, p.Interface, "gateway", "%s is outside %s", p.Gateway, subnet)
+		}
+	}
+
+	reserved := map[string]model.StaticLease{}
+	for _, l := range n.Leases {
+		if other, ok := reserved[l.IP]; ok {
+			n.add(issueError, "static_lease", l.ID, l.Name, "ip", "%s is also reserved for %s (%s)", l.IP, other.Name, other.MAC)
+			continue
+		}
+		reserved[l.IP] = l
+
+		// Only when every pool's subnet is known can a lease be placed
+		// outside all of them.
+		ip := net.ParseIP(l.IP)
+		if ip == nil || unknown || len(known) == 0 {
+			continue
+		}
+		inside := false
+		for _, subnet := range known {
+			inside = inside || subnet.Contains(ip)
+		}
+		if !inside {
+			names := make([]string, len(known))
+			for i, subnet := range known {
+				names[i] = subnet.String()
+			}
+			n.add(issueError, "static_lease", l.ID, l.Name, "ip", "%s is outside every DHCP pool subnet (%s)", l.IP, strings.Join(names, ", "))
+		}
+	}
+}
+
+// --- WireGuard ---
+
+func (n *deviceNetwork) checkWireGuard() {
+	ports := map[int]string{}
+	var subnets []*net.IPNet
+	var names []string
+	for _, iface := range n.Ifaces {
+		sev := severity(iface.Enabled)
+		if iface.Enabled {
+			if other, ok := ports[iface.ListenPort]; ok {
+				n.add(issueError, "vpn_interface", iface.ID, iface.Name, "listen_port", "port %d is also used by %s", iface.ListenPort, other)
+			}
+			ports[iface.ListenPort] = iface.Name
+		}
+
+		peers := 0
+		for _, p := range n.Peers {
+			if p.InterfaceID == iface.ID && p.Enabled {
+				peers++
+			}
+		}
+		if iface.Enabled && peers == 0 {
+			n.add(issueWarning, "vpn_interface", iface.ID, iface.Name, "", "interface has no enabled peers")
+		}
+
+		if iface.Address == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(iface.Address)
+		if err != nil {
+			n.add(sev, "vpn_interface", iface.ID, iface.Name, "address", "%q is not an address in CIDR notation", iface.Address)
+			continue
+		}
+		for i, other := range subnets {
+			if overlaps(subnet, other) {
+				n.add(sev, "vpn_interface", iface.ID, iface.Name, "address", "subnet %s overlaps %s of %s", subnet, other, names[i])
+			}
+		}
+		for _, v := range n.VLANs {
+			if vs := vlanSubnet(v); vs != nil && overlaps(subnet, vs) {
+				n.add(sev, "vpn_interface", iface.ID, iface.Name, "address", "subnet %s overlaps %s of VLAN %d", subnet, vs, v.VID)
+			}
+		}
+		subnets = append(subnets, subnet)
+		names = append(names, iface.Name)
+	}
+
+	for _, p := range n.Peers {
+		if p.Enabled && strings.Trim(p.AllowedIPs, ", ") == "" {
+			n.add(issueWarning, "vpn_peer", p.ID, p.Description, "allowed_ips", "peer routes no addresses")
+		}
+	}
+}
+
+// --- enforcement ---
+
+// issuesFor returns the issues in what the Apply handler of source pushes.
+func issuesFor(issues []configIssue, source string) []configIssue {
+	out := []configIssue{}
+	for _, i := range issues {
+		if issueSources[i.Resource] == source {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+func issueErrors(issues []configIssue) []configIssue {
+	var out []configIssue
+	for _, i := range issues {
+		if i.Severity == issueError {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// validationError carries the errors a write or an apply was refused for.
+type validationError struct {
+	Issues []configIssue
+}
+
+func (e *validationError) Error() string {
+	msg := e.Issues[0].String()
+	if len(e.Issues) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Issues)-1)
+	}
+	return msg
+}
+
+func (e *validationError) respond(c *gin.Context) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "configuration check failed: " + e.Error(), "issues": e.Issues})
+}
+
+// statusError is a write refused for another reason than the check, with
+// the status to answer.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+// checkedWrite runs write in a transaction and rolls it back, answering
+// 422 with the new issues, when it adds errors to the configuration of the
+// given devices (the record's device before and after an update). Errors
+// that were already there do not block it, so references can be fixed in
+// any order. It answers a statusError with its status and 500 for other
+// errors; false means a response was written.
+func checkedWrite(c *gin.Context, db *gorm.DB, deviceIDs []uint, write func(tx *gorm.DB) error) bool {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		before := map[uint][]configIssue{}
+		for _, id := range deviceIDs {
+			if _, done := before[id]; done {
+				continue
+			}
+			issues, err := checkDevice(tx, id)
+			if err != nil {
+				return err
+			}
+			before[id] = issues
+		}
+		if err := write(tx); err != nil {
+			return err
+		}
+
+		var added []configIssue
+		for id, old := range before {
+			seen := map[string]bool{}
+			for _, i := range old {
+				seen[i.key()] = true
+			}
+			issues, err := checkDevice(tx, id)
+			if err != nil {
+				return err
+			}
+			for _, i := range issueErrors(issues) {
+				if !seen[i.key()] {
+					added = append(added, i)
+				}
+			}
+		}
+		if len(added) > 0 {
+			return &validationError{Issues: added}
+		}
+		return nil
+	})
+
+	var verr *validationError
+	var serr *statusError
+	switch {
+	case errors.As(err, &verr):
+		verr.respond(c)
+		return false
+	case errors.As(err, &serr):
+		c.JSON(serr.status, gin.H{"error": serr.msg})
+		return false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// checkBeforeApply answers 422 and returns false when what source pushes
+// to the device has errors.
+func checkBeforeApply(c *gin.Context, db *gorm.DB, deviceID uint, source string) bool {
+	err := checkApply(db, deviceID, source)
+	var verr *validationError
+	switch {
+	case errors.As(err, &verr):
+		verr.respond(c)
+		return false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// checkApply is checkBeforeApply for callers that apply without a request
+// of their own; refusals are a validationError.
+func checkApply(db *gorm.DB, deviceID uint, source string) error {
+	issues, err := checkDevice(db, deviceID)
+	if err != nil {
+		return err
+	}
+	if errs := issueErrors(issuesFor(issues, source)); len(errs) > 0 {
+		return &validationError{Issues: errs}
+	}
+	return nil
+}
+
+// ValidateConfig lists the issues in a device's firewall, VPN, mwan3, DHCP
+// and VLAN configuration, optionally those of one Apply handler (?source=).
+func (h *ConfigHandler) ValidateConfig(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	issues, err := checkDevice(h.DB, device.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if source := strings.ToLower(c.Query("source")); source != "" {
+		if err := validateOneOf("source", source, []string{"firewall", "vpn", "mwan", "dhcp", "vlan"}); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		issues = issuesFor(issues, source)
+	}
+	if issues == nil {
+		issues = []configIssue{}
+	}
+	errs := len(issueErrors(issues))
+	c.JSON(http.StatusOK, gin.H{
+		"device_id": device.ID,
+		"valid":     errs == 0,
+		"errors":    errs,
+		"warnings":  len(issues) - errs,
+		"issues":    issues,
+	})
+}
@@ -3,42 +3,83 @@ package handler
 import (
 	"encoding/csv"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
+	"github.com/nexusgate/nexusgate/internal/jobs"
 	"github.com/nexusgate/nexusgate/internal/model"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"golang.org/x/crypto/ssh"
 	"gorm.io/gorm"
 )
 
 type DeviceHandler struct {
-	DB   *gorm.DB
-	MQTT mqtt.Client
+	DB         *gorm.DB
+	MQTT       mqtt.Client
+	Heartbeats *heartbeat.Cache
+	RPC        *agentmqtt.RPC
+	Timescale  bool // rollups are TimescaleDB continuous aggregates
 }
 
-// Register handles device self-registration (called by nexusgate-agent on first boot).
+// Register handles device self-registration (called by nexusgate-agent on
+// every start). Agents speaking a versioned protocol also send their
+// protocol version and capabilities, which gate the features the server
+// uses with them; the server's own version is returned in X-Protocol-Version.
 func (h *DeviceHandler) Register(c *gin.Context) {
 	var req struct {
-		Name      string `json:"name" binding:"required"`
-		MAC       string `json:"mac" binding:"required"`
-		IPAddress string `json:"ip_address"`
-		Model     string `json:"model"`
-		Firmware  string `json:"firmware"`
+		Name            string   `json:"name" binding:"required"`
+		MAC             string   `json:"mac" binding:"required"`
+		IPAddress       string   `json:"ip_address"`
+		Model           string   `json:"model"`
+		Firmware        string   `json:"firmware"`
+		AgentVersion    string   `json:"agent_version"`
+		ProtocolVersion int      `json:"protocol_version"`
+		Capabilities    []string `json:"capabilities"`
+		TunnelKey       string   `json:"tunnel_key"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.ProtocolVersion < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "protocol_version must not be negative"})
+		return
+	}
+	capabilities, err := protocol.NormalizeCapabilities(req.Capabilities)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tunnelKey := ""
+	if req.TunnelKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.TunnelKey))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tunnel_key"})
+			return
+		}
+		tunnelKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	c.Header("X-Protocol-Version", strconv.Itoa(protocol.Version))
 
 	device := model.Device{
-		Name:      req.Name,
-		MAC:       req.MAC,
-		IPAddress: req.IPAddress,
-		Model:     req.Model,
-		Firmware:  req.Firmware,
-		Status:    model.StatusOnline,
+		Name:            req.Name,
+		MAC:             req.MAC,
+		IPAddress:       req.IPAddress,
+		Model:           req.Model,
+		Firmware:        req.Firmware,
+		AgentVersion:    req.AgentVersion,
+		ProtocolVersion: req.ProtocolVersion,
+		Capabilities:    capabilities,
+		TunnelKey:       tunnelKey,
+		Status:          model.StatusOnline,
 	}
 
 	// Upsert: update if MAC exists, create otherwise
@@ -50,12 +91,29 @@ func (h *DeviceHandler) Register(c *gin.Context) {
 
 	if result.RowsAffected == 0 {
 		now := time.Now()
-		h.DB.Model(&device).Updates(map[string]any{
-			"ip_address":   req.IPAddress,
-			"firmware":     req.Firmware,
-			"status":       model.StatusOnline,
-			"last_seen_at": &now,
-		})
+		updates := map[string]any{
+			"ip_address":       req.IPAddress,
+			"firmware":         req.Firmware,
+			"agent_version":    req.AgentVersion,
+			"protocol_version": req.ProtocolVersion,
+			"capabilities":     capabilities,
+			"status":           model.StatusOnline,
+			"last_seen_at":     &now,
+		}
+		// The tunnel key is trusted on first use: registration is
+		// unauthenticated, so only an admin reset lets a new key in.
+		switch {
+		case tunnelKey == "" || tunnelKey == device.TunnelKey:
+		case device.TunnelKey == "":
+			updates["tunnel_key"] = tunnelKey
+		default:
+			log.Printf("device %s registered a different tunnel key, keeping the trusted one", device.MAC)
+		}
+		h.DB.Model(&device).Updates(updates)
+		device.Status = model.StatusOnline
+	}
+	if h.Heartbeats != nil {
+		h.Heartbeats.SetDevice(device)
 	}
 
 	c.JSON(http.StatusOK, device)
@@ -143,6 +201,10 @@ func (h *DeviceHandler) Update(c *gin.Context) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "device", fmt.Sprintf("updated device %s (id=%d)", device.Name, device.ID))
+	device.Name, device.Group, device.Tags = req.Name, req.Group, req.Tags
+	if h.Heartbeats != nil {
+		h.Heartbeats.SetDevice(device)
+	}
 	c.JSON(http.StatusOK, device)
 }
 
@@ -152,10 +214,13 @@ func (h *DeviceHandler) Delete(c *gin.Context) {
 		// Cascade delete all device-related records
 		for _, m := range []any{
 			&model.DeviceMetrics{}, &model.DeviceConfig{}, &model.Alert{},
+			&model.DeviceInterfaceMetrics{}, &model.DeviceFilesystemMetrics{},
+			&model.DeviceThermalMetrics{}, &model.DeviceWirelessMetrics{},
 			&model.FirewallZone{}, &model.FirewallRule{},
 			&model.WANInterface{}, &model.MWANPolicy{}, &model.MWANRule{},
 			&model.DHCPPool{}, &model.StaticLease{}, &model.VLAN{},
-			&model.FirmwareUpgrade{},
+			&model.FirmwareUpgrade{}, &model.DeviceDiagnostic{}, &model.DeviceLog{},
+			&model.DeviceCredential{},
 		} {
 			if err := tx.Where("device_id = ?", deviceID).Delete(m).Error; err != nil {
 				return err
@@ -178,6 +243,9 @@ func (h *DeviceHandler) Delete(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if id, err := strconv.ParseUint(deviceID, 10, 64); err == nil && h.Heartbeats != nil {
+		h.Heartbeats.Remove(uint(id))
+	}
 	writeAudit(h.DB, c, "delete", "device", fmt.Sprintf("deleted device id=%s and related records", deviceID))
 	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
 }
@@ -189,18 +257,8 @@ func (h *DeviceHandler) Reboot(c *gin.Context) {
 		return
 	}
 
-	if h.MQTT == nil || !h.MQTT.IsConnected() {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT not connected"})
-		return
-	}
-	topic := fmt.Sprintf("nexusgate/devices/%s/command", device.MAC)
-	token := h.MQTT.Publish(topic, 1, false, `{"action":"reboot"}`)
-	if !token.WaitTimeout(mqttPublishTimeout) {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish timed out"})
-		return
-	}
-	if err := token.Error(); err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error()})
+	if err := protocol.PublishCommand(h.MQTT, device, "reboot", nil); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -208,18 +266,46 @@ func (h *DeviceHandler) Reboot(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "reboot command sent"})
 }
 
-func (h *DeviceHandler) Metrics(c *gin.Context) {
-	var metrics []model.DeviceMetrics
-	query := h.DB.Where("device_id = ?", c.Param("id"))
+// maxMetricsPoints caps the number of points Metrics returns for a range;
+// the step is widened when a range would produce more.
+const maxMetricsPoints = 2000
+
+// defaultMetricsPoints is the number of points aimed for when only a range
+// is given.
+const defaultMetricsPoints = 500
+
+// metricsPoint is one point of the metrics API. It keeps the DeviceMetrics
+// field names so charts work with raw rows and rollups alike.
+type metricsPoint struct {
+	DeviceID    uint      `json:"device_id"`
+	CPUUsage    float64   `json:"cpu_usage"`
+	MemUsage    float64   `json:"mem_usage"`
+	MemTotal    int64     `json:"mem_total"`
+	MemFree     int64     `json:"mem_free"`
+	RxBytes     int64     `json:"rx_bytes"`
+	TxBytes     int64     `json:"tx_bytes"`
+	Conntrack   float64   `json:"conntrack"`
+	UptimeSecs  int64     `json:"uptime_secs"`
+	Samples     int       `json:"samples"`
+	CollectedAt time.Time `json:"collected_at"`
+}
 
-	if from := c.Query("from"); from != "" {
-		if t, err := time.Parse(time.RFC3339, from); err == nil {
-			query = query.Where("collected_at >= ?", t)
+// Metrics returns device metrics, newest first. Without a range, step or agg
+// it returns the latest 500 raw heartbeats. Otherwise points are bucketed by
+// step (e.g. 5m, 1h, 1d; derived from the range when omitted) and aggregated
+// by agg (avg, min, max or last) from the coarsest stored resolution that
+// fits; the resolution used is returned in X-Metrics-Resolution.
+func (h *DeviceHandler) Metrics(c *gin.Context) {
+	to := time.Now()
+	var from time.Time
+	if v := c.Query("from"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			from = t
 		}
 	}
-	if to := c.Query("to"); to != "" {
-		if t, err := time.Parse(time.RFC3339, to); err == nil {
-			query = query.Where("collected_at <= ?", t)
+	if v := c.Query("to"); v != "" {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			to = t
 		}
 	}
 	if hours := c.Query("hours"); hours != "" {
@@ -228,16 +314,211 @@ func (h *DeviceHandler) Metrics(c *gin.Context) {
 			if n > 8760 {
 				n = 8760 // cap at 1 year
 			}
-			query = query.Where("collected_at >= ?", time.Now().Add(-time.Duration(n)*time.Hour))
+			from = time.Now().Add(-time.Duration(n) * time.Hour)
 		}
 	}
 
-	if err := query.Order("collected_at DESC").Limit(500).
-		Find(&metrics).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	agg := c.DefaultQuery("agg", "avg")
+	if err := validateOneOf("agg", agg, []string{"avg", "min", "max", "last"}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var step time.Duration
+	if v := c.Query("step"); v != "" {
+		d, err := parseMetricsStep(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		step = d
+	}
+
+	if from.IsZero() && step == 0 && c.Query("agg") == "" {
+		var metrics []model.DeviceMetrics
+		if err := h.DB.Where("device_id = ? AND collected_at <= ?", c.Param("id"), to).
+			Order("collected_at DESC").Limit(500).Find(&metrics).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("X-Metrics-Resolution", "raw")
+		c.JSON(http.StatusOK, metrics)
+		return
+	}
+
+	if from.IsZero() {
+		if step == 0 {
+			step = time.Minute
+		}
+		from = to.Add(-step * defaultMetricsPoints)
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
 		return
 	}
-	c.JSON(http.StatusOK, metrics)
+	if step == 0 {
+		step = to.Sub(from) / defaultMetricsPoints
+	}
+	if min := to.Sub(from) / maxMetricsPoints; step < min {
+		step = min
+	}
+
+	res := pickMetricsResolution(h.DB, from, step)
+	if step < res.Step {
+		step = res.Step
+	}
+
+	var rows []model.DeviceMetricsRollup
+	if res.Name == "raw" {
+		var raw []model.DeviceMetrics
+		if err := h.DB.Where("device_id = ? AND collected_at >= ? AND collected_at <= ?", c.Param("id"), from, to).
+			Order("collected_at").Find(&raw).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rows = make([]model.DeviceMetricsRollup, len(raw))
+		for i, m := range raw {
+			rows[i] = rawToRollup(m)
+		}
+	} else {
+		query := h.DB.Where("device_id = ? AND bucket_start >= ? AND bucket_start <= ?", c.Param("id"), from.Truncate(res.Step), to)
+		if h.Timescale {
+			query = query.Table("device_metrics_" + res.Name)
+		} else {
+			query = query.Where("resolution = ?", res.Name)
+		}
+		if err := query.Order("bucket_start").Find(&rows).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	points := bucketMetrics(rows, step, agg)
+	c.Header("X-Metrics-Resolution", res.Name)
+	c.Header("X-Metrics-Step", step.String())
+	c.JSON(http.StatusOK, points)
+}
+
+// parseMetricsStep parses a Go duration, also accepting whole days ("7d").
+func parseMetricsStep(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid step %q", v)
+	}
+	return d, nil
+}
+
+// pickMetricsResolution returns the coarsest resolution not coarser than step
+// whose retention still covers from. If none is fine enough, the finest one
+// covering from is used; if none covers from, the coarsest.
+func pickMetricsResolution(db *gorm.DB, from time.Time, step time.Duration) jobs.MetricsResolution {
+	var fallback *jobs.MetricsResolution
+	var best *jobs.MetricsResolution
+	for i := range jobs.MetricsResolutions {
+		r := &jobs.MetricsResolutions[i]
+		if from.Before(time.Now().Add(-jobs.MetricsRetention(db, *r))) {
+			continue
+		}
+		if fallback == nil {
+			fallback = r
+		}
+		if r.Step <= step {
+			best = r
+		}
+	}
+	switch {
+	case best != nil:
+		return *best
+	case fallback != nil:
+		return *fallback
+	default:
+		return jobs.MetricsResolutions[len(jobs.MetricsResolutions)-1]
+	}
+}
+
+func rawToRollup(m model.DeviceMetrics) model.DeviceMetricsRollup {
+	conntrack := float64(m.Conntrack)
+	return model.DeviceMetricsRollup{
+		DeviceID:      m.DeviceID,
+		BucketStart:   m.CollectedAt,
+		Samples:       1,
+		CPUMin:        m.CPUUsage,
+		CPUAvg:        m.CPUUsage,
+		CPUMax:        m.CPUUsage,
+		CPULast:       m.CPUUsage,
+		MemMin:        m.MemUsage,
+		MemAvg:        m.MemUsage,
+		MemMax:        m.MemUsage,
+		MemLast:       m.MemUsage,
+		ConntrackMin:  conntrack,
+		ConntrackAvg:  conntrack,
+		ConntrackMax:  conntrack,
+		ConntrackLast: conntrack,
+		RxBytes:       m.RxBytes,
+		TxBytes:       m.TxBytes,
+		MemTotal:      m.MemTotal,
+		MemFree:       m.MemFree,
+		UptimeSecs:    m.UptimeSecs,
+	}
+}
+
+// bucketMetrics merges rows (ordered oldest first) into step-sized buckets
+// and returns one point per bucket, newest first.
+func bucketMetrics(rows []model.DeviceMetricsRollup, step time.Duration, agg string) []metricsPoint {
+	var buckets []model.DeviceMetricsRollup
+	for _, r := range rows {
+		start := r.BucketStart.Truncate(step)
+		n := len(buckets)
+		if n == 0 || !buckets[n-1].BucketStart.Equal(start) {
+			r.BucketStart = start
+			buckets = append(buckets, r)
+			continue
+		}
+		b := &buckets[n-1]
+		total := float64(b.Samples + r.Samples)
+		if total > 0 {
+			b.CPUAvg = (b.CPUAvg*float64(b.Samples) + r.CPUAvg*float64(r.Samples)) / total
+			b.MemAvg = (b.MemAvg*float64(b.Samples) + r.MemAvg*float64(r.Samples)) / total
+			b.ConntrackAvg = (b.ConntrackAvg*float64(b.Samples) + r.ConntrackAvg*float64(r.Samples)) / total
+		}
+		b.Samples += r.Samples
+		b.CPUMin, b.CPUMax = math.Min(b.CPUMin, r.CPUMin), math.Max(b.CPUMax, r.CPUMax)
+		b.MemMin, b.MemMax = math.Min(b.MemMin, r.MemMin), math.Max(b.MemMax, r.MemMax)
+		b.ConntrackMin, b.ConntrackMax = math.Min(b.ConntrackMin, r.ConntrackMin), math.Max(b.ConntrackMax, r.ConntrackMax)
+		b.CPULast, b.MemLast, b.ConntrackLast = r.CPULast, r.MemLast, r.ConntrackLast
+		b.RxBytes, b.TxBytes = r.RxBytes, r.TxBytes
+		b.MemTotal, b.MemFree, b.UptimeSecs = r.MemTotal, r.MemFree, r.UptimeSecs
+	}
+
+	points := make([]metricsPoint, len(buckets))
+	for i, b := range buckets {
+		p := metricsPoint{
+			DeviceID:    b.DeviceID,
+			MemTotal:    b.MemTotal,
+			MemFree:     b.MemFree,
+			RxBytes:     b.RxBytes,
+			TxBytes:     b.TxBytes,
+			UptimeSecs:  b.UptimeSecs,
+			Samples:     b.Samples,
+			CollectedAt: b.BucketStart,
+		}
+		switch agg {
+		case "min":
+			p.CPUUsage, p.MemUsage, p.Conntrack = b.CPUMin, b.MemMin, b.ConntrackMin
+		case "max":
+			p.CPUUsage, p.MemUsage, p.Conntrack = b.CPUMax, b.MemMax, b.ConntrackMax
+		case "last":
+			p.CPUUsage, p.MemUsage, p.Conntrack = b.CPULast, b.MemLast, b.ConntrackLast
+		default:
+			p.CPUUsage, p.MemUsage, p.Conntrack = b.CPUAvg, b.MemAvg, b.ConntrackAvg
+		}
+		points[len(buckets)-1-i] = p
+	}
+	return points
 }
 
 // BulkDelete deletes multiple devices by IDs.
@@ -257,10 +538,13 @@ func (h *DeviceHandler) BulkDelete(c *gin.Context) {
 	err := h.DB.Transaction(func(tx *gorm.DB) error {
 		for _, m := range []any{
 			&model.DeviceMetrics{}, &model.DeviceConfig{}, &model.Alert{},
+			&model.DeviceInterfaceMetrics{}, &model.DeviceFilesystemMetrics{},
+			&model.DeviceThermalMetrics{}, &model.DeviceWirelessMetrics{},
 			&model.FirewallZone{}, &model.FirewallRule{},
 			&model.WANInterface{}, &model.MWANPolicy{}, &model.MWANRule{},
 			&model.DHCPPool{}, &model.StaticLease{}, &model.VLAN{},
-			&model.FirmwareUpgrade{},
+			&model.FirmwareUpgrade{}, &model.DeviceDiagnostic{}, &model.DeviceLog{},
+			&model.DeviceCredential{},
 		} {
 			if err := tx.Where("device_id IN ?", req.IDs).Delete(m).Error; err != nil {
 				return err
@@ -282,6 +566,11 @@ func (h *DeviceHandler) BulkDelete(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if h.Heartbeats != nil {
+		for _, id := range req.IDs {
+			h.Heartbeats.Remove(id)
+		}
+	}
 	writeAudit(h.DB, c, "bulk_delete", "device", fmt.Sprintf("bulk deleted device ids=%v", req.IDs))
 	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("deleted %d device(s)", len(req.IDs))})
 }
@@ -309,9 +598,7 @@ func (h *DeviceHandler) BulkReboot(c *gin.Context) {
 	}
 	count := 0
 	for _, device := range devices {
-		topic := fmt.Sprintf("nexusgate/devices/%s/command", device.MAC)
-		token := h.MQTT.Publish(topic, 1, false, `{"action":"reboot"}`)
-		if token.WaitTimeout(mqttPublishTimeout) && token.Error() == nil {
+		if err := protocol.PublishCommand(h.MQTT, device, "reboot", nil); err == nil {
 			count++
 		}
 	}
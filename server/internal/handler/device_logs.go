@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/syslog"
+	"gorm.io/gorm"
+)
+
+// LogHandler fetches device logs over the agent RPC, configures syslog
+// forwarding and searches stored log entries.
+type LogHandler struct {
+	DB  *gorm.DB
+	RPC *agentmqtt.RPC
+}
+
+const (
+	defaultLogreadLines = 200
+	maxLogreadLines     = 2000
+	logreadTimeout      = 20 * time.Second
+)
+
+var logTagPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Fetch reads the last lines of the device's logread buffer, optionally
+// filtered by tag and maximum severity, stores the entries not seen by a
+// previous fetch and returns them.
+func (h *LogHandler) Fetch(c *gin.Context) {
+	var req struct {
+		Lines    int    `json:"lines"`
+		Tag      string `json:"tag"`
+		Priority string `json:"priority"` // maximum severity, e.g. "warning" or "4"
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Lines <= 0 {
+		req.Lines = defaultLogreadLines
+	}
+	if req.Lines > maxLogreadLines {
+		req.Lines = maxLogreadLines
+	}
+	if req.Tag != "" && !logTagPattern.MatchString(req.Tag) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tag may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
+	maxSeverity := 7
+	if req.Priority != "" {
+		sev, ok := syslog.ParseSeverity(req.Priority)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown priority " + req.Priority})
+			return
+		}
+		maxSeverity = sev
+	}
+
+	params := map[string]any{"lines": req.Lines}
+	if req.Tag != "" {
+		params["tag"] = req.Tag
+	}
+	device, result, ok := callAgent(c, h.DB, h.RPC, "logread", params, logreadTimeout)
+	if !ok {
+		return
+	}
+	var reply struct {
+		Output string `json:"output"`
+	}
+	if err := json.Unmarshal(result, &reply); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "invalid logread reply"})
+		return
+	}
+
+	now := time.Now()
+	entries := []model.DeviceLog{}
+	for _, line := range strings.Split(reply.Output, "\n") {
+		m, ok := syslog.ParseLogread(line)
+		if !ok || m.Severity > maxSeverity || (req.Tag != "" && m.AppName != req.Tag) {
+			continue
+		}
+		entries = append(entries, m.DeviceLog(device.ID, "logread", device.IPAddress, now))
+	}
+
+	fresh := h.unseenLogreadEntries(device.ID, entries)
+	if len(fresh) > 0 {
+		if err := h.DB.CreateInBatches(fresh, 500).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store log entries"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": entries, "fetched": len(entries), "stored": len(fresh)})
+}
+
+// unseenLogreadEntries drops entries already stored by an earlier fetch:
+// everything before the newest stored logread entry, and entries in that
+// same second with an identical tag and message.
+func (h *LogHandler) unseenLogreadEntries(deviceID uint, entries []model.DeviceLog) []model.DeviceLog {
+	var newest model.DeviceLog
+	err := h.DB.Where("device_id = ? AND source = ?", deviceID, "logread").Order("logged_at DESC").First(&newest).Error
+	if err != nil {
+		return entries
+	}
+	var sameSecond []model.DeviceLog
+	h.DB.Select("tag, message").Where("device_id = ? AND source = ? AND logged_at = ?", deviceID, "logread", newest.LoggedAt).Find(&sameSecond)
+	seen := make(map[string]bool, len(sameSecond))
+	for _, e := range sameSecond {
+		seen[e.Tag+"\x00"+e.Message] = true
+	}
+
+	fresh := make([]model.DeviceLog, 0, len(entries))
+	for _, e := range entries {
+		if e.LoggedAt.Before(newest.LoggedAt) {
+			continue
+		}
+		if e.LoggedAt.Equal(newest.LoggedAt) && seen[e.Tag+"\x00"+e.Message] {
+			continue
+		}
+		fresh = append(fresh, e)
+	}
+	return fresh
+}
+
+// SetForwarding turns continuous syslog forwarding to the server's syslog
+// receiver on or off. Host, port and protocol default to the
+// syslog_forward_* settings.
+func (h *LogHandler) SetForwarding(c *gin.Context) {
+	var req struct {
+		Enabled bool   `json:"enabled"`
+		Host    string `json:"host"`
+		Port    int    `json:"port"`
+		Proto   string `json:"proto"` // udp, tcp
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	params := map[string]any{"enabled": req.Enabled}
+	if req.Enabled {
+		if req.Host == "" {
+			req.Host = h.setting("syslog_forward_host", "")
+		}
+		if req.Port == 0 {
+			req.Port, _ = strconv.Atoi(h.setting("syslog_forward_port", "514"))
+		}
+		if req.Proto == "" {
+			req.Proto = h.setting("syslog_forward_proto", "udp")
+		}
+		if req.Host == "" || !logHostPattern.MatchString(req.Host) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "host must be a hostname or IP address (or set syslog_forward_host)"})
+			return
+		}
+		if req.Port < 1 || req.Port > 65535 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "port must be between 1 and 65535"})
+			return
+		}
+		if req.Proto != "udp" && req.Proto != "tcp" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "proto must be udp or tcp"})
+			return
+		}
+		params["host"], params["port"], params["proto"] = req.Host, req.Port, req.Proto
+	}
+
+	device, _, ok := callAgent(c, h.DB, h.RPC, "syslog_forward", params, logreadTimeout)
+	if !ok {
+		return
+	}
+	detail := fmt.Sprintf("disabled syslog forwarding on device %s (id=%d)", device.Name, device.ID)
+	if req.Enabled {
+		detail = fmt.Sprintf("enabled syslog forwarding to %s:%d/%s on device %s (id=%d)", req.Host, req.Port, req.Proto, device.Name, device.ID)
+	}
+	writeAudit(h.DB, c, "syslog_forward", "device", detail)
+	c.JSON(http.StatusOK, gin.H{"message": detail, "forwarding": params})
+}
+
+var logHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.:-]*[A-Za-z0-9])?$`)
+
+func (h *LogHandler) setting(key, fallback string) string {
+	var setting model.SystemSetting
+	if err := h.DB.Where("\"key\" = ?", key).First(&setting).Error; err == nil && setting.Value != "" {
+		return setting.Value
+	}
+	return fallback
+}
+
+// Search returns stored log entries, newest first. Filters: device_id,
+// source, tag (comma-separated), severity (maximum, keyword or number),
+// hostname, q (substring of the message), from/to (RFC3339) and
+// page/page_size.
+func (h *LogHandler) Search(c *gin.Context) {
+	h.search(c, c.Query("device_id"))
+}
+
+// DeviceLogs is Search restricted to the device of :id.
+func (h *LogHandler) DeviceLogs(c *gin.Context) {
+	h.search(c, c.Param("id"))
+}
+
+func (h *LogHandler) search(c *gin.Context, deviceID string) {
+	query := h.DB.Model(&model.DeviceLog{})
+	if deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if source := c.Query("source"); source != "" {
+		query = query.Where("source = ?", source)
+	}
+	if tags := c.Query("tag"); tags != "" {
+		query = query.Where("tag IN ?", strings.Split(tags, ","))
+	}
+	if sev := c.Query("severity"); sev != "" {
+		n, ok := syslog.ParseSeverity(sev)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown severity " + sev})
+			return
+		}
+		query = query.Where("severity <= ?", n)
+	}
+	if host := c.Query("hostname"); host != "" {
+		query = query.Where("hostname = ?", host)
+	}
+	if q := c.Query("q"); q != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q)
+		query = query.Where("message ILIKE ?", "%"+escaped+"%")
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<="}} {
+		if v := c.Query(bound.param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": bound.param + " must be an RFC3339 time"})
+				return
+			}
+			query = query.Where("logged_at "+bound.op+" ?", t)
+		}
+	}
+
+	page := 1
+	pageSize := 100
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 500 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	var entries []model.DeviceLog
+	if err := query.Order("logged_at DESC, id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query logs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": entries, "total": total, "page": page, "page_size": pageSize})
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+)
+
+// maxDetailMetricsRows caps the rows DetailMetrics returns.
+const maxDetailMetricsRows = 5000
+
+// detailMetricsKinds maps the :kind of /devices/:id/metrics/:kind to its
+// table model and the column filtered by the optional name query parameter.
+var detailMetricsKinds = map[string]struct {
+	model  func() any
+	column string
+	param  string
+}{
+	"interfaces":  {func() any { return &[]model.DeviceInterfaceMetrics{} }, "interface", "interface"},
+	"filesystems": {func() any { return &[]model.DeviceFilesystemMetrics{} }, "mount", "mount"},
+	"thermal":     {func() any { return &[]model.DeviceThermalMetrics{} }, "zone", "zone"},
+	"wireless":    {func() any { return &[]model.DeviceWirelessMetrics{} }, "interface", "interface"},
+}
+
+// DetailMetrics returns the per-interface, filesystem, thermal or wireless
+// rows of a device, newest first. The range defaults to the last hour and
+// may be set with hours or from/to. Rows can be limited to some names with
+// a comma-separated filter (interface=wan,br-lan; mount=/overlay; zone=...).
+// latest=true returns only the newest row of each name.
+func (h *DeviceHandler) DetailMetrics(c *gin.Context) {
+	kind, ok := detailMetricsKinds[c.Param("kind")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown metrics kind, expected interfaces, filesystems, thermal or wireless"})
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from, expected RFC3339"})
+			return
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to, expected RFC3339"})
+			return
+		}
+		to = t
+	}
+	if hours := c.Query("hours"); hours != "" {
+		var n int
+		if _, err := fmt.Sscanf(hours, "%d", &n); err == nil && n > 0 {
+			if n > 8760 {
+				n = 8760
+			}
+			from = time.Now().Add(-time.Duration(n) * time.Hour)
+		}
+	}
+
+	query := h.DB.Where("device_id = ? AND collected_at >= ? AND collected_at <= ?", c.Param("id"), from, to)
+	if v := c.Query(kind.param); v != "" {
+		var names []string
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			query = query.Where(kind.column+" IN ?", names)
+		}
+	}
+
+	rows := kind.model()
+	if c.Query("latest") == "true" {
+		// DISTINCT ON keeps the first row of each name in ORDER BY order
+		query = query.Select("DISTINCT ON (" + kind.column + ") *").Order(kind.column).Order("collected_at DESC")
+	} else {
+		query = query.Order("collected_at DESC").Order(kind.column).Limit(maxDetailMetricsRows)
+	}
+	if err := query.Find(rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"gorm.io/gorm"
+)
+
+// maxRPCTimeout caps the timeout query parameter of synchronous device calls.
+const maxRPCTimeout = 60 * time.Second
+
+// callDevice runs an RPC on the device of :id and returns its result; the
+// timeout query parameter overrides timeout (up to maxRPCTimeout). On
+// failure it writes the error response and returns ok=false.
+func (h *DeviceHandler) callDevice(c *gin.Context, method string, params any, timeout time.Duration) (device model.Device, result []byte, ok bool) {
+	if v := c.Query("timeout"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+	if timeout > maxRPCTimeout {
+		timeout = maxRPCTimeout
+	}
+	return callAgent(c, h.DB, h.RPC, method, params, timeout)
+}
+
+// callAgent runs an RPC on the device of :id. On failure it writes the error
+// response and returns ok=false: 404 for an unknown device, 409 when the
+// agent lacks the method, 502 for errors the agent reported, 503 without
+// MQTT and 504 when the agent did not answer in time.
+func callAgent(c *gin.Context, db *gorm.DB, rpc *agentmqtt.RPC, method string, params any, timeout time.Duration) (device model.Device, result []byte, ok bool) {
+	if err := db.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return device, nil, false
+	}
+	if err := protocol.RequireRPC(device, method); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return device, nil, false
+	}
+	if rpc == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT not connected"})
+		return device, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+	result, err := rpc.Call(ctx, device.MAC, method, params)
+	if err != nil {
+		var rpcErr *agentmqtt.RPCError
+		switch {
+		case errors.As(err, &rpcErr):
+			c.JSON(http.StatusBadGateway, gin.H{"error": rpcErr.Error(), "code": rpcErr.Code})
+		case errors.Is(err, agentmqtt.ErrRPCTimeout):
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		}
+		return device, nil, false
+	}
+	return device, result, true
+}
+
+// Ping checks that the agent answers over MQTT and returns the round trip.
+func (h *DeviceHandler) Ping(c *gin.Context) {
+	start := time.Now()
+	if _, _, ok := h.callDevice(c, "ping", nil, 10*time.Second); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rtt_ms": time.Since(start).Milliseconds()})
+}
+
+// SystemInfo returns the board and system information reported live by the
+// agent (ubus system board / system info).
+func (h *DeviceHandler) SystemInfo(c *gin.Context) {
+	_, result, ok := h.callDevice(c, "system_info", nil, 10*time.Second)
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", result)
+}
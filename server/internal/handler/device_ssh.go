@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/tunnel"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// errNoCredential is returned when a device has no stored SSH login.
+var errNoCredential = errors.New("no SSH credentials stored for this device")
+
+// deviceSSH logs in to devices directly or through their reverse tunnel,
+// offering the server key before the stored password. Host keys are pinned
+// on first connection; a changed key refuses the login and raises an alert.
+type deviceSSH struct {
+	DB      *gorm.DB
+	Hub     *ws.Hub
+	MQTT    mqtt.Client
+	Tunnels *tunnel.Server // nil when the tunnel endpoint is disabled
+	SSH     *ssh.Manager
+}
+
+func sshPoolKey(deviceID uint) string {
+	return "device:" + strconv.FormatUint(uint64(deviceID), 10)
+}
+
+func (d *deviceSSH) credential(deviceID uint) (model.DeviceCredential, error) {
+	var cred model.DeviceCredential
+	if err := d.DB.Where("device_id = ?", deviceID).First(&cred).Error; err != nil {
+		return cred, errNoCredential
+	}
+	return cred, nil
+}
+
+// client describes the login to the device.
+func (d *deviceSSH) client(device model.Device, cred model.DeviceCredential) *ssh.Client {
+	client := ssh.NewClient(device.IPAddress, cred.Port, cred.Username, cred.Password)
+	if d.SSH != nil {
+		client.Signer = d.SSH.Signer
+	}
+	pin := ssh.PinHostKey(cred.HostKey, func(key gossh.PublicKey) error {
+		line := ssh.AuthorizedKey(key, "")
+		result := d.DB.Model(&model.DeviceCredential{}).Where("id = ? AND host_key = ''", cred.ID).Update("host_key", line)
+		if result.Error != nil {
+			return fmt.Errorf("failed to store host key: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			// pinned by a concurrent login meanwhile
+			var current model.DeviceCredential
+			d.DB.Select("host_key").First(&current, cred.ID)
+			return ssh.PinHostKey(current.HostKey, nil)("", nil, key)
+		}
+		log.Printf("ssh: pinned host key %s for device %s", gossh.FingerprintSHA256(key), device.Name)
+		return nil
+	})
+	client.HostKeyCallback = func(host string, remote net.Addr, key gossh.PublicKey) error {
+		err := pin(host, remote, key)
+		var mismatch *ssh.HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			jobs.RaiseEventAlert(d.DB, d.Hub, device, jobs.AlertSourceSSH, "ssh_host_key", model.SeverityCritical,
+				fmt.Sprintf("SSH host key of %s changed: pinned %s, presented %s", device.Name, mismatch.Pinned, mismatch.Presented))
+		}
+		return err
+	}
+	return client
+}
+
+// connect logs in to the device directly or through its reverse tunnel.
+// In auto mode the direct connection is tried first. progress, if set, is
+// told when the tunnel is being opened.
+func (d *deviceSSH) connect(ctx context.Context, device model.Device, cred model.DeviceCredential, transport string, progress func(string)) (*gossh.Client, string, error) {
+	client := d.client(device, cred)
+
+	var directErr error
+	if transport != "tunnel" {
+		if device.IPAddress == "" {
+			directErr = errors.New("device has no IP address")
+		} else {
+			dialCtx, cancel := ctx, context.CancelFunc(func() {})
+			if transport == "auto" {
+				dialCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+			}
+			nc, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", net.JoinHostPort(device.IPAddress, strconv.Itoa(cred.Port)))
+			cancel()
+			if err == nil {
+				sc, err := client.Connect(ctx, nc)
+				if err == nil {
+					return sc, "ssh", nil
+				}
+				directErr = err
+			} else {
+				directErr = err
+			}
+		}
+		// A changed host key is not a reason to try another path.
+		var mismatch *ssh.HostKeyMismatchError
+		if transport == "ssh" || errors.As(directErr, &mismatch) {
+			return nil, "", directErr
+		}
+	}
+
+	if d.Tunnels == nil {
+		if directErr != nil {
+			return nil, "", fmt.Errorf("direct SSH failed (%v) and the reverse tunnel is not enabled", directErr)
+		}
+		return nil, "", errors.New("reverse tunnel is not enabled on this server")
+	}
+	if err := protocol.Require(device, protocol.CapTunnel); err != nil {
+		return nil, "", err
+	}
+	if progress != nil {
+		progress("opening reverse tunnel")
+	}
+	// The tunnel forwards the device's own port 22, whatever cred.Port says.
+	if err := d.Tunnels.Open(ctx, d.MQTT, device, 22); err != nil {
+		return nil, "", err
+	}
+	nc, err := d.Tunnels.Dial(device.MAC, 22)
+	if err != nil {
+		return nil, "", err
+	}
+	sc, err := client.Connect(ctx, nc)
+	if err != nil {
+		return nil, "", err
+	}
+	return sc, "tunnel", nil
+}
+
+// pooled returns the shared connection to the device; call release when
+// done with it.
+func (d *deviceSSH) pooled(ctx context.Context, device model.Device) (*gossh.Client, func(), error) {
+	cred, err := d.credential(device.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.SSH.Get(ctx, sshPoolKey(device.ID), func(ctx context.Context) (*gossh.Client, error) {
+		client, _, err := d.connect(ctx, device, cred, "auto", nil)
+		return client, err
+	})
+}
+
+// forget closes the shared connection after the login details changed.
+func (d *deviceSSH) forget(deviceID uint) {
+	d.SSH.Drop(sshPoolKey(deviceID))
+}
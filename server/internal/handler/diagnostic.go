@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/diagnostics"
+	"github.com/nexusgate/nexusgate/internal/model"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+// DiagnosticHandler runs network diagnostics on devices through the agent
+// RPC and keeps their history.
+type DiagnosticHandler struct {
+	DB  *gorm.DB
+	RPC *agentmqtt.RPC
+	Hub *ws.Hub
+}
+
+// Run starts a diagnostic on a device. The run is recorded as "running" and
+// answered with 202; output lines stream over WebSocket as
+// "diagnostic_progress" and the final record is broadcast as "diagnostic".
+// With ?wait=true the request blocks until the run finishes instead.
+func (h *DiagnosticHandler) Run(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	var req diagnostics.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.applyDefaults(&req)
+	if err := req.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := protocol.RequireRPC(device, "diagnostic"); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err := protocol.Require(device, "diagnostic."+req.Action); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s is not installed on the device", req.Action)})
+		return
+	}
+	if h.RPC == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT not connected"})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	username, _ := c.Get("username")
+	params, _ := json.Marshal(req)
+	diag := model.DeviceDiagnostic{
+		DeviceID:  device.ID,
+		Action:    req.Action,
+		Target:    req.Subject(),
+		Params:    string(params),
+		Status:    "running",
+		StartedAt: time.Now(),
+	}
+	diag.UserID, _ = userID.(uint)
+	diag.Username, _ = username.(string)
+	if err := h.DB.Create(&diag).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record diagnostic"})
+		return
+	}
+	writeAudit(h.DB, c, "diagnostic", "device", fmt.Sprintf("ran %s %s on device %s (id=%d, diagnostic=%d)", req.Action, req.Subject(), device.Name, device.ID, diag.ID))
+
+	if c.Query("wait") == "true" {
+		h.execute(device, &diag, req)
+		c.JSON(http.StatusOK, diag)
+		return
+	}
+	go h.execute(device, &diag, req)
+	c.JSON(http.StatusAccepted, diag)
+}
+
+// applyDefaults fills the iperf3 server and speed test URL from the
+// diagnostics settings when the request leaves them out.
+func (h *DiagnosticHandler) applyDefaults(req *diagnostics.Request) {
+	var setting model.SystemSetting
+	switch {
+	case req.Action == diagnostics.ActionIperf3 && req.Server == "":
+		if err := h.DB.Where("\"key\" = ?", "diagnostics_iperf3_server").First(&setting).Error; err == nil {
+			host, port, found := strings.Cut(strings.TrimSpace(setting.Value), ":")
+			req.Server = host
+			if p, err := strconv.Atoi(port); found && err == nil && req.Port == 0 {
+				req.Port = p
+			}
+		}
+	case req.Action == diagnostics.ActionSpeedtest && req.URL == "":
+		if err := h.DB.Where("\"key\" = ?", "diagnostics_speedtest_url").First(&setting).Error; err == nil {
+			req.URL = strings.TrimSpace(setting.Value)
+		}
+	}
+}
+
+// execute calls the agent, parses its output and stores the outcome.
+func (h *DiagnosticHandler) execute(device model.Device, diag *model.DeviceDiagnostic, req diagnostics.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), req.Timeout())
+	defer cancel()
+
+	params := map[string]any{"diagnostic_id": diag.ID}
+	raw, _ := json.Marshal(req)
+	json.Unmarshal(raw, &params)
+
+	status, errMsg := "failed", ""
+	var reply struct {
+		Output   string `json:"output"`
+		ExitCode int    `json:"exit_code"`
+	}
+	result, err := h.RPC.Call(ctx, device.MAC, "diagnostic", params)
+	if err == nil {
+		err = json.Unmarshal(result, &reply)
+	}
+	if err != nil {
+		var rpcErr *agentmqtt.RPCError
+		if errors.As(err, &rpcErr) {
+			errMsg = rpcErr.Message
+		} else {
+			errMsg = err.Error()
+		}
+	} else if parsed, perr := diagnostics.Parse(req.Action, reply.Output); perr != nil {
+		errMsg = perr.Error()
+		if reply.ExitCode != 0 {
+			errMsg = fmt.Sprintf("exit code %d: %s", reply.ExitCode, errMsg)
+		}
+	} else {
+		status = "success"
+		b, _ := json.Marshal(parsed)
+		diag.Result = string(b)
+	}
+
+	now := time.Now()
+	diag.Status, diag.ErrorMsg, diag.Output, diag.FinishedAt = status, errMsg, reply.Output, &now
+	if err := h.DB.Model(&model.DeviceDiagnostic{}).Where("id = ?", diag.ID).Updates(map[string]any{
+		"status":      diag.Status,
+		"error_msg":   diag.ErrorMsg,
+		"output":      diag.Output,
+		"result":      diag.Result,
+		"finished_at": diag.FinishedAt,
+	}).Error; err != nil {
+		log.Printf("failed to store diagnostic %d: %v", diag.ID, err)
+	}
+
+	if h.Hub != nil {
+		h.Hub.Broadcast("diagnostic", diag)
+	}
+}
+
+// List returns the diagnostic history of a device, newest first, without
+// the raw output. Filter with ?action=.
+func (h *DiagnosticHandler) List(c *gin.Context) {
+	query := h.DB.Model(&model.DeviceDiagnostic{}).Where("device_id = ?", c.Param("id"))
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	var items []model.DeviceDiagnostic
+	if err := query.Omit("output").Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query diagnostics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items, "total": total, "page": page, "page_size": pageSize})
+}
+
+// Get returns one diagnostic run including its raw output.
+func (h *DiagnosticHandler) Get(c *gin.Context) {
+	var diag model.DeviceDiagnostic
+	if err := h.DB.Where("id = ? AND device_id = ?", c.Param("diag_id"), c.Param("id")).First(&diag).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "diagnostic not found"})
+		return
+	}
+	c.JSON(http.StatusOK, diag)
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+)
+
+var notificationChannelTypes = []string{"webhook", "email", "log"}
+
+type EscalationHandler struct {
+	DB *gorm.DB
+}
+
+// ==================== Notification Channels ====================
+
+func (h *EscalationHandler) ListChannels(c *gin.Context) {
+	var items []model.NotificationChannel
+	h.DB.Order("id").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *EscalationHandler) CreateChannel(c *gin.Context) {
+	var item model.NotificationChannel
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateChannel(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "notification_channel", fmt.Sprintf("created notification channel %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusCreated, item)
+}
+
+func (h *EscalationHandler) UpdateChannel(c *gin.Context) {
+	var item model.NotificationChannel
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "channel not found"})
+		return
+	}
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateChannel(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "update", "notification_channel", fmt.Sprintf("updated notification channel %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *EscalationHandler) DeleteChannel(c *gin.Context) {
+	if err := h.DB.Delete(&model.NotificationChannel{}, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "delete", "notification_channel", fmt.Sprintf("deleted notification channel id=%s", c.Param("id")))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+func validateChannel(item model.NotificationChannel) error {
+	if item.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateOneOf("type", item.Type, notificationChannelTypes); err != nil {
+		return err
+	}
+	if item.Type != "log" && item.Target == "" {
+		return fmt.Errorf("target is required for %s channels", item.Type)
+	}
+	if item.Type == "webhook" && !strings.HasPrefix(item.Target, "http://") && !strings.HasPrefix(item.Target, "https://") {
+		return fmt.Errorf("target must be an http(s) URL")
+	}
+	return nil
+}
+
+// ==================== Escalation Policies ====================
+
+func (h *EscalationHandler) ListPolicies(c *gin.Context) {
+	var items []model.EscalationPolicy
+	h.DB.Order("id").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *EscalationHandler) CreatePolicy(c *gin.Context) {
+	var item model.EscalationPolicy
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validatePolicy(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "escalation_policy", fmt.Sprintf("created escalation policy %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusCreated, item)
+}
+
+func (h *EscalationHandler) UpdatePolicy(c *gin.Context) {
+	var item model.EscalationPolicy
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+		return
+	}
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.validatePolicy(item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "update", "escalation_policy", fmt.Sprintf("updated escalation policy %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *EscalationHandler) DeletePolicy(c *gin.Context) {
+	if err := h.DB.Delete(&model.EscalationPolicy{}, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "delete", "escalation_policy", fmt.Sprintf("deleted escalation policy id=%s", c.Param("id")))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+func (h *EscalationHandler) validatePolicy(item model.EscalationPolicy) error {
+	if item.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if item.Severity != "" {
+		if err := validateOneOf("severity", string(item.Severity), []string{string(model.SeverityWarning), string(model.SeverityCritical)}); err != nil {
+			return err
+		}
+	}
+	steps, err := jobs.ParseEscalationSteps(item.Steps)
+	if err != nil {
+		return fmt.Errorf("steps is not valid JSON: %v", err)
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("at least one step is required")
+	}
+	last := -1
+	for i, s := range steps {
+		if (s.ChannelID == 0) == (s.ScheduleID == 0) {
+			return fmt.Errorf("step %d must set exactly one of channel_id or schedule_id", i)
+		}
+		if s.AfterMinutes < 0 || s.AfterMinutes < last {
+			return fmt.Errorf("step %d after_minutes must be non-negative and not decrease", i)
+		}
+		last = s.AfterMinutes
+		if s.ChannelID != 0 {
+			var n int64
+			h.DB.Model(&model.NotificationChannel{}).Where("id = ?", s.ChannelID).Count(&n)
+			if n == 0 {
+				return fmt.Errorf("step %d references unknown channel %d", i, s.ChannelID)
+			}
+		}
+		if s.ScheduleID != 0 {
+			var n int64
+			h.DB.Model(&model.OnCallSchedule{}).Where("id = ?", s.ScheduleID).Count(&n)
+			if n == 0 {
+				return fmt.Errorf("step %d references unknown schedule %d", i, s.ScheduleID)
+			}
+		}
+	}
+	return nil
+}
+
+// ==================== On-call Schedules ====================
+
+func (h *EscalationHandler) ListSchedules(c *gin.Context) {
+	var items []model.OnCallSchedule
+	h.DB.Order("id").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *EscalationHandler) CreateSchedule(c *gin.Context) {
+	var item model.OnCallSchedule
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateSchedule(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "oncall_schedule", fmt.Sprintf("created on-call schedule %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusCreated, item)
+}
+
+func (h *EscalationHandler) UpdateSchedule(c *gin.Context) {
+	var item model.OnCallSchedule
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateSchedule(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "update", "oncall_schedule", fmt.Sprintf("updated on-call schedule %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *EscalationHandler) DeleteSchedule(c *gin.Context) {
+	if err := h.DB.Delete(&model.OnCallSchedule{}, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "delete", "oncall_schedule", fmt.Sprintf("deleted on-call schedule id=%s", c.Param("id")))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// CurrentOnCall returns who is on call for a schedule right now.
+func (h *EscalationHandler) CurrentOnCall(c *gin.Context) {
+	var item model.OnCallSchedule
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"schedule_id": item.ID, "username": jobs.CurrentOnCall(item, time.Now())})
+}
+
+func validateSchedule(item *model.OnCallSchedule) error {
+	if item.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.TrimSpace(item.Users) == "" {
+		return fmt.Errorf("users is required")
+	}
+	if item.RotationHours <= 0 {
+		item.RotationHours = 168
+	}
+	if item.StartAt.IsZero() {
+		item.StartAt = time.Now()
+	}
+	return nil
+}
+
+// AlertEscalations lists the escalation steps already sent for an alert.
+func (h *EscalationHandler) AlertEscalations(c *gin.Context) {
+	var items []model.AlertEscalation
+	h.DB.Where("alert_id = ?", c.Param("id")).Order("step, id").Find(&items)
+	c.JSON(http.StatusOK, items)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
 	"gorm.io/gorm"
 )
 
@@ -55,8 +56,7 @@ func (h *FirewallHandler) CreateZone(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&zone).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{zone.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&zone).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "firewall_zone", fmt.Sprintf("created firewall zone %s (id=%d)", zone.Name, zone.ID))
@@ -69,12 +69,12 @@ func (h *FirewallHandler) UpdateZone(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
 		return
 	}
+	oldDevice := zone.DeviceID
 	if err := c.ShouldBindJSON(&zone); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&zone).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, zone.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&zone).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "firewall_zone", fmt.Sprintf("updated firewall zone %s (id=%d)", zone.Name, zone.ID))
@@ -82,8 +82,12 @@ func (h *FirewallHandler) UpdateZone(c *gin.Context) {
 }
 
 func (h *FirewallHandler) DeleteZone(c *gin.Context) {
-	if err := h.DB.Delete(&model.FirewallZone{}, c.Param("id")).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var item model.FirewallZone
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "zone not found"})
+		return
+	}
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Delete(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "delete", "firewall_zone", fmt.Sprintf("deleted firewall zone id=%s", c.Param("id")))
@@ -130,8 +134,7 @@ func (h *FirewallHandler) CreateRule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&rule).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{rule.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&rule).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "firewall_rule", fmt.Sprintf("created firewall rule %s (id=%d)", rule.Name, rule.ID))
@@ -144,12 +147,12 @@ func (h *FirewallHandler) UpdateRule(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
 		return
 	}
+	oldDevice := rule.DeviceID
 	if err := c.ShouldBindJSON(&rule); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&rule).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, rule.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&rule).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "firewall_rule", fmt.Sprintf("updated firewall rule %s (id=%d)", rule.Name, rule.ID))
@@ -175,20 +178,22 @@ func (h *FirewallHandler) ApplyFirewall(c *gin.Context) {
 		return
 	}
 
-	var zones []model.FirewallZone
-	h.DB.Where("device_id = ?", deviceID).Find(&zones)
-
-	var rules []model.FirewallRule
-	h.DB.Where("device_id = ? AND enabled = true", deviceID).Order("position, id").Find(&rules)
-
-	uci := generateFirewallUCI(zones, rules)
+	if !checkBeforeApply(c, h.DB, device.ID, "firewall") {
+		return
+	}
+	pkg := h.firewallConfig(deviceID)
+	if err := pkg.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid firewall config: " + err.Error()})
+		return
+	}
+	content := pkg.Export()
 
-	record := model.DeviceConfig{DeviceID: device.ID, Content: uci, Status: "pending"}
+	record := model.DeviceConfig{DeviceID: device.ID, Source: "firewall", Content: content, Status: "pending"}
 	if err := h.DB.Create(&record).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config record"})
 		return
 	}
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, uci); err != nil {
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
 		return
 	}
@@ -197,59 +202,87 @@ func (h *FirewallHandler) ApplyFirewall(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "firewall config pushed", "config_id": record.ID})
 }
 
-func generateFirewallUCI(zones []model.FirewallZone, rules []model.FirewallRule) string {
-	var b strings.Builder
-	b.WriteString("package firewall\n\n")
+// PreviewFirewall renders the config ApplyFirewall would push and diffs it
+// against the last one the device applied, without pushing anything.
+func (h *FirewallHandler) PreviewFirewall(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("device_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	preview, err := previewConfig(h.DB, device, "firewall", h.firewallConfig(c.Param("device_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// firewallConfig renders a device's zones and enabled rules.
+func (h *FirewallHandler) firewallConfig(deviceID string) *uci.Package {
+	var zones []model.FirewallZone
+	h.DB.Where("device_id = ?", deviceID).Find(&zones)
 
-	b.WriteString("config defaults\n")
-	b.WriteString("\toption syn_flood '1'\n")
-	b.WriteString("\toption input 'REJECT'\n")
-	b.WriteString("\toption output 'ACCEPT'\n")
-	b.WriteString("\toption forward 'REJECT'\n\n")
+	var rules []model.FirewallRule
+	h.DB.Where("device_id = ? AND enabled = true", deviceID).Order("position, id").Find(&rules)
+
+	return generateFirewallUCI(zones, rules)
+}
+
+// generateFirewallUCI renders the firewall package. Zones and rules are
+// named sections when their name is a valid UCI identifier and anonymous
+// otherwise (Allow-SSH); either way the name option identifies them.
+func generateFirewallUCI(zones []model.FirewallZone, rules []model.FirewallRule) *uci.Package {
+	pkg := uci.NewPackage("firewall")
+	pkg.Add("defaults", "").
+		Set("syn_flood", "1").
+		Set("input", "REJECT").
+		Set("output", "ACCEPT").
+		Set("forward", "REJECT")
 
 	for _, z := range zones {
-		b.WriteString(fmt.Sprintf("config zone '%s'\n", z.Name))
-		b.WriteString(fmt.Sprintf("\toption name '%s'\n", z.Name))
-		b.WriteString(fmt.Sprintf("\toption input '%s'\n", z.Input))
-		b.WriteString(fmt.Sprintf("\toption output '%s'\n", z.Output))
-		b.WriteString(fmt.Sprintf("\toption forward '%s'\n", z.Forward))
+		s := pkg.Add("zone", sectionName(z.Name)).
+			Set("name", z.Name).
+			Set("input", z.Input).
+			Set("output", z.Output).
+			Set("forward", z.Forward)
 		if z.Masq {
-			b.WriteString("\toption masq '1'\n")
-			b.WriteString("\toption mtu_fix '1'\n")
+			s.Set("masq", "1").Set("mtu_fix", "1")
 		}
-		for _, net := range strings.Split(z.Networks, ",") {
-			net = strings.TrimSpace(net)
-			if net != "" {
-				b.WriteString(fmt.Sprintf("\tlist network '%s'\n", net))
-			}
-		}
-		b.WriteString("\n")
+		s.Append("network", strings.Split(z.Networks, ",")...)
 	}
 
 	for _, r := range rules {
-		b.WriteString(fmt.Sprintf("config rule '%s'\n", r.Name))
-		b.WriteString(fmt.Sprintf("\toption name '%s'\n", r.Name))
+		s := pkg.Add("rule", sectionName(r.Name)).Set("name", r.Name)
 		if r.Src != "" {
-			b.WriteString(fmt.Sprintf("\toption src '%s'\n", r.Src))
+			s.Set("src", r.Src)
 		}
 		if r.Dest != "" {
-			b.WriteString(fmt.Sprintf("\toption dest '%s'\n", r.Dest))
+			s.Set("dest", r.Dest)
 		}
 		if r.Proto != "" && r.Proto != "any" {
-			b.WriteString(fmt.Sprintf("\toption proto '%s'\n", r.Proto))
+			s.Set("proto", r.Proto)
 		}
 		if r.SrcIP != "" {
-			b.WriteString(fmt.Sprintf("\toption src_ip '%s'\n", r.SrcIP))
+			s.Set("src_ip", r.SrcIP)
 		}
 		if r.DestIP != "" {
-			b.WriteString(fmt.Sprintf("\toption dest_ip '%s'\n", r.DestIP))
+			s.Set("dest_ip", r.DestIP)
 		}
 		if r.DestPort != "" {
-			b.WriteString(fmt.Sprintf("\toption dest_port '%s'\n", r.DestPort))
+			s.Set("dest_port", r.DestPort)
 		}
-		b.WriteString(fmt.Sprintf("\toption target '%s'\n", r.Target))
-		b.WriteString("\n")
+		s.Set("target", r.Target)
 	}
 
-	return b.String()
+	return pkg
+}
+
+// sectionName is name if it can name a UCI section, else empty for an
+// anonymous section.
+func sectionName(name string) string {
+	if uci.ValidName(name) {
+		return name
+	}
+	return ""
 }
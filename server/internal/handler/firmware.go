@@ -12,6 +12,7 @@ import (
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
 	"gorm.io/gorm"
 )
 
@@ -154,6 +155,11 @@ func (h *FirmwareHandler) PushUpgrade(c *gin.Context) {
 		return
 	}
 
+	if err := protocol.Require(device, protocol.CapCommandUpgrade); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
 	now := time.Now()
 	upgrade := model.FirmwareUpgrade{
 		DeviceID:   device.ID,
@@ -163,21 +169,10 @@ func (h *FirmwareHandler) PushUpgrade(c *gin.Context) {
 	}
 	h.DB.Create(&upgrade)
 
-	if h.MQTT == nil || !h.MQTT.IsConnected() {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT not connected"})
-		return
-	}
 	downloadURL := buildDownloadURL(c, fw.DownloadURL)
-	topic := fmt.Sprintf("nexusgate/devices/%s/command", device.MAC)
-	payload := fmt.Sprintf(`{"action":"upgrade","url":"%s","sha256":"%s","version":"%s"}`,
-		downloadURL, fw.SHA256, fw.Version)
-	token := h.MQTT.Publish(topic, 1, false, payload)
-	if !token.WaitTimeout(mqttPublishTimeout) {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish timed out"})
-		return
-	}
-	if err := token.Error(); err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error()})
+	fields := protocol.UpgradeFields(device, upgrade.ID, downloadURL, fw.SHA256, fw.Version)
+	if err := protocol.PublishCommand(h.MQTT, device, "upgrade", fields); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": "MQTT publish failed: " + err.Error()})
 		return
 	}
 
@@ -217,6 +212,9 @@ func (h *FirmwareHandler) BatchUpgrade(c *gin.Context) {
 	now := time.Now()
 	count := 0
 	for _, device := range devices {
+		if !protocol.Supports(device, protocol.CapCommandUpgrade) {
+			continue
+		}
 		upgrade := model.FirmwareUpgrade{
 			DeviceID:   device.ID,
 			FirmwareID: fw.ID,
@@ -225,14 +223,9 @@ func (h *FirmwareHandler) BatchUpgrade(c *gin.Context) {
 		}
 		h.DB.Create(&upgrade)
 
-		if h.MQTT != nil && h.MQTT.IsConnected() {
-			topic := fmt.Sprintf("nexusgate/devices/%s/command", device.MAC)
-			payload := fmt.Sprintf(`{"action":"upgrade","url":"%s","sha256":"%s","version":"%s"}`,
-				downloadURL, fw.SHA256, fw.Version)
-			token := h.MQTT.Publish(topic, 1, false, payload)
-			if token.WaitTimeout(mqttPublishTimeout) && token.Error() == nil {
-				count++
-			}
+		fields := protocol.UpgradeFields(device, upgrade.ID, downloadURL, fw.SHA256, fw.Version)
+		if err := protocol.PublishCommand(h.MQTT, device, "upgrade", fields); err == nil {
+			count++
 		}
 	}
 
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+type IncidentHandler struct {
+	DB  *gorm.DB
+	Hub *ws.Hub
+}
+
+func (h *IncidentHandler) List(c *gin.Context) {
+	var incidents []model.Incident
+	query := h.DB.Model(&model.Incident{})
+
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case string(model.IncidentOpen), string(model.IncidentResolved):
+			query = query.Where("status = ?", status)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status value"})
+			return
+		}
+	}
+
+	// Pagination
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	query.Order("updated_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&incidents)
+	c.JSON(http.StatusOK, gin.H{"data": incidents, "total": total, "page": page, "page_size": pageSize})
+}
+
+// Get returns an incident together with its member alerts.
+func (h *IncidentHandler) Get(c *gin.Context) {
+	var incident model.Incident
+	if err := h.DB.First(&incident, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "incident not found"})
+		return
+	}
+	var alerts []model.Alert
+	h.DB.Where("incident_id = ?", incident.ID).Order("created_at").Limit(1000).Find(&alerts)
+	c.JSON(http.StatusOK, gin.H{"incident": incident, "alerts": alerts})
+}
+
+// Resolve resolves every open member alert and then the incident itself.
+func (h *IncidentHandler) Resolve(c *gin.Context) {
+	var incident model.Incident
+	if err := h.DB.First(&incident, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "incident not found"})
+		return
+	}
+	var open []model.Alert
+	h.DB.Where("incident_id = ? AND resolved = false", incident.ID).Find(&open)
+	jobs.ResolveAlerts(h.DB, h.Hub, open)
+	jobs.ResolveIncidents(h.DB, h.Hub, []uint{incident.ID})
+	writeAudit(h.DB, c, "resolve", "incident", fmt.Sprintf("resolved incident %s (id=%d, %d alerts)", incident.Title, incident.ID, incident.AlertCount))
+	c.JSON(http.StatusOK, gin.H{"message": "resolved"})
+}
@@ -0,0 +1,495 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/ipam"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ipPoolPurposes = []string{model.IPPoolAny, model.IPPoolVLAN, model.IPPoolVPN}
+
+type IPAMHandler struct {
+	DB *gorm.DB
+}
+
+// ==================== Pools ====================
+
+func (h *IPAMHandler) ListPools(c *gin.Context) {
+	var items []model.IPPool
+	h.DB.Order("name").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *IPAMHandler) CreatePool(c *gin.Context) {
+	var item model.IPPool
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := validatePool(h.DB, &item); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "ip_pool", fmt.Sprintf("created IP pool %s %s (id=%d)", item.Name, item.CIDR, item.ID))
+	c.JSON(http.StatusCreated, item)
+}
+
+func (h *IPAMHandler) UpdatePool(c *gin.Context) {
+	var item model.IPPool
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP pool not found"})
+		return
+	}
+	oldCIDR := item.CIDR
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if status, err := validatePool(h.DB, &item); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if item.CIDR != oldCIDR {
+		var n int64
+		h.DB.Model(&model.IPAllocation{}).Where("pool_id = ?", item.ID).Count(&n)
+		if n > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("pool has %d allocations; release them before changing its cidr", n)})
+			return
+		}
+	}
+	if err := h.DB.Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "update", "ip_pool", fmt.Sprintf("updated IP pool %s %s (id=%d)", item.Name, item.CIDR, item.ID))
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *IPAMHandler) DeletePool(c *gin.Context) {
+	var item model.IPPool
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP pool not found"})
+		return
+	}
+	var n int64
+	h.DB.Model(&model.IPAllocation{}).Where("pool_id = ?", item.ID).Count(&n)
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("pool has %d allocations; release them first", n)})
+		return
+	}
+	if err := h.DB.Delete(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "delete", "ip_pool", fmt.Sprintf("deleted IP pool %s %s (id=%d)", item.Name, item.CIDR, item.ID))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// validatePool checks a pool and fills in its defaults. Pools must not
+// overlap, so every subnet belongs to at most one.
+func validatePool(db *gorm.DB, item *model.IPPool) (int, error) {
+	if item.Name == "" {
+		return http.StatusBadRequest, fmt.Errorf("name is required")
+	}
+	if item.Purpose == "" {
+		item.Purpose = model.IPPoolAny
+	}
+	if err := validateOneOf("purpose", item.Purpose, ipPoolPurposes); err != nil {
+		return http.StatusBadRequest, err
+	}
+	item.Purpose = strings.ToLower(item.Purpose)
+	prefix, err := ipam.ParsePrefix(item.CIDR)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("cidr: %v", err)
+	}
+	item.CIDR = prefix.String()
+	if item.PrefixLen == 0 {
+		item.PrefixLen = max(prefix.Bits(), 24)
+		if prefix.Addr().Is6() {
+			item.PrefixLen = max(prefix.Bits(), 64)
+		}
+	}
+	if item.PrefixLen < prefix.Bits() || item.PrefixLen > prefix.Addr().BitLen() {
+		return http.StatusBadRequest, fmt.Errorf("prefix_len must be %d-%d", prefix.Bits(), prefix.Addr().BitLen())
+	}
+
+	var others []model.IPPool
+	db.Where("id <> ?", item.ID).Find(&others)
+	for _, o := range others {
+		if p, err := netip.ParsePrefix(o.CIDR); err == nil && p.Overlaps(prefix) {
+			return http.StatusConflict, fmt.Errorf("%s overlaps pool %s (%s)", item.CIDR, o.Name, o.CIDR)
+		}
+	}
+	return 0, nil
+}
+
+// ==================== Allocations ====================
+
+func (h *IPAMHandler) ListAllocations(c *gin.Context) {
+	var items []model.IPAllocation
+	query := h.DB
+	if pid := c.Query("pool_id"); pid != "" {
+		query = query.Where("pool_id = ?", pid)
+	}
+	if did := c.Query("device_id"); did != "" {
+		query = query.Where("device_id = ?", did)
+	}
+	query.Order("pool_id, id").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+// allocationRequest asks a pool for a subnet: the given cidr, or the next
+// free one of prefix_len (the pool's default if 0).
+type allocationRequest struct {
+	CIDR        string `json:"cidr"`
+	PrefixLen   int    `json:"prefix_len"`
+	DeviceID    *uint  `json:"device_id"`
+	Description string `json:"description"`
+}
+
+// Allocate reserves a subnet of a pool by hand, for a site that is not
+// managed here or ahead of creating its VLANs.
+func (h *IPAMHandler) Allocate(c *gin.Context) {
+	var req allocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var alloc model.IPAllocation
+	var pool model.IPPool
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		alloc, pool, err = allocate(tx, c.Param("id"), "", req)
+		return err
+	})
+	var serr *statusError
+	switch {
+	case errors.As(err, &serr):
+		c.JSON(serr.status, gin.H{"error": serr.msg})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "ip_allocation", fmt.Sprintf("allocated %s from IP pool %s (id=%d)", alloc.CIDR, pool.Name, alloc.ID))
+	c.JSON(http.StatusCreated, alloc)
+}
+
+// Release frees a subnet reserved by hand, or one whose VLAN or WireGuard
+// interface is gone. Those in use are released by deleting their owner.
+func (h *IPAMHandler) Release(c *gin.Context) {
+	var alloc model.IPAllocation
+	if err := h.DB.First(&alloc, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "allocation not found"})
+		return
+	}
+	var n int64
+	switch alloc.Resource {
+	case "vlan":
+		h.DB.Model(&model.VLAN{}).Where("id = ?", alloc.ResourceID).Count(&n)
+	case "vpn_interface":
+		h.DB.Model(&model.WireGuardInterface{}).Where("id = ?", alloc.ResourceID).Count(&n)
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s is used by %s %d; delete it to release the subnet", alloc.CIDR, alloc.Resource, alloc.ResourceID)})
+		return
+	}
+	if err := h.DB.Delete(&alloc).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "delete", "ip_allocation", fmt.Sprintf("released %s (id=%d)", alloc.CIDR, alloc.ID))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted"})
+}
+
+// allocate takes a subnet from pool poolID for a resource of purpose
+// (vlan, vpn; empty for a reservation by hand). The pool row is locked for
+// the rest of tx, so concurrent allocations queue up. Besides the pool's
+// allocations it avoids every subnet configured on any device, managed by
+// IPAM or not. Refusals are statusErrors.
+func allocate(tx *gorm.DB, poolID any, purpose string, req allocationRequest) (model.IPAllocation, model.IPPool, error) {
+	var pool model.IPPool
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&pool, poolID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return model.IPAllocation{}, pool, &statusError{http.StatusNotFound, "IP pool not found"}
+		}
+		return model.IPAllocation{}, pool, err
+	}
+	if purpose != "" && pool.Purpose != model.IPPoolAny && pool.Purpose != purpose {
+		return model.IPAllocation{}, pool, &statusError{http.StatusBadRequest, fmt.Sprintf("pool %s is for %s subnets", pool.Name, pool.Purpose)}
+	}
+	prefix, err := netip.ParsePrefix(pool.CIDR)
+	if err != nil {
+		return model.IPAllocation{}, pool, err
+	}
+	bits := req.PrefixLen
+	if bits == 0 {
+		bits = pool.PrefixLen
+	}
+	if bits < prefix.Bits() || bits > prefix.Addr().BitLen() {
+		return model.IPAllocation{}, pool, &statusError{http.StatusBadRequest, fmt.Sprintf("prefix_len must be %d-%d", prefix.Bits(), prefix.Addr().BitLen())}
+	}
+
+	var allocs []model.IPAllocation
+	if err := tx.Where("pool_id = ?", pool.ID).Find(&allocs).Error; err != nil {
+		return model.IPAllocation{}, pool, err
+	}
+	uses, err := subnetsInUse(tx)
+	if err != nil {
+		return model.IPAllocation{}, pool, err
+	}
+	var used []netip.Prefix
+	var owners []string
+	for _, a := range allocs {
+		if p, err := netip.ParsePrefix(a.CIDR); err == nil {
+			used = append(used, p)
+			owners = append(owners, fmt.Sprintf("allocation %d", a.ID))
+		}
+	}
+	for _, u := range uses {
+		used = append(used, u.Prefix)
+		owners = append(owners, u.String())
+	}
+
+	var subnet netip.Prefix
+	if req.CIDR != "" {
+		if subnet, err = ipam.ParsePrefix(req.CIDR); err != nil {
+			return model.IPAllocation{}, pool, &statusError{http.StatusBadRequest, "cidr: " + err.Error()}
+		}
+		if subnet.Bits() < prefix.Bits() || !prefix.Contains(subnet.Addr()) {
+			return model.IPAllocation{}, pool, &statusError{http.StatusBadRequest, fmt.Sprintf("%s is not inside pool %s (%s)", subnet, pool.Name, pool.CIDR)}
+		}
+		for i, u := range used {
+			if u.Overlaps(subnet) {
+				return model.IPAllocation{}, pool, &statusError{http.StatusConflict, fmt.Sprintf("%s overlaps %s of %s", subnet, u, owners[i])}
+			}
+		}
+	} else {
+		var ok bool
+		if subnet, ok = ipam.Next(prefix, bits, used); !ok {
+			return model.IPAllocation{}, pool, &statusError{http.StatusConflict, fmt.Sprintf("pool %s has no free /%d", pool.Name, bits)}
+		}
+	}
+
+	alloc := model.IPAllocation{PoolID: pool.ID, CIDR: subnet.String(), DeviceID: req.DeviceID, Description: req.Description}
+	if err := tx.Create(&alloc).Error; err != nil {
+		return model.IPAllocation{}, pool, err
+	}
+	return alloc, pool, nil
+}
+
+// allocateFor takes a subnet for a new VLAN or WireGuard interface when
+// the request names a pool (?ipam_pool=<id>&prefix_len=), and returns its
+// first host address. The caller sets the allocation's resource once the
+// record exists.
+func allocateFor(tx *gorm.DB, c *gin.Context, purpose string, deviceID uint, description string) (model.IPAllocation, netip.Addr, error) {
+	req := allocationRequest{DeviceID: &deviceID, Description: description}
+	if s := c.Query("prefix_len"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return model.IPAllocation{}, netip.Addr{}, &statusError{http.StatusBadRequest, "prefix_len must be a number"}
+		}
+		req.PrefixLen = n
+	}
+	alloc, _, err := allocate(tx, c.Query("ipam_pool"), purpose, req)
+	if err != nil {
+		return alloc, netip.Addr{}, err
+	}
+	subnet := netip.MustParsePrefix(alloc.CIDR)
+	// Leave room for the network and broadcast addresses and a host.
+	if ipam.Size(subnet) < 4 {
+		return alloc, netip.Addr{}, &statusError{http.StatusBadRequest, fmt.Sprintf("a /%d has no room for hosts", subnet.Bits())}
+	}
+	return alloc, subnet.Addr().Next(), nil
+}
+
+// ==================== Reports ====================
+
+// subnetUse is a subnet configured on a device.
+type subnetUse struct {
+	Prefix     netip.Prefix `json:"-"`
+	CIDR       string       `json:"cidr"`
+	DeviceID   uint         `json:"device_id"`
+	DeviceName string       `json:"device_name"`
+	Resource   string       `json:"resource"` // vlan, vpn_interface
+	ResourceID uint         `json:"resource_id"`
+	Name       string       `json:"name"`
+	Address    string       `json:"address"` // the device's own address on it
+}
+
+func (u subnetUse) String() string {
+	return fmt.Sprintf("%s %s on %s", u.Resource, u.Name, u.DeviceName)
+}
+
+// subnetsInUse returns the VLAN and WireGuard subnets of all devices,
+// skipping addresses the consistency check reports as invalid.
+func subnetsInUse(db *gorm.DB) ([]subnetUse, error) {
+	var devices []model.Device
+	var vlans []model.VLAN
+	var ifaces []model.WireGuardInterface
+	if err := db.Select("id", "name").Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Order("device_id, vid").Find(&vlans).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Order("device_id, name").Find(&ifaces).Error; err != nil {
+		return nil, err
+	}
+	names := map[uint]string{}
+	for _, d := range devices {
+		names[d.ID] = d.Name
+	}
+
+	var uses []subnetUse
+	for _, v := range vlans {
+		subnet := vlanSubnet(v)
+		if subnet == nil {
+			continue
+		}
+		p, err := netip.ParsePrefix(subnet.String())
+		if err != nil {
+			continue
+		}
+		uses = append(uses, subnetUse{
+			Prefix: p, CIDR: p.String(), DeviceID: v.DeviceID, DeviceName: names[v.DeviceID],
+			Resource: "vlan", ResourceID: v.ID, Name: vlanInterface(v), Address: v.IPAddr,
+		})
+	}
+	for _, iface := range ifaces {
+		p, err := netip.ParsePrefix(iface.Address)
+		if err != nil {
+			continue
+		}
+		uses = append(uses, subnetUse{
+			Prefix: p.Masked(), CIDR: p.Masked().String(), DeviceID: iface.DeviceID, DeviceName: names[iface.DeviceID],
+			Resource: "vpn_interface", ResourceID: iface.ID, Name: iface.Name, Address: p.Addr().String(),
+		})
+	}
+	return uses, nil
+}
+
+type poolUtilization struct {
+	model.IPPool
+	Size          float64              `json:"size"` // addresses
+	Allocations   int                  `json:"allocations"`
+	Allocated     float64              `json:"allocated"`      // addresses in allocations
+	InUse         float64              `json:"in_use"`         // addresses in allocations or configured subnets
+	Utilization   float64              `json:"utilization"`    // in_use / size, percent
+	FreeSubnets   float64              `json:"free_subnets"`   // free subnets of prefix_len
+	DHCPAddresses int                  `json:"dhcp_addresses"` // dynamic addresses of DHCP pools on VLANs in the pool
+	Unmanaged     []subnetUse          `json:"unmanaged"`      // configured subnets without an allocation
+	Stale         []model.IPAllocation `json:"stale"`          // allocations whose VLAN or interface is gone or renumbered
+}
+
+func (h *IPAMHandler) Utilization(c *gin.Context) {
+	var pools []model.IPPool
+	var allocs []model.IPAllocation
+	var dhcp []model.DHCPPool
+	h.DB.Order("name").Find(&pools)
+	h.DB.Order("id").Find(&allocs)
+	h.DB.Where("enabled = ?", true).Find(&dhcp)
+	uses, err := subnetsInUse(h.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	owned := map[string]subnetUse{}
+	for _, u := range uses {
+		owned[fmt.Sprintf("%s/%d", u.Resource, u.ResourceID)] = u
+	}
+
+	out := make([]poolUtilization, 0, len(pools))
+	for _, pool := range pools {
+		prefix, err := netip.ParsePrefix(pool.CIDR)
+		if err != nil {
+			continue
+		}
+		r := poolUtilization{IPPool: pool, Size: ipam.Size(prefix), Unmanaged: []subnetUse{}, Stale: []model.IPAllocation{}}
+		var allocated, used []netip.Prefix
+		for _, a := range allocs {
+			p, err := netip.ParsePrefix(a.CIDR)
+			if a.PoolID != pool.ID || err != nil {
+				continue
+			}
+			allocated = append(allocated, p)
+			r.Allocations++
+			if a.Resource != "" {
+				if u, ok := owned[fmt.Sprintf("%s/%d", a.Resource, a.ResourceID)]; !ok || !u.Prefix.Overlaps(p) {
+					r.Stale = append(r.Stale, a)
+				}
+			}
+		}
+		used = append(used, allocated...)
+		for _, u := range uses {
+			if !u.Prefix.Overlaps(prefix) {
+				continue
+			}
+			used = append(used, u.Prefix)
+			managed := false
+			for _, p := range allocated {
+				managed = managed || p.Overlaps(u.Prefix)
+			}
+			if !managed {
+				r.Unmanaged = append(r.Unmanaged, u)
+			}
+			if u.Resource != "vlan" {
+				continue
+			}
+			for _, d := range dhcp {
+				if d.DeviceID == u.DeviceID && d.Interface == u.Name {
+					r.DHCPAddresses += d.Limit
+				}
+			}
+		}
+		r.Allocated = ipam.Covered(prefix, allocated)
+		r.InUse = ipam.Covered(prefix, used)
+		r.Utilization = r.InUse / r.Size * 100
+		r.FreeSubnets = ipam.Free(prefix, pool.PrefixLen, used)
+		out = append(out, r)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+type subnetOverlap struct {
+	A subnetUse `json:"a"`
+	B subnetUse `json:"b"`
+}
+
+// Overlaps lists overlapping subnets across all devices. Devices on the
+// same WireGuard tunnel share its subnet with different addresses, which
+// is not an overlap.
+func (h *IPAMHandler) Overlaps(c *gin.Context) {
+	uses, err := subnetsInUse(h.DB)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	prefixes := make([]netip.Prefix, len(uses))
+	for i, u := range uses {
+		prefixes[i] = u.Prefix
+	}
+	out := []subnetOverlap{}
+	for _, pair := range ipam.Overlaps(prefixes) {
+		a, b := uses[pair[0]], uses[pair[1]]
+		if a.Resource == "vpn_interface" && b.Resource == "vpn_interface" &&
+			a.Prefix == b.Prefix && a.DeviceID != b.DeviceID && a.Address != b.Address {
+			continue
+		}
+		out = append(out, subnetOverlap{A: a, B: b})
+	}
+	c.JSON(http.StatusOK, out)
+}
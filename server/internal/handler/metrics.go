@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
 	"github.com/nexusgate/nexusgate/internal/model"
 	"github.com/nexusgate/nexusgate/internal/ws"
 	"gorm.io/gorm"
@@ -68,14 +72,173 @@ func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(c.wsClients, prometheus.GaugeValue, float64(c.hub.ClientCount()))
 }
 
+// deviceMetricsStaleAfter is how long a device keeps exporting series after
+// its last heartbeat.
+const deviceMetricsStaleAfter = 5 * time.Minute
+
+// deviceSampleSeries is the number of series a device with a recent
+// heartbeat exports; a device without one exports only nexusgate_device_up.
+const deviceSampleSeries = 11
+
+// deviceMetricsCollector exports per-device series from the heartbeat cache.
+// Every known device exports nexusgate_device_up, 0 while it is offline or
+// has sent no recent heartbeat. Only allowlisted labels are attached and at
+// most maxSeries series are exported in total, lowest device ID first.
+type deviceMetricsCollector struct {
+	cache     *heartbeat.Cache
+	labels    []string
+	maxSeries int
+
+	up         *prometheus.Desc
+	cpuUsage   *prometheus.Desc
+	memUsage   *prometheus.Desc
+	memTotal   *prometheus.Desc
+	memFree    *prometheus.Desc
+	rxBytes    *prometheus.Desc
+	txBytes    *prometheus.Desc
+	conntrack  *prometheus.Desc
+	uptime     *prometheus.Desc
+	load1      *prometheus.Desc
+	lastSeen   *prometheus.Desc
+	exported   *prometheus.Desc
+	suppressed *prometheus.Desc
+}
+
+func newDeviceMetricsCollector(cache *heartbeat.Cache, labels []string, maxSeries int) *deviceMetricsCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, labels, nil)
+	}
+	return &deviceMetricsCollector{
+		cache:      cache,
+		labels:     labels,
+		maxSeries:  maxSeries,
+		up:         desc("nexusgate_device_up", "Whether the device is online and sent a heartbeat recently"),
+		cpuUsage:   desc("nexusgate_device_cpu_usage_percent", "Device CPU usage"),
+		memUsage:   desc("nexusgate_device_memory_usage_percent", "Device memory usage"),
+		memTotal:   desc("nexusgate_device_memory_total_bytes", "Device total memory"),
+		memFree:    desc("nexusgate_device_memory_free_bytes", "Device available memory"),
+		rxBytes:    desc("nexusgate_device_network_receive_bytes_total", "Bytes received on the device uplink"),
+		txBytes:    desc("nexusgate_device_network_transmit_bytes_total", "Bytes transmitted on the device uplink"),
+		conntrack:  desc("nexusgate_device_conntrack_entries", "Tracked connections on the device"),
+		uptime:     desc("nexusgate_device_uptime_seconds", "Device uptime"),
+		load1:      desc("nexusgate_device_load1", "Device 1-minute load average"),
+		lastSeen:   desc("nexusgate_device_last_heartbeat_timestamp_seconds", "Unix time of the last heartbeat"),
+		exported:   prometheus.NewDesc("nexusgate_device_metrics_exported_devices", "Devices exported as per-device series", nil, nil),
+		suppressed: prometheus.NewDesc("nexusgate_device_metrics_suppressed_devices", "Devices not exported due to the series limit or duplicate labels", nil, nil),
+	}
+}
+
+func (c *deviceMetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.cpuUsage
+	ch <- c.memUsage
+	ch <- c.memTotal
+	ch <- c.memFree
+	ch <- c.rxBytes
+	ch <- c.txBytes
+	ch <- c.conntrack
+	ch <- c.uptime
+	ch <- c.load1
+	ch <- c.lastSeen
+	ch <- c.exported
+	ch <- c.suppressed
+}
+
+func (c *deviceMetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	fresh := make(map[uint]heartbeat.Sample)
+	for _, s := range c.cache.Snapshot(time.Now().Add(-deviceMetricsStaleAfter)) {
+		fresh[s.DeviceID] = s
+	}
+	devices := c.cache.Devices()
+
+	seen := make(map[string]bool, len(devices))
+	exported, suppressed, series := 0, 0, 0
+	for _, d := range devices {
+		s, ok := fresh[d.ID]
+		n := 1
+		if ok {
+			n = deviceSampleSeries
+		}
+		if c.maxSeries > 0 && series+n > c.maxSeries {
+			suppressed++
+			continue
+		}
+		values := c.labelValues(d)
+		key := strings.Join(values, "\xff")
+		if seen[key] {
+			// e.g. two devices with the same name when only "device" is allowlisted
+			suppressed++
+			continue
+		}
+		seen[key] = true
+		exported++
+		series += n
+
+		gauge := func(d *prometheus.Desc, v float64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, values...)
+		}
+		up := 0.0
+		if ok && d.Online {
+			up = 1
+		}
+		gauge(c.up, up)
+		if !ok {
+			continue
+		}
+		gauge(c.cpuUsage, s.CPUUsage)
+		gauge(c.memUsage, s.MemUsage)
+		gauge(c.memTotal, float64(s.MemTotal))
+		gauge(c.memFree, float64(s.MemFree))
+		gauge(c.conntrack, float64(s.Conntrack))
+		gauge(c.uptime, float64(s.UptimeSecs))
+		gauge(c.load1, s.Load1)
+		gauge(c.lastSeen, float64(s.ReceivedAt.Unix()))
+		ch <- prometheus.MustNewConstMetric(c.rxBytes, prometheus.CounterValue, float64(s.RxBytes), values...)
+		ch <- prometheus.MustNewConstMetric(c.txBytes, prometheus.CounterValue, float64(s.TxBytes), values...)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.exported, prometheus.GaugeValue, float64(exported))
+	ch <- prometheus.MustNewConstMetric(c.suppressed, prometheus.GaugeValue, float64(suppressed))
+}
+
+func (c *deviceMetricsCollector) labelValues(d heartbeat.Device) []string {
+	values := make([]string, len(c.labels))
+	for i, l := range c.labels {
+		switch l {
+		case "device":
+			values[i] = d.Name
+		case "mac":
+			values[i] = d.MAC
+		case "group":
+			values[i] = d.Group
+		case "model":
+			values[i] = d.Model
+		}
+	}
+	return values
+}
+
 // RegisterMetrics creates a Prometheus registry with NexusGate collectors
 // and returns a gin.HandlerFunc that serves the /metrics endpoint.
-func RegisterMetrics(db *gorm.DB, hub *ws.Hub) gin.HandlerFunc {
+// Extra collectors, such as per-device metrics, are added to the same registry.
+func RegisterMetrics(db *gorm.DB, hub *ws.Hub, extra ...prometheus.Collector) gin.HandlerFunc {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(prometheus.NewGoCollector())
 	reg.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	reg.MustRegister(newMetricsCollector(db, hub))
+	reg.MustRegister(extra...)
+	return serveRegistry(reg)
+}
+
+// RegisterDeviceMetrics returns a handler serving only per-device metrics,
+// for federation or a dedicated scrape job on large fleets.
+func RegisterDeviceMetrics(collector prometheus.Collector) gin.HandlerFunc {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	return serveRegistry(reg)
+}
 
+func serveRegistry(reg *prometheus.Registry) gin.HandlerFunc {
 	handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
 	return func(c *gin.Context) {
 		handler.ServeHTTP(c.Writer, c.Request)
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gather collects c into "name{value,...}" keys, label values in the
+// order of the collector's label names.
+func gather(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]float64)
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var values []string
+			for _, l := range m.GetLabel() {
+				values = append(values, l.GetValue())
+			}
+			v := m.GetGauge().GetValue()
+			if m.GetCounter() != nil {
+				v = m.GetCounter().GetValue()
+			}
+			out[mf.GetName()+"{"+strings.Join(values, ",")+"}"] = v
+		}
+	}
+	return out
+}
+
+func TestDeviceMetricsCollector(t *testing.T) {
+	cache := heartbeat.NewCache()
+	now := time.Now()
+	cache.Update(heartbeat.Sample{DeviceID: 1, Name: "gw-01", MAC: "02:00:00:00:00:01", Group: "branch", CPUUsage: 42, RxBytes: 1000, ReceivedAt: now})
+	cache.SetDevice(model.Device{ID: 2, Name: "gw-02", MAC: "02:00:00:00:00:02", Group: "branch", Status: model.StatusOffline})
+	cache.Update(heartbeat.Sample{DeviceID: 3, Name: "gw-03", MAC: "02:00:00:00:00:03", Group: "hq", CPUUsage: 7, ReceivedAt: now.Add(-time.Hour)})
+
+	got := gather(t, newDeviceMetricsCollector(cache, []string{"device", "group"}, 0))
+	want := map[string]float64{
+		"nexusgate_device_up{gw-01,branch}":                               1,
+		"nexusgate_device_cpu_usage_percent{gw-01,branch}":                42,
+		"nexusgate_device_network_receive_bytes_total{gw-01,branch}":      1000,
+		"nexusgate_device_up{gw-02,branch}":                               0,
+		"nexusgate_device_up{gw-03,hq}":                                   0, // stale heartbeat
+		"nexusgate_device_metrics_exported_devices{}":                     3,
+		"nexusgate_device_metrics_suppressed_devices{}":                   0,
+		"nexusgate_device_last_heartbeat_timestamp_seconds{gw-01,branch}": float64(now.Unix()),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if _, ok := got["nexusgate_device_cpu_usage_percent{gw-03,hq}"]; ok {
+		t.Error("stale device exports heartbeat series")
+	}
+	if n := len(got); n != deviceSampleSeries+2+2 {
+		t.Errorf("exported %d series, want %d", n, deviceSampleSeries+4)
+	}
+
+	cache.SetOffline(1)
+	cache.Remove(3)
+	got = gather(t, newDeviceMetricsCollector(cache, []string{"device"}, 0))
+	if got["nexusgate_device_up{gw-01}"] != 0 {
+		t.Error("device marked offline still exports up 1")
+	}
+	if _, ok := got["nexusgate_device_up{gw-03}"]; ok {
+		t.Error("removed device is still exported")
+	}
+}
+
+func TestDeviceMetricsCollectorLimits(t *testing.T) {
+	cache := heartbeat.NewCache()
+	for id := uint(1); id <= 3; id++ {
+		cache.Update(heartbeat.Sample{DeviceID: id, Name: fmt.Sprintf("gw-%02d", id), Group: "branch", ReceivedAt: time.Now()})
+	}
+
+	// Only "group" is allowlisted, so all three devices share one label set
+	got := gather(t, newDeviceMetricsCollector(cache, []string{"group"}, 0))
+	if got["nexusgate_device_metrics_exported_devices{}"] != 1 || got["nexusgate_device_metrics_suppressed_devices{}"] != 2 {
+		t.Errorf("duplicate labels: exported %v, suppressed %v", got["nexusgate_device_metrics_exported_devices{}"], got["nexusgate_device_metrics_suppressed_devices{}"])
+	}
+
+	// gw-01 takes all but one series; gw-04 without a heartbeat needs one
+	cache.SetDevice(model.Device{ID: 4, Name: "gw-04", Status: model.StatusOffline})
+	got = gather(t, newDeviceMetricsCollector(cache, []string{"device"}, deviceSampleSeries+1))
+	if _, ok := got["nexusgate_device_up{gw-04}"]; !ok || got["nexusgate_device_metrics_exported_devices{}"] != 2 || got["nexusgate_device_metrics_suppressed_devices{}"] != 2 {
+		t.Errorf("series limit: exported %v, suppressed %v", got["nexusgate_device_metrics_exported_devices{}"], got["nexusgate_device_metrics_suppressed_devices{}"])
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
 	"gorm.io/gorm"
 )
 
@@ -51,8 +55,7 @@ func (h *NetworkHandler) CreateWANInterface(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "wan_interface", fmt.Sprintf("created WAN interface %s (id=%d)", item.Name, item.ID))
@@ -65,12 +68,12 @@ func (h *NetworkHandler) UpdateWANInterface(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "wan interface not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "wan_interface", fmt.Sprintf("updated WAN interface %s (id=%d)", item.Name, item.ID))
@@ -78,8 +81,12 @@ func (h *NetworkHandler) UpdateWANInterface(c *gin.Context) {
 }
 
 func (h *NetworkHandler) DeleteWANInterface(c *gin.Context) {
-	if err := h.DB.Delete(&model.WANInterface{}, c.Param("id")).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var item model.WANInterface
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wan interface not found"})
+		return
+	}
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Delete(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "delete", "wan_interface", fmt.Sprintf("deleted WAN interface id=%s", c.Param("id")))
@@ -102,8 +109,7 @@ func (h *NetworkHandler) CreateMWANPolicy(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "mwan_policy", fmt.Sprintf("created MWAN policy %s (id=%d)", item.Name, item.ID))
@@ -116,12 +122,12 @@ func (h *NetworkHandler) UpdateMWANPolicy(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "mwan_policy", fmt.Sprintf("updated MWAN policy %s (id=%d)", item.Name, item.ID))
@@ -129,8 +135,12 @@ func (h *NetworkHandler) UpdateMWANPolicy(c *gin.Context) {
 }
 
 func (h *NetworkHandler) DeleteMWANPolicy(c *gin.Context) {
-	if err := h.DB.Delete(&model.MWANPolicy{}, c.Param("id")).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var item model.MWANPolicy
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+		return
+	}
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Delete(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "delete", "mwan_policy", fmt.Sprintf("deleted MWAN policy id=%s", c.Param("id")))
@@ -153,8 +163,7 @@ func (h *NetworkHandler) CreateMWANRule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "mwan_rule", fmt.Sprintf("created MWAN rule %s (id=%d)", item.Name, item.ID))
@@ -167,12 +176,12 @@ func (h *NetworkHandler) UpdateMWANRule(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "mwan_rule", fmt.Sprintf("updated MWAN rule %s (id=%d)", item.Name, item.ID))
@@ -196,21 +205,22 @@ func (h *NetworkHandler) ApplyMWAN(c *gin.Context) {
 		return
 	}
 
-	var wans []model.WANInterface
-	h.DB.Where("device_id = ? AND enabled = true", deviceID).Find(&wans)
-	var policies []model.MWANPolicy
-	h.DB.Where("device_id = ?", deviceID).Find(&policies)
-	var rules []model.MWANRule
-	h.DB.Where("device_id = ? AND enabled = true", deviceID).Order("position, id").Find(&rules)
-
-	uci := generateMWANUCI(wans, policies, rules)
+	if !checkBeforeApply(c, h.DB, device.ID, "mwan") {
+		return
+	}
+	pkg := h.mwanConfig(deviceID)
+	if err := pkg.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid MWAN config: " + err.Error()})
+		return
+	}
+	content := pkg.Export()
 
-	record := model.DeviceConfig{DeviceID: device.ID, Content: uci, Status: "pending"}
+	record := model.DeviceConfig{DeviceID: device.ID, Source: "mwan", Content: content, Status: "pending"}
 	if err := h.DB.Create(&record).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config record"})
 		return
 	}
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, uci); err != nil {
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
 		return
 	}
@@ -218,25 +228,46 @@ func (h *NetworkHandler) ApplyMWAN(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "mwan3 config pushed", "config_id": record.ID})
 }
 
-func generateMWANUCI(wans []model.WANInterface, policies []model.MWANPolicy, rules []model.MWANRule) string {
-	var b strings.Builder
-	b.WriteString("package mwan3\n\n")
+// PreviewMWAN renders the config ApplyMWAN would push and diffs it against
+// the last one the device applied.
+func (h *NetworkHandler) PreviewMWAN(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("device_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	preview, err := previewConfig(h.DB, device, "mwan", h.mwanConfig(c.Param("device_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// mwanConfig renders a device's enabled WANs, its policies and enabled rules.
+func (h *NetworkHandler) mwanConfig(deviceID string) *uci.Package {
+	var wans []model.WANInterface
+	h.DB.Where("device_id = ? AND enabled = true", deviceID).Find(&wans)
+	var policies []model.MWANPolicy
+	h.DB.Where("device_id = ?", deviceID).Find(&policies)
+	var rules []model.MWANRule
+	h.DB.Where("device_id = ? AND enabled = true", deviceID).Order("position, id").Find(&rules)
+
+	return generateMWANUCI(wans, policies, rules)
+}
+
+func generateMWANUCI(wans []model.WANInterface, policies []model.MWANPolicy, rules []model.MWANRule) *uci.Package {
+	pkg := uci.NewPackage("mwan3")
 	for _, w := range wans {
-		b.WriteString(fmt.Sprintf("config interface '%s'\n", w.Name))
-		b.WriteString("\toption enabled '1'\n")
-		for _, ip := range strings.Split(w.TrackIPs, ",") {
-			ip = strings.TrimSpace(ip)
-			if ip != "" {
-				b.WriteString(fmt.Sprintf("\tlist track_ip '%s'\n", ip))
-			}
-		}
-		b.WriteString(fmt.Sprintf("\toption reliability '%d'\n", w.Reliability))
-		b.WriteString(fmt.Sprintf("\toption count '3'\n"))
-		b.WriteString(fmt.Sprintf("\toption timeout '3'\n"))
-		b.WriteString(fmt.Sprintf("\toption interval '%d'\n", w.Interval))
-		b.WriteString(fmt.Sprintf("\toption down '%d'\n", w.Down))
-		b.WriteString(fmt.Sprintf("\toption up '%d'\n", w.Up))
-		b.WriteString("\n")
+		pkg.Add("interface", w.Name).
+			Set("enabled", "1").
+			Append("track_ip", strings.Split(w.TrackIPs, ",")...).
+			Set("reliability", strconv.Itoa(w.Reliability)).
+			Set("count", "3").
+			Set("timeout", "3").
+			Set("interval", strconv.Itoa(w.Interval)).
+			Set("down", strconv.Itoa(w.Down)).
+			Set("up", strconv.Itoa(w.Up))
 	}
 	for _, p := range policies {
 		// Generate config member stanzas from the JSON members list
@@ -247,43 +278,43 @@ func generateMWANUCI(wans []model.WANInterface, policies []model.MWANPolicy, rul
 				continue
 			}
 		}
+		var use []string
 		for _, m := range members {
 			memberName := fmt.Sprintf("%s_m%d_w%d", m.Iface, m.Metric, m.Weight)
-			b.WriteString(fmt.Sprintf("config member '%s'\n", memberName))
-			b.WriteString(fmt.Sprintf("\toption interface '%s'\n", m.Iface))
-			b.WriteString(fmt.Sprintf("\toption metric '%d'\n", m.Metric))
-			b.WriteString(fmt.Sprintf("\toption weight '%d'\n", m.Weight))
-			b.WriteString("\n")
-		}
-		b.WriteString(fmt.Sprintf("config policy '%s'\n", p.Name))
-		b.WriteString(fmt.Sprintf("\toption last_resort '%s'\n", p.LastResort))
-		for _, m := range members {
-			memberName := fmt.Sprintf("%s_m%d_w%d", m.Iface, m.Metric, m.Weight)
-			b.WriteString(fmt.Sprintf("\tlist use_member '%s'\n", memberName))
+			use = append(use, memberName)
+			// Policies sharing a member share its section.
+			if pkg.Section(memberName) != nil {
+				continue
+			}
+			pkg.Add("member", memberName).
+				Set("interface", m.Iface).
+				Set("metric", strconv.Itoa(m.Metric)).
+				Set("weight", strconv.Itoa(m.Weight))
 		}
-		b.WriteString("\n")
+		pkg.Add("policy", p.Name).
+			Set("last_resort", p.LastResort).
+			Append("use_member", use...)
 	}
 	for _, r := range rules {
-		b.WriteString(fmt.Sprintf("config rule '%s'\n", r.Name))
+		s := pkg.Add("rule", r.Name)
 		if r.SrcIP != "" {
-			b.WriteString(fmt.Sprintf("\toption src_ip '%s'\n", r.SrcIP))
+			s.Set("src_ip", r.SrcIP)
 		}
 		if r.DestIP != "" {
-			b.WriteString(fmt.Sprintf("\toption dest_ip '%s'\n", r.DestIP))
+			s.Set("dest_ip", r.DestIP)
 		}
 		if r.Proto != "" && r.Proto != "all" {
-			b.WriteString(fmt.Sprintf("\toption proto '%s'\n", r.Proto))
+			s.Set("proto", r.Proto)
 		}
 		if r.SrcPort != "" {
-			b.WriteString(fmt.Sprintf("\toption src_port '%s'\n", r.SrcPort))
+			s.Set("src_port", r.SrcPort)
 		}
 		if r.DestPort != "" {
-			b.WriteString(fmt.Sprintf("\toption dest_port '%s'\n", r.DestPort))
+			s.Set("dest_port", r.DestPort)
 		}
-		b.WriteString(fmt.Sprintf("\toption use_policy '%s'\n", r.Policy))
-		b.WriteString("\n")
+		s.Set("use_policy", r.Policy)
 	}
-	return b.String()
+	return pkg
 }
 
 // ==================== DHCP ====================
@@ -316,26 +347,50 @@ func (h *NetworkHandler) CreateDHCPPool(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	h.dhcpDefaults(&item)
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "dhcp_pool", fmt.Sprintf("created DHCP pool %s (id=%d)", item.Interface, item.ID))
 	c.JSON(http.StatusCreated, item)
 }
 
+// dhcpDefaults fills in what a new pool on a VLAN interface leaves out
+// from the VLAN's subnet: the gateway, and a range in the upper half of
+// the subnet when the default 100-249 does not fit it.
+func (h *NetworkHandler) dhcpDefaults(item *model.DHCPPool) {
+	var vlans []model.VLAN
+	h.DB.Where("device_id = ?", item.DeviceID).Find(&vlans)
+	for _, v := range vlans {
+		subnet := vlanSubnet(v)
+		if vlanInterface(v) != item.Interface || subnet == nil {
+			continue
+		}
+		if item.Gateway == "" {
+			item.Gateway = v.IPAddr
+		}
+		ones, bits := subnet.Mask.Size()
+		hosts := 1<<(bits-ones) - 2
+		if item.Start == 0 && item.Limit == 0 && hosts >= 2 && 100+150-1 > hosts {
+			item.Start = hosts/2 + 1
+			item.Limit = hosts - item.Start + 1
+		}
+		return
+	}
+}
+
 func (h *NetworkHandler) UpdateDHCPPool(c *gin.Context) {
 	var item model.DHCPPool
 	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "dhcp pool not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "dhcp_pool", fmt.Sprintf("updated DHCP pool %s (id=%d)", item.Interface, item.ID))
@@ -343,8 +398,12 @@ func (h *NetworkHandler) UpdateDHCPPool(c *gin.Context) {
 }
 
 func (h *NetworkHandler) DeleteDHCPPool(c *gin.Context) {
-	if err := h.DB.Delete(&model.DHCPPool{}, c.Param("id")).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var item model.DHCPPool
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "dhcp pool not found"})
+		return
+	}
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Delete(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "delete", "dhcp_pool", fmt.Sprintf("deleted DHCP pool id=%s", c.Param("id")))
@@ -379,8 +438,7 @@ func (h *NetworkHandler) CreateStaticLease(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "create", "static_lease", fmt.Sprintf("created static lease %s/%s (id=%d)", item.Name, item.MAC, item.ID))
@@ -393,12 +451,12 @@ func (h *NetworkHandler) UpdateStaticLease(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "static lease not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "static_lease", fmt.Sprintf("updated static lease %s/%s (id=%d)", item.Name, item.MAC, item.ID))
@@ -444,10 +502,38 @@ func (h *NetworkHandler) CreateVLAN(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Create(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// ?ipam_pool=<id>&prefix_len= numbers the VLAN from an IPAM pool.
+	fromPool := c.Query("ipam_pool") != ""
+	if fromPool && item.IPAddr != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip_addr and ipam_pool are mutually exclusive"})
 		return
 	}
+	var alloc model.IPAllocation
+	if !checkedWrite(c, h.DB, []uint{item.DeviceID}, func(tx *gorm.DB) error {
+		if !fromPool {
+			return tx.Create(&item).Error
+		}
+		var host netip.Addr
+		var err error
+		alloc, host, err = allocateFor(tx, c, model.IPPoolVLAN, item.DeviceID, fmt.Sprintf("VLAN %d %s", item.VID, item.Name))
+		if err != nil {
+			return err
+		}
+		if !host.Is4() {
+			return &statusError{http.StatusBadRequest, "VLAN subnets must be IPv4"}
+		}
+		item.IPAddr = host.String()
+		item.Netmask = net.IP(net.CIDRMask(netip.MustParsePrefix(alloc.CIDR).Bits(), 32)).String()
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+		return tx.Model(&alloc).Updates(model.IPAllocation{Resource: "vlan", ResourceID: item.ID}).Error
+	}) {
+		return
+	}
+	if fromPool {
+		writeAudit(h.DB, c, "create", "ip_allocation", fmt.Sprintf("allocated %s for VLAN %d %s (id=%d)", alloc.CIDR, item.VID, item.Name, alloc.ID))
+	}
 	writeAudit(h.DB, c, "create", "vlan", fmt.Sprintf("created VLAN %d %s (id=%d)", item.VID, item.Name, item.ID))
 	c.JSON(http.StatusCreated, item)
 }
@@ -458,12 +544,12 @@ func (h *NetworkHandler) UpdateVLAN(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "vlan not found"})
 		return
 	}
+	oldDevice := item.DeviceID
 	if err := c.ShouldBindJSON(&item); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&item).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !checkedWrite(c, h.DB, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "vlan", fmt.Sprintf("updated VLAN %d %s (id=%d)", item.VID, item.Name, item.ID))
@@ -471,7 +557,13 @@ func (h *NetworkHandler) UpdateVLAN(c *gin.Context) {
 }
 
 func (h *NetworkHandler) DeleteVLAN(c *gin.Context) {
-	if err := h.DB.Delete(&model.VLAN{}, c.Param("id")).Error; err != nil {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("resource = ? AND resource_id = ?", "vlan", c.Param("id")).Delete(&model.IPAllocation{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.VLAN{}, c.Param("id")).Error
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -489,19 +581,22 @@ func (h *NetworkHandler) ApplyDHCP(c *gin.Context) {
 		return
 	}
 
-	var pools []model.DHCPPool
-	h.DB.Where("device_id = ? AND enabled = true", deviceID).Find(&pools)
-	var leases []model.StaticLease
-	h.DB.Where("device_id = ?", deviceID).Find(&leases)
-
-	uci := generateDHCPUCI(pools, leases)
+	if !checkBeforeApply(c, h.DB, device.ID, "dhcp") {
+		return
+	}
+	pkg := h.dhcpConfig(deviceID)
+	if err := pkg.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid DHCP config: " + err.Error()})
+		return
+	}
+	content := pkg.Export()
 
-	record := model.DeviceConfig{DeviceID: device.ID, Content: uci, Status: "pending"}
+	record := model.DeviceConfig{DeviceID: device.ID, Source: "dhcp", Content: content, Status: "pending"}
 	if err := h.DB.Create(&record).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config record"})
 		return
 	}
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, uci); err != nil {
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
 		return
 	}
@@ -509,36 +604,56 @@ func (h *NetworkHandler) ApplyDHCP(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "dhcp config pushed", "config_id": record.ID})
 }
 
-func generateDHCPUCI(pools []model.DHCPPool, leases []model.StaticLease) string {
-	var b strings.Builder
-	b.WriteString("package dhcp\n\n")
+// PreviewDHCP renders the config ApplyDHCP would push and diffs it against
+// the last one the device applied.
+func (h *NetworkHandler) PreviewDHCP(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("device_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	preview, err := previewConfig(h.DB, device, "dhcp", h.dhcpConfig(c.Param("device_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// dhcpConfig renders a device's enabled pools and its static leases.
+func (h *NetworkHandler) dhcpConfig(deviceID string) *uci.Package {
+	var pools []model.DHCPPool
+	h.DB.Where("device_id = ? AND enabled = true", deviceID).Find(&pools)
+	var leases []model.StaticLease
+	h.DB.Where("device_id = ?", deviceID).Find(&leases)
+
+	return generateDHCPUCI(pools, leases)
+}
+
+func generateDHCPUCI(pools []model.DHCPPool, leases []model.StaticLease) *uci.Package {
+	pkg := uci.NewPackage("dhcp")
 	for _, p := range pools {
-		b.WriteString(fmt.Sprintf("config dhcp '%s'\n", p.Interface))
-		b.WriteString(fmt.Sprintf("\toption interface '%s'\n", p.Interface))
-		b.WriteString(fmt.Sprintf("\toption start '%d'\n", p.Start))
-		b.WriteString(fmt.Sprintf("\toption limit '%d'\n", p.Limit))
-		b.WriteString(fmt.Sprintf("\toption leasetime '%s'\n", p.LeaseTime))
-		if p.DNS != "" {
-			for _, dns := range strings.Split(p.DNS, ",") {
-				dns = strings.TrimSpace(dns)
-				if dns != "" {
-					b.WriteString(fmt.Sprintf("\tlist dhcp_option '6,%s'\n", dns))
-				}
+		s := pkg.Add("dhcp", p.Interface).
+			Set("interface", p.Interface).
+			Set("start", strconv.Itoa(p.Start)).
+			Set("limit", strconv.Itoa(p.Limit)).
+			Set("leasetime", p.LeaseTime)
+		for _, dns := range strings.Split(p.DNS, ",") {
+			if dns = strings.TrimSpace(dns); dns != "" {
+				s.Append("dhcp_option", "6,"+dns)
 			}
 		}
 		if p.Gateway != "" {
-			b.WriteString(fmt.Sprintf("\tlist dhcp_option '3,%s'\n", p.Gateway))
+			s.Append("dhcp_option", "3,"+p.Gateway)
 		}
-		b.WriteString("\n")
 	}
 	for _, l := range leases {
-		b.WriteString("config host\n")
-		b.WriteString(fmt.Sprintf("\toption name '%s'\n", l.Name))
-		b.WriteString(fmt.Sprintf("\toption mac '%s'\n", l.MAC))
-		b.WriteString(fmt.Sprintf("\toption ip '%s'\n", l.IP))
-		b.WriteString("\n")
+		pkg.Add("host", "").
+			Set("name", l.Name).
+			Set("mac", l.MAC).
+			Set("ip", l.IP)
 	}
-	return b.String()
+	return pkg
 }
 
 // ==================== Apply VLAN ====================
@@ -551,17 +666,22 @@ func (h *NetworkHandler) ApplyVLAN(c *gin.Context) {
 		return
 	}
 
-	var vlans []model.VLAN
-	h.DB.Where("device_id = ?", deviceID).Order("vid").Find(&vlans)
-
-	uci := generateVLANUCI(vlans)
+	if !checkBeforeApply(c, h.DB, device.ID, "vlan") {
+		return
+	}
+	pkg := h.vlanConfig(deviceID)
+	if err := pkg.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid VLAN config: " + err.Error()})
+		return
+	}
+	content := pkg.Export()
 
-	record := model.DeviceConfig{DeviceID: device.ID, Content: uci, Status: "pending"}
+	record := model.DeviceConfig{DeviceID: device.ID, Source: "vlan", Content: content, Status: "pending"}
 	if err := h.DB.Create(&record).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config record"})
 		return
 	}
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, uci); err != nil {
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
 		return
 	}
@@ -569,47 +689,62 @@ func (h *NetworkHandler) ApplyVLAN(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "vlan config pushed", "config_id": record.ID})
 }
 
-func generateVLANUCI(vlans []model.VLAN) string {
-	var b strings.Builder
-	b.WriteString("package network\n\n")
+// PreviewVLAN renders the config ApplyVLAN would push and diffs it against
+// the last one the device applied.
+func (h *NetworkHandler) PreviewVLAN(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("device_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	preview, err := previewConfig(h.DB, device, "vlan", h.vlanConfig(c.Param("device_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, preview)
+}
+
+// vlanConfig renders a device's VLANs.
+func (h *NetworkHandler) vlanConfig(deviceID string) *uci.Package {
+	var vlans []model.VLAN
+	h.DB.Where("device_id = ?", deviceID).Order("vid").Find(&vlans)
+
+	return generateVLANUCI(vlans)
+}
+
+func generateVLANUCI(vlans []model.VLAN) *uci.Package {
+	pkg := uci.NewPackage("network")
 	for _, v := range vlans {
 		// Bridge VLAN filtering entry
-		b.WriteString(fmt.Sprintf("config bridge-vlan 'brvlan%d'\n", v.VID))
-		b.WriteString("\toption device 'br-lan'\n")
-		b.WriteString(fmt.Sprintf("\toption vlan '%d'\n", v.VID))
-		b.WriteString("\tlist ports 'lan1:t'\n")
-		b.WriteString("\tlist ports 'lan2:t'\n")
-		b.WriteString("\n")
+		pkg.Add("bridge-vlan", fmt.Sprintf("brvlan%d", v.VID)).
+			Set("device", "br-lan").
+			Set("vlan", strconv.Itoa(v.VID)).
+			Append("ports", "lan1:t", "lan2:t")
 
 		// Network interface for the VLAN
-		ifName := v.Name
-		if ifName == "" {
-			ifName = fmt.Sprintf("vlan%d", v.VID)
-		}
-		b.WriteString(fmt.Sprintf("config interface '%s'\n", ifName))
-		b.WriteString("\toption proto 'static'\n")
+		ifName := vlanInterface(v)
 		device := v.Interface
 		if device == "" {
 			device = fmt.Sprintf("br-lan.%d", v.VID)
 		}
-		b.WriteString(fmt.Sprintf("\toption device '%s'\n", device))
+		s := pkg.Add("interface", ifName).
+			Set("proto", "static").
+			Set("device", device)
 		if v.IPAddr != "" {
-			b.WriteString(fmt.Sprintf("\toption ipaddr '%s'\n", v.IPAddr))
+			s.Set("ipaddr", v.IPAddr)
 		}
-		b.WriteString(fmt.Sprintf("\toption netmask '%s'\n", v.Netmask))
-		b.WriteString("\n")
+		s.Set("netmask", v.Netmask)
 
-		// If isolated, add a firewall zone
+		// If isolated, add a zone that denies forwarding
 		if v.Isolated {
-			b.WriteString(fmt.Sprintf("# firewall: zone '%s' isolated — deny forwarding\n", ifName))
-			b.WriteString(fmt.Sprintf("config zone '%s_zone'\n", ifName))
-			b.WriteString(fmt.Sprintf("\toption name '%s'\n", ifName))
-			b.WriteString(fmt.Sprintf("\tlist network '%s'\n", ifName))
-			b.WriteString("\toption input 'ACCEPT'\n")
-			b.WriteString("\toption output 'ACCEPT'\n")
-			b.WriteString("\toption forward 'REJECT'\n")
-			b.WriteString("\n")
+			pkg.Add("zone", ifName+"_zone").
+				Set("name", ifName).
+				Append("network", ifName).
+				Set("input", "ACCEPT").
+				Set("output", "ACCEPT").
+				Set("forward", "REJECT")
 		}
 	}
-	return b.String()
+	return pkg
 }
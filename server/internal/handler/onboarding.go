@@ -0,0 +1,463 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/onboard"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+const (
+	// onboardingWorkers is the number of hosts of a job onboarded at once.
+	onboardingWorkers = 8
+	// onboardingHostTimeout bounds one host, opkg update and install included.
+	onboardingHostTimeout = 10 * time.Minute
+	// onboardingRegisterTimeout is how long a started agent has to register.
+	onboardingRegisterTimeout = 2 * time.Minute
+)
+
+// OnboardingHandler brings routers that run OpenWrt without the agent under
+// management over SSH. Jobs run in the background; every host change is
+// broadcast over WebSocket as "onboarding_host" and the finished job as
+// "onboarding_job".
+type OnboardingHandler struct {
+	DB  *gorm.DB
+	SSH *deviceSSH
+
+	mu      sync.Mutex
+	running map[uint]context.CancelFunc
+}
+
+// onboardingLogin is the SSH login of a job. It is only kept in memory
+// until it becomes a registered device's credential.
+type onboardingLogin struct {
+	User     string
+	Password string
+	Port     int
+	UseKey   bool
+}
+
+func (h *OnboardingHandler) setting(key, fallback string) string {
+	var setting model.SystemSetting
+	if err := h.DB.Where("\"key\" = ?", key).First(&setting).Error; err == nil && setting.Value != "" {
+		return setting.Value
+	}
+	return fallback
+}
+
+// AbandonOnboardingJobs marks jobs left running by a previous server process
+// as canceled; their goroutines did not survive the restart.
+func AbandonOnboardingJobs(db *gorm.DB) {
+	now := time.Now()
+	var ids []uint
+	db.Model(&model.OnboardingJob{}).Where("status = ?", model.OnboardingRunning).Pluck("id", &ids)
+	if len(ids) == 0 {
+		return
+	}
+	db.Model(&model.OnboardingHost{}).
+		Where("job_id IN ? AND status NOT IN ?", ids, []string{model.OnboardingHostRegistered, model.OnboardingHostFailed, model.OnboardingHostSkipped}).
+		Updates(map[string]any{"status": model.OnboardingHostFailed, "error_msg": "interrupted by server restart", "finished_at": &now})
+	db.Model(&model.OnboardingJob{}).Where("id IN ?", ids).
+		Updates(map[string]any{"status": model.OnboardingCanceled, "finished_at": &now})
+	log.Printf("onboarding: marked %d interrupted job(s) as canceled", len(ids))
+}
+
+// Create starts an onboarding job and answers 202 with it. The target is
+// one IP address, which is tried directly, or a CIDR (at most 1024
+// addresses), of which the hosts accepting connections on the SSH port are
+// tried. Agent settings left out of the request come from the onboarding
+// settings; the server URL defaults to the address this request was made to.
+func (h *OnboardingHandler) Create(c *gin.Context) {
+	var req struct {
+		Target   string `json:"target" binding:"required"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Port     int    `json:"port"`
+		UseKey   bool   `json:"use_key"` // log in with the server key instead of a password
+		onboard.Agent
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Username == "" {
+		req.Username = "root"
+	}
+	if req.Port == 0 {
+		req.Port = 22
+	}
+	if req.Port < 1 || req.Port > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "port must be between 1 and 65535"})
+		return
+	}
+	if req.Password == "" && !req.UseKey {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password is required unless use_key is set"})
+		return
+	}
+	addrs, err := onboard.Expand(req.Target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DeviceName != "" && len(addrs) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_name only applies to a single address"})
+		return
+	}
+
+	agent := req.Agent
+	if agent.ServerURL == "" {
+		agent.ServerURL = h.setting("onboarding_server_url", buildDownloadURL(c, ""))
+	}
+	if agent.MQTTBroker == "" {
+		agent.MQTTBroker = h.setting("onboarding_mqtt_broker", "")
+	}
+	if agent.MQTTPort == 0 {
+		agent.MQTTPort, _ = strconv.Atoi(h.setting("onboarding_mqtt_port", "1883"))
+	}
+	if agent.Package == "" {
+		agent.Package = h.setting("onboarding_agent_package", onboard.DefaultPackage)
+	}
+	if err := agent.Normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	username, _ := c.Get("username")
+	agentJSON, _ := json.Marshal(agent)
+	job := model.OnboardingJob{
+		Target:    req.Target,
+		SSHUser:   req.Username,
+		SSHPort:   req.Port,
+		UseKey:    req.UseKey,
+		Agent:     string(agentJSON),
+		Status:    model.OnboardingRunning,
+		Scanned:   len(addrs),
+		StartedAt: time.Now(),
+	}
+	job.UserID, _ = userID.(uint)
+	job.Username, _ = username.(string)
+	if err := h.DB.Create(&job).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create onboarding job"})
+		return
+	}
+	writeAudit(h.DB, c, "onboarding_start", "onboarding", fmt.Sprintf("onboarding job %d: target=%s user=%s port=%d use_key=%v server_url=%s", job.ID, job.Target, job.SSHUser, job.SSHPort, job.UseKey, agent.ServerURL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	if h.running == nil {
+		h.running = make(map[uint]context.CancelFunc)
+	}
+	h.running[job.ID] = cancel
+	h.mu.Unlock()
+
+	login := onboardingLogin{User: req.Username, Password: req.Password, Port: req.Port, UseKey: req.UseKey}
+	go h.run(ctx, job, login, agent, addrs)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// run onboards the hosts of a job with a pool of workers.
+func (h *OnboardingHandler) run(ctx context.Context, job model.OnboardingJob, login onboardingLogin, agent onboard.Agent, addrs []netip.Addr) {
+	defer func() {
+		h.mu.Lock()
+		if cancel := h.running[job.ID]; cancel != nil {
+			cancel()
+			delete(h.running, job.ID)
+		}
+		h.mu.Unlock()
+	}()
+
+	if len(addrs) > 1 {
+		addrs = onboard.Probe(ctx, addrs, login.Port, 2*time.Second)
+	}
+	hosts := make([]model.OnboardingHost, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = model.OnboardingHost{JobID: job.ID, Address: addr.String(), Status: model.OnboardingHostPending}
+	}
+	if len(hosts) > 0 {
+		if err := h.DB.CreateInBatches(&hosts, 100).Error; err != nil {
+			log.Printf("onboarding job %d: failed to record hosts: %v", job.ID, err)
+			hosts = nil
+		}
+	}
+	h.DB.Model(&model.OnboardingJob{}).Where("id = ?", job.ID).Update("hosts", len(hosts))
+
+	work := make(chan *model.OnboardingHost)
+	var wg sync.WaitGroup
+	for range min(onboardingWorkers, len(hosts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range work {
+				h.onboardHost(ctx, host, login, agent)
+			}
+		}()
+	}
+feed:
+	for i := range hosts {
+		select {
+		case work <- &hosts[i]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	now := time.Now()
+	status := model.OnboardingFinished
+	if ctx.Err() != nil {
+		status = model.OnboardingCanceled
+		h.DB.Model(&model.OnboardingHost{}).Where("job_id = ? AND status = ?", job.ID, model.OnboardingHostPending).
+			Updates(map[string]any{"status": model.OnboardingHostSkipped, "error_msg": "job canceled", "finished_at": &now})
+	}
+	h.DB.Model(&model.OnboardingJob{}).Where("id = ?", job.ID).
+		Updates(map[string]any{"status": status, "finished_at": &now})
+	h.DB.First(&job, job.ID)
+	log.Printf("onboarding job %d %s: %d of %d hosts registered, %d failed", job.ID, status, job.Registered, job.Hosts, job.Failed)
+	if h.SSH.Hub != nil {
+		h.SSH.Hub.Broadcast("onboarding_job", job)
+	}
+}
+
+// onboardHost logs in to one host, installs, configures and starts the
+// agent, and waits for it to register.
+func (h *OnboardingHandler) onboardHost(ctx context.Context, host *model.OnboardingHost, login onboardingLogin, agent onboard.Agent) {
+	ctx, cancel := context.WithTimeout(ctx, onboardingHostTimeout)
+	defer cancel()
+	now := time.Now()
+	host.StartedAt = &now
+	h.step(host, model.OnboardingHostConnecting)
+
+	// Nothing is pinned for a host yet: the key presented now is recorded
+	// and becomes the device's pinned key once it registers.
+	var presented gossh.PublicKey
+	client := &ssh.Client{
+		Host:     host.Address,
+		Port:     login.Port,
+		User:     login.User,
+		Password: login.Password,
+		HostKeyCallback: func(_ string, _ net.Addr, key gossh.PublicKey) error {
+			presented = key
+			return nil
+		},
+	}
+	if login.UseKey {
+		client.Signer = h.SSH.SSH.Signer
+	}
+	conn, err := client.Dial(ctx)
+	if err != nil {
+		h.fail(ctx, host, err)
+		return
+	}
+	defer conn.Close()
+	host.HostKey = ssh.AuthorizedKey(presented, "")
+
+	info, err := onboard.Collect(ctx, conn)
+	if err != nil {
+		h.fail(ctx, host, err)
+		return
+	}
+	host.Hostname, host.Model, host.Firmware, host.MAC = info.Hostname, info.Model, info.Firmware, info.MAC
+
+	var existing model.Device
+	if h.DB.Where("mac = ?", info.MAC).First(&existing).Error == nil {
+		var cred model.DeviceCredential
+		if h.DB.Where("device_id = ?", existing.ID).First(&cred).Error == nil && cred.HostKey != "" && cred.HostKey != host.HostKey {
+			pinned, _, _, _, _ := gossh.ParseAuthorizedKey([]byte(cred.HostKey))
+			mismatch := &ssh.HostKeyMismatchError{Presented: gossh.FingerprintSHA256(presented)}
+			if pinned != nil {
+				mismatch.Pinned = gossh.FingerprintSHA256(pinned)
+			}
+			h.fail(ctx, host, fmt.Errorf("device %s (id=%d): %w", existing.Name, existing.ID, mismatch))
+			return
+		}
+		if existing.Status == model.StatusOnline {
+			host.DeviceID = &existing.ID
+			h.finish(host, model.OnboardingHostSkipped, fmt.Sprintf("already managed as device %s (id=%d)", existing.Name, existing.ID))
+			return
+		}
+	}
+
+	h.step(host, model.OnboardingHostInstalling)
+	host.Output, _, err = onboard.Install(ctx, conn, agent)
+	if err != nil {
+		h.fail(ctx, host, err)
+		return
+	}
+	h.step(host, model.OnboardingHostConfiguring)
+	if err := onboard.Configure(ctx, conn, agent); err != nil {
+		h.fail(ctx, host, fmt.Errorf("writing %s: %w", onboard.ConfigPath, err))
+		return
+	}
+	h.step(host, model.OnboardingHostStarting)
+	started := time.Now()
+	if err := onboard.Start(ctx, conn); err != nil {
+		h.fail(ctx, host, fmt.Errorf("starting the agent: %w", err))
+		return
+	}
+	h.step(host, model.OnboardingHostWaiting)
+	device, err := h.awaitRegistration(ctx, info.MAC, started)
+	if err != nil {
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("agent did not register within %s; check that the device reaches %s", onboardingRegisterTimeout, agent.ServerURL)
+		}
+		h.fail(ctx, host, err)
+		return
+	}
+	h.saveCredential(device, login, host.HostKey)
+	host.DeviceID = &device.ID
+	h.finish(host, model.OnboardingHostRegistered, "")
+}
+
+// awaitRegistration waits for the agent with the given MAC to register, or
+// to report in if the device was known already.
+func (h *OnboardingHandler) awaitRegistration(ctx context.Context, mac string, since time.Time) (model.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, onboardingRegisterTimeout)
+	defer cancel()
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		var device model.Device
+		if h.DB.Where("mac = ? AND (registered_at >= ? OR last_seen_at >= ?)", mac, since, since).First(&device).Error == nil {
+			return device, nil
+		}
+		select {
+		case <-ctx.Done():
+			return device, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// saveCredential stores the job's login as the device's SSH credential,
+// pinning the host key seen during onboarding unless one is pinned already.
+func (h *OnboardingHandler) saveCredential(device model.Device, login onboardingLogin, hostKey string) {
+	var cred model.DeviceCredential
+	h.DB.Where("device_id = ?", device.ID).FirstOrInit(&cred, model.DeviceCredential{DeviceID: device.ID})
+	cred.Username, cred.Port = login.User, login.Port
+	if login.Password != "" {
+		cred.Password = login.Password
+	}
+	if cred.HostKey == "" {
+		cred.HostKey = hostKey
+	}
+	if login.UseKey {
+		cred.KeyDeployed = true
+	}
+	if err := h.DB.Save(&cred).Error; err != nil {
+		log.Printf("onboarding: failed to store SSH credential of device %d: %v", device.ID, err)
+	}
+	h.SSH.forget(device.ID)
+}
+
+// step records that a host entered a new state.
+func (h *OnboardingHandler) step(host *model.OnboardingHost, status string) {
+	host.Status = status
+	if err := h.DB.Save(host).Error; err != nil {
+		log.Printf("onboarding: failed to store host %s: %v", host.Address, err)
+	}
+	if h.SSH.Hub != nil {
+		h.SSH.Hub.Broadcast("onboarding_host", host)
+	}
+}
+
+// finish records the outcome of a host and counts it on the job.
+func (h *OnboardingHandler) finish(host *model.OnboardingHost, status, errMsg string) {
+	now := time.Now()
+	host.FinishedAt = &now
+	host.ErrorMsg = errMsg
+	h.step(host, status)
+	switch status {
+	case model.OnboardingHostRegistered:
+		h.DB.Model(&model.OnboardingJob{}).Where("id = ?", host.JobID).UpdateColumn("registered", gorm.Expr("registered + 1"))
+	case model.OnboardingHostFailed:
+		h.DB.Model(&model.OnboardingJob{}).Where("id = ?", host.JobID).UpdateColumn("failed", gorm.Expr("failed + 1"))
+	}
+}
+
+func (h *OnboardingHandler) fail(ctx context.Context, host *model.OnboardingHost, err error) {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		err = errors.New("job canceled")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("timed out after %s: %w", onboardingHostTimeout, err)
+	}
+	h.finish(host, model.OnboardingHostFailed, err.Error())
+}
+
+// List returns onboarding jobs, newest first. Filter with ?status=.
+func (h *OnboardingHandler) List(c *gin.Context) {
+	query := h.DB.Model(&model.OnboardingJob{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	var items []model.OnboardingJob
+	if err := query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query onboarding jobs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items, "total": total, "page": page, "page_size": pageSize})
+}
+
+// Get returns a job with the status of each of its hosts.
+func (h *OnboardingHandler) Get(c *gin.Context) {
+	var job model.OnboardingJob
+	if err := h.DB.First(&job, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "onboarding job not found"})
+		return
+	}
+	var hosts []model.OnboardingHost
+	h.DB.Where("job_id = ?", job.ID).Order("id").Find(&hosts)
+	c.JSON(http.StatusOK, gin.H{"job": job, "hosts": hosts})
+}
+
+// Cancel stops a running job. Hosts in progress fail with "job canceled";
+// hosts not started yet are skipped.
+func (h *OnboardingHandler) Cancel(c *gin.Context) {
+	var job model.OnboardingJob
+	if err := h.DB.First(&job, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "onboarding job not found"})
+		return
+	}
+	h.mu.Lock()
+	cancel := h.running[job.ID]
+	h.mu.Unlock()
+	if cancel == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "onboarding job is not running"})
+		return
+	}
+	cancel()
+	writeAudit(h.DB, c, "onboarding_cancel", "onboarding", fmt.Sprintf("canceled onboarding job %d (target=%s)", job.ID, job.Target))
+	c.JSON(http.StatusOK, gin.H{"message": "onboarding job canceled"})
+}
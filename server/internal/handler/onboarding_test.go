@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/onboard"
+	"github.com/nexusgate/nexusgate/internal/secret"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/ssh/sshtest"
+	"github.com/nexusgate/nexusgate/internal/store"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB connects to the database in NEXUSGATE_TEST_DSN and migrates it;
+// tests that need one are skipped without it.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("NEXUSGATE_TEST_DSN")
+	if dsn == "" {
+		t.Skip("NEXUSGATE_TEST_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AutoMigrate(db, "off"); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := secret.NewLocalKMS(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.SetKMS(kms)
+	return db
+}
+
+const onboardMAC = "02:4e:47:00:00:01"
+
+// fakeRouter answers the onboarding commands like a stock OpenWrt device.
+// Starting the agent registers the device, as the agent would.
+type fakeRouter struct {
+	db         *gorm.DB
+	notOpenWrt bool
+	opkgError  string
+	startError string
+}
+
+func (r *fakeRouter) exec(s *sshtest.Server) sshtest.ExecFunc {
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		switch {
+		case strings.HasPrefix(command, "scp "):
+			return s.SCP(command, stdin, stdout, stderr)
+		case command == "test -f /etc/openwrt_release":
+			if r.notOpenWrt {
+				return 1
+			}
+			return 0
+		case command == ssh.SystemInfoCommand:
+			io.WriteString(stdout, `{"hostname":"gw-01","model":"GL.iNet GL-MT3000","firmware":"r23809-234f1a2efa","uptime":5123,"kernel":"5.15.150"}`+"\n")
+			return 0
+		case strings.HasPrefix(command, "cat /sys/class/net/br-lan/address"):
+			io.WriteString(stdout, onboardMAC+"\n")
+			return 0
+		case strings.HasPrefix(command, "if opkg list-installed"):
+			if r.opkgError != "" {
+				io.WriteString(stdout, r.opkgError)
+				return 255
+			}
+			io.WriteString(stdout, "Installing nexusgate-agent (1.2.0-1) to root...\n")
+			return 0
+		case strings.HasPrefix(command, "/etc/init.d/nexusgate-agent enable"):
+			if r.startError != "" {
+				io.WriteString(stderr, r.startError)
+				return 1
+			}
+			now := time.Now()
+			var device model.Device
+			if r.db.Where("mac = ?", onboardMAC).First(&device).Error == nil {
+				r.db.Model(&device).Updates(map[string]any{"status": model.StatusOnline, "last_seen_at": &now})
+			} else {
+				r.db.Create(&model.Device{Name: "gw-01", MAC: onboardMAC, IPAddress: "127.0.0.1", Status: model.StatusOnline, LastSeenAt: &now})
+			}
+			return 0
+		}
+		fmt.Fprintf(stderr, "sh: unexpected command %q\n", command)
+		return 127
+	}
+}
+
+// onboardingSetup returns a handler and an SSH server for router, and
+// removes the test device before and after the test.
+func onboardingSetup(t *testing.T, router *fakeRouter) (*OnboardingHandler, *sshtest.Server) {
+	t.Helper()
+	db := testDB(t)
+	router.db = db
+	cleanup := func() {
+		var ids []uint
+		db.Unscoped().Model(&model.Device{}).Where("mac = ?", onboardMAC).Pluck("id", &ids)
+		if len(ids) > 0 {
+			db.Unscoped().Where("device_id IN ?", ids).Delete(&model.DeviceCredential{})
+			db.Unscoped().Where("id IN ?", ids).Delete(&model.Device{})
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "admin"
+	s.Exec = router.exec(s)
+	s.Start(t)
+	signer, err := ssh.LoadOrGenerateKey(t.TempDir()+"/id_ed25519", "nexusgate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &OnboardingHandler{DB: db, SSH: &deviceSSH{DB: db, SSH: ssh.NewManager(signer, time.Minute)}}
+	return h, s
+}
+
+// runJob runs an onboarding job against s to completion and returns the
+// job and its host.
+func runJob(t *testing.T, h *OnboardingHandler, s *sshtest.Server, password string) (model.OnboardingJob, model.OnboardingHost) {
+	t.Helper()
+	agent := onboard.Agent{ServerURL: "http://127.0.0.1:8080"}
+	if err := agent.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	job := model.OnboardingJob{Target: "127.0.0.1", SSHUser: "root", SSHPort: s.Port(), Status: model.OnboardingRunning, Scanned: 1, StartedAt: time.Now()}
+	if err := h.DB.Create(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.DB.Where("job_id = ?", job.ID).Delete(&model.OnboardingHost{})
+		h.DB.Delete(&job)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	login := onboardingLogin{User: "root", Password: password, Port: s.Port()}
+	h.run(ctx, job, login, agent, []netip.Addr{netip.MustParseAddr(s.Host())})
+
+	var hosts []model.OnboardingHost
+	h.DB.First(&job, job.ID)
+	h.DB.Where("job_id = ?", job.ID).Find(&hosts)
+	if len(hosts) != 1 {
+		t.Fatalf("job has %d hosts, want 1", len(hosts))
+	}
+	if job.Status != model.OnboardingFinished || job.Hosts != 1 || job.FinishedAt == nil {
+		t.Errorf("job = %+v, want finished with 1 host", job)
+	}
+	host := hosts[0]
+	if host.StartedAt == nil || host.FinishedAt == nil || host.Address != s.Host() {
+		t.Errorf("host = %+v, want started and finished at %s", host, s.Host())
+	}
+	return job, host
+}
+
+func TestOnboardingRegisters(t *testing.T) {
+	h, s := onboardingSetup(t, &fakeRouter{})
+	job, host := runJob(t, h, s, "admin")
+
+	if host.Status != model.OnboardingHostRegistered || host.ErrorMsg != "" || host.DeviceID == nil {
+		t.Fatalf("host = %+v, want registered", host)
+	}
+	if job.Registered != 1 || job.Failed != 0 {
+		t.Errorf("job counts registered=%d failed=%d, want 1/0", job.Registered, job.Failed)
+	}
+	if host.Hostname != "gw-01" || host.Model != "GL.iNet GL-MT3000" || host.MAC != onboardMAC || !strings.Contains(host.Output, "Installing nexusgate-agent") {
+		t.Errorf("host details = %+v", host)
+	}
+	if data, _, ok := s.ReadFile(onboard.ConfigPath); !ok || !strings.Contains(string(data), "option server_url 'http://127.0.0.1:8080'") {
+		t.Errorf("agent config = %q", data)
+	}
+
+	// The login becomes the device's credential, pinned to the host key
+	// the device presented.
+	var cred model.DeviceCredential
+	if err := h.DB.Where("device_id = ?", *host.DeviceID).First(&cred).Error; err != nil {
+		t.Fatalf("no credential stored: %v", err)
+	}
+	wantKey := ssh.AuthorizedKey(s.HostKey.PublicKey(), "")
+	if cred.Username != "root" || cred.Password != "admin" || cred.Port != s.Port() || cred.HostKey != wantKey || host.HostKey != wantKey {
+		t.Errorf("credential = %s@:%d host key %q, want root@:%d pinned to %q", cred.Username, cred.Port, cred.HostKey, s.Port(), wantKey)
+	}
+}
+
+func TestOnboardingFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		router   fakeRouter
+		password string
+		wantErr  string
+	}{
+		{name: "wrong password", password: "wrong", wantErr: "ssh handshake failed"},
+		{name: "not OpenWrt", router: fakeRouter{notOpenWrt: true}, password: "admin", wantErr: onboard.ErrNotOpenWrt.Error()},
+		{
+			name:     "opkg fails",
+			router:   fakeRouter{opkgError: "Collected errors:\n * opkg_install_cmd: Cannot install package nexusgate-agent.\n"},
+			password: "admin",
+			wantErr:  "opkg install nexusgate-agent failed: * opkg_install_cmd: Cannot install package nexusgate-agent.",
+		},
+		{name: "agent does not start", router: fakeRouter{startError: "/etc/init.d/nexusgate-agent: not found"}, password: "admin", wantErr: "starting the agent: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, s := onboardingSetup(t, &tt.router)
+			job, host := runJob(t, h, s, tt.password)
+			if host.Status != model.OnboardingHostFailed || !strings.Contains(host.ErrorMsg, tt.wantErr) {
+				t.Errorf("host status %s error %q, want failed with %q", host.Status, host.ErrorMsg, tt.wantErr)
+			}
+			if job.Failed != 1 || job.Registered != 0 {
+				t.Errorf("job counts registered=%d failed=%d, want 0/1", job.Registered, job.Failed)
+			}
+			var n int64
+			h.DB.Model(&model.Device{}).Where("mac = ?", onboardMAC).Count(&n)
+			if n != 0 {
+				t.Errorf("%d devices registered by a failed onboarding", n)
+			}
+		})
+	}
+}
+
+// existingDevice stores the test device with a credential pinned to
+// hostKey.
+func existingDevice(t *testing.T, h *OnboardingHandler, status model.DeviceStatus, hostKey string) model.Device {
+	t.Helper()
+	device := model.Device{Name: "gw-01", MAC: onboardMAC, Status: status}
+	if err := h.DB.Create(&device).Error; err != nil {
+		t.Fatal(err)
+	}
+	cred := model.DeviceCredential{DeviceID: device.ID, Username: "root", Password: "old", Port: 22, HostKey: hostKey}
+	if err := h.DB.Create(&cred).Error; err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestOnboardingHostKeyMismatch(t *testing.T) {
+	h, s := onboardingSetup(t, &fakeRouter{})
+	other := sshtest.NewUnstartedServer(t).HostKey.PublicKey()
+	device := existingDevice(t, h, model.StatusOffline, ssh.AuthorizedKey(other, ""))
+
+	job, host := runJob(t, h, s, "admin")
+	if host.Status != model.OnboardingHostFailed || !strings.Contains(host.ErrorMsg, "host key changed") || job.Failed != 1 {
+		t.Fatalf("host status %s error %q, want failed on the host key", host.Status, host.ErrorMsg)
+	}
+	if len(s.Commands()) != 3 {
+		t.Errorf("commands after the mismatch: %q, want only the system checks", s.Commands())
+	}
+	var cred model.DeviceCredential
+	h.DB.Where("device_id = ?", device.ID).First(&cred)
+	if cred.HostKey != ssh.AuthorizedKey(other, "") || cred.Password != "old" {
+		t.Errorf("credential changed to host key %q password %q", cred.HostKey, cred.Password)
+	}
+}
+
+func TestOnboardingKeepsPinnedKey(t *testing.T) {
+	h, s := onboardingSetup(t, &fakeRouter{})
+	pinned := ssh.AuthorizedKey(s.HostKey.PublicKey(), "")
+	device := existingDevice(t, h, model.StatusOffline, pinned)
+
+	_, host := runJob(t, h, s, "admin")
+	if host.Status != model.OnboardingHostRegistered || host.DeviceID == nil || *host.DeviceID != device.ID {
+		t.Fatalf("host = %+v, want registered as device %d", host, device.ID)
+	}
+	var cred model.DeviceCredential
+	h.DB.Where("device_id = ?", device.ID).First(&cred)
+	if cred.HostKey != pinned || cred.Password != "admin" {
+		t.Errorf("credential host key %q password %q, want the pinned key and the new password", cred.HostKey, cred.Password)
+	}
+}
+
+func TestOnboardingSkipsManagedDevice(t *testing.T) {
+	h, s := onboardingSetup(t, &fakeRouter{})
+	device := existingDevice(t, h, model.StatusOnline, "")
+
+	job, host := runJob(t, h, s, "admin")
+	if host.Status != model.OnboardingHostSkipped || host.DeviceID == nil || *host.DeviceID != device.ID {
+		t.Fatalf("host = %+v, want skipped as device %d", host, device.ID)
+	}
+	if job.Registered != 0 || job.Failed != 0 {
+		t.Errorf("job counts registered=%d failed=%d, want 0/0", job.Registered, job.Failed)
+	}
+	if _, _, ok := s.ReadFile(onboard.ConfigPath); ok {
+		t.Error("agent configured on a managed device")
+	}
+}
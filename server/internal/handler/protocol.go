@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+)
+
+// ProtocolInfo describes the agent protocol spoken by this server: its
+// version, the capabilities it knows and the published payload schemas.
+func ProtocolInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"version": protocol.Version,
+		"capabilities": []string{
+			protocol.CapHeartbeatDetails, protocol.CapConfigAck, protocol.CapConfigConfirm,
+			protocol.CapUpgradeAck, protocol.CapUpgradeProgress, protocol.CapRPC,
+			protocol.CapCommandReboot, protocol.CapCommandUpgrade, protocol.CapCommandConfirmConfig,
+			protocol.CapCommandPing, protocol.CapCommandSystemInfo, protocol.CapCommandDiagnostic,
+			protocol.CapCommandLogread, protocol.CapCommandSyslogForward, protocol.CapCommandUCIExport,
+		},
+		"legacy_capabilities": protocol.LegacyCapabilities,
+		"schemas":             protocol.SchemaNames(),
+	})
+}
+
+// ProtocolSchema serves the JSON Schema of one topic payload.
+func ProtocolSchema(c *gin.Context) {
+	schema, ok := protocol.Schema(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+		return
+	}
+	c.Data(http.StatusOK, "application/schema+json", schema)
+}
@@ -5,12 +5,18 @@ import (
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/config"
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
 	"github.com/nexusgate/nexusgate/internal/handler/middleware"
+	agentmqtt "github.com/nexusgate/nexusgate/internal/mqtt"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/store"
+	"github.com/nexusgate/nexusgate/internal/tunnel"
 	"github.com/nexusgate/nexusgate/internal/ws"
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
 
-func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub *ws.Hub) *gin.Engine {
+func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub *ws.Hub, heartbeats *heartbeat.Cache, caps store.Capabilities, rpc *agentmqtt.RPC, tunnels *tunnel.Server, sshManager *ssh.Manager, collectors ...prometheus.Collector) *gin.Engine {
 	r := gin.Default()
 
 	// Request tracing
@@ -33,23 +39,45 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 	authLimiter := middleware.NewRateLimiter(10.0/60.0, 5)
 
 	authHandler := &AuthHandler{DB: db, JWTSecret: cfg.JWTSecret}
-	deviceHandler := &DeviceHandler{DB: db, MQTT: mqttClient}
+	deviceHandler := &DeviceHandler{DB: db, MQTT: mqttClient, Heartbeats: heartbeats, RPC: rpc, Timescale: caps.Timescale}
 	configHandler := &ConfigHandler{DB: db, MQTT: mqttClient}
 	firewallHandler := &FirewallHandler{DB: db, MQTT: mqttClient}
 	vpnHandler := &VPNHandler{DB: db, MQTT: mqttClient}
 	firmwareHandler := &FirmwareHandler{DB: db, MQTT: mqttClient}
 	networkHandler := &NetworkHandler{DB: db, MQTT: mqttClient}
+	ipamHandler := &IPAMHandler{DB: db}
 	settingHandler := &SettingHandler{DB: db}
-	alertHandler := &AlertHandler{DB: db}
+	alertHandler := &AlertHandler{DB: db, Hub: wsHub}
+	diagnosticHandler := &DiagnosticHandler{DB: db, RPC: rpc, Hub: wsHub}
+	logHandler := &LogHandler{DB: db, RPC: rpc}
+	devSSH := &deviceSSH{DB: db, Hub: wsHub, MQTT: mqttClient, Tunnels: tunnels, SSH: sshManager}
+	shellHandler := &ShellHandler{DB: db, SSH: devSSH, JWTSecret: cfg.JWTSecret, RecordingsDir: cfg.ShellRecordingsDir}
+	sshHandler := &SSHHandler{DB: db, SSH: devSSH}
+	onboardingHandler := &OnboardingHandler{DB: db, SSH: devSSH}
+	importHandler := &ImportHandler{DB: db, RPC: rpc, SSH: devSSH}
+	tunnelHandler := &TunnelHandler{DB: db, MQTT: mqttClient, Tunnels: tunnels}
+	escalationHandler := &EscalationHandler{DB: db}
+	incidentHandler := &IncidentHandler{DB: db, Hub: wsHub}
+	alertmanagerHandler := &AlertmanagerHandler{DB: db, Hub: wsHub, Token: cfg.AlertmanagerWebhookToken}
 
 	// Health check (no auth — used by load balancers and Docker)
 	r.GET("/health", HealthCheck(db, mqttClient))
 
 	// Prometheus metrics (protected by JWT or accessible from localhost)
-	r.GET("/metrics", middleware.MetricsAuth(cfg.JWTSecret), RegisterMetrics(db, wsHub))
+	deviceMetrics := newDeviceMetricsCollector(heartbeats, cfg.DeviceMetricsLabels, cfg.DeviceMetricsMaxSeries)
+	switch cfg.DeviceMetricsMode {
+	case "inline":
+		r.GET("/metrics", middleware.MetricsAuth(cfg.JWTSecret), RegisterMetrics(db, wsHub, append(collectors, deviceMetrics)...))
+	case "separate":
+		r.GET("/metrics", middleware.MetricsAuth(cfg.JWTSecret), RegisterMetrics(db, wsHub, collectors...))
+		r.GET("/metrics/devices", middleware.MetricsAuth(cfg.JWTSecret), RegisterDeviceMetrics(deviceMetrics))
+	default:
+		r.GET("/metrics", middleware.MetricsAuth(cfg.JWTSecret), RegisterMetrics(db, wsHub, collectors...))
+	}
 
 	// WebSocket endpoint (no JWT for WS upgrade, auth via query param)
 	r.GET("/ws", wsHub.HandleWS)
+	r.GET("/ws/devices/:id/shell", shellHandler.Open) // admin only
 
 	// Public routes (rate-limited)
 	pub := r.Group("/api/v1")
@@ -57,8 +85,15 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 	{
 		pub.POST("/auth/login", authHandler.Login)
 		pub.POST("/devices/register", deviceHandler.Register)
+		pub.GET("/protocol", ProtocolInfo)
+		pub.GET("/protocol/schemas/:name", ProtocolSchema)
 	}
 
+	// Alertmanager webhook (bearer token). Not behind the auth limiter:
+	// Alertmanager batches and retries, and must not use up the login
+	// budget of its address.
+	r.POST("/api/v1/alerts/alertmanager", alertmanagerHandler.Webhook)
+
 	// Protected routes — all authenticated users (including viewer) can read
 	api := r.Group("/api/v1")
 	api.Use(middleware.JWTAuth(cfg.JWTSecret))
@@ -72,25 +107,57 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 		api.GET("/devices", deviceHandler.List)
 		api.GET("/devices/:id", deviceHandler.Get)
 		api.GET("/devices/:id/metrics", deviceHandler.Metrics)
+		api.GET("/devices/:id/metrics/:kind", deviceHandler.DetailMetrics)
+		api.GET("/devices/:id/system-info", deviceHandler.SystemInfo)
+		api.POST("/devices/:id/ping", deviceHandler.Ping)
+		api.GET("/devices/:id/diagnostics", diagnosticHandler.List)
+		api.GET("/devices/:id/diagnostics/:diag_id", diagnosticHandler.Get)
+		api.GET("/devices/:id/logs", logHandler.DeviceLogs)
+		api.POST("/devices/:id/logs/fetch", logHandler.Fetch)
+		api.GET("/logs", logHandler.Search)
+		api.GET("/devices/:id/tunnel", tunnelHandler.Status)
+		api.GET("/tunnels", tunnelHandler.List)
+		api.GET("/tunnel-sessions", tunnelHandler.ListSessions)
 		api.GET("/devices/:id/config/history", configHandler.ConfigHistory)
+		api.GET("/devices/:id/config/validate", configHandler.ValidateConfig)
 		api.GET("/templates", configHandler.ListTemplates)
 		api.GET("/firewall/zones", firewallHandler.ListZones)
 		api.GET("/firewall/rules", firewallHandler.ListRules)
+		api.GET("/firewall/preview/:device_id", firewallHandler.PreviewFirewall)
 		api.GET("/vpn/interfaces", vpnHandler.ListInterfaces)
 		api.GET("/vpn/peers", vpnHandler.ListPeers)
+		api.GET("/vpn/key-rotations/:id", vpnHandler.GetKeyRotation)
+		api.GET("/vpn/preview/:device_id", vpnHandler.PreviewVPN)
+		api.GET("/vpn/networks", vpnHandler.ListNetworks)
+		api.GET("/vpn/networks/:id", vpnHandler.GetNetwork)
 		api.GET("/firmware", firmwareHandler.List)
 		api.GET("/firmware/download/:filename", firmwareHandler.Download)
 		api.GET("/firmware/upgrades", firmwareHandler.UpgradeHistory)
 		api.GET("/network/wan", networkHandler.ListWANInterfaces)
 		api.GET("/network/mwan/policies", networkHandler.ListMWANPolicies)
 		api.GET("/network/mwan/rules", networkHandler.ListMWANRules)
+		api.GET("/network/mwan/preview/:device_id", networkHandler.PreviewMWAN)
 		api.GET("/network/dhcp/pools", networkHandler.ListDHCPPools)
 		api.GET("/network/dhcp/leases", networkHandler.ListStaticLeases)
+		api.GET("/network/dhcp/preview/:device_id", networkHandler.PreviewDHCP)
 		api.GET("/network/vlans", networkHandler.ListVLANs)
+		api.GET("/network/vlans/preview/:device_id", networkHandler.PreviewVLAN)
+		api.GET("/ipam/pools", ipamHandler.ListPools)
+		api.GET("/ipam/allocations", ipamHandler.ListAllocations)
+		api.GET("/ipam/utilization", ipamHandler.Utilization)
+		api.GET("/ipam/overlaps", ipamHandler.Overlaps)
 		api.GET("/settings", settingHandler.List)
 		api.GET("/settings/:key", settingHandler.Get)
 		api.GET("/alerts", alertHandler.List)
 		api.GET("/alerts/summary", alertHandler.Summary)
+		api.GET("/alerts/silences", alertHandler.ListSilences)
+		api.GET("/alerts/:id/escalations", escalationHandler.AlertEscalations)
+		api.GET("/incidents", incidentHandler.List)
+		api.GET("/incidents/:id", incidentHandler.Get)
+		api.GET("/escalation/policies", escalationHandler.ListPolicies)
+		api.GET("/escalation/channels", escalationHandler.ListChannels)
+		api.GET("/oncall/schedules", escalationHandler.ListSchedules)
+		api.GET("/oncall/schedules/:id/current", escalationHandler.CurrentOnCall)
 		api.GET("/dashboard/summary", deviceHandler.DashboardSummary)
 		api.GET("/devices/export", deviceHandler.Export)
 
@@ -102,6 +169,12 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 			write.PUT("/devices/:id", deviceHandler.Update)
 			write.DELETE("/devices/:id", deviceHandler.Delete)
 			write.POST("/devices/:id/reboot", deviceHandler.Reboot)
+			write.POST("/devices/:id/diagnostics", diagnosticHandler.Run)
+			write.PUT("/devices/:id/logs/forwarding", logHandler.SetForwarding)
+			write.POST("/devices/:id/tunnel", tunnelHandler.Open)
+			write.DELETE("/devices/:id/tunnel", tunnelHandler.Close)
+			write.POST("/devices/:id/tunnel/sessions", tunnelHandler.CreateSession) // port 22 admin only
+			write.DELETE("/tunnel-sessions/:id", tunnelHandler.CloseSession)        // owner or admin
 			write.POST("/devices/bulk/delete", deviceHandler.BulkDelete)
 			write.POST("/devices/bulk/reboot", deviceHandler.BulkReboot)
 
@@ -110,6 +183,7 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 			write.PUT("/templates/:id", configHandler.UpdateTemplate)
 			write.DELETE("/templates/:id", configHandler.DeleteTemplate)
 			write.POST("/devices/:id/config/push", configHandler.PushConfig)
+			write.POST("/devices/:id/config/import", importHandler.Import)
 
 			// Firewall
 			write.POST("/firewall/zones", firewallHandler.CreateZone)
@@ -124,10 +198,18 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 			write.POST("/vpn/interfaces", vpnHandler.CreateInterface)
 			write.PUT("/vpn/interfaces/:id", vpnHandler.UpdateInterface)
 			write.DELETE("/vpn/interfaces/:id", vpnHandler.DeleteInterface)
+			write.POST("/vpn/interfaces/:id/rotate-key", vpnHandler.RotateInterfaceKey)
 			write.POST("/vpn/peers", vpnHandler.CreatePeer)
 			write.PUT("/vpn/peers/:id", vpnHandler.UpdatePeer)
 			write.DELETE("/vpn/peers/:id", vpnHandler.DeletePeer)
 			write.POST("/vpn/apply/:device_id", vpnHandler.ApplyVPN)
+			write.POST("/vpn/networks", vpnHandler.CreateNetwork)
+			write.PUT("/vpn/networks/:id", vpnHandler.UpdateNetwork)
+			write.DELETE("/vpn/networks/:id", vpnHandler.DeleteNetwork)
+			write.POST("/vpn/networks/:id/apply", vpnHandler.ApplyNetwork)
+			write.POST("/vpn/networks/:id/members", vpnHandler.CreateNetworkMember)
+			write.PUT("/vpn/networks/:id/members/:member_id", vpnHandler.UpdateNetworkMember)
+			write.DELETE("/vpn/networks/:id/members/:member_id", vpnHandler.DeleteNetworkMember)
 
 			// Firmware
 			write.POST("/firmware/upload", firmwareHandler.Upload)
@@ -163,6 +245,13 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 			write.DELETE("/network/vlans/:id", networkHandler.DeleteVLAN)
 			write.POST("/network/vlans/apply/:device_id", networkHandler.ApplyVLAN)
 
+			// IPAM
+			write.POST("/ipam/pools", ipamHandler.CreatePool)
+			write.PUT("/ipam/pools/:id", ipamHandler.UpdatePool)
+			write.DELETE("/ipam/pools/:id", ipamHandler.DeletePool)
+			write.POST("/ipam/pools/:id/allocations", ipamHandler.Allocate)
+			write.DELETE("/ipam/allocations/:id", ipamHandler.Release)
+
 			// Settings
 			write.POST("/settings", settingHandler.Upsert)
 			write.POST("/settings/batch", settingHandler.BatchUpsert)
@@ -170,6 +259,21 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 
 			// Alerts
 			write.POST("/alerts/:id/resolve", alertHandler.Resolve)
+			write.POST("/alerts/:id/ack", alertHandler.Acknowledge)
+			write.POST("/alerts/silences", alertHandler.CreateSilence)
+			write.DELETE("/alerts/silences/:id", alertHandler.ExpireSilence)
+			write.POST("/incidents/:id/resolve", incidentHandler.Resolve)
+
+			// Escalation
+			write.POST("/escalation/policies", escalationHandler.CreatePolicy)
+			write.PUT("/escalation/policies/:id", escalationHandler.UpdatePolicy)
+			write.DELETE("/escalation/policies/:id", escalationHandler.DeletePolicy)
+			write.POST("/escalation/channels", escalationHandler.CreateChannel)
+			write.PUT("/escalation/channels/:id", escalationHandler.UpdateChannel)
+			write.DELETE("/escalation/channels/:id", escalationHandler.DeleteChannel)
+			write.POST("/oncall/schedules", escalationHandler.CreateSchedule)
+			write.PUT("/oncall/schedules/:id", escalationHandler.UpdateSchedule)
+			write.DELETE("/oncall/schedules/:id", escalationHandler.DeleteSchedule)
 		}
 
 		// Admin-only routes
@@ -181,6 +285,25 @@ func SetupRouter(db *gorm.DB, mqttClient mqtt.Client, cfg *config.Config, wsHub
 			admin.PUT("/users/:id", authHandler.UpdateUser)
 			admin.DELETE("/users/:id", authHandler.DeleteUser)
 			admin.GET("/audit-logs", authHandler.AuditLogs)
+
+			// Web terminal
+			admin.GET("/devices/:id/ssh-credential", shellHandler.GetCredential)
+			admin.PUT("/devices/:id/ssh-credential", shellHandler.SetCredential)
+			admin.DELETE("/devices/:id/ssh-credential", shellHandler.DeleteCredential)
+			admin.DELETE("/devices/:id/tunnel-key", tunnelHandler.ResetKey)
+			admin.POST("/devices/:id/ssh-credential/deploy-key", sshHandler.DeployKey)
+			admin.DELETE("/devices/:id/ssh-host-key", sshHandler.ResetHostKey)
+			admin.GET("/ssh/public-key", sshHandler.PublicKey)
+			admin.GET("/devices/:id/files", sshHandler.Download)
+			admin.PUT("/devices/:id/files", sshHandler.Upload)
+			admin.GET("/shell-sessions", shellHandler.ListSessions)
+			admin.GET("/shell-sessions/:id/recording", shellHandler.Recording)
+
+			// Agentless onboarding over SSH
+			admin.POST("/onboarding", onboardingHandler.Create)
+			admin.GET("/onboarding", onboardingHandler.List)
+			admin.GET("/onboarding/:id", onboardingHandler.Get)
+			admin.DELETE("/onboarding/:id", onboardingHandler.Cancel)
 		}
 	}
 
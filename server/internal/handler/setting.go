@@ -58,7 +58,11 @@ func (h *SettingHandler) Upsert(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save setting"})
 		return
 	}
-	writeAudit(h.DB, c, "upsert", "setting", fmt.Sprintf("set setting %s=%s", req.Key, req.Value))
+	value := req.Value
+	if model.SecretSettingKeys[req.Key] {
+		value = "[redacted]"
+	}
+	writeAudit(h.DB, c, "upsert", "setting", fmt.Sprintf("set setting %s=%s", req.Key, value))
 	c.JSON(http.StatusOK, item)
 }
 
@@ -0,0 +1,473 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nexusgate/nexusgate/internal/asciicast"
+	"github.com/nexusgate/nexusgate/internal/handler/middleware"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// ShellHandler serves web terminal sessions to devices. Sessions are
+// admin-only, time-limited and recorded in asciicast format for audit.
+type ShellHandler struct {
+	DB            *gorm.DB
+	SSH           *deviceSSH
+	JWTSecret     string
+	RecordingsDir string
+}
+
+var shellUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// shellMessage is a client message on the terminal WebSocket. Binary frames
+// are taken as raw terminal input.
+type shellMessage struct {
+	Type string `json:"type"` // input, resize
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// shellConn serializes writes to the terminal WebSocket.
+type shellConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (s *shellConn) output(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ws.WriteMessage(websocket.BinaryMessage, p)
+}
+
+// status sends a {"type": kind, "message": ...} text frame.
+func (s *shellConn) status(kind, message string, extra ...any) {
+	msg := gin.H{"type": kind, "message": message}
+	for i := 0; i+1 < len(extra); i += 2 {
+		msg[extra[i].(string)] = extra[i+1]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ws.WriteJSON(msg)
+}
+
+func (s *shellConn) close(reason string) {
+	s.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+	s.ws.Close()
+}
+
+// queryClaims authenticates a WebSocket upgrade by its ?token= parameter.
+func queryClaims(c *gin.Context, secret string) (*middleware.Claims, error) {
+	tokenStr := c.Query("token")
+	if tokenStr == "" {
+		return nil, errors.New("missing token query param")
+	}
+	claims := &middleware.Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// settingMinutes reads a positive number of minutes from system settings.
+func settingMinutes(db *gorm.DB, key string, fallback int) time.Duration {
+	var setting model.SystemSetting
+	if err := db.Where("\"key\" = ?", key).First(&setting).Error; err == nil {
+		if v, err := strconv.Atoi(setting.Value); err == nil && v > 0 {
+			fallback = v
+		}
+	}
+	return time.Duration(fallback) * time.Minute
+}
+
+func queryBounded(c *gin.Context, name string, fallback, min, max int) int {
+	v, err := strconv.Atoi(c.Query(name))
+	if err != nil {
+		return fallback
+	}
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Open upgrades to a terminal WebSocket:
+// /ws/devices/:id/shell?token=<jwt>&transport=auto|ssh|tunnel&cols=80&rows=24
+//
+// Client frames are JSON {"type":"input","data":"..."} or
+// {"type":"resize","cols":N,"rows":N} (binary frames are raw input); the
+// server sends terminal output as binary frames and JSON status, warning and
+// error messages as text frames.
+func (h *ShellHandler) Open(c *gin.Context) {
+	claims, err := queryClaims(c, h.JWTSecret)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if claims.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "shell sessions are restricted to admins"})
+		return
+	}
+	c.Set("user_id", claims.UserID)
+	c.Set("username", claims.Username)
+	c.Set("role", claims.Role)
+
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var cred model.DeviceCredential
+	if err := h.DB.Where("device_id = ?", device.ID).First(&cred).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "no SSH credentials stored for this device"})
+		return
+	}
+	transport := strings.ToLower(c.DefaultQuery("transport", "auto"))
+	if err := validateOneOf("transport", transport, []string{"auto", "ssh", "tunnel"}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cols := queryBounded(c, "cols", 80, 20, 500)
+	rows := queryBounded(c, "rows", 24, 5, 200)
+
+	ws, err := shellUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("shell ws upgrade error: %v", err)
+		return
+	}
+	conn := &shellConn{ws: ws}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
+	client, used, err := h.SSH.connect(ctx, device, cred, transport, func(msg string) { conn.status("status", msg) })
+	cancel()
+	if err != nil {
+		writeAudit(h.DB, c, "shell_failed", "device", fmt.Sprintf("device=%s error=%v", device.Name, err))
+		conn.status("error", err.Error())
+		conn.close("connect failed")
+		return
+	}
+	defer client.Close()
+	shell, err := ssh.StartShell(client, "xterm-256color", cols, rows)
+	if err != nil {
+		conn.status("error", err.Error())
+		conn.close("shell failed")
+		return
+	}
+
+	session := model.ShellSession{
+		DeviceID:  device.ID,
+		UserID:    claims.UserID,
+		Username:  claims.Username,
+		Transport: used,
+		ClientIP:  c.ClientIP(),
+		StartedAt: time.Now(),
+	}
+	rec, err := h.record(&session, device, cols, rows)
+	if err != nil {
+		log.Printf("shell recording for device %d: %v", device.ID, err)
+		shell.Close()
+		conn.status("error", "failed to start session recording")
+		conn.close("recording failed")
+		return
+	}
+	writeAudit(h.DB, c, "shell_open", "device",
+		fmt.Sprintf("device=%s session=%d transport=%s", device.Name, session.ID, used))
+
+	limit := settingMinutes(h.DB, "shell_max_minutes", 30)
+	idle := settingMinutes(h.DB, "shell_idle_minutes", 10)
+	conn.status("connected", fmt.Sprintf("connected to %s via %s", device.Name, used),
+		"session_id", session.ID, "expires_at", session.StartedAt.Add(limit))
+
+	reason, bytesOut := runShell(conn, shell, rec, limit, idle)
+	if err := rec.Close(); err != nil {
+		log.Printf("shell recording %s: %v", session.Recording, err)
+	}
+	now := time.Now()
+	h.DB.Model(&session).Updates(map[string]any{"ended_at": &now, "end_reason": reason, "bytes_out": bytesOut})
+	writeAudit(h.DB, c, "shell_close", "device",
+		fmt.Sprintf("device=%s session=%d reason=%s duration=%s", device.Name, session.ID, reason, now.Sub(session.StartedAt).Round(time.Second)))
+}
+
+// record creates the session row and its recording file.
+func (h *ShellHandler) record(session *model.ShellSession, device model.Device, cols, rows int) (*asciicast.Recorder, error) {
+	if err := os.MkdirAll(h.RecordingsDir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := h.DB.Create(session).Error; err != nil {
+		return nil, err
+	}
+	session.Recording = filepath.Join(h.RecordingsDir, fmt.Sprintf("%d-%s.cast", session.ID, session.StartedAt.Format("20060102-150405")))
+	title := fmt.Sprintf("%s (%s) by %s", device.Name, device.MAC, session.Username)
+	rec, err := asciicast.Create(session.Recording, cols, rows, title)
+	if err != nil {
+		return nil, err
+	}
+	h.DB.Model(session).Update("recording", session.Recording)
+	return rec, nil
+}
+
+// runShell relays the terminal until either side closes it or a time limit
+// hits, and returns why it ended with the output byte count. Input is not
+// recorded: it would capture passwords typed at prompts.
+func runShell(conn *shellConn, shell *ssh.Shell, rec *asciicast.Recorder, limit, idle time.Duration) (string, int64) {
+	var (
+		once      sync.Once
+		reason    string
+		bytesOut  atomic.Int64
+		lastInput atomic.Int64
+		done      = make(chan struct{})
+	)
+	end := func(r string) {
+		once.Do(func() {
+			reason = r
+			close(done)
+			shell.Close()
+			conn.close(r)
+		})
+	}
+	lastInput.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := shell.Output.Read(buf)
+			if n > 0 {
+				bytesOut.Add(int64(n))
+				rec.Output(buf[:n])
+				if conn.output(buf[:n]) != nil {
+					end("closed")
+					return
+				}
+			}
+			if err != nil {
+				end("exited")
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		deadline := time.NewTimer(limit)
+		defer deadline.Stop()
+		var warning <-chan time.Time
+		if limit > 2*time.Minute {
+			t := time.NewTimer(limit - time.Minute)
+			defer t.Stop()
+			warning = t.C
+		}
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-warning:
+				conn.status("warning", "session ends in 1 minute")
+			case <-deadline.C:
+				end("time_limit")
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastInput.Load())) > idle {
+					end("idle")
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		kind, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			end("closed")
+			break
+		}
+		lastInput.Store(time.Now().UnixNano())
+		if kind == websocket.BinaryMessage {
+			shell.Input.Write(data)
+			continue
+		}
+		var msg shellMessage
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+		switch msg.Type {
+		case "input":
+			shell.Input.Write([]byte(msg.Data))
+		case "resize":
+			if msg.Cols >= 20 && msg.Cols <= 500 && msg.Rows >= 5 && msg.Rows <= 200 {
+				shell.Resize(msg.Cols, msg.Rows)
+				rec.Resize(msg.Cols, msg.Rows)
+			}
+		}
+	}
+	wg.Wait()
+	return reason, bytesOut.Load()
+}
+
+// GetCredential returns the SSH login of a device without its password.
+func (h *ShellHandler) GetCredential(c *gin.Context) {
+	var cred model.DeviceCredential
+	if err := h.DB.Where("device_id = ?", c.Param("id")).First(&cred).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no SSH credentials stored for this device"})
+		return
+	}
+	c.JSON(http.StatusOK, credentialResponse(cred))
+}
+
+func credentialResponse(cred model.DeviceCredential) gin.H {
+	resp := gin.H{
+		"device_id":    cred.DeviceID,
+		"username":     cred.Username,
+		"port":         cred.Port,
+		"has_password": cred.Password != "",
+		"key_deployed": cred.KeyDeployed,
+		"host_key":     cred.HostKey,
+		"updated_at":   cred.UpdatedAt,
+	}
+	if key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(cred.HostKey)); err == nil {
+		resp["host_key_fingerprint"] = gossh.FingerprintSHA256(key)
+	}
+	return resp
+}
+
+// SetCredential stores the SSH login of a device. An empty password keeps
+// the stored one.
+func (h *ShellHandler) SetCredential(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password"`
+		Port     int    `json:"port"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Port == 0 {
+		req.Port = 22
+	}
+	if err := validatePort("port", strconv.Itoa(req.Port)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cred model.DeviceCredential
+	h.DB.Where("device_id = ?", device.ID).First(&cred)
+	cred.DeviceID = device.ID
+	cred.Username = req.Username
+	cred.Port = req.Port
+	if req.Password != "" {
+		cred.Password = req.Password
+	}
+	if err := h.DB.Save(&cred).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save credentials"})
+		return
+	}
+	h.SSH.forget(device.ID)
+	writeAudit(h.DB, c, "update", "ssh_credential", fmt.Sprintf("device=%s user=%s port=%d", device.Name, cred.Username, cred.Port))
+	c.JSON(http.StatusOK, credentialResponse(cred))
+}
+
+// DeleteCredential removes the SSH login of a device.
+func (h *ShellHandler) DeleteCredential(c *gin.Context) {
+	var cred model.DeviceCredential
+	if err := h.DB.Where("device_id = ?", c.Param("id")).First(&cred).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no SSH credentials stored for this device"})
+		return
+	}
+	h.DB.Delete(&cred)
+	h.SSH.forget(cred.DeviceID)
+	writeAudit(h.DB, c, "delete", "ssh_credential", fmt.Sprintf("device_id=%s", c.Param("id")))
+	c.JSON(http.StatusOK, gin.H{"message": "credentials deleted"})
+}
+
+// ListSessions returns web terminal sessions, newest first. Filter with
+// ?device_id= and ?username=.
+func (h *ShellHandler) ListSessions(c *gin.Context) {
+	query := h.DB.Model(&model.ShellSession{})
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if username := c.Query("username"); username != "" {
+		query = query.Where("username = ?", username)
+	}
+
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	var items []model.ShellSession
+	if err := query.Order("started_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query shell sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items, "total": total, "page": page, "page_size": pageSize})
+}
+
+// Recording serves the asciicast recording of a session for playback.
+func (h *ShellHandler) Recording(c *gin.Context) {
+	var session model.ShellSession
+	if err := h.DB.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "shell session not found"})
+		return
+	}
+	if session.Recording == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session has no recording"})
+		return
+	}
+	if _, err := os.Stat(session.Recording); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "recording file not found"})
+		return
+	}
+	writeAudit(h.DB, c, "view", "shell_recording", fmt.Sprintf("session=%d", session.ID))
+	c.Header("Content-Type", asciicast.ContentType)
+	c.File(session.Recording)
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// maxFileTransfer caps uploads to and downloads from devices.
+const maxFileTransfer = 16 << 20
+
+// authorizedKeysPath is where dropbear on OpenWrt reads root's keys.
+const authorizedKeysPath = "/etc/dropbear/authorized_keys"
+
+// SSHHandler manages the server's SSH access to devices: the server key,
+// pinned host keys and file transfers.
+type SSHHandler struct {
+	DB  *gorm.DB
+	SSH *deviceSSH
+}
+
+// sshError maps a connection or transfer error to a response.
+func sshError(c *gin.Context, err error) {
+	var mismatch *ssh.HostKeyMismatchError
+	switch {
+	case errors.Is(err, errNoCredential):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.As(err, &mismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error() + "; reset the pinned host key if the change is expected"})
+	case errors.Is(err, ssh.ErrFileTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds %d bytes", maxFileTransfer)})
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	}
+}
+
+// PublicKey returns the server key devices are given, for baking into
+// firmware images.
+func (h *SSHHandler) PublicKey(c *gin.Context) {
+	key := h.SSH.SSH.Signer.PublicKey()
+	c.JSON(http.StatusOK, gin.H{
+		"public_key":  ssh.AuthorizedKey(key, "nexusgate"),
+		"fingerprint": gossh.FingerprintSHA256(key),
+	})
+}
+
+// DeployKey appends the server key to the device's authorized_keys over the
+// stored login and checks that it logs in. With remove_password the stored
+// password is then dropped, leaving key authentication only.
+func (h *SSHHandler) DeployKey(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var req struct {
+		RemovePassword bool `json:"remove_password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cred, err := h.SSH.credential(device.ID)
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Minute)
+	defer cancel()
+
+	line := ssh.AuthorizedKey(h.SSH.SSH.Signer.PublicKey(), "nexusgate")
+	command := fmt.Sprintf("mkdir -p %[1]s && touch %[2]s && chmod 600 %[2]s && (grep -qxF %[3]s %[2]s || echo %[3]s >> %[2]s)",
+		path.Dir(authorizedKeysPath), authorizedKeysPath, "'"+line+"'")
+	client, release, err := h.SSH.pooled(ctx, device)
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	_, err = ssh.Exec(ctx, client, command, 4096)
+	release()
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+
+	// Log in again with the key alone before relying on it.
+	cred.Password = ""
+	var pinned model.DeviceCredential
+	h.DB.Select("host_key").First(&pinned, cred.ID)
+	cred.HostKey = pinned.HostKey
+	check, _, err := h.SSH.connect(ctx, device, cred, "auto", nil)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("key installed but login with it failed: %v", err)})
+		return
+	}
+	check.Close()
+
+	updates := map[string]any{"key_deployed": true}
+	if req.RemovePassword {
+		updates["password"] = ""
+	}
+	h.DB.Model(&model.DeviceCredential{}).Where("id = ?", cred.ID).Updates(updates)
+	h.SSH.forget(device.ID)
+	writeAudit(h.DB, c, "ssh_key_deploy", "device", fmt.Sprintf("device=%s remove_password=%v", device.Name, req.RemovePassword))
+	c.JSON(http.StatusOK, gin.H{"message": "server key deployed", "password_removed": req.RemovePassword})
+}
+
+// ResetHostKey forgets the pinned host key of a device, e.g. after it was
+// reflashed, so that the next connection pins the new one. Open host key
+// alerts for the device are resolved.
+func (h *SSHHandler) ResetHostKey(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	result := h.DB.Model(&model.DeviceCredential{}).Where("device_id = ?", device.ID).Update("host_key", "")
+	if result.Error != nil || result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no SSH credentials stored for this device"})
+		return
+	}
+	h.SSH.forget(device.ID)
+	var alerts []model.Alert
+	h.DB.Where("device_id = ? AND metric = ? AND source = ? AND resolved = false", device.ID, "ssh_host_key", jobs.AlertSourceSSH).Find(&alerts)
+	jobs.ResolveAlerts(h.DB, h.SSH.Hub, alerts)
+	writeAudit(h.DB, c, "reset_ssh_host_key", "device", fmt.Sprintf("device=%s", device.Name))
+	c.JSON(http.StatusOK, gin.H{"message": "host key reset; the next connection pins the presented key"})
+}
+
+// devicePath validates the ?path= of a file transfer.
+func devicePath(c *gin.Context) (string, bool) {
+	p := c.Query("path")
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\x00\n") || strings.HasSuffix(p, "/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path must be an absolute file path"})
+		return "", false
+	}
+	return path.Clean(p), true
+}
+
+// Download sends a file from the device: GET /devices/:id/files?path=
+func (h *SSHHandler) Download(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	remotePath, ok := devicePath(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+	defer cancel()
+	client, release, err := h.SSH.pooled(ctx, device)
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	defer release()
+
+	// Buffered so that a failed transfer still gets an error response.
+	var buf bytes.Buffer
+	n, proto, err := ssh.Download(ctx, client, remotePath, &buf, maxFileTransfer)
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	writeAudit(h.DB, c, "file_download", "device", fmt.Sprintf("device=%s path=%s bytes=%d protocol=%s", device.Name, remotePath, n, proto))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(remotePath)))
+	c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+}
+
+// Upload writes the request body to a file on the device:
+// PUT /devices/:id/files?path=&mode=0644
+func (h *SSHHandler) Upload(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	remotePath, ok := devicePath(c)
+	if !ok {
+		return
+	}
+	mode, err := strconv.ParseUint(c.DefaultQuery("mode", "0644"), 8, 32)
+	if err != nil || mode > 0o777 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be octal permissions, e.g. 0644"})
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxFileTransfer))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds %d bytes", maxFileTransfer)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Minute)
+	defer cancel()
+	client, release, err := h.SSH.pooled(ctx, device)
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	defer release()
+	proto, err := ssh.Upload(ctx, client, remotePath, bytes.NewReader(data), int64(len(data)), os.FileMode(mode))
+	if err != nil {
+		sshError(c, err)
+		return
+	}
+	writeAudit(h.DB, c, "file_upload", "device", fmt.Sprintf("device=%s path=%s bytes=%d mode=%04o protocol=%s", device.Name, remotePath, len(data), mode, proto))
+	c.JSON(http.StatusOK, gin.H{"path": remotePath, "bytes": len(data), "protocol": proto})
+}
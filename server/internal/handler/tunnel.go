@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/nexusgate/nexusgate/internal/tunnel"
+	"gorm.io/gorm"
+)
+
+// TunnelHandler manages the reverse tunnels agents open to the server and
+// the sessions that expose device-local ports through them.
+type TunnelHandler struct {
+	DB      *gorm.DB
+	MQTT    mqtt.Client
+	Tunnels *tunnel.Server
+}
+
+func (h *TunnelHandler) enabled(c *gin.Context) bool {
+	if h.Tunnels == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "reverse tunnel is not enabled on this server"})
+		return false
+	}
+	return true
+}
+
+// ResetKey forgets the tunnel key of a device so that the key sent with its
+// next registration is trusted, e.g. after the router was reflashed.
+func (h *TunnelHandler) ResetKey(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if err := h.DB.Model(&device).Update("tunnel_key", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset tunnel key"})
+		return
+	}
+	writeAudit(h.DB, c, "reset_tunnel_key", "device", fmt.Sprintf("device=%s", device.Name))
+	c.JSON(http.StatusOK, gin.H{"message": "tunnel key reset; the next registration sets a new one"})
+}
+
+// List returns the open tunnels.
+func (h *TunnelHandler) List(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": h.Tunnels.Tunnels()})
+}
+
+// Status returns the tunnel of a device and its active sessions.
+func (h *TunnelHandler) Status(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var sessions []model.TunnelSession
+	h.DB.Where("device_id = ? AND status = ?", device.ID, model.TunnelSessionActive).Order("created_at DESC").Find(&sessions)
+
+	resp := gin.H{"connected": false, "supported": protocol.Supports(device, protocol.CapTunnel), "sessions": sessions}
+	if info, ok := h.Tunnels.Tunnel(device.MAC); ok {
+		resp["connected"] = true
+		resp["tunnel"] = info
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Open sends tunnel_open to the device and waits until its tunnel is up.
+func (h *TunnelHandler) Open(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	if err := protocol.Require(device, protocol.CapTunnel); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	if err := h.Tunnels.Open(ctx, h.MQTT, device, 0); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, protocol.ErrUnsupported) {
+			status = http.StatusConflict
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "tunnel_open", "device", fmt.Sprintf("device=%s", device.Name))
+	info, _ := h.Tunnels.Tunnel(device.MAC)
+	c.JSON(http.StatusOK, gin.H{"message": "tunnel open", "tunnel": info})
+}
+
+// Close ends the device's sessions, asks the agent to stop its tunnel
+// client and drops the tunnel connection.
+func (h *TunnelHandler) Close(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	sessions := 0
+	for _, e := range h.Tunnels.Exposures() {
+		if e.MAC == device.MAC {
+			e.Close(tunnel.CloseTunnelClosed)
+			sessions++
+		}
+	}
+	// Older agents only exit dbclient once the connection drops.
+	if err := protocol.PublishCommand(h.MQTT, device, "tunnel_close", nil); err != nil && !errors.Is(err, protocol.ErrUnsupported) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	connected := h.Tunnels.Disconnect(device.MAC)
+	writeAudit(h.DB, c, "tunnel_close", "device", fmt.Sprintf("device=%s sessions=%d", device.Name, sessions))
+	c.JSON(http.StatusOK, gin.H{"message": "tunnel closed", "was_connected": connected, "sessions_closed": sessions})
+}
+
+// CreateSession reserves a server port that relays to a device-local port
+// through the device's tunnel. Only connections from allowed_ip (the
+// caller's address by default) are relayed, until the session expires or is
+// closed. Exposing SSH (port 22) is restricted to admins.
+func (h *TunnelHandler) CreateSession(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var req struct {
+		Port       int    `json:"port" binding:"required"`
+		TTLMinutes int    `json:"ttl_minutes"`
+		AllowedIP  string `json:"allowed_ip"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	allowed := false
+	for _, p := range tunnel.Ports {
+		allowed = allowed || p == req.Port
+	}
+	if !allowed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("port must be one of %v", tunnel.Ports)})
+		return
+	}
+	if role, _ := c.Get("role"); req.Port == 22 && role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "SSH sessions are restricted to admins"})
+		return
+	}
+	if req.AllowedIP == "" {
+		req.AllowedIP = c.ClientIP()
+	}
+	ip := net.ParseIP(req.AllowedIP)
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "allowed_ip must be an IP address"})
+		return
+	}
+	maxTTL := settingMinutes(h.DB, "tunnel_session_max_minutes", 240)
+	ttl := time.Duration(req.TTLMinutes) * time.Minute
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if err := protocol.Require(device, protocol.CapTunnel); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _ := c.Get("user_id")
+	username, _ := c.Get("username")
+	uid, _ := userID.(uint)
+	uname, _ := username.(string)
+	session := model.TunnelSession{
+		DeviceID:   device.ID,
+		UserID:     uid,
+		Username:   uname,
+		DevicePort: req.Port,
+		AllowedIP:  ip.String(),
+		Status:     model.TunnelSessionActive,
+		ExpiresAt:  time.Now().Add(ttl),
+	}
+	if err := h.DB.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create tunnel session"})
+		return
+	}
+
+	e, err := h.Tunnels.Expose(tunnel.ExposeOptions{
+		SessionID: session.ID,
+		Device:    device,
+		Port:      req.Port,
+		AllowedIP: session.AllowedIP,
+		TTL:       ttl,
+		Client:    h.MQTT,
+		OnConnect: h.sessionAudit(session, device),
+		OnClose: func(e *tunnel.Exposure, reason string) {
+			conns, in, out := e.Stats()
+			now := time.Now()
+			h.DB.Model(&model.TunnelSession{}).Where("id = ?", e.SessionID).Updates(map[string]any{
+				"status": model.TunnelSessionClosed, "close_reason": reason, "closed_at": &now,
+				"connections": conns, "bytes_in": in, "bytes_out": out,
+			})
+		},
+	})
+	if err != nil {
+		now := time.Now()
+		h.DB.Model(&session).Updates(map[string]any{"status": model.TunnelSessionClosed, "close_reason": "error", "closed_at": &now})
+		status := http.StatusInternalServerError
+		if errors.Is(err, tunnel.ErrNoFreePort) {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	session.ListenPort = e.ListenPort
+	h.DB.Model(&session).Update("listen_port", e.ListenPort)
+
+	// Have the tunnel ready for the first connection.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := h.Tunnels.Open(ctx, h.MQTT, device, req.Port); err != nil {
+			log.Printf("tunnel session %d: %v", session.ID, err)
+		}
+	}()
+
+	writeAudit(h.DB, c, "tunnel_session_create", "device",
+		fmt.Sprintf("device=%s session=%d port=%d listen=%d allowed_ip=%s ttl=%s", device.Name, session.ID, req.Port, e.ListenPort, session.AllowedIP, ttl))
+	c.JSON(http.StatusCreated, gin.H{"data": session, "address": h.sessionAddress(e.ListenPort)})
+}
+
+// sessionAudit records every connection to a session port.
+func (h *TunnelHandler) sessionAudit(session model.TunnelSession, device model.Device) func(*tunnel.Exposure, string, error) {
+	return func(e *tunnel.Exposure, remoteIP string, err error) {
+		action, detail := "tunnel_connect", fmt.Sprintf("device=%s session=%d port=%d", device.Name, session.ID, session.DevicePort)
+		if errors.Is(err, tunnel.ErrNotAllowed) {
+			action = "tunnel_denied"
+		} else if err != nil {
+			detail += " error=" + err.Error()
+		}
+		h.DB.Create(&model.AuditLog{
+			UserID:   session.UserID,
+			Username: session.Username,
+			Action:   action,
+			Resource: "tunnel_session",
+			Detail:   detail,
+			IP:       remoteIP,
+		})
+	}
+}
+
+// sessionAddress is where clients connect: the public tunnel host and the
+// session port.
+func (h *TunnelHandler) sessionAddress(port int) string {
+	host, _, err := net.SplitHostPort(h.Tunnels.PublicAddr())
+	if err != nil {
+		host = h.Tunnels.PublicAddr()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// ListSessions returns tunnel sessions, newest first. Filter with
+// ?device_id= and ?status=.
+func (h *TunnelHandler) ListSessions(c *gin.Context) {
+	query := h.DB.Model(&model.TunnelSession{})
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if v, err := strconv.Atoi(ps); err == nil && v > 0 && v <= 200 {
+			pageSize = v
+		}
+	}
+
+	var total int64
+	query.Count(&total)
+	var items []model.TunnelSession
+	if err := query.Order("created_at DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query tunnel sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": items, "total": total, "page": page, "page_size": pageSize})
+}
+
+// CloseSession ends a session; only its owner or an admin may close it.
+func (h *TunnelHandler) CloseSession(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+	var session model.TunnelSession
+	if err := h.DB.First(&session, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "tunnel session not found"})
+		return
+	}
+	userID, _ := c.Get("user_id")
+	if role, _ := c.Get("role"); role != "admin" && userID != session.UserID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the session owner or an admin can close it"})
+		return
+	}
+	e, ok := h.Tunnels.Exposure(session.ID)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "tunnel session is not active"})
+		return
+	}
+	e.Close(tunnel.CloseRequested)
+	writeAudit(h.DB, c, "tunnel_session_close", "tunnel_session", fmt.Sprintf("session=%d device_id=%d", session.ID, session.DeviceID))
+	c.JSON(http.StatusOK, gin.H{"message": "tunnel session closed"})
+}
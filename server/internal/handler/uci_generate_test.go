@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in ../uci/testdata")
+
+// The generated configs are kept with the uci package's fixtures.
+const uciTestdata = "../uci/testdata"
+
+// TestGenerateUCI renders each generator's package, compares it with its
+// golden file and parses the golden file back into the same package.
+func TestGenerateUCI(t *testing.T) {
+	tests := []struct {
+		golden string
+		pkg    *uci.Package
+	}{
+		{"firewall.golden", generateFirewallUCI(
+			[]model.FirewallZone{
+				{Name: "lan", Input: "ACCEPT", Output: "ACCEPT", Forward: "ACCEPT", Networks: "lan, guest,"},
+				{Name: "wan", Input: "REJECT", Output: "ACCEPT", Forward: "REJECT", Masq: true, Networks: "wan,wan6"},
+				{Name: "iot-zone", Input: "DROP", Output: "ACCEPT", Forward: "DROP"},
+			},
+			[]model.FirewallRule{
+				{Name: "Allow-SSH", Src: "wan", Proto: "tcp", DestPort: "22", Target: "ACCEPT"},
+				{Name: "block_printer", Src: "lan", Dest: "wan", Proto: "any", SrcIP: "192.168.1.50", Target: "REJECT"},
+				{Name: "Bob's $HOME `rule`", Src: "wan", Dest: "lan", Proto: "tcp udp", DestIP: "192.168.1.10", DestPort: "80 443", Target: "ACCEPT"},
+			})},
+		{"wireguard.golden", generateWireGuardUCI(
+			[]model.WireGuardInterface{
+				{ID: 1, Name: "wg0", PrivateKey: "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=", Address: "10.99.0.1/24", ListenPort: 51820},
+				{ID: 2, Name: "wg1", PrivateKey: "+Cf0dZpl5SYRbSXdM6jHQg2Zz9sdkVvM8jMgc/IUv1Q=", Address: "fd00:99::1/64", ListenPort: 51821},
+			},
+			[]model.WireGuardPeer{
+				{InterfaceID: 1, Description: "Alice's laptop", PublicKey: "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", PresharedKey: "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE=",
+					AllowedIPs: "10.99.0.2/32, 192.168.10.0/24", Endpoint: "alice.example.com:51820", Keepalive: 25},
+				{InterfaceID: 1, PublicKey: "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=", AllowedIPs: "10.99.0.3/32", Endpoint: "[2001:db8::1]:51820"},
+				{InterfaceID: 2, Description: `branch "7"`, PublicKey: "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA=", AllowedIPs: "fd00:99::2/128", Endpoint: "vpn.example.com"},
+				{InterfaceID: 3, PublicKey: "orphan", AllowedIPs: "10.0.0.0/8"},
+			})},
+		{"dhcp.golden", generateDHCPUCI(
+			[]model.DHCPPool{
+				{Interface: "lan", Start: 100, Limit: 150, LeaseTime: "12h", DNS: "1.1.1.1, 8.8.8.8,", Gateway: "192.168.1.1"},
+				{Interface: "guest", Start: 10, Limit: 50, LeaseTime: "1h"},
+			},
+			[]model.StaticLease{
+				{Name: "printer", MAC: "00:11:22:33:44:55", IP: "192.168.1.50"},
+				{Name: "Bob's NAS", MAC: "00:11:22:33:44:66", IP: "192.168.1.60"},
+			})},
+		{"vlan.golden", generateVLANUCI([]model.VLAN{
+			{VID: 10, Name: "office", IPAddr: "10.0.10.1", Netmask: "255.255.255.0"},
+			{VID: 20, Name: "guest", Interface: "eth0.20", IPAddr: "10.0.20.1", Netmask: "255.255.255.0", Isolated: true},
+			{VID: 30, Netmask: "255.255.0.0"},
+		})},
+		{"mwan3.golden", generateMWANUCI(
+			[]model.WANInterface{
+				{Name: "wan1", Interface: "eth1", TrackIPs: "8.8.8.8,114.114.114.114", Reliability: 2, Interval: 5, Down: 3, Up: 3},
+				{Name: "wan2", Interface: "pppoe-wan", TrackIPs: " 1.1.1.1 ", Reliability: 1, Interval: 10, Down: 5, Up: 2},
+			},
+			[]model.MWANPolicy{
+				{Name: "balanced", LastResort: "default", Members: `[{"iface":"wan1","metric":1,"weight":3},{"iface":"wan2","metric":1,"weight":2}]`},
+				{Name: "wan1_first", LastResort: "unreachable", Members: `[{"iface":"wan1","metric":1,"weight":3},{"iface":"wan2","metric":2,"weight":1}]`},
+				{Name: "broken", Members: `not json`},
+			},
+			[]model.MWANRule{
+				{Name: "https", DestPort: "443", Proto: "tcp", Policy: "balanced"},
+				{Name: "voip", SrcIP: "192.168.1.20", DestIP: "203.0.113.0/24", SrcPort: "5060", Proto: "udp", Policy: "wan1_first"},
+				{Name: "default_rule", DestIP: "0.0.0.0/0", Proto: "all", Policy: "balanced"},
+			})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			if err := tt.pkg.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			got := tt.pkg.Export()
+			path := filepath.Join(uciTestdata, tt.golden)
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s differs (run go test -update to rewrite it):\ngot:\n%s\nwant:\n%s", path, got, want)
+			}
+
+			pkgs, err := uci.Parse(strings.NewReader(string(want)))
+			if err != nil {
+				t.Fatalf("Parse(%s) error = %v", path, err)
+			}
+			if len(pkgs) != 1 || !reflect.DeepEqual(pkgs[0], tt.pkg) {
+				t.Errorf("Parse(%s) does not give back the generated package:\n%s", path, pkgs[0].Export())
+			}
+			if changes := uci.Diff(tt.pkg, pkgs[0]); len(changes) != 0 {
+				t.Errorf("Diff() after a round trip = %v", changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,712 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
+	"github.com/nexusgate/nexusgate/internal/wgkey"
+)
+
+// importedConfig is a device's existing configuration mapped onto the
+// NexusGate models: the reverse of the generate*UCI functions. Sections
+// and options the models cannot hold are left out and explained in
+// Warnings.
+type importedConfig struct {
+	Zones      []model.FirewallZone
+	Rules      []model.FirewallRule
+	Interfaces []model.WireGuardInterface
+	Peers      map[string][]model.WireGuardPeer // by interface name
+	Pools      []model.DHCPPool
+	Leases     []model.StaticLease
+	VLANs      []model.VLAN
+	WANs       []model.WANInterface
+	Policies   []model.MWANPolicy
+	MWANRules  []model.MWANRule
+	Warnings   []string
+}
+
+// Options read into the models. Firewall rules with other options are
+// skipped, since dropping a match (icmp_type, family, src_port, ...) would
+// widen what they allow; other sections are imported and the remaining
+// options reported.
+var (
+	importedZoneOptions     = []string{"name", "input", "output", "forward", "masq", "mtu_fix", "network"}
+	importedRuleOptions     = []string{"name", "enabled", "src", "dest", "proto", "src_ip", "dest_ip", "dest_port", "target"}
+	importedWGOptions       = []string{"proto", "private_key", "addresses", "listen_port", "disabled"}
+	importedPeerOptions     = []string{"description", "public_key", "preshared_key", "allowed_ips", "endpoint_host", "endpoint_port", "persistent_keepalive", "disabled"}
+	importedVLANOptions     = []string{"proto", "device", "ifname", "ipaddr", "netmask"}
+	importedPoolOptions     = []string{"interface", "start", "limit", "leasetime", "dhcp_option", "ignore"}
+	importedLeaseOptions    = []string{"name", "mac", "ip"}
+	importedWANOptions      = []string{"enabled", "track_ip", "reliability", "interval", "down", "up", "count", "timeout"}
+	importedMWANRuleOptions = []string{"src_ip", "dest_ip", "proto", "src_port", "dest_port", "use_policy", "sticky", "timeout", "family", "logging"}
+)
+
+var (
+	unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+	vlanDevice      = regexp.MustCompile(`^([A-Za-z0-9_-]+)\.(\d+)$`)
+)
+
+// importUCI maps the firewall, network, dhcp and mwan3 packages of a uci
+// export onto records for the device. Packages not in pkgs are skipped.
+func importUCI(deviceID uint, pkgs []*uci.Package) *importedConfig {
+	imp := &importedConfig{Peers: map[string][]model.WireGuardPeer{}}
+	firewall := uci.Find(pkgs, "firewall")
+	network := uci.Find(pkgs, "network")
+	if firewall != nil {
+		imp.firewall(deviceID, firewall)
+	}
+	if network != nil {
+		imp.wireGuard(deviceID, network)
+		imp.vlans(deviceID, network, firewall)
+	}
+	if p := uci.Find(pkgs, "dhcp"); p != nil {
+		imp.dhcp(deviceID, p)
+	}
+	if p := uci.Find(pkgs, "mwan3"); p != nil {
+		imp.mwan(deviceID, p, network)
+	}
+	return imp
+}
+
+func (imp *importedConfig) warn(p *uci.Package, s *uci.Section, format string, args ...any) {
+	imp.Warnings = append(imp.Warnings, p.Path(s)+": "+fmt.Sprintf(format, args...))
+}
+
+// warnExtra reports the options of s that are not imported.
+func (imp *importedConfig) warnExtra(p *uci.Package, s *uci.Section, imported []string) {
+	if extra := extraOptions(s, imported); len(extra) > 0 {
+		imp.warn(p, s, "options not imported: %s", strings.Join(extra, ", "))
+	}
+}
+
+// warnUnmanaged reports the sections of p whose types NexusGate does not
+// manage, once per type.
+func (imp *importedConfig) warnUnmanaged(p *uci.Package, managed ...string) {
+	counts := map[string]int{}
+	var types []string
+	for _, s := range p.Sections {
+		if contains(managed, s.Type) {
+			continue
+		}
+		if counts[s.Type] == 0 {
+			types = append(types, s.Type)
+		}
+		counts[s.Type]++
+	}
+	for _, t := range types {
+		imp.Warnings = append(imp.Warnings, fmt.Sprintf("%s: %d %s section(s) not imported", p.Name, counts[t], t))
+	}
+}
+
+func extraOptions(s *uci.Section, imported []string) []string {
+	var extra []string
+	for _, o := range s.Options {
+		if !contains(imported, o.Name) {
+			extra = append(extra, o.Name)
+		}
+	}
+	return extra
+}
+
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intOption reads an integer option, fallback when it is unset.
+func intOption(s *uci.Section, name string, fallback int) (int, error) {
+	v := s.Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q is not a number", name, v)
+	}
+	return n, nil
+}
+
+// uniqueName turns a section's name option (or its section name) into a
+// record name valid for validateName and unused in taken.
+func uniqueName(name, fallback string, taken map[string]bool) string {
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = fallback
+	}
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d", name, i)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// importPorts joins port lists and turns iptables-style ranges (1000:2000)
+// into the 1000-2000 the models use.
+func importPorts(values []string) string {
+	return strings.ReplaceAll(strings.Join(values, ","), ":", "-")
+}
+
+// validateAddress accepts an IP address with or without a prefix length.
+func validateAddress(field, value string) error {
+	if validateIP(field, value) != nil && validateCIDR(field, value) != nil {
+		return fmt.Errorf("%s is not a valid IP address or CIDR", field)
+	}
+	return nil
+}
+
+// --- firewall ---
+
+func (imp *importedConfig) firewall(deviceID uint, p *uci.Package) {
+	policy := map[string]string{"input": "REJECT", "output": "ACCEPT", "forward": "REJECT"}
+	for _, s := range p.OfType("defaults") {
+		for k := range policy {
+			if v := s.Get(k); v != "" {
+				policy[k] = strings.ToUpper(v)
+			}
+		}
+		if policy["input"] != "REJECT" || policy["output"] != "ACCEPT" || policy["forward"] != "REJECT" {
+			imp.warn(p, s, "default policies input %s, output %s, forward %s are not imported; applying the firewall sets REJECT, ACCEPT, REJECT",
+				policy["input"], policy["output"], policy["forward"])
+		}
+	}
+
+	zones := map[string]bool{}
+	for _, s := range p.OfType("zone") {
+		z := model.FirewallZone{
+			DeviceID: deviceID,
+			Name:     s.Get("name"),
+			Input:    strings.ToUpper(s.Get("input")),
+			Output:   strings.ToUpper(s.Get("output")),
+			Forward:  strings.ToUpper(s.Get("forward")),
+			Masq:     s.Bool("masq", false),
+			Networks: strings.Join(s.Values("network"), ","),
+		}
+		if z.Name == "" {
+			z.Name = s.Name
+		}
+		// Unset zone policies fall back to the defaults section.
+		for field, v := range map[string]*string{"input": &z.Input, "output": &z.Output, "forward": &z.Forward} {
+			if *v == "" {
+				*v = policy[field]
+			}
+		}
+		err := firstError(
+			validateName("name", z.Name),
+			validateOneOf("input", z.Input, firewallTargets),
+			validateOneOf("output", z.Output, firewallTargets),
+			validateOneOf("forward", z.Forward, firewallTargets),
+			validateUCIValue("networks", z.Networks),
+		)
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		if zones[z.Name] {
+			imp.warn(p, s, "skipped: zone %s is defined twice", z.Name)
+			continue
+		}
+		zones[z.Name] = true
+		imp.warnExtra(p, s, importedZoneOptions)
+		imp.Zones = append(imp.Zones, z)
+	}
+
+	names := map[string]bool{}
+	for i, s := range p.OfType("rule") {
+		if extra := extraOptions(s, importedRuleOptions); len(extra) > 0 {
+			imp.warn(p, s, "skipped: %s not supported", strings.Join(extra, ", "))
+			continue
+		}
+		r := model.FirewallRule{
+			DeviceID: deviceID,
+			Src:      s.Get("src"),
+			Dest:     s.Get("dest"),
+			Proto:    importFirewallProto(s.Values("proto")),
+			DestPort: importPorts(s.Values("dest_port")),
+			Target:   strings.ToUpper(s.Get("target")),
+			Enabled:  s.Bool("enabled", true),
+		}
+		if r.Target == "" {
+			r.Target = "ACCEPT"
+		}
+		srcIPs, destIPs := s.Values("src_ip"), s.Values("dest_ip")
+		if len(srcIPs) > 1 || len(destIPs) > 1 {
+			imp.warn(p, s, "skipped: several src_ip or dest_ip not supported")
+			continue
+		}
+		r.SrcIP = strings.Join(srcIPs, "")
+		r.DestIP = strings.Join(destIPs, "")
+		err := firstError(
+			validateUCIValue("src", r.Src), validateUCIValue("dest", r.Dest),
+			validateUCIValue("src_ip", r.SrcIP), validateUCIValue("dest_ip", r.DestIP),
+			validateOneOf("target", r.Target, firewallTargets),
+			validateOneOf("proto", r.Proto, firewallProtos),
+			validatePort("dest_port", r.DestPort),
+		)
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		fallback := s.Name
+		if fallback == "" {
+			fallback = fmt.Sprintf("rule_%d", i)
+		}
+		r.Name = uniqueName(s.Get("name"), fallback, names)
+		r.Position = len(imp.Rules)
+		imp.Rules = append(imp.Rules, r)
+	}
+
+	imp.warnUnmanaged(p, "defaults", "zone", "rule")
+}
+
+// importFirewallProto maps fw3/fw4 protocols onto firewallProtos; unset
+// means tcp and udp.
+func importFirewallProto(values []string) string {
+	for i, v := range values {
+		values[i] = strings.ToLower(v)
+	}
+	switch strings.Join(values, " ") {
+	case "", "tcpudp", "tcp udp", "udp tcp":
+		return "tcp udp"
+	case "all":
+		return "any"
+	}
+	return strings.Join(values, " ")
+}
+
+// --- network: WireGuard ---
+
+func (imp *importedConfig) wireGuard(deviceID uint, p *uci.Package) {
+	for _, s := range p.OfType("interface") {
+		if s.Get("proto") != "wireguard" || s.Name == "" {
+			continue
+		}
+		iface := model.WireGuardInterface{
+			DeviceID:   deviceID,
+			Name:       s.Name,
+			PrivateKey: s.Get("private_key"),
+			Enabled:    !s.Bool("disabled", false),
+		}
+		pub, err := wgkey.PublicKeyOf(iface.PrivateKey)
+		if err != nil {
+			imp.warn(p, s, "skipped: private_key: %v", err)
+			continue
+		}
+		iface.PublicKey = pub
+		addrs := s.Values("addresses")
+		if len(addrs) > 0 {
+			iface.Address = addrs[0]
+		}
+		if len(addrs) > 1 {
+			imp.warn(p, s, "only the first of %d addresses imported", len(addrs))
+		}
+		iface.ListenPort, err = intOption(s, "listen_port", 51820)
+		if err == nil && (iface.ListenPort < 1 || iface.ListenPort > 65535) {
+			err = errors.New("listen_port out of range")
+		}
+		if err == nil {
+			err = firstError(validateName("name", iface.Name), validateAddress("address", iface.Address))
+		}
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		imp.warnExtra(p, s, importedWGOptions)
+		imp.Interfaces = append(imp.Interfaces, iface)
+		imp.wireGuardPeers(p, iface)
+	}
+}
+
+func (imp *importedConfig) wireGuardPeers(p *uci.Package, iface model.WireGuardInterface) {
+	keys := map[string]bool{}
+	for _, s := range p.OfType("wireguard_" + iface.Name) {
+		peer := model.WireGuardPeer{
+			Description:  s.Get("description"),
+			PublicKey:    s.Get("public_key"),
+			PresharedKey: s.Get("preshared_key"),
+			AllowedIPs:   strings.Join(s.Values("allowed_ips"), ","),
+			Endpoint:     s.Get("endpoint_host"),
+			Enabled:      !s.Bool("disabled", false),
+		}
+		if port := s.Get("endpoint_port"); port != "" && peer.Endpoint != "" {
+			peer.Endpoint = net.JoinHostPort(peer.Endpoint, port)
+		}
+		var err error
+		peer.Keepalive, err = intOption(s, "persistent_keepalive", 0)
+		if err == nil {
+			_, err = wgkey.Parse(peer.PublicKey)
+		}
+		if err == nil && peer.PresharedKey != "" {
+			_, err = wgkey.Parse(peer.PresharedKey)
+		}
+		if err == nil {
+			for _, a := range s.Values("allowed_ips") {
+				if err = validateAddress("allowed_ips", a); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = firstError(validateUCIValue("description", peer.Description), validateUCIValue("endpoint", peer.Endpoint))
+		}
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		if keys[peer.PublicKey] {
+			imp.warn(p, s, "skipped: peer %s is defined twice", peer.PublicKey)
+			continue
+		}
+		if peer.PublicKey == iface.PublicKey {
+			imp.warn(p, s, "skipped: peer has the interface's own key")
+			continue
+		}
+		keys[peer.PublicKey] = true
+		imp.warnExtra(p, s, importedPeerOptions)
+		imp.Peers[iface.Name] = append(imp.Peers[iface.Name], peer)
+	}
+}
+
+// --- network: VLANs ---
+
+// vlans imports the interfaces on an 802.1Q device (br-lan.10, eth0.20). A
+// VLAN is isolated when a firewall zone covering its interface rejects or
+// drops forwarded traffic.
+func (imp *importedConfig) vlans(deviceID uint, p, firewall *uci.Package) {
+	closed := map[string]bool{}
+	for _, zp := range []*uci.Package{firewall, p} {
+		if zp == nil {
+			continue
+		}
+		for _, z := range zp.OfType("zone") {
+			if f := strings.ToUpper(z.Get("forward")); f == "REJECT" || f == "DROP" {
+				for _, n := range z.Values("network") {
+					closed[n] = true
+				}
+			}
+		}
+	}
+
+	vids := map[int]bool{}
+	for _, s := range p.OfType("interface") {
+		dev := s.Get("device")
+		if dev == "" {
+			dev = s.Get("ifname")
+		}
+		m := vlanDevice.FindStringSubmatch(dev)
+		if m == nil || s.Name == "" || s.Get("proto") == "wireguard" {
+			continue
+		}
+		vid, _ := strconv.Atoi(m[2])
+		v := model.VLAN{
+			DeviceID:  deviceID,
+			VID:       vid,
+			Name:      s.Name,
+			Interface: dev,
+			Netmask:   s.Get("netmask"),
+			Isolated:  closed[s.Name],
+		}
+		if proto := s.Get("proto"); proto != "" && proto != "static" && proto != "none" {
+			imp.warn(p, s, "proto %s not imported; applying VLANs sets static", proto)
+		}
+		if addrs := s.Values("ipaddr"); len(addrs) > 0 {
+			v.IPAddr = addrs[0]
+			if len(addrs) > 1 {
+				imp.warn(p, s, "only the first of %d addresses imported", len(addrs))
+			}
+		}
+		// ipaddr may carry the prefix length in place of a netmask.
+		if prefix, err := netip.ParsePrefix(v.IPAddr); err == nil && prefix.Addr().Is4() {
+			v.IPAddr = prefix.Addr().String()
+			v.Netmask = net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+		}
+		if v.Netmask == "" {
+			v.Netmask = "255.255.255.0"
+		}
+		var err error
+		if vid < 1 || vid > 4094 {
+			err = errors.New("VLAN ID must be 1-4094")
+		}
+		if err == nil {
+			err = firstError(validateUCIValue("name", v.Name), validateUCIValue("interface", v.Interface),
+				validateIP("ip_addr", v.IPAddr), validateIP("netmask", v.Netmask))
+		}
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		if vids[vid] {
+			imp.warn(p, s, "skipped: VLAN %d is used by another interface", vid)
+			continue
+		}
+		vids[vid] = true
+		imp.warnExtra(p, s, importedVLANOptions)
+		imp.VLANs = append(imp.VLANs, v)
+	}
+
+	for _, s := range p.OfType("bridge-vlan") {
+		vid, _ := strconv.Atoi(s.Get("vlan"))
+		ports := strings.Join(s.Values("ports"), " ")
+		switch {
+		case !vids[vid]:
+			imp.warn(p, s, "VLAN %s has no interface, not imported", s.Get("vlan"))
+		case s.Get("device") != "br-lan" || ports != "lan1:t lan2:t":
+			imp.warn(p, s, "device %s ports %q not imported; applying VLANs tags lan1 and lan2 on br-lan", s.Get("device"), ports)
+		}
+	}
+}
+
+// --- dhcp ---
+
+func (imp *importedConfig) dhcp(deviceID uint, p *uci.Package) {
+	ifaces := map[string]bool{}
+	for _, s := range p.OfType("dhcp") {
+		pool := model.DHCPPool{
+			DeviceID:  deviceID,
+			Interface: s.Get("interface"),
+			LeaseTime: s.Get("leasetime"),
+			Enabled:   !s.Bool("ignore", false),
+		}
+		if pool.Interface == "" {
+			pool.Interface = s.Name
+		}
+		if pool.LeaseTime == "" {
+			pool.LeaseTime = "12h"
+		}
+		var dns, other []string
+		for _, opt := range s.Values("dhcp_option") {
+			code, value, _ := strings.Cut(opt, ",")
+			switch code {
+			case "6", "option:dns-server":
+				dns = append(dns, strings.Split(value, ",")...)
+			case "3", "option:router":
+				pool.Gateway = value
+			default:
+				other = append(other, opt)
+			}
+		}
+		pool.DNS = strings.Join(dns, ",")
+		if len(other) > 0 {
+			imp.warn(p, s, "dhcp_option %s not imported", strings.Join(other, " "))
+		}
+		var err error
+		pool.Start, err = intOption(s, "start", 100)
+		if err == nil {
+			pool.Limit, err = intOption(s, "limit", 150)
+		}
+		if err == nil {
+			err = firstError(validateUCIValue("interface", pool.Interface), validateUCIValue("lease_time", pool.LeaseTime),
+				validateUCIValue("dns", pool.DNS), validateIP("gateway", pool.Gateway))
+		}
+		for _, d := range dns {
+			if err == nil {
+				err = validateIP("dns", d)
+			}
+		}
+		if err == nil && pool.Interface == "" {
+			err = errors.New("interface is required")
+		}
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		if ifaces[pool.Interface] {
+			imp.warn(p, s, "skipped: interface %s has another pool", pool.Interface)
+			continue
+		}
+		ifaces[pool.Interface] = true
+		imp.warnExtra(p, s, importedPoolOptions)
+		imp.Pools = append(imp.Pools, pool)
+	}
+
+	macs := map[string]bool{}
+	for _, s := range p.OfType("host") {
+		ip := s.Get("ip")
+		if len(s.Values("mac")) == 0 || ip == "" || ip == "ignore" {
+			imp.warn(p, s, "skipped: only hosts with a MAC and an IP address are imported")
+			continue
+		}
+		extra := false
+		// A host entry may list several MACs of the same machine.
+		for _, mac := range s.Values("mac") {
+			lease := model.StaticLease{DeviceID: deviceID, Name: s.Get("name"), MAC: mac, IP: ip}
+			if lease.Name == "" {
+				lease.Name = "host-" + strings.ReplaceAll(strings.ToLower(mac), ":", "")
+			}
+			err := firstError(validateMAC("mac", lease.MAC), validateIP("ip", lease.IP), validateUCIValue("name", lease.Name))
+			if err != nil {
+				imp.warn(p, s, "skipped %s: %v", mac, err)
+				continue
+			}
+			if macs[strings.ToLower(mac)] {
+				imp.warn(p, s, "skipped: MAC %s has another lease", mac)
+				continue
+			}
+			macs[strings.ToLower(mac)] = true
+			if !extra {
+				imp.warnExtra(p, s, importedLeaseOptions)
+				extra = true
+			}
+			imp.Leases = append(imp.Leases, lease)
+		}
+	}
+
+	imp.warnUnmanaged(p, "dhcp", "host")
+}
+
+// --- mwan3 ---
+
+func (imp *importedConfig) mwan(deviceID uint, p, network *uci.Package) {
+	members := map[string]mwanMember{}
+	weights := map[string]int{}
+	for _, s := range p.OfType("member") {
+		m := mwanMember{Iface: s.Get("interface")}
+		var err error
+		m.Metric, err = intOption(s, "metric", 1)
+		if err == nil {
+			m.Weight, err = intOption(s, "weight", 1)
+		}
+		if err == nil && (s.Name == "" || m.Iface == "") {
+			err = errors.New("members need a name and an interface")
+		}
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		members[s.Name] = m
+		if _, ok := weights[m.Iface]; !ok {
+			weights[m.Iface] = m.Weight
+		}
+	}
+
+	for _, s := range p.OfType("interface") {
+		w := model.WANInterface{
+			DeviceID:  deviceID,
+			Name:      s.Name,
+			Interface: networkDevice(network, s.Name),
+			Enabled:   s.Bool("enabled", false),
+			Weight:    weights[s.Name],
+			TrackIPs:  strings.Join(s.Values("track_ip"), ","),
+		}
+		if w.Weight == 0 {
+			w.Weight = 1
+		}
+		// mwan3's defaults for unset options.
+		var errs []error
+		for _, o := range []struct {
+			name     string
+			v        *int
+			fallback int
+		}{{"reliability", &w.Reliability, 1}, {"interval", &w.Interval, 5}, {"down", &w.Down, 3}, {"up", &w.Up, 3}} {
+			var err error
+			*o.v, err = intOption(s, o.name, o.fallback)
+			errs = append(errs, err)
+		}
+		errs = append(errs, validateName("name", w.Name), validateUCIValue("interface", w.Interface), validateUCIValue("track_ips", w.TrackIPs))
+		if err := firstError(errs...); err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		imp.warnExtra(p, s, importedWANOptions)
+		imp.WANs = append(imp.WANs, w)
+	}
+
+	for _, s := range p.OfType("policy") {
+		policy := model.MWANPolicy{DeviceID: deviceID, Name: s.Name, LastResort: s.Get("last_resort")}
+		if policy.LastResort == "" {
+			policy.LastResort = "unreachable"
+		}
+		used := []mwanMember{}
+		for _, name := range s.Values("use_member") {
+			m, ok := members[name]
+			if !ok {
+				imp.warn(p, s, "member %s not found, left out", name)
+				continue
+			}
+			used = append(used, m)
+		}
+		data, _ := json.Marshal(used)
+		policy.Members = string(data)
+		if err := firstError(validateName("name", policy.Name),
+			validateOneOf("last_resort", policy.LastResort, []string{"default", "unreachable", "blackhole"})); err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		imp.warnExtra(p, s, []string{"use_member", "last_resort"})
+		imp.Policies = append(imp.Policies, policy)
+	}
+
+	names := map[string]bool{}
+	for i, s := range p.OfType("rule") {
+		if s.Has("ipset") {
+			imp.warn(p, s, "skipped: ipset not supported")
+			continue
+		}
+		r := model.MWANRule{
+			DeviceID: deviceID,
+			SrcIP:    s.Get("src_ip"),
+			DestIP:   s.Get("dest_ip"),
+			Proto:    strings.ToLower(s.Get("proto")),
+			SrcPort:  importPorts(s.Values("src_port")),
+			DestPort: importPorts(s.Values("dest_port")),
+			Policy:   s.Get("use_policy"),
+			Enabled:  true,
+		}
+		if r.Proto == "" {
+			r.Proto = "all"
+		}
+		err := firstError(
+			validateUCIValue("src_ip", r.SrcIP), validateUCIValue("dest_ip", r.DestIP),
+			validateOneOf("proto", r.Proto, mwanProtos),
+			validatePort("src_port", r.SrcPort), validatePort("dest_port", r.DestPort),
+			validateName("policy", r.Policy),
+		)
+		if err != nil {
+			imp.warn(p, s, "skipped: %v", err)
+			continue
+		}
+		r.Name = uniqueName(s.Name, fmt.Sprintf("rule_%d", i), names)
+		r.Position = len(imp.MWANRules)
+		imp.warnExtra(p, s, importedMWANRuleOptions)
+		imp.MWANRules = append(imp.MWANRules, r)
+	}
+
+	imp.warnUnmanaged(p, "member", "interface", "policy", "rule")
+}
+
+// networkDevice returns the device of a network interface, the interface
+// name when the network package does not say.
+func networkDevice(network *uci.Package, name string) string {
+	if network != nil {
+		if s := network.Section(name); s != nil {
+			if dev := s.Get("device"); dev != "" {
+				return dev
+			}
+			if devs := s.Values("ifname"); len(devs) > 0 {
+				return devs[0]
+			}
+		}
+	}
+	return name
+}
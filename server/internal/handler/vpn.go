@@ -1,14 +1,23 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/ipam"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/uci"
+	"github.com/nexusgate/nexusgate/internal/wgkey"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type VPNHandler struct {
@@ -35,22 +44,52 @@ func (h *VPNHandler) CreateInterface(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	iface.NetworkID = nil
 	if err := validateName("name", iface.Name); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := validateUCIValue("private_key", iface.PrivateKey); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// The server generates the key pair and keeps the only copy of the
+	// private key; clients get the public key for the other end.
+	key, err := wgkey.Generate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	now := time.Now()
+	iface.PrivateKey, iface.PublicKey, iface.KeyRotatedAt = key.String(), key.PublicKey().String(), &now
 	if iface.ListenPort < 1 || iface.ListenPort > 65535 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "listen_port must be 1-65535"})
 		return
 	}
-	if err := h.DB.Create(&iface).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// ?ipam_pool=<id>&prefix_len= numbers the tunnel from an IPAM pool.
+	fromPool := c.Query("ipam_pool") != ""
+	if fromPool && iface.Address != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "address and ipam_pool are mutually exclusive"})
+		return
+	}
+	var alloc model.IPAllocation
+	if !checkedWrite(c, h.DB, []uint{iface.DeviceID}, func(tx *gorm.DB) error {
+		if !fromPool {
+			return tx.Create(&iface).Error
+		}
+		var host netip.Addr
+		var err error
+		alloc, host, err = allocateFor(tx, c, model.IPPoolVPN, iface.DeviceID, "WireGuard "+iface.Name)
+		if err != nil {
+			return err
+		}
+		iface.Address = netip.PrefixFrom(host, netip.MustParsePrefix(alloc.CIDR).Bits()).String()
+		if err := tx.Create(&iface).Error; err != nil {
+			return err
+		}
+		return tx.Model(&alloc).Updates(model.IPAllocation{Resource: "vpn_interface", ResourceID: iface.ID}).Error
+	}) {
 		return
 	}
+	if fromPool {
+		writeAudit(h.DB, c, "create", "ip_allocation", fmt.Sprintf("allocated %s for WireGuard interface %s (id=%d)", alloc.CIDR, iface.Name, alloc.ID))
+	}
 	writeAudit(h.DB, c, "create", "vpn_interface", fmt.Sprintf("created WireGuard interface %s (id=%d)", iface.Name, iface.ID))
 	c.JSON(http.StatusCreated, iface)
 }
@@ -61,12 +100,18 @@ func (h *VPNHandler) UpdateInterface(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "interface not found"})
 		return
 	}
+	if iface.NetworkID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("interface is generated for VPN network %d; change the network instead", *iface.NetworkID)})
+		return
+	}
+	oldDevice, publicKey, rotatedAt := iface.DeviceID, iface.PublicKey, iface.KeyRotatedAt
 	if err := c.ShouldBindJSON(&iface); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.DB.Save(&iface).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Keys change only by rotation.
+	iface.NetworkID, iface.PublicKey, iface.KeyRotatedAt = nil, publicKey, rotatedAt
+	if !checkedWrite(c, h.DB, []uint{oldDevice, iface.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&iface).Error }) {
 		return
 	}
 	writeAudit(h.DB, c, "update", "vpn_interface", fmt.Sprintf("updated WireGuard interface %s (id=%d)", iface.Name, iface.ID))
@@ -74,10 +119,22 @@ func (h *VPNHandler) UpdateInterface(c *gin.Context) {
 }
 
 func (h *VPNHandler) DeleteInterface(c *gin.Context) {
+	var iface model.WireGuardInterface
+	if err := h.DB.First(&iface, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "interface not found"})
+		return
+	}
+	if iface.NetworkID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("interface is generated for VPN network %d; remove the device from the network instead", *iface.NetworkID)})
+		return
+	}
 	err := h.DB.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Where("interface_id = ?", c.Param("id")).Delete(&model.WireGuardPeer{}).Error; err != nil {
 			return err
 		}
+		if err := tx.Where("resource = ? AND resource_id = ?", "vpn_interface", c.Param("id")).Delete(&model.IPAllocation{}).Error; err != nil {
+			return err
+		}
 		return tx.Delete(&model.WireGuardInterface{}, c.Param("id")).Error
 	})
 	if err != nil {
@@ -107,6 +164,7 @@ func (h *VPNHandler) CreatePeer(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	peer.NetworkID = nil
 	for _, v := range []struct{ f, val string }{
 		{"public_key", peer.PublicKey}, {"allowed_ips", peer.AllowedIPs},
 		{"endpoint", peer.Endpoint}, {"description", peer.Description},
@@ -116,12 +174,109 @@ func (h *VPNHandler) CreatePeer(c *gin.Context) {
 			return
 		}
 	}
-	if err := h.DB.Create(&peer).Error; err != nil {
+	if _, err := wgkey.Parse(peer.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "public_key: " + err.Error()})
+		return
+	}
+	psk, ok := generatePresharedKey(c, &peer)
+	if !ok {
+		return
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if c.Query("allocate_address") == "true" {
+			if err := allocatePeerAddress(tx, &peer); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&peer).Error
+	})
+	var serr *statusError
+	switch {
+	case errors.As(err, &serr):
+		c.JSON(serr.status, gin.H{"error": serr.msg})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	writeAudit(h.DB, c, "create", "vpn_peer", fmt.Sprintf("created WireGuard peer %s (id=%d)", peer.Description, peer.ID))
-	c.JSON(http.StatusCreated, peer)
+	c.JSON(http.StatusCreated, peerWithKey{peer, psk})
+}
+
+// peerWithKey shows a peer's preshared key once, when it was generated, to
+// configure the other end of a tunnel the server does not manage.
+type peerWithKey struct {
+	model.WireGuardPeer
+	PresharedKey string `json:"preshared_key,omitempty"`
+}
+
+// generatePresharedKey gives peer a new preshared key when the request asks
+// for one (?generate_psk=true) and returns it. False means a response was
+// written.
+func generatePresharedKey(c *gin.Context, peer *model.WireGuardPeer) (string, bool) {
+	if c.Query("generate_psk") != "true" {
+		return "", true
+	}
+	psk, err := wgkey.GeneratePreshared()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", false
+	}
+	peer.PresharedKey = psk.String()
+	return peer.PresharedKey, true
+}
+
+// allocatePeerAddress gives a peer the next free host address of its
+// interface's tunnel subnet (?allocate_address=true), ahead of the routes
+// it already has in allowed_ips. Taken are the addresses of every device
+// on the tunnel and those the interface's other peers route.
+func allocatePeerAddress(tx *gorm.DB, peer *model.WireGuardPeer) error {
+	// Only the address columns are read: loading whole rows would decrypt
+	// every private and preshared key on the way.
+	var iface model.WireGuardInterface
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "name", "address").First(&iface, peer.InterfaceID).Error; err != nil {
+		return &statusError{http.StatusBadRequest, "interface not found"}
+	}
+	addr, err := netip.ParsePrefix(iface.Address)
+	if err != nil {
+		return &statusError{http.StatusBadRequest, fmt.Sprintf("interface %s has no address in CIDR notation to allocate from", iface.Name)}
+	}
+	subnet := addr.Masked()
+	host := subnet.Addr().BitLen()
+
+	used := []netip.Prefix{netip.PrefixFrom(subnet.Addr(), host)}
+	if subnet.Addr().Is4() {
+		used = append(used, netip.PrefixFrom(ipam.Last(subnet), host))
+	}
+	var addresses, allowed []string
+	if err := tx.Model(&model.WireGuardInterface{}).Pluck("address", &addresses).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&model.WireGuardPeer{}).Where("interface_id = ?", iface.ID).Pluck("allowed_ips", &allowed).Error; err != nil {
+		return err
+	}
+	for _, a := range addresses {
+		if p, err := netip.ParsePrefix(a); err == nil && subnet.Contains(p.Addr()) {
+			used = append(used, netip.PrefixFrom(p.Addr(), host))
+		}
+	}
+	for _, ips := range allowed {
+		for _, s := range strings.Split(ips, ",") {
+			if a, err := netip.ParsePrefix(strings.TrimSpace(s)); err == nil && a.Overlaps(subnet) {
+				used = append(used, a)
+			}
+		}
+	}
+	next, ok := ipam.Next(subnet, host, used)
+	if !ok {
+		return &statusError{http.StatusConflict, fmt.Sprintf("no free address left in %s", subnet)}
+	}
+	if strings.Trim(peer.AllowedIPs, ", ") == "" {
+		peer.AllowedIPs = next.String()
+	} else {
+		peer.AllowedIPs = next.String() + "," + peer.AllowedIPs
+	}
+	return nil
 }
 
 func (h *VPNHandler) UpdatePeer(c *gin.Context) {
@@ -130,20 +285,42 @@ func (h *VPNHandler) UpdatePeer(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
 		return
 	}
+	if peer.NetworkID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("peer is generated for VPN network %d; change the network instead", *peer.NetworkID)})
+		return
+	}
 	if err := c.ShouldBindJSON(&peer); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	peer.NetworkID = nil
+	if _, err := wgkey.Parse(peer.PublicKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "public_key: " + err.Error()})
+		return
+	}
+	psk, ok := generatePresharedKey(c, &peer)
+	if !ok {
+		return
+	}
 	if err := h.DB.Save(&peer).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	writeAudit(h.DB, c, "update", "vpn_peer", fmt.Sprintf("updated WireGuard peer %s (id=%d)", peer.Description, peer.ID))
-	c.JSON(http.StatusOK, peer)
+	c.JSON(http.StatusOK, peerWithKey{peer, psk})
 }
 
 func (h *VPNHandler) DeletePeer(c *gin.Context) {
-	if err := h.DB.Delete(&model.WireGuardPeer{}, c.Param("id")).Error; err != nil {
+	var peer model.WireGuardPeer
+	if err := h.DB.First(&peer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "peer not found"})
+		return
+	}
+	if peer.NetworkID != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("peer is generated for VPN network %d; change the network instead", *peer.NetworkID)})
+		return
+	}
+	if err := h.DB.Delete(&peer).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -161,71 +338,124 @@ func (h *VPNHandler) ApplyVPN(c *gin.Context) {
 		return
 	}
 
-	var ifaces []model.WireGuardInterface
-	h.DB.Where("device_id = ? AND enabled = true", deviceID).Find(&ifaces)
-
-	var allPeers []model.WireGuardPeer
-	for _, iface := range ifaces {
-		var peers []model.WireGuardPeer
-		h.DB.Where("interface_id = ? AND enabled = true", iface.ID).Find(&peers)
-		allPeers = append(allPeers, peers...)
+	record, err := h.applyVPN(device)
+	var verr *validationError
+	var serr *statusError
+	switch {
+	case errors.As(err, &verr):
+		verr.respond(c)
+		return
+	case errors.As(err, &serr) && record.ID != 0:
+		c.JSON(serr.status, gin.H{"error": serr.msg, "config_id": record.ID})
+		return
+	case errors.As(err, &serr):
+		c.JSON(serr.status, gin.H{"error": serr.msg})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	uci := generateWireGuardUCI(ifaces, allPeers)
+	writeAudit(h.DB, c, "apply", "vpn", fmt.Sprintf("applied VPN config to device %s", device.Name))
+	c.JSON(http.StatusOK, gin.H{"message": "vpn config pushed", "config_id": record.ID})
+}
+
+// applyVPN checks, records and publishes the VPN config of device. Errors
+// are a validationError, or a statusError with what ApplyVPN answers; the
+// record is returned once it exists.
+func (h *VPNHandler) applyVPN(device model.Device) (model.DeviceConfig, error) {
+	if err := checkApply(h.DB, device.ID, "vpn"); err != nil {
+		return model.DeviceConfig{}, err
+	}
+	pkg := wireGuardConfig(h.DB, device.ID)
+	if err := pkg.Validate(); err != nil {
+		return model.DeviceConfig{}, &statusError{http.StatusBadRequest, "invalid VPN config: " + err.Error()}
+	}
+	content := pkg.Export()
 
-	record := model.DeviceConfig{DeviceID: device.ID, Content: uci, Status: "pending"}
+	record := model.DeviceConfig{DeviceID: device.ID, Source: "vpn", Content: content, Status: "pending"}
 	if err := h.DB.Create(&record).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config record"})
+		return model.DeviceConfig{}, &statusError{http.StatusInternalServerError, "failed to save config record"}
+	}
+	if err := publishConfig(h.MQTT, device, record.ID, content); err != nil {
+		return record, &statusError{http.StatusServiceUnavailable, "MQTT publish failed: " + err.Error()}
+	}
+	return record, nil
+}
+
+// PreviewVPN renders the config ApplyVPN would push and diffs it against the
+// last one the device applied. Keys are redacted.
+func (h *VPNHandler) PreviewVPN(c *gin.Context) {
+	var device model.Device
+	if err := h.DB.First(&device, c.Param("device_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
 		return
 	}
-	if err := publishConfig(h.MQTT, device.MAC, record.ID, uci); err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MQTT publish failed: " + err.Error(), "config_id": record.ID})
+	preview, err := previewConfig(h.DB, device, "vpn", h.vpnConfig(c.Param("device_id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, preview)
+}
 
-	writeAudit(h.DB, c, "apply", "vpn", fmt.Sprintf("applied VPN config to device %s", device.Name))
-	c.JSON(http.StatusOK, gin.H{"message": "vpn config pushed", "config_id": record.ID})
+// vpnConfig renders a device's enabled WireGuard interfaces and peers.
+func (h *VPNHandler) vpnConfig(deviceID string) *uci.Package {
+	return wireGuardConfig(h.DB, deviceID)
+}
+
+func wireGuardConfig(db *gorm.DB, deviceID any) *uci.Package {
+	var ifaces []model.WireGuardInterface
+	db.Where("device_id = ? AND enabled = true", deviceID).Find(&ifaces)
+
+	var allPeers []model.WireGuardPeer
+	for _, iface := range ifaces {
+		var peers []model.WireGuardPeer
+		db.Where("interface_id = ? AND enabled = true", iface.ID).Find(&peers)
+		allPeers = append(allPeers, peers...)
+	}
+
+	return generateWireGuardUCI(ifaces, allPeers)
 }
 
-func generateWireGuardUCI(ifaces []model.WireGuardInterface, peers []model.WireGuardPeer) string {
-	var b strings.Builder
-	b.WriteString("package network\n\n")
+// generateWireGuardUCI renders the WireGuard interfaces and their peers as
+// sections of the network package.
+func generateWireGuardUCI(ifaces []model.WireGuardInterface, peers []model.WireGuardPeer) *uci.Package {
+	pkg := uci.NewPackage("network")
 
 	for _, iface := range ifaces {
-		b.WriteString(fmt.Sprintf("config interface '%s'\n", iface.Name))
-		b.WriteString("\toption proto 'wireguard'\n")
-		b.WriteString(fmt.Sprintf("\toption private_key '%s'\n", iface.PrivateKey))
-		b.WriteString(fmt.Sprintf("\tlist addresses '%s'\n", iface.Address))
-		b.WriteString(fmt.Sprintf("\toption listen_port '%d'\n", iface.ListenPort))
-		b.WriteString("\n")
+		pkg.Add("interface", iface.Name).
+			Set("proto", "wireguard").
+			Set("private_key", iface.PrivateKey).
+			Append("addresses", iface.Address).
+			Set("listen_port", strconv.Itoa(iface.ListenPort))
 
 		for _, peer := range peers {
 			if peer.InterfaceID != iface.ID {
 				continue
 			}
-			b.WriteString(fmt.Sprintf("config wireguard_%s\n", iface.Name))
+			s := pkg.Add("wireguard_"+iface.Name, "")
 			if peer.Description != "" {
-				b.WriteString(fmt.Sprintf("\toption description '%s'\n", peer.Description))
+				s.Set("description", peer.Description)
 			}
-			b.WriteString(fmt.Sprintf("\toption public_key '%s'\n", peer.PublicKey))
+			s.Set("public_key", peer.PublicKey)
 			if peer.PresharedKey != "" {
-				b.WriteString(fmt.Sprintf("\toption preshared_key '%s'\n", peer.PresharedKey))
-			}
-			for _, cidr := range strings.Split(peer.AllowedIPs, ",") {
-				cidr = strings.TrimSpace(cidr)
-				if cidr != "" {
-					b.WriteString(fmt.Sprintf("\tlist allowed_ips '%s'\n", cidr))
-				}
+				s.Set("preshared_key", peer.PresharedKey)
 			}
+			s.Append("allowed_ips", strings.Split(peer.AllowedIPs, ",")...)
 			if peer.Endpoint != "" {
-				b.WriteString(fmt.Sprintf("\toption endpoint_host '%s'\n", peer.Endpoint))
+				// Endpoints are stored as host:port, netifd wants them apart.
+				if host, port, err := net.SplitHostPort(peer.Endpoint); err == nil {
+					s.Set("endpoint_host", host).Set("endpoint_port", port)
+				} else {
+					s.Set("endpoint_host", peer.Endpoint)
+				}
 			}
 			if peer.Keepalive > 0 {
-				b.WriteString(fmt.Sprintf("\toption persistent_keepalive '%d'\n", peer.Keepalive))
+				s.Set("persistent_keepalive", strconv.Itoa(peer.Keepalive))
 			}
-			b.WriteString("\n")
 		}
 	}
 
-	return b.String()
+	return pkg
 }
@@ -0,0 +1,389 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/wgkey"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// keyRotationAckTimeout bounds how long a key rotation waits for the
+// devices to confirm the new key: the remote devices before it gives up and
+// restores the old one, then the owner.
+const keyRotationAckTimeout = 2 * time.Minute
+
+// RotateInterfaceKey gives an interface a new key pair, moves every managed
+// peer that pointed at the old public key to the new one and re-applies the
+// devices involved in the background (see finishKeyRotation). It answers
+// 202 with the key rotation, which GetKeyRotation reports on until the
+// devices have confirmed or the old key is back. Peers of unmanaged clients
+// cannot follow the change, so an interface with any needs ?force=true.
+// With ?apply=false the keys are only changed in the database.
+func (h *VPNHandler) RotateInterfaceKey(c *gin.Context) {
+	var iface model.WireGuardInterface
+	if err := h.DB.First(&iface, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "interface not found"})
+		return
+	}
+	if c.Query("force") != "true" {
+		external, err := externalPeers(h.DB, iface)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(external) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": "interface has peers outside NexusGate that would lose the tunnel; retry with force=true",
+				"peers": external,
+			})
+			return
+		}
+	}
+
+	var record *model.WireGuardKeyRotation
+	if c.Query("apply") != "false" {
+		userID, _ := c.Get("user_id")
+		username, _ := c.Get("username")
+		record = &model.WireGuardKeyRotation{}
+		record.UserID, _ = userID.(uint)
+		record.Username, _ = username.(string)
+	}
+	rotation, err := beginKeyRotation(h.DB, &iface, record)
+	if err != nil {
+		var serr *statusError
+		if errors.As(err, &serr) {
+			c.JSON(serr.status, gin.H{"error": serr.msg})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "rotate_key", "vpn_interface", fmt.Sprintf("rotated key of WireGuard interface %s (id=%d)", iface.Name, iface.ID))
+	if record == nil {
+		c.JSON(http.StatusOK, gin.H{"data": iface})
+		return
+	}
+	go h.finishKeyRotation(record, rotation, iface)
+	c.JSON(http.StatusAccepted, gin.H{"data": iface, "rotation": record})
+}
+
+// GetKeyRotation returns a key rotation started by RotateInterfaceKey or
+// the rotation job.
+func (h *VPNHandler) GetKeyRotation(c *gin.Context) {
+	var record model.WireGuardKeyRotation
+	if err := h.DB.First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "key rotation not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": record})
+}
+
+// AbandonKeyRotations fails rotations left running by a previous server
+// process. The database already holds the new key, but the devices may
+// not: re-applying their VPN config brings them in step.
+func AbandonKeyRotations(db *gorm.DB) {
+	now := time.Now()
+	result := db.Model(&model.WireGuardKeyRotation{}).Where("status = ?", model.KeyRotationRunning).
+		Updates(map[string]any{"status": model.KeyRotationFailed, "error_msg": "interrupted by server restart; re-apply the VPN config of the devices", "finished_at": &now})
+	if result.RowsAffected > 0 {
+		log.Printf("key rotation: marked %d interrupted rotation(s) as failed", result.RowsAffected)
+	}
+}
+
+// keyRotation records what rotateInterfaceKey changed, so that the old key
+// can be put back when the remote devices do not take the new one.
+type keyRotation struct {
+	iface  model.WireGuardInterface // key fields before the rotation
+	peers  []model.WireGuardPeer    // changed peers before the rotation
+	remote []uint                   // devices holding a peer of the interface
+	owner  uint
+}
+
+// revert restores the keys saved in r.
+func (r *keyRotation) revert(tx *gorm.DB) error {
+	if err := tx.Model(&model.WireGuardInterface{ID: r.iface.ID}).
+		Select("private_key", "public_key", "key_rotated_at").Updates(&r.iface).Error; err != nil {
+		return err
+	}
+	for i := range r.peers {
+		p := &r.peers[i]
+		if err := tx.Model(&model.WireGuardPeer{ID: p.ID}).Select("public_key", "preshared_key").Updates(p).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateInterfaceKey replaces iface's key pair and updates the peers on
+// other interfaces that reference it. Tunnels with a preshared key get a
+// fresh one on both ends.
+func rotateInterfaceKey(tx *gorm.DB, iface *model.WireGuardInterface) (*keyRotation, error) {
+	key, err := wgkey.Generate()
+	if err != nil {
+		return nil, err
+	}
+	r := &keyRotation{iface: *iface, owner: iface.DeviceID}
+	now := time.Now()
+	iface.PrivateKey = key.String()
+	iface.PublicKey = key.PublicKey().String()
+	iface.KeyRotatedAt = &now
+	if err := tx.Save(iface).Error; err != nil {
+		return nil, err
+	}
+
+	var remote []model.WireGuardPeer
+	if err := tx.Where("public_key = ? AND interface_id <> ?", r.iface.PublicKey, iface.ID).Find(&remote).Error; err != nil {
+		return nil, err
+	}
+	seen := map[uint]bool{iface.DeviceID: true}
+	for _, p := range remote {
+		r.peers = append(r.peers, p)
+		var other model.WireGuardInterface
+		if err := tx.Select("id", "device_id", "public_key").First(&other, p.InterfaceID).Error; err != nil {
+			return nil, err
+		}
+		if p.PresharedKey != "" {
+			psk, err := wgkey.GeneratePreshared()
+			if err != nil {
+				return nil, err
+			}
+			// The counterpart on iface shares the old preshared key.
+			// Preshared keys are sealed, so they are compared here rather
+			// than in SQL.
+			var back model.WireGuardPeer
+			err = tx.Where("interface_id = ? AND public_key = ?", iface.ID, other.PublicKey).First(&back).Error
+			if err == nil && back.PresharedKey == p.PresharedKey {
+				r.peers = append(r.peers, back)
+				back.PresharedKey = psk.String()
+				if err := tx.Save(&back).Error; err != nil {
+					return nil, err
+				}
+			} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, err
+			}
+			p.PresharedKey = psk.String()
+		}
+		p.PublicKey = iface.PublicKey
+		if err := tx.Save(&p).Error; err != nil {
+			return nil, err
+		}
+		if !seen[other.DeviceID] {
+			seen[other.DeviceID] = true
+			r.remote = append(r.remote, other.DeviceID)
+		}
+	}
+	sort.Slice(r.remote, func(i, j int) bool { return r.remote[i] < r.remote[j] })
+	return r, nil
+}
+
+// beginKeyRotation rotates the key of iface, locked against concurrent
+// changes, and records the rotation as running unless record is nil. A
+// second rotation of an interface waits for the first one to finish.
+func beginKeyRotation(db *gorm.DB, iface *model.WireGuardInterface, record *model.WireGuardKeyRotation) (*keyRotation, error) {
+	var r *keyRotation
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(iface, iface.ID).Error; err != nil {
+			return err
+		}
+		var running int64
+		if err := tx.Model(&model.WireGuardKeyRotation{}).
+			Where("interface_id = ? AND status = ?", iface.ID, model.KeyRotationRunning).Count(&running).Error; err != nil {
+			return err
+		}
+		if running > 0 {
+			return &statusError{http.StatusConflict, fmt.Sprintf("a key rotation of interface %s is still running", iface.Name)}
+		}
+		var err error
+		if r, err = rotateInterfaceKey(tx, iface); err != nil {
+			return err
+		}
+		if record == nil {
+			return nil
+		}
+		record.InterfaceID = iface.ID
+		record.Status = model.KeyRotationRunning
+		record.StartedAt = time.Now()
+		return tx.Create(record).Error
+	})
+	return r, err
+}
+
+// finishKeyRotation applies a rotation begun by beginKeyRotation (see
+// applyKeyRotation), waits for the owner to confirm the new key and
+// records the outcome in record. Audit entries go under the user who
+// started the rotation.
+func (h *VPNHandler) finishKeyRotation(record *model.WireGuardKeyRotation, r *keyRotation, iface model.WireGuardInterface) {
+	audit := func(action, resource, detail string) {
+		h.DB.Create(&model.AuditLog{UserID: record.UserID, Username: record.Username, Action: action, Resource: resource, Detail: detail})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyRotationAckTimeout)
+	results, reverted, err := h.applyKeyRotation(ctx, r, func(device model.Device) {
+		audit("apply", "vpn", fmt.Sprintf("applied VPN config to device %s after key rotation of %s", device.Name, iface.Name))
+	})
+	cancel()
+	status := model.KeyRotationApplied
+	switch {
+	case err != nil && reverted:
+		status = model.KeyRotationReverted
+		audit("rotate_key", "vpn_interface", fmt.Sprintf("reverted key rotation of WireGuard interface %s (id=%d): %v", iface.Name, iface.ID, err))
+	case err != nil:
+		status = model.KeyRotationFailed
+	default:
+		// The owner switches last; its tunnels are renegotiating until it
+		// confirms.
+		ctx, cancel := context.WithTimeout(context.Background(), keyRotationAckTimeout)
+		err = waitApplied(ctx, h.DB, results[len(results)-1:])
+		cancel()
+		if err != nil {
+			status = model.KeyRotationFailed
+		}
+	}
+
+	now := time.Now()
+	raw, _ := json.Marshal(results)
+	record.Status, record.Results, record.FinishedAt = status, string(raw), &now
+	if err != nil {
+		record.ErrorMsg = err.Error()
+		log.Printf("key rotation %d: interface %s (id=%d): %v", record.ID, iface.Name, iface.ID, err)
+	}
+	h.DB.Model(record).Select("status", "results", "error_msg", "finished_at").Updates(record)
+}
+
+// applyKeyRotation pushes a rotation to the remote devices and waits until
+// they have all applied it before pushing it to the owner, which only then
+// switches to the new key. If a push fails, a device reports failure or
+// ctx ends first, the old keys are restored and pushed to the remote
+// devices again, and the owner is left untouched; reverted reports whether
+// restoring the keys succeeded.
+func (h *VPNHandler) applyKeyRotation(ctx context.Context, r *keyRotation, audit func(model.Device)) (results []vpnApplyResult, reverted bool, err error) {
+	results = h.applyVPNDevices(r.remote, audit)
+	err = waitApplied(ctx, h.DB, results)
+	if err == nil {
+		return append(results, h.applyVPNDevices([]uint{r.owner}, audit)...), false, nil
+	}
+
+	if rerr := h.DB.Transaction(r.revert); rerr != nil {
+		return results, false, fmt.Errorf("%w; restoring the old key failed: %v", err, rerr)
+	}
+	results = append(results, h.applyVPNDevices(r.remote, func(model.Device) {})...)
+	return results, true, fmt.Errorf("%w; kept the old key", err)
+}
+
+// externalPeers returns the peers of iface whose public key belongs to no
+// managed interface.
+func externalPeers(db *gorm.DB, iface model.WireGuardInterface) ([]model.WireGuardPeer, error) {
+	var peers []model.WireGuardPeer
+	err := db.Where("interface_id = ? AND public_key NOT IN (?)", iface.ID,
+		db.Model(&model.WireGuardInterface{}).Select("public_key")).Find(&peers).Error
+	return peers, err
+}
+
+// StartWireGuardKeyRotation runs a periodic job that rotates the keys of
+// interfaces older than the "vpn_key_rotation_days" system setting (0 or
+// unset disables it). Interfaces are rotated one at a time, and the job
+// waits for the devices to confirm before moving on, so only one tunnel
+// set is renegotiating at once. Interfaces with unmanaged peers are
+// skipped.
+func StartWireGuardKeyRotation(db *gorm.DB, mqttClient mqtt.Client) {
+	h := &VPNHandler{DB: db, MQTT: mqttClient}
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.runKeyRotation()
+		}
+	}()
+	log.Println("WireGuard key rotation started (interval: 1h)")
+}
+
+func (h *VPNHandler) runKeyRotation() {
+	var setting model.SystemSetting
+	if err := h.DB.Where("\"key\" = ?", "vpn_key_rotation_days").First(&setting).Error; err != nil {
+		return
+	}
+	days, err := strconv.Atoi(setting.Value)
+	if err != nil || days <= 0 {
+		return
+	}
+	if h.MQTT == nil || !h.MQTT.IsConnected() {
+		return
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	var due []model.WireGuardInterface
+	h.DB.Where("enabled = true AND COALESCE(key_rotated_at, created_at) < ?", cutoff).Order("id").Find(&due)
+	for _, iface := range due {
+		external, err := externalPeers(h.DB, iface)
+		if err != nil {
+			log.Printf("key rotation: interface %s (id=%d): %v", iface.Name, iface.ID, err)
+			continue
+		}
+		if len(external) > 0 {
+			log.Printf("key rotation: skipping interface %s (id=%d) with %d unmanaged peers", iface.Name, iface.ID, len(external))
+			continue
+		}
+		record := &model.WireGuardKeyRotation{Username: "system"}
+		rotation, err := beginKeyRotation(h.DB, &iface, record)
+		if err != nil {
+			log.Printf("key rotation: interface %s (id=%d): %v", iface.Name, iface.ID, err)
+			continue
+		}
+		writeSystemAudit(h.DB, "rotate_key", "vpn_interface", fmt.Sprintf("rotated key of WireGuard interface %s (id=%d)", iface.Name, iface.ID))
+		h.finishKeyRotation(record, rotation, iface)
+	}
+}
+
+// waitApplied polls until every pushed config has been applied. It fails
+// when a push failed, a device reports failure or rolls back, or ctx ends
+// while a config is still pending.
+func waitApplied(ctx context.Context, db *gorm.DB, results []vpnApplyResult) error {
+	var ids []uint
+	for _, r := range results {
+		if r.Error != "" {
+			return fmt.Errorf("apply to device %d: %s", r.DeviceID, r.Error)
+		}
+		if r.ConfigID != 0 {
+			ids = append(ids, r.ConfigID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		var configs []model.DeviceConfig
+		if err := db.Select("id", "device_id", "status", "error_msg").Where("id IN ?", ids).Find(&configs).Error; err != nil {
+			return err
+		}
+		applied := 0
+		for _, cfg := range configs {
+			switch cfg.Status {
+			case "applied":
+				applied++
+			case "failed", "rolled_back":
+				return fmt.Errorf("device %d reported %s for config %d: %s", cfg.DeviceID, cfg.Status, cfg.ID, cfg.ErrorMsg)
+			}
+		}
+		if applied == len(ids) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d of %d devices did not confirm the new key: %w", len(ids)-applied, len(ids), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
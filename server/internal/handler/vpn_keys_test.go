@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/wgkey"
+	"gorm.io/gorm"
+)
+
+// rollbackTx runs a test inside a transaction that is rolled back at the
+// end.
+func rollbackTx(t *testing.T) *gorm.DB {
+	t.Helper()
+	tx := testDB(t).Begin()
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+func mustCreate(t *testing.T, tx *gorm.DB, value any) {
+	t.Helper()
+	if err := tx.Create(value).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newInterface(t *testing.T, tx *gorm.DB, deviceID uint) model.WireGuardInterface {
+	t.Helper()
+	key, err := wgkey.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iface := model.WireGuardInterface{DeviceID: deviceID, Name: "wg0", PrivateKey: key.String(), PublicKey: key.PublicKey().String(), Address: "10.99.0.1/24"}
+	mustCreate(t, tx, &iface)
+	return iface
+}
+
+func TestRotateInterfaceKeyRevert(t *testing.T) {
+	tx := rollbackTx(t)
+	owner := model.Device{Name: "hub", MAC: "02:4e:47:00:01:01"}
+	remote := model.Device{Name: "branch", MAC: "02:4e:47:00:01:02"}
+	mustCreate(t, tx, &owner)
+	mustCreate(t, tx, &remote)
+	hub := newInterface(t, tx, owner.ID)
+	branch := newInterface(t, tx, remote.ID)
+	psk := "FpCyhws9cxwWoV4xELtfJvjJN+zQVRPISllRWgeopVE="
+	toHub := model.WireGuardPeer{InterfaceID: branch.ID, PublicKey: hub.PublicKey, PresharedKey: psk, AllowedIPs: "10.99.0.1/32"}
+	toBranch := model.WireGuardPeer{InterfaceID: hub.ID, PublicKey: branch.PublicKey, PresharedKey: psk, AllowedIPs: "10.99.0.2/32"}
+	mustCreate(t, tx, &toHub)
+	mustCreate(t, tx, &toBranch)
+
+	rotated := hub
+	r, err := rotateInterfaceKey(tx, &rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.owner != owner.ID || len(r.remote) != 1 || r.remote[0] != remote.ID {
+		t.Errorf("rotation devices = owner %d, remote %v", r.owner, r.remote)
+	}
+	var peer, back model.WireGuardPeer
+	tx.First(&peer, toHub.ID)
+	tx.First(&back, toBranch.ID)
+	if rotated.PublicKey == hub.PublicKey || peer.PublicKey != rotated.PublicKey {
+		t.Errorf("peer public key = %s, want the new key %s", peer.PublicKey, rotated.PublicKey)
+	}
+	if peer.PresharedKey == psk || back.PresharedKey != peer.PresharedKey {
+		t.Errorf("preshared keys after rotation = %s and %s, want a new shared one", peer.PresharedKey, back.PresharedKey)
+	}
+
+	if err := r.revert(tx); err != nil {
+		t.Fatal(err)
+	}
+	var got model.WireGuardInterface
+	tx.First(&got, hub.ID)
+	tx.First(&peer, toHub.ID)
+	tx.First(&back, toBranch.ID)
+	if got.PrivateKey != hub.PrivateKey || got.PublicKey != hub.PublicKey || got.KeyRotatedAt != nil {
+		t.Errorf("interface after revert = %s (rotated %v), want the old key", got.PublicKey, got.KeyRotatedAt)
+	}
+	if peer.PublicKey != hub.PublicKey || peer.PresharedKey != psk || back.PresharedKey != psk {
+		t.Errorf("peers after revert = %s/%s and %s, want the old keys", peer.PublicKey, peer.PresharedKey, back.PresharedKey)
+	}
+}
+
+func TestWaitApplied(t *testing.T) {
+	tx := rollbackTx(t)
+	device := model.Device{Name: "branch", MAC: "02:4e:47:00:01:03"}
+	mustCreate(t, tx, &device)
+	config := func(status string) vpnApplyResult {
+		cfg := model.DeviceConfig{DeviceID: device.ID, Source: "vpn", Content: "{}", Status: status}
+		mustCreate(t, tx, &cfg)
+		return vpnApplyResult{DeviceID: device.ID, ConfigID: cfg.ID}
+	}
+
+	tests := []struct {
+		name    string
+		results []vpnApplyResult
+		wantErr string
+	}{
+		{name: "nothing pushed"},
+		{name: "applied", results: []vpnApplyResult{config("applied"), config("applied")}},
+		{name: "push failed", results: []vpnApplyResult{config("applied"), {DeviceID: device.ID, Error: "device offline"}}, wantErr: "device offline"},
+		{name: "failed", results: []vpnApplyResult{config("applied"), config("failed")}, wantErr: "reported failed"},
+		{name: "rolled back", results: []vpnApplyResult{config("rolled_back")}, wantErr: "reported rolled_back"},
+		{name: "pending", results: []vpnApplyResult{config("applied"), config("pending_confirm")}, wantErr: "1 of 2 devices did not confirm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := waitApplied(ctx, tx, tt.results)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("waitApplied() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("waitApplied() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := waitApplied(ctx, tx, []vpnApplyResult{config("pending")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitApplied() on a timeout = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestBeginKeyRotationRunning(t *testing.T) {
+	tx := rollbackTx(t)
+	owner := model.Device{Name: "hub", MAC: "02:4e:47:00:01:04"}
+	mustCreate(t, tx, &owner)
+	iface := newInterface(t, tx, owner.ID)
+
+	record := &model.WireGuardKeyRotation{Username: "system"}
+	if _, err := beginKeyRotation(tx, &iface, record); err != nil {
+		t.Fatal(err)
+	}
+	if record.ID == 0 || record.InterfaceID != iface.ID || record.Status != model.KeyRotationRunning {
+		t.Errorf("rotation record = %+v, want a running rotation of interface %d", record, iface.ID)
+	}
+	rotated := iface.PublicKey
+	var serr *statusError
+	if _, err := beginKeyRotation(tx, &iface, &model.WireGuardKeyRotation{}); !errors.As(err, &serr) || serr.status != http.StatusConflict {
+		t.Fatalf("second rotation = %v, want 409", err)
+	}
+	if _, err := beginKeyRotation(tx, &iface, nil); !errors.As(err, &serr) {
+		t.Fatalf("rotation without a record = %v, want 409", err)
+	}
+	var got model.WireGuardInterface
+	tx.First(&got, iface.ID)
+	if got.PublicKey != rotated {
+		t.Errorf("refused rotation changed the key to %s", got.PublicKey)
+	}
+
+	tx.Model(record).Update("status", model.KeyRotationApplied)
+	if _, err := beginKeyRotation(tx, &iface, nil); err != nil {
+		t.Errorf("rotation after the first finished = %v", err)
+	}
+}
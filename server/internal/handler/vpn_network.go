@@ -0,0 +1,687 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nexusgate/nexusgate/internal/ipam"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/wgkey"
+	"gorm.io/gorm"
+)
+
+var vpnTopologies = []string{model.VPNTopologyHubSpoke, model.VPNTopologyMesh}
+
+// vpnNetworkDetail is a network with its members.
+type vpnNetworkDetail struct {
+	model.VPNNetwork
+	Members []model.VPNNetworkMember `json:"members"`
+}
+
+// vpnApplyResult is the outcome of re-applying one device after a network
+// change.
+type vpnApplyResult struct {
+	DeviceID   uint   `json:"device_id"`
+	DeviceName string `json:"device_name"`
+	ConfigID   uint   `json:"config_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ==================== Networks ====================
+
+func (h *VPNHandler) ListNetworks(c *gin.Context) {
+	var items []model.VPNNetwork
+	h.DB.Order("name").Limit(500).Find(&items)
+	c.JSON(http.StatusOK, items)
+}
+
+func (h *VPNHandler) GetNetwork(c *gin.Context) {
+	var item vpnNetworkDetail
+	if err := h.DB.First(&item.VPNNetwork, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	item.Members = vpnMembers(h.DB, item.ID)
+	c.JSON(http.StatusOK, item)
+}
+
+func (h *VPNHandler) CreateNetwork(c *gin.Context) {
+	var item model.VPNNetwork
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateVPNNetwork(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	writeAudit(h.DB, c, "create", "vpn_network", fmt.Sprintf("created VPN network %s %s (id=%d)", item.Name, item.Subnet, item.ID))
+	c.JSON(http.StatusCreated, item)
+}
+
+func (h *VPNHandler) UpdateNetwork(c *gin.Context) {
+	var item model.VPNNetwork
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	id := item.ID
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	item.ID = id
+	if err := validateVPNNetwork(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applied, ok := h.changeNetwork(c, item.ID, nil, func(tx *gorm.DB) error { return tx.Save(&item).Error })
+	if !ok {
+		return
+	}
+	writeAudit(h.DB, c, "update", "vpn_network", fmt.Sprintf("updated VPN network %s %s (id=%d)", item.Name, item.Subnet, item.ID))
+	c.JSON(http.StatusOK, gin.H{"data": item, "applied": applied})
+}
+
+// DeleteNetwork removes the network with the interfaces and peers it
+// generated, and re-applies its former members.
+func (h *VPNHandler) DeleteNetwork(c *gin.Context) {
+	var item model.VPNNetwork
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	applied, ok := h.changeNetwork(c, item.ID, nil, func(tx *gorm.DB) error {
+		if err := tx.Where("network_id = ?", item.ID).Delete(&model.VPNNetworkMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&item).Error
+	})
+	if !ok {
+		return
+	}
+	writeAudit(h.DB, c, "delete", "vpn_network", fmt.Sprintf("deleted VPN network %s (id=%d)", item.Name, item.ID))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted", "applied": applied})
+}
+
+// ApplyNetwork pushes the VPN config of every member, the hub first.
+func (h *VPNHandler) ApplyNetwork(c *gin.Context) {
+	var item model.VPNNetwork
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	var devices []uint
+	for _, m := range vpnMembers(h.DB, item.ID) {
+		devices = append(devices, m.DeviceID)
+	}
+	c.JSON(http.StatusOK, gin.H{"applied": h.applyVPNDevices(devices, networkApplyAudit(h.DB, c, item.Name))})
+}
+
+// ==================== Members ====================
+
+func (h *VPNHandler) CreateNetworkMember(c *gin.Context) {
+	var network model.VPNNetwork
+	if err := h.DB.First(&network, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	var item model.VPNNetworkMember
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	item.NetworkID = network.ID
+	if status, err := validateVPNMember(h.DB, network, &item); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	applied, ok := h.changeNetwork(c, network.ID, []uint{item.DeviceID}, func(tx *gorm.DB) error { return tx.Create(&item).Error })
+	if !ok {
+		return
+	}
+	h.DB.First(&item, item.ID) // the address may have been assigned
+	writeAudit(h.DB, c, "create", "vpn_network_member", fmt.Sprintf("added device %d to VPN network %s as %s (id=%d)", item.DeviceID, network.Name, item.Role, item.ID))
+	c.JSON(http.StatusCreated, gin.H{"data": item, "applied": applied})
+}
+
+func (h *VPNHandler) UpdateNetworkMember(c *gin.Context) {
+	var network model.VPNNetwork
+	if err := h.DB.First(&network, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	var item model.VPNNetworkMember
+	if err := h.DB.Where("network_id = ?", network.ID).First(&item, c.Param("member_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+		return
+	}
+	id, oldDevice := item.ID, item.DeviceID
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	item.ID, item.NetworkID = id, network.ID
+	if status, err := validateVPNMember(h.DB, network, &item); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	applied, ok := h.changeNetwork(c, network.ID, []uint{oldDevice, item.DeviceID}, func(tx *gorm.DB) error { return tx.Save(&item).Error })
+	if !ok {
+		return
+	}
+	h.DB.First(&item, item.ID)
+	writeAudit(h.DB, c, "update", "vpn_network_member", fmt.Sprintf("updated device %d in VPN network %s (id=%d)", item.DeviceID, network.Name, item.ID))
+	c.JSON(http.StatusOK, gin.H{"data": item, "applied": applied})
+}
+
+func (h *VPNHandler) DeleteNetworkMember(c *gin.Context) {
+	var network model.VPNNetwork
+	if err := h.DB.First(&network, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "VPN network not found"})
+		return
+	}
+	var item model.VPNNetworkMember
+	if err := h.DB.Where("network_id = ?", network.ID).First(&item, c.Param("member_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "member not found"})
+		return
+	}
+	applied, ok := h.changeNetwork(c, network.ID, nil, func(tx *gorm.DB) error { return tx.Delete(&item).Error })
+	if !ok {
+		return
+	}
+	writeAudit(h.DB, c, "delete", "vpn_network_member", fmt.Sprintf("removed device %d from VPN network %s (id=%d)", item.DeviceID, network.Name, item.ID))
+	c.JSON(http.StatusOK, gin.H{"message": "deleted", "applied": applied})
+}
+
+// ==================== Generation ====================
+
+// changeNetwork runs change and regenerates the network's interfaces and
+// peers in one checked transaction (see checkedWrite) over its members and
+// deviceIDs, the devices change adds. It then re-applies the VPN config of
+// the devices whose config changed, the hub first, unless ?apply=false.
+// False means a response was written.
+func (h *VPNHandler) changeNetwork(c *gin.Context, networkID uint, deviceIDs []uint, change func(tx *gorm.DB) error) ([]vpnApplyResult, bool) {
+	for _, m := range vpnMembers(h.DB, networkID) {
+		deviceIDs = append(deviceIDs, m.DeviceID)
+	}
+	var changed []uint
+	if !checkedWrite(c, h.DB, deviceIDs, func(tx *gorm.DB) error {
+		before := map[uint]string{}
+		for _, id := range deviceIDs {
+			before[id] = wireGuardConfig(tx, id).Export()
+		}
+		if err := change(tx); err != nil {
+			return err
+		}
+		if err := syncVPNNetwork(tx, networkID); err != nil {
+			return err
+		}
+
+		// The hub first, so it is up when the spokes reconnect; devices
+		// that left last.
+		rank := map[uint]int{}
+		for _, m := range vpnMembers(tx, networkID) {
+			rank[m.DeviceID] = 1
+			if m.Role == model.VPNRoleHub {
+				rank[m.DeviceID] = 0
+			}
+		}
+		for id, old := range before {
+			if _, ok := rank[id]; !ok {
+				rank[id] = 2
+			}
+			if wireGuardConfig(tx, id).Export() != old {
+				changed = append(changed, id)
+			}
+		}
+		sort.Slice(changed, func(i, j int) bool {
+			if rank[changed[i]] != rank[changed[j]] {
+				return rank[changed[i]] < rank[changed[j]]
+			}
+			return changed[i] < changed[j]
+		})
+		return nil
+	}) {
+		return nil, false
+	}
+	if c.Query("apply") == "false" {
+		return []vpnApplyResult{}, true
+	}
+	var network model.VPNNetwork
+	h.DB.First(&network, networkID)
+	name := network.Name
+	if name == "" {
+		name = fmt.Sprintf("network %d", networkID)
+	}
+	return h.applyVPNDevices(changed, networkApplyAudit(h.DB, c, name)), true
+}
+
+func networkApplyAudit(db *gorm.DB, c *gin.Context, network string) func(model.Device) {
+	return func(device model.Device) {
+		writeAudit(db, c, "apply", "vpn", fmt.Sprintf("applied VPN config to device %s for VPN network %s", device.Name, network))
+	}
+}
+
+// applyVPNDevices pushes the VPN config of devices in order and audits each
+// push. A device that fails does not stop the others.
+func (h *VPNHandler) applyVPNDevices(deviceIDs []uint, audit func(model.Device)) []vpnApplyResult {
+	results := []vpnApplyResult{}
+	for _, id := range deviceIDs {
+		r := vpnApplyResult{DeviceID: id}
+		var device model.Device
+		if err := h.DB.First(&device, id).Error; err != nil {
+			r.Error = "device not found"
+			results = append(results, r)
+			continue
+		}
+		r.DeviceName = device.Name
+		record, err := h.applyVPN(device)
+		r.ConfigID = record.ID
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			audit(device)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func vpnMembers(db *gorm.DB, networkID uint) []model.VPNNetworkMember {
+	var members []model.VPNNetworkMember
+	db.Where("network_id = ?", networkID).Order("id").Find(&members)
+	// The hub first: it gets the first free address.
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].Role == model.VPNRoleHub && members[j].Role != model.VPNRoleHub
+	})
+	return members
+}
+
+// syncVPNNetwork generates the interfaces and peers of a network from its
+// members: an interface on every member device and, per topology, a peer
+// for every member it has a tunnel to. Generated records carry the
+// network's ID; those of devices that are no longer members, or of a
+// network that is gone, are removed. Peers added by hand to a generated
+// interface are kept.
+func syncVPNNetwork(tx *gorm.DB, networkID uint) error {
+	var network model.VPNNetwork
+	var members []model.VPNNetworkMember
+	if err := tx.First(&network, networkID).Error; err == nil {
+		members = vpnMembers(tx, networkID)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	isMember := map[uint]bool{}
+	var deviceIDs []uint
+	for _, m := range members {
+		isMember[m.DeviceID] = true
+		deviceIDs = append(deviceIDs, m.DeviceID)
+	}
+
+	var existing []model.WireGuardInterface
+	if err := tx.Where("network_id = ?", networkID).Find(&existing).Error; err != nil {
+		return err
+	}
+	ifaces := map[uint]*model.WireGuardInterface{}
+	for i, iface := range existing {
+		if isMember[iface.DeviceID] {
+			ifaces[iface.DeviceID] = &existing[i]
+			continue
+		}
+		// Hard deletes: the unique indexes would still hold soft-deleted
+		// rows when the device rejoins.
+		if err := tx.Unscoped().Where("interface_id = ?", iface.ID).Delete(&model.WireGuardPeer{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&iface).Error; err != nil {
+			return err
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	subnet := netip.MustParsePrefix(network.Subnet)
+	if err := assignVPNAddresses(tx, network, subnet, members); err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		iface := ifaces[m.DeviceID]
+		if iface == nil {
+			key, err := wgkey.Generate()
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			iface = &model.WireGuardInterface{
+				DeviceID: m.DeviceID, PrivateKey: key.String(), PublicKey: key.PublicKey().String(),
+				KeyRotatedAt: &now, NetworkID: &network.ID,
+			}
+			ifaces[m.DeviceID] = iface
+		}
+		var clash int64
+		tx.Model(&model.WireGuardInterface{}).Where("device_id = ? AND name = ? AND id <> ?", m.DeviceID, network.Interface, iface.ID).Count(&clash)
+		if clash > 0 {
+			return &statusError{http.StatusConflict, fmt.Sprintf("device %d already has an interface %s", m.DeviceID, network.Interface)}
+		}
+		iface.Name = network.Interface
+		iface.Address = netip.PrefixFrom(netip.MustParseAddr(m.Address), subnet.Bits()).String()
+		iface.ListenPort = network.ListenPort
+		iface.Enabled = true
+		if err := tx.Save(iface).Error; err != nil {
+			return err
+		}
+	}
+
+	var devices []model.Device
+	tx.Select("id", "name").Where("id IN ?", deviceIDs).Find(&devices)
+	names := map[uint]string{}
+	for _, d := range devices {
+		names[d.ID] = d.Name
+	}
+	psks, err := vpnPairKeys(tx, networkID, ifaces)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		var want []model.WireGuardPeer
+		for _, x := range members {
+			if x.ID == m.ID {
+				continue
+			}
+			var allowed []string
+			switch {
+			case network.Topology == model.VPNTopologyMesh || m.Role == model.VPNRoleHub:
+				addr := netip.MustParseAddr(x.Address)
+				allowed = append([]string{netip.PrefixFrom(addr, addr.BitLen()).String()}, splitRoutes(x.Routes)...)
+			case x.Role == model.VPNRoleHub:
+				// Spokes reach the tunnel and every other site through the hub.
+				allowed = []string{subnet.String()}
+				for _, o := range members {
+					if o.ID != m.ID {
+						allowed = append(allowed, splitRoutes(o.Routes)...)
+					}
+				}
+			default:
+				continue
+			}
+			peer := model.WireGuardPeer{
+				InterfaceID: ifaces[m.DeviceID].ID, NetworkID: &network.ID,
+				Description: fmt.Sprintf("%s: %s", network.Name, names[x.DeviceID]),
+				PublicKey:   ifaces[x.DeviceID].PublicKey,
+				AllowedIPs:  strings.Join(allowed, ","),
+				Endpoint:    x.Endpoint,
+				Enabled:     true,
+			}
+			if x.Endpoint != "" {
+				peer.Keepalive = network.Keepalive
+			}
+			pair := [2]uint{min(m.DeviceID, x.DeviceID), max(m.DeviceID, x.DeviceID)}
+			if psks[pair] == "" {
+				psk, err := wgkey.GeneratePreshared()
+				if err != nil {
+					return err
+				}
+				psks[pair] = psk.String()
+			}
+			peer.PresharedKey = psks[pair]
+			want = append(want, peer)
+		}
+		if err := syncVPNPeers(tx, ifaces[m.DeviceID].ID, network.ID, want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncVPNPeers makes the generated peers of an interface want, matching
+// them by public key.
+func syncVPNPeers(tx *gorm.DB, ifaceID, networkID uint, want []model.WireGuardPeer) error {
+	var have []model.WireGuardPeer
+	if err := tx.Where("interface_id = ? AND network_id = ?", ifaceID, networkID).Find(&have).Error; err != nil {
+		return err
+	}
+	byKey := map[string]model.WireGuardPeer{}
+	for _, p := range have {
+		byKey[p.PublicKey] = p
+	}
+	for _, p := range want {
+		if old, ok := byKey[p.PublicKey]; ok {
+			delete(byKey, p.PublicKey)
+			p.ID, p.CreatedAt = old.ID, old.CreatedAt
+			p.LastHandshake, p.TxBytes, p.RxBytes = old.LastHandshake, old.TxBytes, old.RxBytes
+			if err := tx.Save(&p).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tx.Create(&p).Error; err != nil {
+			return err
+		}
+		// gorm skips zero values with a default on create.
+		if p.Keepalive == 0 {
+			if err := tx.Model(&p).Update("keepalive", 0).Error; err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range byKey {
+		if err := tx.Unscoped().Delete(&p).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vpnPairKeys returns the preshared keys of the tunnels between members
+// that already have one, by the pair of device IDs, lower first. Both
+// peers of a tunnel hold the same key.
+func vpnPairKeys(tx *gorm.DB, networkID uint, ifaces map[uint]*model.WireGuardInterface) (map[[2]uint]string, error) {
+	owner := map[uint]uint{}   // interface ID -> device
+	byKey := map[string]uint{} // public key -> device
+	for device, iface := range ifaces {
+		owner[iface.ID] = device
+		byKey[iface.PublicKey] = device
+	}
+	var peers []model.WireGuardPeer
+	if err := tx.Where("network_id = ? AND preshared_key <> ''", networkID).Find(&peers).Error; err != nil {
+		return nil, err
+	}
+	psks := map[[2]uint]string{}
+	for _, p := range peers {
+		a, ok := owner[p.InterfaceID]
+		b, ok2 := byKey[p.PublicKey]
+		if ok && ok2 {
+			psks[[2]uint{min(a, b), max(a, b)}] = p.PresharedKey
+		}
+	}
+	return psks, nil
+}
+
+// assignVPNAddresses gives members without a tunnel address, or with one
+// outside the subnet after it changed, the next free one, and brings roles
+// in line with the topology.
+func assignVPNAddresses(tx *gorm.DB, network model.VPNNetwork, subnet netip.Prefix, members []model.VPNNetworkMember) error {
+	host := subnet.Addr().BitLen()
+	used := []netip.Prefix{netip.PrefixFrom(subnet.Addr(), host)}
+	if subnet.Addr().Is4() {
+		used = append(used, netip.PrefixFrom(ipam.Last(subnet), host))
+	}
+	valid := make([]bool, len(members))
+	for i, m := range members {
+		if a, err := netip.ParseAddr(m.Address); err == nil && subnet.Contains(a) {
+			valid[i] = true
+			used = append(used, netip.PrefixFrom(a, host))
+		}
+	}
+	for i := range members {
+		m := &members[i]
+		dirty := false
+		if !valid[i] {
+			next, ok := ipam.Next(subnet, host, used)
+			if !ok {
+				return &statusError{http.StatusConflict, fmt.Sprintf("no free address left in %s", subnet)}
+			}
+			used = append(used, next)
+			m.Address, dirty = next.Addr().String(), true
+		}
+		role := m.Role
+		switch {
+		case network.Topology == model.VPNTopologyMesh:
+			role = model.VPNRolePeer
+		case role != model.VPNRoleHub:
+			role = model.VPNRoleSpoke
+		}
+		if role != m.Role {
+			m.Role, dirty = role, true
+		}
+		if dirty {
+			if err := tx.Save(m).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ==================== Validation ====================
+
+func validateVPNNetwork(item *model.VPNNetwork) error {
+	if item.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if item.Topology == "" {
+		item.Topology = model.VPNTopologyHubSpoke
+	}
+	if err := validateOneOf("topology", item.Topology, vpnTopologies); err != nil {
+		return err
+	}
+	item.Topology = strings.ToLower(item.Topology)
+	if item.Interface == "" {
+		item.Interface = "wg1"
+	}
+	if err := validateName("interface", item.Interface); err != nil {
+		return err
+	}
+	subnet, err := ipam.ParsePrefix(item.Subnet)
+	if err != nil {
+		return fmt.Errorf("subnet: %v", err)
+	}
+	if ipam.Size(subnet) < 4 {
+		return fmt.Errorf("subnet %s has no room for members", subnet)
+	}
+	item.Subnet = subnet.String()
+	if item.ListenPort == 0 {
+		item.ListenPort = 51820
+	}
+	if item.ListenPort < 1 || item.ListenPort > 65535 {
+		return fmt.Errorf("listen_port must be 1-65535")
+	}
+	if item.Keepalive == 0 {
+		item.Keepalive = 25
+	}
+	if item.Keepalive < 0 || item.Keepalive > 65535 {
+		return fmt.Errorf("keepalive must be 1-65535")
+	}
+	return nil
+}
+
+// validateVPNMember checks a member against its network and normalizes its
+// endpoint and routes. Roles follow the topology: mesh members are peers.
+func validateVPNMember(db *gorm.DB, network model.VPNNetwork, m *model.VPNNetworkMember) (int, error) {
+	var device model.Device
+	if err := db.First(&device, m.DeviceID).Error; err != nil {
+		return http.StatusBadRequest, fmt.Errorf("device not found")
+	}
+	var n int64
+	db.Model(&model.VPNNetworkMember{}).Where("network_id = ? AND device_id = ? AND id <> ?", network.ID, m.DeviceID, m.ID).Count(&n)
+	if n > 0 {
+		return http.StatusConflict, fmt.Errorf("device %s is already a member", device.Name)
+	}
+
+	if network.Topology == model.VPNTopologyMesh {
+		m.Role = model.VPNRolePeer
+	} else {
+		if m.Role == "" {
+			m.Role = model.VPNRoleSpoke
+		}
+		if err := validateOneOf("role", m.Role, []string{model.VPNRoleHub, model.VPNRoleSpoke}); err != nil {
+			return http.StatusBadRequest, err
+		}
+		m.Role = strings.ToLower(m.Role)
+	}
+
+	if m.Endpoint != "" {
+		host, port, err := net.SplitHostPort(m.Endpoint)
+		if err != nil {
+			host, port = m.Endpoint, strconv.Itoa(network.ListenPort)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 || host == "" {
+			return http.StatusBadRequest, fmt.Errorf("endpoint must be host or host:port")
+		}
+		m.Endpoint = net.JoinHostPort(host, port)
+		if err := validateUCIValue("endpoint", m.Endpoint); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+	if m.Role == model.VPNRoleHub {
+		if m.Endpoint == "" {
+			return http.StatusBadRequest, fmt.Errorf("the hub needs an endpoint the spokes can reach")
+		}
+		var hub model.VPNNetworkMember
+		if err := db.Where("network_id = ? AND role = ? AND id <> ?", network.ID, model.VPNRoleHub, m.ID).First(&hub).Error; err == nil {
+			return http.StatusConflict, fmt.Errorf("device %d is already the hub", hub.DeviceID)
+		}
+	}
+
+	if m.Address != "" {
+		subnet := netip.MustParsePrefix(network.Subnet)
+		addr, err := netip.ParseAddr(m.Address)
+		if err != nil || !subnet.Contains(addr) {
+			return http.StatusBadRequest, fmt.Errorf("address must be an address in %s", subnet)
+		}
+		if addr == subnet.Addr() || (addr.Is4() && addr == ipam.Last(subnet)) {
+			return http.StatusBadRequest, fmt.Errorf("%s is the network or broadcast address of %s", addr, subnet)
+		}
+		m.Address = addr.String()
+		db.Model(&model.VPNNetworkMember{}).Where("network_id = ? AND address = ? AND id <> ?", network.ID, m.Address, m.ID).Count(&n)
+		if n > 0 {
+			return http.StatusConflict, fmt.Errorf("address %s is taken", m.Address)
+		}
+	}
+
+	var routes []string
+	for _, r := range splitRoutes(m.Routes) {
+		p, err := netip.ParsePrefix(r)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("routes: %q is not a valid CIDR", r)
+		}
+		routes = append(routes, p.Masked().String())
+	}
+	m.Routes = strings.Join(routes, ",")
+	return 0, nil
+}
+
+func splitRoutes(s string) []string {
+	var out []string
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			out = append(out, r)
+		}
+	}
+	return out
+}
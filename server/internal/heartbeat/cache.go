@@ -0,0 +1,168 @@
+package heartbeat
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+)
+
+// Sample is the latest heartbeat of one device together with the device
+// labels known when it was received.
+type Sample struct {
+	DeviceID   uint
+	Name       string
+	MAC        string
+	Group      string
+	Model      string
+	CPUUsage   float64
+	MemUsage   float64
+	MemTotal   int64
+	MemFree    int64
+	RxBytes    int64
+	TxBytes    int64
+	Conntrack  int
+	UptimeSecs int64
+	Load1      float64
+	ReceivedAt time.Time
+}
+
+// Device is a registered device with the labels per-device metrics carry
+// and whether it is online.
+type Device struct {
+	ID     uint
+	Name   string
+	MAC    string
+	Group  string
+	Model  string
+	Online bool
+}
+
+// Cache keeps the registered devices and the most recent heartbeat per
+// device in memory so that Prometheus scrapes do not hit the database.
+// It is loaded once with LoadDevices; the ingest pipeline, the offline
+// detector and the device handlers keep it current.
+type Cache struct {
+	mu      sync.RWMutex
+	devices map[uint]Device
+	samples map[uint]Sample
+}
+
+func NewCache() *Cache {
+	return &Cache{devices: make(map[uint]Device), samples: make(map[uint]Sample)}
+}
+
+// LoadDevices replaces the cached devices with the registered ones.
+func (c *Cache) LoadDevices(db *gorm.DB) error {
+	var devices []model.Device
+	if err := db.Select("id", "name", "mac", "group", "model", "status").Find(&devices).Error; err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.devices = make(map[uint]Device, len(devices))
+	for _, d := range devices {
+		c.devices[d.ID] = deviceOf(d)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// SetDevice adds or updates a registered device, e.g. after it registers
+// or is renamed.
+func (c *Cache) SetDevice(d model.Device) {
+	if d.ID == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.devices[d.ID] = deviceOf(d)
+	c.mu.Unlock()
+}
+
+func deviceOf(d model.Device) Device {
+	return Device{ID: d.ID, Name: d.Name, MAC: d.MAC, Group: d.Group, Model: d.Model, Online: d.Status == model.StatusOnline}
+}
+
+// SetOffline marks devices as offline.
+func (c *Cache) SetOffline(ids ...uint) {
+	c.mu.Lock()
+	for _, id := range ids {
+		if d, ok := c.devices[id]; ok {
+			d.Online = false
+			c.devices[id] = d
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Update stores s as the latest sample of its device, which the heartbeat
+// shows to be online with the labels in s. Samples of unknown devices
+// (DeviceID 0) are ignored.
+func (c *Cache) Update(s Sample) {
+	if s.DeviceID == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.samples[s.DeviceID] = s
+	c.devices[s.DeviceID] = Device{ID: s.DeviceID, Name: s.Name, MAC: s.MAC, Group: s.Group, Model: s.Model, Online: true}
+	c.mu.Unlock()
+}
+
+// Remove drops a device and its cached sample, e.g. after it is deleted.
+func (c *Cache) Remove(deviceID uint) {
+	c.mu.Lock()
+	delete(c.devices, deviceID)
+	delete(c.samples, deviceID)
+	c.mu.Unlock()
+}
+
+// Devices returns the registered devices ordered by ID.
+func (c *Cache) Devices() []Device {
+	c.mu.RLock()
+	out := make([]Device, 0, len(c.devices))
+	for _, d := range c.devices {
+		out = append(out, d)
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Snapshot returns the samples received after since, ordered by device ID.
+// Older samples are evicted.
+func (c *Cache) Snapshot(since time.Time) []Sample {
+	c.mu.Lock()
+	out := make([]Sample, 0, len(c.samples))
+	for id, s := range c.samples {
+		if s.ReceivedAt.Before(since) {
+			delete(c.samples, id)
+			continue
+		}
+		out = append(out, s)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].DeviceID < out[j].DeviceID })
+	return out
+}
+
+// Len returns the number of cached samples.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.samples)
+}
+
+// ParseLoad1 returns the 1-minute load from a "/proc/loadavg"-style string.
+func ParseLoad1(loadAvg string) float64 {
+	fields := strings.Fields(loadAvg)
+	if len(fields) == 0 {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(fields[0], 64)
+	return v
+}
@@ -0,0 +1,551 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
+	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Heartbeat is the status payload an agent publishes every 30s.
+type Heartbeat struct {
+	MAC        string  `json:"mac"`
+	CPUUsage   float64 `json:"cpu_usage"`
+	MemUsage   float64 `json:"mem_usage"`
+	MemTotal   int64   `json:"mem_total"`
+	MemFree    int64   `json:"mem_free"`
+	RxBytes    int64   `json:"rx_bytes"`
+	TxBytes    int64   `json:"tx_bytes"`
+	Conntrack  int     `json:"conntrack"`
+	UptimeSecs int64   `json:"uptime_secs"`
+	LoadAvg    string  `json:"load_avg"`
+
+	// Optional details, sent by agents since 1.1
+	Interfaces  []InterfaceStats  `json:"interfaces,omitempty"`
+	Filesystems []FilesystemStats `json:"filesystems,omitempty"`
+	Thermal     []ThermalStats    `json:"thermal,omitempty"`
+	Wireless    []WirelessStats   `json:"wireless,omitempty"`
+
+	ReceivedAt time.Time `json:"-"`
+}
+
+// InterfaceStats are the kernel counters of one network interface.
+type InterfaceStats struct {
+	Name      string `json:"name"`
+	RxBytes   int64  `json:"rx_bytes"`
+	TxBytes   int64  `json:"tx_bytes"`
+	RxPackets int64  `json:"rx_packets"`
+	TxPackets int64  `json:"tx_packets"`
+	RxErrors  int64  `json:"rx_errors"`
+	TxErrors  int64  `json:"tx_errors"`
+	Up        bool   `json:"up"`
+	Speed     int    `json:"speed"` // Mbit/s, -1 or 0 when unknown
+}
+
+// FilesystemStats is the usage of one mount point in KiB, as reported by df.
+type FilesystemStats struct {
+	Mount   string `json:"mount"`
+	TotalKB int64  `json:"total_kb"`
+	UsedKB  int64  `json:"used_kb"`
+}
+
+// ThermalStats is the temperature of one thermal zone in millidegrees
+// Celsius, as read from /sys/class/thermal.
+type ThermalStats struct {
+	Zone string `json:"zone"`
+	Temp int64  `json:"temp"`
+}
+
+// WirelessStats is the client count of one wireless interface.
+type WirelessStats struct {
+	Radio     string `json:"radio"`
+	Interface string `json:"interface"`
+	SSID      string `json:"ssid"`
+	Clients   int    `json:"clients"`
+}
+
+// maxHeartbeatDetails bounds each detail list so a misbehaving agent cannot
+// flood the detail tables.
+const maxHeartbeatDetails = 64
+
+// Options tunes the pipeline. Zero values fall back to the defaults.
+type Options struct {
+	QueueSize     int           // total queued heartbeats across workers
+	Workers       int           // heartbeats of one MAC always go to the same worker
+	BatchSize     int           // max heartbeats per flush
+	FlushInterval time.Duration // max wait before a partial batch is flushed
+}
+
+func (o *Options) setDefaults() {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 20000
+	}
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+}
+
+// ingestedDevice is a device row as returned by the heartbeat update.
+type ingestedDevice struct {
+	ID    uint
+	MAC   string
+	Name  string
+	Group string
+	Model string
+}
+
+// Pipeline ingests heartbeats asynchronously. Submit never blocks: when a
+// worker queue is full the heartbeat is dropped and counted. Workers flush
+// batches with one bulk device update, one batched metrics insert and one
+// alert evaluation pass.
+type Pipeline struct {
+	db         *gorm.DB
+	hub        *ws.Hub
+	heartbeats *heartbeat.Cache
+	opts       Options
+
+	queues []chan Heartbeat
+	wg     sync.WaitGroup
+
+	received      prometheus.Counter
+	dropped       *prometheus.CounterVec
+	stored        prometheus.Counter
+	flushErrors   prometheus.Counter
+	flushDuration prometheus.Histogram
+	batchSize     prometheus.Histogram
+	queueDepth    *prometheus.Desc
+	queueCapacity *prometheus.Desc
+}
+
+func NewPipeline(db *gorm.DB, hub *ws.Hub, heartbeats *heartbeat.Cache, opts Options) *Pipeline {
+	opts.setDefaults()
+	p := &Pipeline{
+		db:         db,
+		hub:        hub,
+		heartbeats: heartbeats,
+		opts:       opts,
+
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nexusgate_ingest_heartbeats_received_total", Help: "Heartbeats submitted to the ingestion pipeline",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nexusgate_ingest_heartbeats_dropped_total", Help: "Heartbeats dropped by the ingestion pipeline",
+		}, []string{"reason"}),
+		stored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nexusgate_ingest_heartbeats_stored_total", Help: "Heartbeats written to the database",
+		}),
+		flushErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nexusgate_ingest_flush_errors_total", Help: "Batch flushes that failed to write",
+		}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "nexusgate_ingest_flush_duration_seconds", Help: "Time to flush one batch",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "nexusgate_ingest_batch_size", Help: "Heartbeats per flushed batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		queueDepth:    prometheus.NewDesc("nexusgate_ingest_queue_depth", "Heartbeats waiting in the ingestion queues", nil, nil),
+		queueCapacity: prometheus.NewDesc("nexusgate_ingest_queue_capacity", "Capacity of the ingestion queues", nil, nil),
+	}
+	// Pre-create the reasons so they are exported as 0
+	for _, reason := range []string{"invalid", "queue_full", "write_failed"} {
+		p.dropped.WithLabelValues(reason)
+	}
+
+	perWorker := opts.QueueSize / opts.Workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	p.queues = make([]chan Heartbeat, opts.Workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan Heartbeat, perWorker)
+	}
+	return p
+}
+
+// Start launches the workers.
+func (p *Pipeline) Start() {
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go p.worker(q)
+	}
+	log.Printf("heartbeat ingestion started (workers: %d, queue: %d, batch: %d, flush: %s)",
+		p.opts.Workers, p.opts.QueueSize, p.opts.BatchSize, p.opts.FlushInterval)
+}
+
+// Stop closes the queues and waits for queued heartbeats to be flushed.
+// Submit must not be called afterwards.
+func (p *Pipeline) Stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+// SubmitJSON decodes a heartbeat payload and enqueues it.
+func (p *Pipeline) SubmitJSON(payload []byte) error {
+	var hb Heartbeat
+	if err := json.Unmarshal(payload, &hb); err != nil || hb.MAC == "" {
+		p.received.Inc()
+		p.dropped.WithLabelValues("invalid").Inc()
+		if err == nil {
+			err = fmt.Errorf("missing mac")
+		}
+		return err
+	}
+	hb.truncateDetails()
+	if !p.Submit(hb) {
+		return fmt.Errorf("ingestion queue full")
+	}
+	return nil
+}
+
+func (hb *Heartbeat) truncateDetails() {
+	if len(hb.Interfaces) > maxHeartbeatDetails {
+		hb.Interfaces = hb.Interfaces[:maxHeartbeatDetails]
+	}
+	if len(hb.Filesystems) > maxHeartbeatDetails {
+		hb.Filesystems = hb.Filesystems[:maxHeartbeatDetails]
+	}
+	if len(hb.Thermal) > maxHeartbeatDetails {
+		hb.Thermal = hb.Thermal[:maxHeartbeatDetails]
+	}
+	if len(hb.Wireless) > maxHeartbeatDetails {
+		hb.Wireless = hb.Wireless[:maxHeartbeatDetails]
+	}
+}
+
+// Submit enqueues a heartbeat and reports whether it was accepted.
+func (p *Pipeline) Submit(hb Heartbeat) bool {
+	p.received.Inc()
+	if hb.ReceivedAt.IsZero() {
+		hb.ReceivedAt = time.Now()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hb.MAC))
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- hb:
+		return true
+	default:
+		p.dropped.WithLabelValues("queue_full").Inc()
+		return false
+	}
+}
+
+func (p *Pipeline) worker(queue chan Heartbeat) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Heartbeat, 0, p.opts.BatchSize)
+	for {
+		select {
+		case hb, ok := <-queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, hb)
+			if len(batch) >= p.opts.BatchSize {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				p.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush writes one batch: a bulk device update, a batched metrics insert,
+// the heartbeat cache, alert evaluation and WebSocket broadcasts.
+// Heartbeats of an unknown or deleted device are still stored, with device
+// ID 0, but skip the detail tables, the cache and alerts.
+func (p *Pipeline) flush(batch []Heartbeat) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	defer func() {
+		p.flushDuration.Observe(time.Since(start).Seconds())
+		p.batchSize.Observe(float64(len(batch)))
+	}()
+
+	// Keep the latest heartbeat per MAC for the device row
+	latest := make(map[string]Heartbeat, len(batch))
+	for _, hb := range batch {
+		if prev, ok := latest[hb.MAC]; !ok || !hb.ReceivedAt.Before(prev.ReceivedAt) {
+			latest[hb.MAC] = hb
+		}
+	}
+	devices, err := p.updateDevices(latest)
+	if err != nil {
+		log.Printf("failed to update %d device(s) from heartbeats: %v", len(latest), err)
+		p.flushErrors.Inc()
+	}
+
+	metrics := make([]model.DeviceMetrics, 0, len(batch))
+	var details heartbeatDetails
+	known := batch[:0:0]
+	for _, hb := range batch {
+		dev, ok := devices[hb.MAC]
+		if ok {
+			known = append(known, hb)
+			details.add(dev.ID, hb)
+		}
+		metrics = append(metrics, model.DeviceMetrics{
+			DeviceID:    dev.ID,
+			CPUUsage:    hb.CPUUsage,
+			MemUsage:    hb.MemUsage,
+			MemTotal:    hb.MemTotal,
+			MemFree:     hb.MemFree,
+			RxBytes:     hb.RxBytes,
+			TxBytes:     hb.TxBytes,
+			Conntrack:   hb.Conntrack,
+			UptimeSecs:  hb.UptimeSecs,
+			LoadAvg:     hb.LoadAvg,
+			CollectedAt: hb.ReceivedAt,
+		})
+	}
+
+	if err := p.db.CreateInBatches(metrics, p.opts.BatchSize).Error; err != nil {
+		log.Printf("failed to store %d heartbeat metric(s): %v", len(metrics), err)
+		p.flushErrors.Inc()
+		p.dropped.WithLabelValues("write_failed").Add(float64(len(metrics)))
+	} else {
+		p.stored.Add(float64(len(metrics)))
+	}
+	if err := details.store(p.db, p.opts.BatchSize); err != nil {
+		log.Printf("failed to store heartbeat details: %v", err)
+		p.flushErrors.Inc()
+	}
+
+	samples := make([]jobs.HeartbeatSample, 0, len(known))
+	for _, hb := range known {
+		dev := devices[hb.MAC]
+		if p.heartbeats != nil {
+			p.heartbeats.Update(heartbeat.Sample{
+				DeviceID:   dev.ID,
+				Name:       dev.Name,
+				MAC:        hb.MAC,
+				Group:      dev.Group,
+				Model:      dev.Model,
+				CPUUsage:   hb.CPUUsage,
+				MemUsage:   hb.MemUsage,
+				MemTotal:   hb.MemTotal,
+				MemFree:    hb.MemFree,
+				RxBytes:    hb.RxBytes,
+				TxBytes:    hb.TxBytes,
+				Conntrack:  hb.Conntrack,
+				UptimeSecs: hb.UptimeSecs,
+				Load1:      heartbeat.ParseLoad1(hb.LoadAvg),
+				ReceivedAt: hb.ReceivedAt,
+			})
+		}
+		samples = append(samples, jobs.HeartbeatSample{
+			DeviceID:   dev.ID,
+			DeviceName: dev.Name,
+			CPUUsage:   hb.CPUUsage,
+			MemUsage:   hb.MemUsage,
+			Conntrack:  hb.Conntrack,
+		})
+	}
+
+	jobs.EvaluateHeartbeatAlerts(p.db, p.hub, samples)
+
+	if p.hub != nil {
+		for _, hb := range batch {
+			p.hub.Broadcast("device_status", map[string]any{
+				"mac":         hb.MAC,
+				"device_id":   devices[hb.MAC].ID,
+				"cpu_usage":   hb.CPUUsage,
+				"mem_usage":   hb.MemUsage,
+				"rx_bytes":    hb.RxBytes,
+				"tx_bytes":    hb.TxBytes,
+				"conntrack":   hb.Conntrack,
+				"uptime_secs": hb.UptimeSecs,
+				"load_avg":    hb.LoadAvg,
+				"status":      "online",
+			})
+		}
+	}
+}
+
+// heartbeatDetails collects the detail rows of a batch, one table each.
+type heartbeatDetails struct {
+	interfaces  []model.DeviceInterfaceMetrics
+	filesystems []model.DeviceFilesystemMetrics
+	thermal     []model.DeviceThermalMetrics
+	wireless    []model.DeviceWirelessMetrics
+}
+
+func (d *heartbeatDetails) add(deviceID uint, hb Heartbeat) {
+	for _, i := range hb.Interfaces {
+		if i.Name == "" {
+			continue
+		}
+		speed := i.Speed
+		if speed < 0 {
+			speed = 0
+		}
+		d.interfaces = append(d.interfaces, model.DeviceInterfaceMetrics{
+			DeviceID:    deviceID,
+			Interface:   i.Name,
+			RxBytes:     i.RxBytes,
+			TxBytes:     i.TxBytes,
+			RxPackets:   i.RxPackets,
+			TxPackets:   i.TxPackets,
+			RxErrors:    i.RxErrors,
+			TxErrors:    i.TxErrors,
+			Up:          i.Up,
+			SpeedMbps:   speed,
+			CollectedAt: hb.ReceivedAt,
+		})
+	}
+	for _, f := range hb.Filesystems {
+		if f.Mount == "" {
+			continue
+		}
+		d.filesystems = append(d.filesystems, model.DeviceFilesystemMetrics{
+			DeviceID:    deviceID,
+			Mount:       f.Mount,
+			TotalBytes:  f.TotalKB * 1024,
+			UsedBytes:   f.UsedKB * 1024,
+			CollectedAt: hb.ReceivedAt,
+		})
+	}
+	for _, t := range hb.Thermal {
+		if t.Zone == "" {
+			continue
+		}
+		d.thermal = append(d.thermal, model.DeviceThermalMetrics{
+			DeviceID:    deviceID,
+			Zone:        t.Zone,
+			TempCelsius: float64(t.Temp) / 1000,
+			CollectedAt: hb.ReceivedAt,
+		})
+	}
+	for _, w := range hb.Wireless {
+		if w.Interface == "" {
+			continue
+		}
+		d.wireless = append(d.wireless, model.DeviceWirelessMetrics{
+			DeviceID:    deviceID,
+			Radio:       w.Radio,
+			Interface:   w.Interface,
+			SSID:        w.SSID,
+			Clients:     w.Clients,
+			CollectedAt: hb.ReceivedAt,
+		})
+	}
+}
+
+// store inserts the collected rows, skipping empty tables.
+func (d *heartbeatDetails) store(db *gorm.DB, batchSize int) error {
+	var errs []error
+	if len(d.interfaces) > 0 {
+		errs = append(errs, db.CreateInBatches(d.interfaces, batchSize).Error)
+	}
+	if len(d.filesystems) > 0 {
+		errs = append(errs, db.CreateInBatches(d.filesystems, batchSize).Error)
+	}
+	if len(d.thermal) > 0 {
+		errs = append(errs, db.CreateInBatches(d.thermal, batchSize).Error)
+	}
+	if len(d.wireless) > 0 {
+		errs = append(errs, db.CreateInBatches(d.wireless, batchSize).Error)
+	}
+	return errors.Join(errs...)
+}
+
+// updateDevices marks the registered devices of a batch online and stores
+// their latest stats with one UPDATE ... FROM (VALUES ...) per batch.
+// Heartbeats never create devices: unknown MACs and deleted devices are
+// left alone and are absent from the result, which maps MACs to the
+// device rows.
+func (p *Pipeline) updateDevices(latest map[string]Heartbeat) (map[string]ingestedDevice, error) {
+	out := make(map[string]ingestedDevice, len(latest))
+	macs := make([]string, 0, len(latest))
+	for mac := range latest {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	for len(macs) > 0 {
+		n := min(len(macs), p.opts.BatchSize)
+		rows := make([]string, 0, n)
+		args := make([]any, 0, 1+n*5)
+		args = append(args, model.StatusOnline)
+		for _, mac := range macs[:n] {
+			hb := latest[mac]
+			rows = append(rows, "(?, ?::float8, ?::float8, ?::bigint, ?::timestamptz)")
+			args = append(args, mac, hb.CPUUsage, hb.MemUsage, hb.UptimeSecs, hb.ReceivedAt)
+		}
+		macs = macs[n:]
+
+		sql := fmt.Sprintf(
+			"UPDATE devices SET status = ?, cpu_usage = v.cpu_usage, mem_usage = v.mem_usage, "+
+				"uptime_secs = v.uptime_secs, last_seen_at = v.last_seen_at, updated_at = now() "+
+				"FROM (VALUES %s) AS v (mac, cpu_usage, mem_usage, uptime_secs, last_seen_at) "+
+				"WHERE devices.mac = v.mac AND devices.deleted_at IS NULL "+
+				"RETURNING devices.id, devices.mac, devices.name, devices.\"group\", devices.model",
+			strings.Join(rows, ", "))
+		var devices []ingestedDevice
+		if err := p.db.Raw(sql, args...).Scan(&devices).Error; err != nil {
+			return out, err
+		}
+		for _, d := range devices {
+			out[d.MAC] = d
+		}
+	}
+	return out, nil
+}
+
+func (p *Pipeline) Describe(ch chan<- *prometheus.Desc) {
+	p.received.Describe(ch)
+	p.dropped.Describe(ch)
+	p.stored.Describe(ch)
+	p.flushErrors.Describe(ch)
+	p.flushDuration.Describe(ch)
+	p.batchSize.Describe(ch)
+	ch <- p.queueDepth
+	ch <- p.queueCapacity
+}
+
+func (p *Pipeline) Collect(ch chan<- prometheus.Metric) {
+	p.received.Collect(ch)
+	p.dropped.Collect(ch)
+	p.stored.Collect(ch)
+	p.flushErrors.Collect(ch)
+	p.flushDuration.Collect(ch)
+	p.batchSize.Collect(ch)
+
+	depth, capacity := 0, 0
+	for _, q := range p.queues {
+		depth += len(q)
+		capacity += cap(q)
+	}
+	ch <- prometheus.MustNewConstMetric(p.queueDepth, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(p.queueCapacity, prometheus.GaugeValue, float64(capacity))
+}
@@ -0,0 +1,101 @@
+package ingest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/store"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	benchDevices  = 10000
+	benchInterval = 30 * time.Second
+)
+
+// BenchmarkPipeline feeds one heartbeat interval of a 10k device fleet
+// through the pipeline per iteration, all at once, and fails if any
+// heartbeat is dropped or the batch takes longer than the interval to be
+// written. It registers the fleet in the database in NEXUSGATE_TEST_DSN
+// and is skipped without it.
+func BenchmarkPipeline(b *testing.B) {
+	db := benchDB(b)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	hbs := make([]Heartbeat, benchDevices)
+	devices := make([]model.Device, benchDevices)
+	for i := range hbs {
+		mac := fmt.Sprintf("02:00:00:%02x:%02x:%02x", i>>16&0xff, i>>8&0xff, i&0xff)
+		devices[i] = model.Device{Name: "bench-" + mac, MAC: mac, Status: model.StatusOffline}
+		hbs[i] = Heartbeat{
+			MAC:        mac,
+			CPUUsage:   float64(i % 50),
+			MemUsage:   float64(i % 60),
+			MemTotal:   128 << 20,
+			MemFree:    64 << 20,
+			RxBytes:    int64(i) << 20,
+			TxBytes:    int64(i) << 18,
+			Conntrack:  i % 1000,
+			UptimeSecs: 86400,
+			LoadAvg:    "0.10 0.05 0.01",
+		}
+	}
+	cleanup := func() {
+		ids := db.Unscoped().Model(&model.Device{}).Select("id").Where("name LIKE ?", "bench-%")
+		db.Where("device_id IN (?)", ids).Delete(&model.DeviceMetrics{})
+		db.Unscoped().Where("name LIKE ?", "bench-%").Delete(&model.Device{})
+	}
+	cleanup()
+	b.Cleanup(cleanup)
+	if err := db.CreateInBatches(devices, 1000).Error; err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	var slowest time.Duration
+	for n := 0; n < b.N; n++ {
+		p := NewPipeline(db, nil, heartbeat.NewCache(), Options{})
+		p.Start()
+		start := time.Now()
+		for _, hb := range hbs {
+			hb.ReceivedAt = start
+			if !p.Submit(hb) {
+				b.Fatalf("heartbeat of %s dropped: queue full", hb.MAC)
+			}
+		}
+		p.Stop()
+		elapsed := time.Since(start)
+		if elapsed > benchInterval {
+			b.Fatalf("%d heartbeats took %s to flush, more than the %s interval", benchDevices, elapsed, benchInterval)
+		}
+		slowest = max(slowest, elapsed)
+	}
+	b.ReportMetric(float64(benchDevices*b.N)/b.Elapsed().Seconds(), "heartbeats/s")
+	b.ReportMetric(slowest.Seconds(), "max-interval-s")
+}
+
+// benchDB connects to NEXUSGATE_TEST_DSN and migrates it.
+func benchDB(b *testing.B) *gorm.DB {
+	b.Helper()
+	dsn := os.Getenv("NEXUSGATE_TEST_DSN")
+	if dsn == "" {
+		b.Skip("NEXUSGATE_TEST_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := store.AutoMigrate(db, "off"); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,172 @@
+// Package ipam does the prefix arithmetic of IP address management:
+// finding the next free subnet of a supernet, detecting overlapping
+// prefixes and measuring how much of a supernet is used. It does not know
+// where prefixes are stored.
+package ipam
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"sort"
+)
+
+// ParsePrefix parses a prefix in CIDR notation that must be given by its
+// network address: 10.20.0.0/16, not 10.20.1.1/16.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if p.Masked() != p {
+		return netip.Prefix{}, fmt.Errorf("%s has host bits set, the network is %s", s, p.Masked())
+	}
+	return p, nil
+}
+
+// Last returns the last address of p, the broadcast address of an IPv4
+// subnet.
+func Last(p netip.Prefix) netip.Addr {
+	p = p.Masked()
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+// Size is the number of addresses in p, a float64 because an IPv6 prefix
+// can hold more than any integer type.
+func Size(p netip.Prefix) float64 {
+	return math.Ldexp(1, p.Addr().BitLen()-p.Bits())
+}
+
+// Next returns the first prefix of length bits inside pool that overlaps
+// none of used, and false when there is none.
+func Next(pool netip.Prefix, bits int, used []netip.Prefix) (netip.Prefix, bool) {
+	pool = pool.Masked()
+	if bits < pool.Bits() || bits > pool.Addr().BitLen() {
+		return netip.Prefix{}, false
+	}
+	used = sorted(used)
+	cand := netip.PrefixFrom(pool.Addr(), bits)
+	for {
+		end := Last(cand)
+		blocked := false
+		for _, u := range used {
+			if u.Addr().Compare(end) > 0 {
+				break
+			}
+			if u.Overlaps(cand) {
+				blocked = true
+				if l := Last(u); l.Compare(end) > 0 {
+					end = l
+				}
+			}
+		}
+		if !blocked {
+			return cand, true
+		}
+		// Prefixes are nested or disjoint, so the address after the last
+		// blocking one is aligned to at least the candidate's size.
+		next := end.Next()
+		if !next.IsValid() || !pool.Contains(next) {
+			return netip.Prefix{}, false
+		}
+		cand = netip.PrefixFrom(next, bits)
+	}
+}
+
+// Covered counts the addresses of pool that prefixes cover, each address
+// once however many prefixes contain it.
+func Covered(pool netip.Prefix, prefixes []netip.Prefix) float64 {
+	pool = pool.Masked()
+	var clipped []netip.Prefix
+	for _, p := range prefixes {
+		switch p = p.Masked(); {
+		case !p.Overlaps(pool):
+		case p.Bits() < pool.Bits():
+			clipped = append(clipped, pool)
+		default:
+			clipped = append(clipped, p)
+		}
+	}
+	total := 0.0
+	var outer netip.Prefix
+	for _, p := range sorted(clipped) {
+		// Sorted by address, then largest first: p is either inside the
+		// last outermost prefix or after it.
+		if outer.IsValid() && outer.Contains(p.Addr()) {
+			continue
+		}
+		outer = p
+		total += Size(p)
+	}
+	return total
+}
+
+// Free counts the prefixes of length bits inside pool that overlap none
+// of used.
+func Free(pool netip.Prefix, bits int, used []netip.Prefix) float64 {
+	pool = pool.Masked()
+	if bits < pool.Bits() || bits > pool.Addr().BitLen() {
+		return 0
+	}
+	// A block is taken by any used prefix inside it.
+	blocks := make([]netip.Prefix, 0, len(used))
+	for _, u := range used {
+		if u.Bits() > bits {
+			u = netip.PrefixFrom(u.Addr(), bits)
+		}
+		blocks = append(blocks, u.Masked())
+	}
+	return (Size(pool) - Covered(pool, blocks)) / math.Ldexp(1, pool.Addr().BitLen()-bits)
+}
+
+// Overlaps returns the pairs of indexes i < j of prefixes that overlap.
+func Overlaps(prefixes []netip.Prefix) [][2]int {
+	idx := make([]int, len(prefixes))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return less(prefixes[idx[a]], prefixes[idx[b]]) })
+
+	var pairs [][2]int
+	for a, i := range idx {
+		last := Last(prefixes[i])
+		for _, j := range idx[a+1:] {
+			if prefixes[j].Masked().Addr().Compare(last) > 0 {
+				break
+			}
+			if prefixes[i].Overlaps(prefixes[j]) {
+				pairs = append(pairs, [2]int{min(i, j), max(i, j)})
+			}
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool {
+		if pairs[a][0] != pairs[b][0] {
+			return pairs[a][0] < pairs[b][0]
+		}
+		return pairs[a][1] < pairs[b][1]
+	})
+	return pairs
+}
+
+// sorted returns masked copies of prefixes by address, larger prefixes
+// first among those starting at the same address.
+func sorted(prefixes []netip.Prefix) []netip.Prefix {
+	out := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		out[i] = p.Masked()
+	}
+	sort.Slice(out, func(a, b int) bool { return less(out[a], out[b]) })
+	return out
+}
+
+func less(a, b netip.Prefix) bool {
+	if c := a.Masked().Addr().Compare(b.Masked().Addr()); c != 0 {
+		return c < 0
+	}
+	return a.Bits() < b.Bits()
+}
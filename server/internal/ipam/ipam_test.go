@@ -0,0 +1,187 @@
+package ipam
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixes(s ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(s))
+	for i, p := range s {
+		out[i] = netip.MustParsePrefix(p)
+	}
+	return out
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{in: "10.20.0.0/16"},
+		{in: "10.20.1.1/32"},
+		{in: "10.20.1.0/31"},
+		{in: "fd00:4e47::/48"},
+		{in: "10.20.1.1/16", wantErr: true},
+		{in: "10.20.1.1/31", wantErr: true},
+		{in: "fd00:4e47::1/64", wantErr: true},
+		{in: "10.20.0.0", wantErr: true},
+		{in: "10.20.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := ParsePrefix(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePrefix(%s) = %v, %v; want error %v", tt.in, p, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLastAndSize(t *testing.T) {
+	tests := []struct {
+		prefix string
+		last   string
+		size   float64
+	}{
+		{prefix: "10.20.1.0/24", last: "10.20.1.255", size: 256},
+		{prefix: "10.20.1.7/24", last: "10.20.1.255", size: 256},
+		{prefix: "10.20.1.4/30", last: "10.20.1.7", size: 4},
+		{prefix: "10.20.1.4/31", last: "10.20.1.5", size: 2},
+		{prefix: "10.20.1.4/32", last: "10.20.1.4", size: 1},
+		{prefix: "0.0.0.0/0", last: "255.255.255.255", size: 1 << 32},
+		{prefix: "fd00::/64", last: "fd00::ffff:ffff:ffff:ffff", size: 1 << 64},
+		{prefix: "fd00::1/128", last: "fd00::1", size: 1},
+	}
+	for _, tt := range tests {
+		p := netip.MustParsePrefix(tt.prefix)
+		if got := Last(p); got != netip.MustParseAddr(tt.last) {
+			t.Errorf("Last(%s) = %s, want %s", tt.prefix, got, tt.last)
+		}
+		if got := Size(p); got != tt.size {
+			t.Errorf("Size(%s) = %v, want %v", tt.prefix, got, tt.size)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name string
+		pool string
+		bits int
+		used []string
+		want string // empty when the pool is exhausted
+	}{
+		{name: "empty pool", pool: "10.20.0.0/16", bits: 24, want: "10.20.0.0/24"},
+		{name: "first taken", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.0.0/24"}, want: "10.20.1.0/24"},
+		{name: "hole", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.2.0/24", "10.20.0.0/24"}, want: "10.20.1.0/24"},
+		{name: "larger used prefix", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.0.0/23"}, want: "10.20.2.0/24"},
+		{name: "smaller used prefix", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.0.128/25"}, want: "10.20.1.0/24"},
+		{name: "nested used prefixes", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.0.0/22", "10.20.1.0/24", "10.20.4.0/25"}, want: "10.20.5.0/24"},
+		{name: "used outside the pool", pool: "10.20.0.0/16", bits: 24, used: []string{"10.19.0.0/16", "192.168.0.0/24"}, want: "10.20.0.0/24"},
+		{name: "pool given with host bits", pool: "10.20.3.1/16", bits: 24, want: "10.20.0.0/24"},
+		{name: "whole pool", pool: "10.20.0.0/24", bits: 24, want: "10.20.0.0/24"},
+		{name: "exhausted", pool: "10.20.0.0/23", bits: 24, used: []string{"10.20.0.0/24", "10.20.1.0/24"}},
+		{name: "covered by a supernet", pool: "10.20.0.0/16", bits: 24, used: []string{"10.0.0.0/8"}},
+		{name: "larger than the pool", pool: "10.20.0.0/16", bits: 15},
+		{name: "longer than an address", pool: "10.20.0.0/16", bits: 33},
+
+		// Host addresses, with the network and broadcast address reserved
+		// the way peer address allocation does
+		{name: "first host", pool: "10.99.0.0/24", bits: 32, used: []string{"10.99.0.0/32", "10.99.0.255/32"}, want: "10.99.0.1/32"},
+		{name: "after the server", pool: "10.99.0.0/24", bits: 32, used: []string{"10.99.0.0/32", "10.99.0.255/32", "10.99.0.1/32", "10.99.0.2/32"}, want: "10.99.0.3/32"},
+		{name: "last host", pool: "10.99.0.0/30", bits: 32, used: []string{"10.99.0.0/32", "10.99.0.3/32", "10.99.0.1/32"}, want: "10.99.0.2/32"},
+		{name: "hosts exhausted", pool: "10.99.0.0/30", bits: 32, used: []string{"10.99.0.0/32", "10.99.0.3/32", "10.99.0.1/32", "10.99.0.2/32"}},
+
+		// Point-to-point /31 and single-address /32 have no network or
+		// broadcast address
+		{name: "/31 first", pool: "10.99.0.4/31", bits: 32, want: "10.99.0.4/32"},
+		{name: "/31 second", pool: "10.99.0.4/31", bits: 32, used: []string{"10.99.0.4/32"}, want: "10.99.0.5/32"},
+		{name: "/31 exhausted", pool: "10.99.0.4/31", bits: 32, used: []string{"10.99.0.4/32", "10.99.0.5/32"}},
+		{name: "/32", pool: "10.99.0.9/32", bits: 32, want: "10.99.0.9/32"},
+		{name: "/32 exhausted", pool: "10.99.0.9/32", bits: 32, used: []string{"10.99.0.9/32"}},
+		{name: "end of the address space", pool: "255.255.255.254/31", bits: 32, used: []string{"255.255.255.254/32", "255.255.255.255/32"}},
+
+		{name: "ipv6 subnet", pool: "fd00:4e47::/48", bits: 64, used: []string{"fd00:4e47::/64"}, want: "fd00:4e47:0:1::/64"},
+		{name: "ipv6 host", pool: "fd00:4e47::/64", bits: 128, used: []string{"fd00:4e47::/128", "fd00:4e47::1/128"}, want: "fd00:4e47::2/128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Next(netip.MustParsePrefix(tt.pool), tt.bits, prefixes(tt.used...))
+			if tt.want == "" {
+				if ok {
+					t.Errorf("Next() = %s, want none free", got)
+				}
+				return
+			}
+			if !ok || got != netip.MustParsePrefix(tt.want) {
+				t.Errorf("Next() = %s, %v; want %s", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoveredAndFree(t *testing.T) {
+	tests := []struct {
+		name    string
+		pool    string
+		bits    int
+		used    []string
+		covered float64
+		free    float64
+	}{
+		{name: "empty", pool: "10.20.0.0/16", bits: 24, covered: 0, free: 256},
+		{name: "one subnet", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.5.0/24"}, covered: 256, free: 255},
+		{name: "nested counted once", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.0.0/23", "10.20.1.0/24", "10.20.1.0/24"}, covered: 512, free: 254},
+		{name: "small prefixes block a subnet", pool: "10.20.0.0/16", bits: 24, used: []string{"10.20.3.1/32", "10.20.3.128/25"}, covered: 129, free: 255},
+		{name: "outside", pool: "10.20.0.0/16", bits: 24, used: []string{"10.21.0.0/24"}, covered: 0, free: 256},
+		{name: "supernet", pool: "10.20.0.0/16", bits: 24, used: []string{"10.0.0.0/8"}, covered: 65536, free: 0},
+		{name: "/31", pool: "10.99.0.4/31", bits: 32, used: []string{"10.99.0.5/32"}, covered: 1, free: 1},
+		{name: "/32", pool: "10.99.0.9/32", bits: 32, used: []string{"10.99.0.9/32"}, covered: 1, free: 0},
+		{name: "larger than the pool", pool: "10.20.0.0/16", bits: 8, covered: 0, free: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, used := netip.MustParsePrefix(tt.pool), prefixes(tt.used...)
+			if got := Covered(pool, used); got != tt.covered {
+				t.Errorf("Covered() = %v, want %v", got, tt.covered)
+			}
+			if got := Free(pool, tt.bits, used); got != tt.free {
+				t.Errorf("Free() = %v, want %v", got, tt.free)
+			}
+		})
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		want     [][2]int
+	}{
+		{name: "none"},
+		{name: "disjoint", prefixes: []string{"192.168.10.0/24", "192.168.11.0/24", "10.99.0.0/24"}},
+		{name: "adjacent /31", prefixes: []string{"10.99.0.4/31", "10.99.0.6/31", "10.99.0.3/32"}},
+		{
+			// A VLAN, a WireGuard tunnel inside the same range on another
+			// device and a DHCP range inside the VLAN
+			name:     "vlan, wireguard and dhcp",
+			prefixes: []string{"192.168.10.0/24", "10.99.0.0/24", "192.168.10.128/25", "192.168.0.0/16"},
+			want:     [][2]int{{0, 2}, {0, 3}, {2, 3}},
+		},
+		{name: "identical", prefixes: []string{"10.99.0.0/24", "10.99.0.0/24"}, want: [][2]int{{0, 1}}},
+		{name: "host bits", prefixes: []string{"10.99.0.1/24", "10.99.0.77/32"}, want: [][2]int{{0, 1}}},
+		{name: "broadcast address", prefixes: []string{"10.99.0.255/32", "10.99.0.0/24", "10.99.1.0/32"}, want: [][2]int{{0, 1}}},
+		{name: "ipv6", prefixes: []string{"fd00:4e47::/48", "fd00:4e48::/64", "fd00:4e47:0:9::/64"}, want: [][2]int{{0, 2}}},
+		{name: "mixed families", prefixes: []string{"0.0.0.0/0", "::/0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Overlaps(prefixes(tt.prefixes...))
+			if len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Overlaps() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
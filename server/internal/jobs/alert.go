@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/smtp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nexusgate/nexusgate/internal/model"
@@ -42,30 +43,84 @@ func getAlertThresholds(db *gorm.DB) alertThresholds {
 	return t
 }
 
+// HeartbeatSample is the part of a heartbeat checked against alert thresholds.
+type HeartbeatSample struct {
+	DeviceID   uint
+	DeviceName string
+	CPUUsage   float64
+	MemUsage   float64
+	Conntrack  int
+}
+
 // EvaluateDeviceAlerts checks a single heartbeat against thresholds and creates alerts.
-// Called from the MQTT handler on each heartbeat.
 func EvaluateDeviceAlerts(db *gorm.DB, hub *ws.Hub, deviceID uint, deviceName string, cpuUsage, memUsage float64, conntrack int) {
+	EvaluateHeartbeatAlerts(db, hub, []HeartbeatSample{{
+		DeviceID: deviceID, DeviceName: deviceName, CPUUsage: cpuUsage, MemUsage: memUsage, Conntrack: conntrack,
+	}})
+}
+
+// EvaluateHeartbeatAlerts checks a batch of heartbeats against thresholds.
+// Thresholds and open alerts are loaded once per batch, so a heartbeat below
+// every threshold with nothing to resolve costs no further queries.
+// Called from the heartbeat ingestion pipeline.
+func EvaluateHeartbeatAlerts(db *gorm.DB, hub *ws.Hub, samples []HeartbeatSample) {
+	if len(samples) == 0 {
+		return
+	}
 	t := getAlertThresholds(db)
+
+	ids := make([]uint, 0, len(samples))
+	for _, s := range samples {
+		ids = append(ids, s.DeviceID)
+	}
+	var rows []model.Alert
+	db.Select("device_id", "metric").
+		Where("device_id IN ? AND resolved = false AND source <> ?", ids, AlertSourceAlertmanager).
+		Find(&rows)
+	open := make(map[uint]map[string]bool)
+	for _, a := range rows {
+		if open[a.DeviceID] == nil {
+			open[a.DeviceID] = make(map[string]bool)
+		}
+		open[a.DeviceID][a.Metric] = true
+	}
+
+	for _, s := range samples {
+		if open[s.DeviceID] == nil {
+			open[s.DeviceID] = make(map[string]bool)
+		}
+		evaluateDeviceAlerts(db, hub, t, open[s.DeviceID], s)
+	}
+}
+
+func evaluateDeviceAlerts(db *gorm.DB, hub *ws.Hub, t alertThresholds, open map[string]bool, s HeartbeatSample) {
+	deviceID, deviceName := s.DeviceID, s.DeviceName
 	now := time.Now()
 
 	check := func(metric string, value, threshold float64) {
 		if value < threshold {
+			if !open[metric] {
+				return
+			}
 			// Auto-resolve if previously alerting
-			db.Model(&model.Alert{}).
-				Where("device_id = ? AND metric = ? AND resolved = false", deviceID, metric).
-				Updates(map[string]any{"resolved": true, "resolved_at": &now})
+			var alerts []model.Alert
+			db.Where("device_id = ? AND metric = ? AND resolved = false AND source <> ?", deviceID, metric, AlertSourceAlertmanager).
+				Find(&alerts)
+			ResolveAlerts(db, hub, alerts)
+			open[metric] = false
 			return
 		}
 		// Check if there's already an unresolved alert for this device+metric
 		var existing model.Alert
-		if err := db.Where("device_id = ? AND metric = ? AND resolved = false", deviceID, metric).
-			First(&existing).Error; err == nil {
+		if open[metric] && db.Where("device_id = ? AND metric = ? AND resolved = false AND source <> ?", deviceID, metric, AlertSourceAlertmanager).
+			First(&existing).Error == nil {
 			// Update value on existing alert
 			db.Model(&existing).Update("value", value)
 			return
 		}
 		// Create new alert
 		alert := model.Alert{
+			Source:     "threshold",
 			DeviceID:   deviceID,
 			DeviceName: deviceName,
 			Metric:     metric,
@@ -76,8 +131,18 @@ func EvaluateDeviceAlerts(db *gorm.DB, hub *ws.Hub, deviceID uint, deviceName st
 		if value > threshold*1.2 {
 			alert.Severity = model.SeverityCritical
 		}
+		labels := getAlertLabels(db, deviceID)
+		if silenced, silenceID, note := checkSilenced(db, deviceID, labels.Group, metric, alert.Severity, now); silenced {
+			alert.Silenced = true
+			alert.SilenceID = silenceID
+			alert.SilenceNote = note
+		}
 		db.Create(&alert)
-		log.Printf("ALERT: device=%s metric=%s value=%.1f threshold=%.1f", deviceName, metric, value, threshold)
+		open[metric] = true
+		log.Printf("ALERT: device=%s metric=%s value=%.1f threshold=%.1f silenced=%v", deviceName, metric, value, threshold, alert.Silenced)
+
+		// Roll the alert into an incident, which notifies once for all its members
+		notify := assignIncident(db, hub, &alert, labels)
 
 		// Broadcast to WebSocket
 		if hub != nil {
@@ -89,16 +154,127 @@ func EvaluateDeviceAlerts(db *gorm.DB, hub *ws.Hub, deviceID uint, deviceName st
 				"value":       value,
 				"threshold":   threshold,
 				"severity":    alert.Severity,
+				"silenced":    alert.Silenced,
+				"incident_id": alert.IncidentID,
 			})
 		}
 
-		// Dispatch notification
+		// Silenced alerts are recorded but never notify
+		if notify {
+			dispatchNotification(db, alert)
+		}
+		ForwardToAlertmanager(db, []model.Alert{alert})
+	}
+
+	check("cpu", s.CPUUsage, t.CPU)
+	check("memory", s.MemUsage, t.Memory)
+	check("conntrack", float64(s.Conntrack), float64(t.Conntrack))
+}
+
+// AlertSourceSSH marks alerts raised by the SSH client.
+const AlertSourceSSH = "ssh"
+
+// RaiseEventAlert opens an alert for an event rather than a threshold
+// breach, such as a changed SSH host key, unless one for the same device
+// and metric is still open. It is silenced, grouped and notified like a
+// threshold alert; an admin resolves it once the cause is dealt with.
+func RaiseEventAlert(db *gorm.DB, hub *ws.Hub, device model.Device, source, metric string, severity model.AlertSeverity, description string) {
+	var existing model.Alert
+	if db.Where("device_id = ? AND metric = ? AND source = ? AND resolved = false", device.ID, metric, source).
+		First(&existing).Error == nil {
+		db.Model(&existing).Update("description", description)
+		return
+	}
+	alert := model.Alert{
+		Source:      source,
+		DeviceID:    device.ID,
+		DeviceName:  device.Name,
+		Metric:      metric,
+		Severity:    severity,
+		Description: description,
+	}
+	labels := getAlertLabels(db, device.ID)
+	if silenced, silenceID, note := checkSilenced(db, device.ID, labels.Group, metric, severity, time.Now()); silenced {
+		alert.Silenced = true
+		alert.SilenceID = silenceID
+		alert.SilenceNote = note
+	}
+	if err := db.Create(&alert).Error; err != nil {
+		log.Printf("failed to store %s alert for device %s: %v", metric, device.Name, err)
+		return
+	}
+	log.Printf("ALERT: device=%s metric=%s %s silenced=%v", device.Name, metric, description, alert.Silenced)
+
+	notify := assignIncident(db, hub, &alert, labels)
+	if hub != nil {
+		hub.Broadcast("alert", map[string]any{
+			"id":          alert.ID,
+			"device_id":   alert.DeviceID,
+			"device_name": alert.DeviceName,
+			"metric":      metric,
+			"severity":    severity,
+			"source":      source,
+			"description": description,
+			"silenced":    alert.Silenced,
+			"incident_id": alert.IncidentID,
+		})
+	}
+	if notify {
 		dispatchNotification(db, alert)
 	}
+	ForwardToAlertmanager(db, []model.Alert{alert})
+}
+
+// upgradeSilenceMaxAge bounds how long a firmware upgrade mutes its device's
+// alerts; an upgrade still unfinished after that is assumed stuck.
+const upgradeSilenceMaxAge = 1 * time.Hour
+
+// checkSilenced reports whether a new alert should be muted, either because the
+// device is mid firmware upgrade or because an active silence matches it.
+func checkSilenced(db *gorm.DB, deviceID uint, group, metric string, severity model.AlertSeverity, now time.Time) (bool, *uint, string) {
+	var upgrading int64
+	db.Model(&model.FirmwareUpgrade{}).
+		Where("device_id = ? AND status IN ? AND COALESCE(started_at, created_at) > ?",
+			deviceID, []string{"pending", "downloading", "verifying", "upgrading"}, now.Add(-upgradeSilenceMaxAge)).
+		Count(&upgrading)
+	if upgrading > 0 {
+		return true, nil, "firmware upgrade in progress"
+	}
+
+	var silences []model.AlertSilence
+	db.Where("starts_at <= ? AND expires_at > ?", now, now).Find(&silences)
+	if len(silences) == 0 {
+		return false, nil, ""
+	}
+
+	for _, s := range silences {
+		if silenceMatches(s, deviceID, group, metric, severity) {
+			id := s.ID
+			note := s.Comment
+			if note == "" {
+				note = s.Kind
+			}
+			return true, &id, note
+		}
+	}
+	return false, nil, ""
+}
 
-	check("cpu", cpuUsage, t.CPU)
-	check("memory", memUsage, t.Memory)
-	check("conntrack", float64(conntrack), float64(t.Conntrack))
+// silenceMatches reports whether every non-empty matcher of s applies to the alert labels.
+func silenceMatches(s model.AlertSilence, deviceID uint, group, metric string, severity model.AlertSeverity) bool {
+	if s.DeviceID != 0 && s.DeviceID != deviceID {
+		return false
+	}
+	if s.Group != "" && s.Group != group {
+		return false
+	}
+	if s.Metric != "" && s.Metric != metric {
+		return false
+	}
+	if s.Severity != "" && s.Severity != severity {
+		return false
+	}
+	return true
 }
 
 func dispatchNotification(db *gorm.DB, alert model.Alert) {
@@ -124,6 +300,12 @@ func dispatchNotification(db *gorm.DB, alert model.Alert) {
 }
 
 func sendWebhook(url string, alert model.Alert) {
+	if err := postWebhook(url, alert); err != nil {
+		log.Printf("webhook send failed: %v", err)
+	}
+}
+
+func postWebhook(url string, alert model.Alert) error {
 	payload, _ := json.Marshal(map[string]any{
 		"device_name": alert.DeviceName,
 		"device_id":   alert.DeviceID,
@@ -131,24 +313,56 @@ func sendWebhook(url string, alert model.Alert) {
 		"value":       alert.Value,
 		"threshold":   alert.Threshold,
 		"severity":    alert.Severity,
+		"incident_id": alert.IncidentID,
 		"time":        alert.CreatedAt.Format(time.RFC3339),
 	})
+	return postJSON(url, payload)
+}
 
+func postJSON(url string, payload []byte) error {
 	resp, err := http.Post(url, "application/json", bytes.NewReader(payload))
 	if err != nil {
-		log.Printf("webhook send failed: %v", err)
-		return
+		return err
 	}
 	resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		log.Printf("webhook returned status %d", resp.StatusCode)
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
 	}
+	return nil
 }
 
 // sendEmailAlert sends an alert email using SMTP settings from system_settings.
 // Required settings: smtp_host, smtp_port, smtp_from, smtp_to
 // Optional settings: smtp_user, smtp_pass
 func sendEmailAlert(db *gorm.DB, alert model.Alert) {
+	var s model.SystemSetting
+	if err := db.Where("\"key\" = ?", "smtp_to").First(&s).Error; err != nil || s.Value == "" {
+		log.Println("email alert: SMTP settings incomplete (need smtp_host, smtp_from, smtp_to)")
+		return
+	}
+	if err := sendEmailAlertTo(db, alert, s.Value); err != nil {
+		log.Printf("email alert send failed: %v", err)
+		return
+	}
+	log.Printf("email alert sent to %s for device %s", s.Value, alert.DeviceName)
+}
+
+// sendEmailAlertTo sends an alert email to the given recipients using the SMTP
+// settings from system_settings.
+func sendEmailAlertTo(db *gorm.DB, alert model.Alert, to string) error {
+	subject := fmt.Sprintf("[NexusGate %s] %s alert on %s", alert.Severity, alert.Metric, alert.DeviceName)
+	body := fmt.Sprintf("Device: %s (ID: %d)\nMetric: %s\nValue: %.1f\nThreshold: %.1f\nSeverity: %s\nTime: %s",
+		alert.DeviceName, alert.DeviceID, alert.Metric, alert.Value, alert.Threshold, alert.Severity,
+		alert.CreatedAt.Format(time.RFC3339))
+	if alert.Description != "" {
+		body += "\n\n" + alert.Description
+	}
+	return sendEmail(db, to, subject, body)
+}
+
+// sendEmail sends a plain text email to the given comma-separated
+// recipients using the SMTP settings from system_settings.
+func sendEmail(db *gorm.DB, to, subject, body string) error {
 	getSetting := func(key string) string {
 		var s model.SystemSetting
 		if err := db.Where("\"key\" = ?", key).First(&s).Error; err == nil {
@@ -160,21 +374,14 @@ func sendEmailAlert(db *gorm.DB, alert model.Alert) {
 	host := getSetting("smtp_host")
 	port := getSetting("smtp_port")
 	from := getSetting("smtp_from")
-	to := getSetting("smtp_to")
 
 	if host == "" || from == "" || to == "" {
-		log.Println("email alert: SMTP settings incomplete (need smtp_host, smtp_from, smtp_to)")
-		return
+		return fmt.Errorf("SMTP settings incomplete (need smtp_host, smtp_from and a recipient)")
 	}
 	if port == "" {
 		port = "25"
 	}
 
-	subject := fmt.Sprintf("[NexusGate %s] %s alert on %s", alert.Severity, alert.Metric, alert.DeviceName)
-	body := fmt.Sprintf("Device: %s (ID: %d)\nMetric: %s\nValue: %.1f\nThreshold: %.1f\nSeverity: %s\nTime: %s",
-		alert.DeviceName, alert.DeviceID, alert.Metric, alert.Value, alert.Threshold, alert.Severity,
-		alert.CreatedAt.Format(time.RFC3339))
-
 	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
 		from, to, subject, body)
 
@@ -186,9 +393,11 @@ func sendEmailAlert(db *gorm.DB, alert model.Alert) {
 		auth = smtp.PlainAuth("", user, pass, host)
 	}
 
-	if err := smtp.SendMail(addr, auth, from, []string{to}, []byte(msg)); err != nil {
-		log.Printf("email alert send failed: %v", err)
-		return
+	var recipients []string
+	for _, r := range strings.Split(to, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			recipients = append(recipients, r)
+		}
 	}
-	log.Printf("email alert sent to %s for device %s", to, alert.DeviceName)
+	return smtp.SendMail(addr, auth, from, recipients, []byte(msg))
 }
@@ -0,0 +1,165 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+// AlertSourceAlertmanager marks alerts received from the Alertmanager webhook.
+// They are never forwarded back to Alertmanager.
+const AlertSourceAlertmanager = "alertmanager"
+
+// alertmanagerAlert is one entry of the Alertmanager /api/v2/alerts payload.
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+var alertmanagerClient = &http.Client{Timeout: 10 * time.Second}
+
+// ResolveAlerts marks open alerts resolved, forwards the resolution to
+// Alertmanager and closes incidents left without open members.
+func ResolveAlerts(db *gorm.DB, hub *ws.Hub, alerts []model.Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+	now := time.Now()
+	ids := make([]uint, 0, len(alerts))
+	var incidentIDs []uint
+	for i := range alerts {
+		ids = append(ids, alerts[i].ID)
+		alerts[i].Resolved = true
+		alerts[i].ResolvedAt = &now
+		if alerts[i].IncidentID != nil {
+			incidentIDs = append(incidentIDs, *alerts[i].IncidentID)
+		}
+	}
+	db.Model(&model.Alert{}).Where("id IN ? AND resolved = false", ids).
+		Updates(map[string]any{"resolved": true, "resolved_at": &now})
+
+	ForwardToAlertmanager(db, alerts)
+	ResolveIncidents(db, hub, incidentIDs)
+}
+
+// alertmanagerResendInterval is how often open alerts are re-sent. Alertmanager
+// resolves an alert it has not heard of for resolve_timeout (5m by default), so
+// it must be well below that.
+const alertmanagerResendInterval = time.Minute
+
+// StartAlertmanagerResend periodically re-sends open alerts to Alertmanager so
+// that it does not resolve alerts that are still firing.
+func StartAlertmanagerResend(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(alertmanagerResendInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			resendOpenAlerts(db)
+		}
+	}()
+	log.Printf("alertmanager resend job started (interval: %s)", alertmanagerResendInterval)
+}
+
+func resendOpenAlerts(db *gorm.DB) {
+	var setting model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alertmanager_url").First(&setting).Error; err != nil || setting.Value == "" {
+		return
+	}
+	var alerts []model.Alert
+	db.Where("resolved = false AND silenced = false AND source <> ?", AlertSourceAlertmanager).Find(&alerts)
+	ForwardToAlertmanager(db, alerts)
+}
+
+// ForwardToAlertmanager posts alerts to the Alertmanager configured by the
+// "alertmanager_url" setting. Resolved alerts are sent with endsAt set.
+// It runs asynchronously and is a no-op when forwarding is not configured.
+func ForwardToAlertmanager(db *gorm.DB, alerts []model.Alert) {
+	var setting model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alertmanager_url").First(&setting).Error; err != nil || setting.Value == "" {
+		return
+	}
+
+	var payload []alertmanagerAlert
+	for _, a := range alerts {
+		if a.Source == AlertSourceAlertmanager || a.Silenced {
+			continue
+		}
+		payload = append(payload, buildAlertmanagerAlert(db, a))
+	}
+	if len(payload) == 0 {
+		return
+	}
+
+	url := strings.TrimRight(setting.Value, "/") + "/api/v2/alerts"
+	go func() {
+		if err := postAlertmanager(url, payload); err != nil {
+			log.Printf("alertmanager forward failed: %v", err)
+		}
+	}()
+}
+
+func buildAlertmanagerAlert(db *gorm.DB, a model.Alert) alertmanagerAlert {
+	var device model.Device
+	db.Select("id", "name", "mac", "group", "model").First(&device, a.DeviceID)
+
+	labels := map[string]string{
+		"alertname": "nexusgate_" + a.Metric,
+		"source":    "nexusgate",
+		"metric":    a.Metric,
+		"severity":  string(a.Severity),
+		"device":    device.Name,
+		"mac":       device.MAC,
+	}
+	if device.Group != "" {
+		labels["group"] = device.Group
+	}
+	if device.Model != "" {
+		labels["model"] = device.Model
+	}
+
+	summary := fmt.Sprintf("%s on %s is %.1f (threshold %.1f)", a.Metric, device.Name, a.Value, a.Threshold)
+	if a.Description != "" {
+		summary = a.Description
+	}
+	out := alertmanagerAlert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary":   summary,
+			"value":     fmt.Sprintf("%.2f", a.Value),
+			"threshold": fmt.Sprintf("%.2f", a.Threshold),
+			"alert_id":  fmt.Sprintf("%d", a.ID),
+		},
+		StartsAt: a.CreatedAt,
+	}
+	if a.Resolved && a.ResolvedAt != nil {
+		out.EndsAt = a.ResolvedAt
+	}
+	return out
+}
+
+func postAlertmanager(url string, payload []alertmanagerAlert) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := alertmanagerClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alertmanager returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,12 +1,12 @@
 package jobs
 
 import (
-	"fmt"
 	"log"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
 	"gorm.io/gorm"
 )
 
@@ -69,15 +69,16 @@ func runAutoUpgrade(db *gorm.DB, mqttClient mqtt.Client) {
 			continue
 		}
 
-		// Skip if device is already on this firmware version
-		if device.Firmware == fw.Version {
+		// Skip if device is already on this firmware version or its agent
+		// cannot upgrade
+		if device.Firmware == fw.Version || !protocol.Supports(device, protocol.CapCommandUpgrade) {
 			continue
 		}
 
 		// Skip if there's already a pending/in-progress upgrade for this device
 		var pendingCount int64
 		db.Model(&model.FirmwareUpgrade{}).
-			Where("device_id = ? AND status IN ?", device.ID, []string{"pending", "downloading", "upgrading"}).
+			Where("device_id = ? AND status IN ?", device.ID, []string{"pending", "downloading", "verifying", "upgrading"}).
 			Count(&pendingCount)
 		if pendingCount > 0 {
 			continue
@@ -92,10 +93,11 @@ func runAutoUpgrade(db *gorm.DB, mqttClient mqtt.Client) {
 		}
 		db.Create(&upgrade)
 
-		topic := fmt.Sprintf("nexusgate/devices/%s/command", device.MAC)
-		payload := fmt.Sprintf(`{"action":"upgrade","url":"%s","sha256":"%s","version":"%s"}`,
-			fw.DownloadURL, fw.SHA256, fw.Version)
-		mqttClient.Publish(topic, 1, false, payload)
+		fields := protocol.UpgradeFields(device, upgrade.ID, fw.DownloadURL, fw.SHA256, fw.Version)
+		if err := protocol.PublishCommand(mqttClient, device, "upgrade", fields); err != nil {
+			log.Printf("auto-upgrade: failed to push firmware to %s: %v", device.Name, err)
+			continue
+		}
 		upgradedCount++
 	}
 
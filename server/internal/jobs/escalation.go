@@ -0,0 +1,210 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+// EscalationStep is one entry of the EscalationPolicy.Steps JSON. Exactly one of
+// ChannelID or ScheduleID should be set.
+type EscalationStep struct {
+	AfterMinutes int  `json:"after_minutes"`
+	ChannelID    uint `json:"channel_id,omitempty"`
+	ScheduleID   uint `json:"schedule_id,omitempty"`
+}
+
+// ParseEscalationSteps decodes the Steps JSON of an escalation policy.
+func ParseEscalationSteps(raw string) ([]EscalationStep, error) {
+	var steps []EscalationStep
+	if raw == "" {
+		return steps, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &steps); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// CurrentOnCall returns the username on call for the schedule at time t.
+func CurrentOnCall(s model.OnCallSchedule, t time.Time) string {
+	var users []string
+	for _, u := range strings.Split(s.Users, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			users = append(users, u)
+		}
+	}
+	if len(users) == 0 {
+		return ""
+	}
+	rotation := s.RotationHours
+	if rotation <= 0 {
+		rotation = 168
+	}
+	if t.Before(s.StartAt) {
+		return users[0]
+	}
+	shifts := int(t.Sub(s.StartAt) / (time.Duration(rotation) * time.Hour))
+	return users[shifts%len(users)]
+}
+
+// StartEscalationJob periodically walks open alerts through their escalation
+// policy, sending the next step once its delay has elapsed.
+func StartEscalationJob(db *gorm.DB, hub *ws.Hub) {
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			runEscalations(db, hub)
+		}
+	}()
+	log.Println("alert escalation job started (interval: 1m)")
+}
+
+func runEscalations(db *gorm.DB, hub *ws.Hub) {
+	var policies []model.EscalationPolicy
+	db.Where("enabled = true").Order("id").Find(&policies)
+	if len(policies) == 0 {
+		return
+	}
+
+	var alerts []model.Alert
+	db.Where("resolved = false AND acknowledged = false AND silenced = false").Order("id").Find(&alerts)
+	if len(alerts) == 0 {
+		return
+	}
+
+	groups := make(map[uint]string)
+	incidents := make(map[uint]bool)
+	now := time.Now()
+	for _, alert := range alerts {
+		// An incident escalates once per run, through its oldest open member
+		// that has a step due; members without a policy or with no steps
+		// left do not hold the others back.
+		if alert.IncidentID != nil && incidents[*alert.IncidentID] {
+			continue
+		}
+
+		group, ok := groups[alert.DeviceID]
+		if !ok {
+			var device model.Device
+			db.Select("id", "group").First(&device, alert.DeviceID)
+			group = device.Group
+			groups[alert.DeviceID] = group
+		}
+
+		policy := matchEscalationPolicy(policies, alert.Severity, group)
+		if policy == nil {
+			continue
+		}
+		steps, err := ParseEscalationSteps(policy.Steps)
+		if err != nil {
+			log.Printf("warning: failed to parse escalation policy %s steps: %v", policy.Name, err)
+			continue
+		}
+		if alert.EscalationStep >= len(steps) {
+			continue
+		}
+		step := steps[alert.EscalationStep]
+		if now.Sub(alert.CreatedAt) < time.Duration(step.AfterMinutes)*time.Minute {
+			continue
+		}
+
+		record := sendEscalationStep(db, alert, step)
+		record.AlertID = alert.ID
+		record.PolicyID = policy.ID
+		record.Step = alert.EscalationStep
+		db.Create(&record)
+		db.Model(&model.Alert{}).Where("id = ?", alert.ID).Update("escalation_step", alert.EscalationStep+1)
+		if alert.IncidentID != nil {
+			incidents[*alert.IncidentID] = true
+		}
+
+		log.Printf("alert %d escalated: policy=%s step=%d channel=%s status=%s", alert.ID, policy.Name, record.Step, record.Channel, record.Status)
+		if hub != nil {
+			hub.Broadcast("alert_escalation", map[string]any{
+				"alert_id":  alert.ID,
+				"policy_id": policy.ID,
+				"step":      record.Step,
+				"channel":   record.Channel,
+				"recipient": record.Recipient,
+				"status":    record.Status,
+			})
+		}
+	}
+}
+
+// matchEscalationPolicy returns the first policy whose severity and group match.
+func matchEscalationPolicy(policies []model.EscalationPolicy, severity model.AlertSeverity, group string) *model.EscalationPolicy {
+	for i := range policies {
+		p := &policies[i]
+		if p.Severity != "" && p.Severity != severity {
+			continue
+		}
+		if p.Group != "" && p.Group != group {
+			continue
+		}
+		return p
+	}
+	return nil
+}
+
+// sendEscalationStep delivers one step synchronously and returns its record.
+func sendEscalationStep(db *gorm.DB, alert model.Alert, step EscalationStep) model.AlertEscalation {
+	record := model.AlertEscalation{Status: "sent"}
+	fail := func(err error) model.AlertEscalation {
+		record.Status = "failed"
+		record.Error = err.Error()
+		return record
+	}
+
+	if step.ScheduleID != 0 {
+		var schedule model.OnCallSchedule
+		if err := db.First(&schedule, step.ScheduleID).Error; err != nil {
+			return fail(fmt.Errorf("on-call schedule %d not found", step.ScheduleID))
+		}
+		record.Channel = "oncall:" + schedule.Name
+		username := CurrentOnCall(schedule, time.Now())
+		if username == "" {
+			return fail(fmt.Errorf("on-call schedule %s has no users", schedule.Name))
+		}
+		record.Recipient = username
+		var user model.User
+		if err := db.Where("username = ?", username).First(&user).Error; err != nil || user.Email == "" {
+			return fail(fmt.Errorf("on-call user %s has no email address", username))
+		}
+		if err := sendEmailAlertTo(db, alert, user.Email); err != nil {
+			return fail(err)
+		}
+		return record
+	}
+
+	var channel model.NotificationChannel
+	if err := db.First(&channel, step.ChannelID).Error; err != nil {
+		return fail(fmt.Errorf("notification channel %d not found", step.ChannelID))
+	}
+	record.Channel = channel.Name
+	record.Recipient = channel.Target
+	switch channel.Type {
+	case "webhook":
+		if err := postWebhook(channel.Target, alert); err != nil {
+			return fail(err)
+		}
+	case "email":
+		if err := sendEmailAlertTo(db, alert, channel.Target); err != nil {
+			return fail(err)
+		}
+	case "log":
+		log.Printf("ALERT ESCALATION [%s]: device=%s metric=%s value=%.1f threshold=%.1f",
+			alert.Severity, alert.DeviceName, alert.Metric, alert.Value, alert.Threshold)
+	default:
+		return fail(fmt.Errorf("unsupported channel type %q", channel.Type))
+	}
+	return record
+}
@@ -0,0 +1,313 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/ws"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultIncidentWindow    = 300 // seconds
+	defaultIncidentGroupWait = 30  // seconds
+)
+
+// alertLabels are the device-level labels used to group alerts into incidents.
+type alertLabels struct {
+	Group  string
+	Uplink string // from an "uplink=<name>" or "uplink:<name>" device tag
+}
+
+func getAlertLabels(db *gorm.DB, deviceID uint) alertLabels {
+	var device model.Device
+	db.Select("id", "group", "tags").First(&device, deviceID)
+	labels := alertLabels{Group: device.Group}
+	for _, tag := range strings.Split(device.Tags, ",") {
+		tag = strings.TrimSpace(tag)
+		for _, prefix := range []string{"uplink=", "uplink:"} {
+			if strings.HasPrefix(tag, prefix) {
+				labels.Uplink = strings.TrimPrefix(tag, prefix)
+			}
+		}
+	}
+	return labels
+}
+
+// incidentSettings reads the grouping labels ("alert_group_by", default
+// "group,metric") and the sliding window ("alert_group_window" in seconds).
+func incidentSettings(db *gorm.DB) ([]string, time.Duration) {
+	groupBy := []string{"group", "metric"}
+	window := defaultIncidentWindow
+
+	var s model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alert_group_by").First(&s).Error; err == nil {
+		groupBy = nil
+		for _, l := range strings.Split(s.Value, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				groupBy = append(groupBy, l)
+			}
+		}
+	}
+	var w model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alert_group_window").First(&w).Error; err == nil {
+		if v, err := strconv.Atoi(w.Value); err == nil && v > 0 {
+			window = v
+		}
+	}
+	return groupBy, time.Duration(window) * time.Second
+}
+
+// incidentKey builds the grouping key for an alert. It returns "" when the
+// alert cannot be grouped, e.g. the device has no group but grouping is by group.
+func incidentKey(groupBy []string, labels alertLabels, metric string) string {
+	var parts []string
+	for _, l := range groupBy {
+		var v string
+		switch l {
+		case "group":
+			v = labels.Group
+		case "uplink":
+			v = labels.Uplink
+		case "metric":
+			v = metric
+		default:
+			continue
+		}
+		if v == "" {
+			return ""
+		}
+		parts = append(parts, l+"="+v)
+	}
+	return strings.Join(parts, "|")
+}
+
+// assignIncident attaches a new alert to an open incident with the same grouping
+// key that saw activity within the window, or opens a new incident. It reports
+// whether the alert should notify on its own, which only an ungrouped,
+// unsilenced alert does; incidents notify through notifyIncidents.
+func assignIncident(db *gorm.DB, hub *ws.Hub, alert *model.Alert, labels alertLabels) bool {
+	groupBy, window := incidentSettings(db)
+	key := incidentKey(groupBy, labels, alert.Metric)
+	if key == "" {
+		return !alert.Silenced
+	}
+
+	now := time.Now()
+	var incident model.Incident
+	created := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The ingest workers evaluate devices of one group in parallel;
+		// the lock keeps them from opening an incident each for the key.
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "incident:"+key).Error; err != nil {
+			return err
+		}
+		err := tx.Where("group_key = ? AND status = ? AND updated_at >= ?", key, model.IncidentOpen, now.Add(-window)).
+			Order("id DESC").First(&incident).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			incident = model.Incident{
+				GroupKey:   key,
+				Title:      fmt.Sprintf("%s alerts (%s)", alert.Metric, strings.ReplaceAll(key, "|", ", ")),
+				Severity:   alert.Severity,
+				Status:     model.IncidentOpen,
+				AlertCount: 1,
+			}
+			created = true
+			return tx.Create(&incident).Error
+		} else if err != nil {
+			return err
+		}
+		updates := map[string]any{"alert_count": gorm.Expr("alert_count + 1"), "updated_at": now}
+		if alert.Severity == model.SeverityCritical {
+			updates["severity"] = model.SeverityCritical
+		}
+		if err := tx.Model(&incident).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.First(&incident, incident.ID).Error
+	})
+	if err != nil {
+		log.Printf("failed to assign alert %d to an incident for %s: %v", alert.ID, key, err)
+		return !alert.Silenced
+	}
+
+	alert.IncidentID = &incident.ID
+	db.Model(alert).Update("incident_id", incident.ID)
+
+	if hub != nil {
+		action := "updated"
+		if created {
+			action = "created"
+		}
+		hub.Broadcast("incident", map[string]any{
+			"action":      action,
+			"id":          incident.ID,
+			"group_key":   incident.GroupKey,
+			"title":       incident.Title,
+			"severity":    incident.Severity,
+			"status":      incident.Status,
+			"alert_count": incident.AlertCount,
+			"alert_id":    alert.ID,
+		})
+	}
+	return false
+}
+
+// StartIncidentNotifier periodically sends the notifications of new
+// incidents. An incident waits "alert_group_wait" seconds (default 30)
+// after it opens, so that its one notification lists the alerts that
+// arrived together.
+func StartIncidentNotifier(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			notifyIncidents(db, time.Now())
+		}
+	}()
+	log.Println("incident notifier started (interval: 10s)")
+}
+
+// notifyIncidents notifies the open incidents past their group wait that
+// have not notified yet and have an open, unsilenced member. An incident
+// whose members are all silenced notifies once one of them is released.
+func notifyIncidents(db *gorm.DB, now time.Time) {
+	wait := defaultIncidentGroupWait
+	var s model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alert_group_wait").First(&s).Error; err == nil {
+		if v, err := strconv.Atoi(s.Value); err == nil && v >= 0 {
+			wait = v
+		}
+	}
+
+	var incidents []model.Incident
+	db.Where("status = ? AND notified = false AND created_at <= ? AND id IN (?)",
+		model.IncidentOpen, now.Add(-time.Duration(wait)*time.Second),
+		db.Model(&model.Alert{}).Select("incident_id").Where("resolved = false AND silenced = false AND incident_id IS NOT NULL")).
+		Order("id").Find(&incidents)
+	for _, incident := range incidents {
+		// Claim the notification so a second server cannot send it as well
+		if db.Model(&model.Incident{}).Where("id = ? AND notified = false", incident.ID).
+			Update("notified", true).RowsAffected != 1 {
+			continue
+		}
+		var members []model.Alert
+		db.Where("incident_id = ?", incident.ID).Order("id").Find(&members)
+		dispatchIncidentNotification(db, incident, members)
+	}
+}
+
+// dispatchIncidentNotification sends one notification for an incident that
+// lists its member alerts, through the configured notification method.
+func dispatchIncidentNotification(db *gorm.DB, incident model.Incident, members []model.Alert) {
+	var methodSetting model.SystemSetting
+	if err := db.Where("\"key\" = ?", "alert_notify_method").First(&methodSetting).Error; err != nil {
+		return // No notification method configured
+	}
+
+	switch methodSetting.Value {
+	case "webhook":
+		var urlSetting model.SystemSetting
+		if err := db.Where("\"key\" = ?", "alert_webhook_url").First(&urlSetting).Error; err != nil || urlSetting.Value == "" {
+			log.Println("alert webhook URL not configured")
+			return
+		}
+		alerts := make([]map[string]any, 0, len(members))
+		for _, a := range members {
+			alerts = append(alerts, map[string]any{
+				"id":          a.ID,
+				"device_name": a.DeviceName,
+				"device_id":   a.DeviceID,
+				"metric":      a.Metric,
+				"value":       a.Value,
+				"threshold":   a.Threshold,
+				"severity":    a.Severity,
+				"silenced":    a.Silenced,
+				"resolved":    a.Resolved,
+				"time":        a.CreatedAt.Format(time.RFC3339),
+			})
+		}
+		payload, _ := json.Marshal(map[string]any{
+			"incident_id": incident.ID,
+			"title":       incident.Title,
+			"group_key":   incident.GroupKey,
+			"severity":    incident.Severity,
+			"alert_count": len(members),
+			"alerts":      alerts,
+			"time":        incident.CreatedAt.Format(time.RFC3339),
+		})
+		go func() {
+			if err := postJSON(urlSetting.Value, payload); err != nil {
+				log.Printf("webhook send failed: %v", err)
+			}
+		}()
+	case "email":
+		var to model.SystemSetting
+		if err := db.Where("\"key\" = ?", "smtp_to").First(&to).Error; err != nil || to.Value == "" {
+			log.Println("email alert: SMTP settings incomplete (need smtp_host, smtp_from, smtp_to)")
+			return
+		}
+		subject := fmt.Sprintf("[NexusGate %s] %s: %d alerts", incident.Severity, incident.Title, len(members))
+		go func() {
+			if err := sendEmail(db, to.Value, subject, incidentSummary(incident, members)); err != nil {
+				log.Printf("email alert send failed: %v", err)
+				return
+			}
+			log.Printf("email alert sent to %s for incident %d", to.Value, incident.ID)
+		}()
+	case "log":
+		log.Printf("INCIDENT NOTIFICATION [%s]: %s\n%s", incident.Severity, incident.Title, incidentSummary(incident, members))
+	}
+}
+
+// incidentSummary is the plain text body of an incident notification.
+func incidentSummary(incident model.Incident, members []model.Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Incident: %s (ID: %d)\nGrouped by: %s\nSeverity: %s\nOpened: %s\n\nAlerts (%d):\n",
+		incident.Title, incident.ID, incident.GroupKey, incident.Severity, incident.CreatedAt.Format(time.RFC3339), len(members))
+	for _, a := range members {
+		fmt.Fprintf(&b, "- %s (ID: %d) %s [%s] value=%.1f threshold=%.1f", a.DeviceName, a.DeviceID, a.Metric, a.Severity, a.Value, a.Threshold)
+		switch {
+		case a.Resolved:
+			b.WriteString(" resolved")
+		case a.Silenced:
+			b.WriteString(" silenced")
+		}
+		if a.Description != "" {
+			b.WriteString(": " + a.Description)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ResolveIncidents closes the given incidents once all their member alerts are resolved.
+func ResolveIncidents(db *gorm.DB, hub *ws.Hub, incidentIDs []uint) {
+	now := time.Now()
+	for _, id := range incidentIDs {
+		var open int64
+		db.Model(&model.Alert{}).Where("incident_id = ? AND resolved = false", id).Count(&open)
+		if open > 0 {
+			continue
+		}
+		result := db.Model(&model.Incident{}).Where("id = ? AND status = ?", id, model.IncidentOpen).
+			Updates(map[string]any{"status": model.IncidentResolved, "resolved_at": &now})
+		if result.RowsAffected == 0 {
+			continue
+		}
+		log.Printf("incident %d resolved", id)
+		if hub != nil {
+			hub.Broadcast("incident", map[string]any{
+				"action": "resolved",
+				"id":     id,
+				"status": model.IncidentResolved,
+			})
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/nexusgate/nexusgate/internal/heartbeat"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/store"
 	"github.com/nexusgate/nexusgate/internal/ws"
 	"gorm.io/gorm"
 )
@@ -14,19 +16,19 @@ const defaultOfflineThreshold = 120 // seconds
 
 // StartOfflineDetector runs a periodic check that marks devices as offline
 // when their last_seen_at exceeds the configured threshold. It also broadcasts
-// status changes to WebSocket clients.
-func StartOfflineDetector(db *gorm.DB, hub *ws.Hub) {
+// status changes to WebSocket clients and records them in the heartbeat cache.
+func StartOfflineDetector(db *gorm.DB, hub *ws.Hub, heartbeats *heartbeat.Cache) {
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 		for range ticker.C {
-			checkOfflineDevices(db, hub)
+			checkOfflineDevices(db, hub, heartbeats)
 		}
 	}()
 	log.Println("offline detector started (interval: 30s)")
 }
 
-func checkOfflineDevices(db *gorm.DB, hub *ws.Hub) {
+func checkOfflineDevices(db *gorm.DB, hub *ws.Hub, heartbeats *heartbeat.Cache) {
 	threshold := defaultOfflineThreshold
 
 	// Try to read the threshold from system settings
@@ -52,6 +54,9 @@ func checkOfflineDevices(db *gorm.DB, hub *ws.Hub) {
 	}
 
 	db.Model(&model.Device{}).Where("id IN ?", ids).Update("status", model.StatusOffline)
+	if heartbeats != nil {
+		heartbeats.SetOffline(ids...)
+	}
 
 	log.Printf("marked %d device(s) as offline (threshold: %ds)", len(staleDevices), threshold)
 
@@ -67,49 +72,131 @@ func checkOfflineDevices(db *gorm.DB, hub *ws.Hub) {
 	}
 }
 
-// StartMetricsCleanup runs a daily cleanup of old device metrics and audit logs.
-func StartMetricsCleanup(db *gorm.DB) {
+// StartMetricsCleanup runs an hourly cleanup of old device metrics and audit
+// logs. Raw metrics are kept briefly; rollups keep the long-term history.
+// With TimescaleDB, metrics expire through retention policies instead, which
+// drop whole chunks rather than deleting rows.
+func StartMetricsCleanup(db *gorm.DB, caps store.Capabilities) {
 	go func() {
-		ticker := time.NewTicker(24 * time.Hour)
+		if caps.Timescale {
+			applyMetricsRetentionPolicies(db)
+		}
+		ticker := time.NewTicker(1 * time.Hour)
 		defer ticker.Stop()
 		for range ticker.C {
-			cleanupOldMetrics(db)
+			if caps.Timescale {
+				applyMetricsRetentionPolicies(db)
+			} else {
+				cleanupOldMetrics(db)
+			}
+			cleanupOldDetailMetrics(db)
 			cleanupOldAuditLogs(db)
+			cleanupDiagnostics(db)
+			cleanupOldLogs(db)
 		}
 	}()
-	log.Println("metrics/audit cleanup job started (interval: 24h)")
+	log.Println("metrics/audit/diagnostics/logs cleanup job started (interval: 1h)")
 }
 
 func cleanupOldMetrics(db *gorm.DB) {
-	retentionDays := 30
+	for _, r := range MetricsResolutions {
+		retention := MetricsRetention(db, r)
+		cutoff := time.Now().Add(-retention)
+
+		var result *gorm.DB
+		if r.Name == "raw" {
+			result = db.Where("collected_at < ?", cutoff).Delete(&model.DeviceMetrics{})
+		} else {
+			result = db.Where("resolution = ? AND bucket_start < ?", r.Name, cutoff).Delete(&model.DeviceMetricsRollup{})
+		}
+		if result.RowsAffected > 0 {
+			log.Printf("cleaned up %d old %s metric records (retention: %s)", result.RowsAffected, r.Name, retention)
+		}
+	}
+}
+
+// cleanupOldDetailMetrics deletes per-interface, filesystem, thermal and
+// wireless rows with the raw retention. These tables are plain tables in
+// both storage modes.
+func cleanupOldDetailMetrics(db *gorm.DB) {
+	retention := MetricsRetention(db, MetricsResolutions[0])
+	cutoff := time.Now().Add(-retention)
+	for name, m := range map[string]any{
+		"interface":  &model.DeviceInterfaceMetrics{},
+		"filesystem": &model.DeviceFilesystemMetrics{},
+		"thermal":    &model.DeviceThermalMetrics{},
+		"wireless":   &model.DeviceWirelessMetrics{},
+	} {
+		result := db.Where("collected_at < ?", cutoff).Delete(m)
+		if result.RowsAffected > 0 {
+			log.Printf("cleaned up %d old %s metric records (retention: %s)", result.RowsAffected, name, retention)
+		}
+	}
+}
+
+// applyMetricsRetentionPolicies syncs TimescaleDB retention policies with
+// the retention settings.
+func applyMetricsRetentionPolicies(db *gorm.DB) {
+	retention := make(map[string]time.Duration, len(MetricsResolutions))
+	for _, r := range MetricsResolutions {
+		retention[r.Name] = MetricsRetention(db, r)
+	}
+	store.ApplyTimescaleRetention(db, retention)
+}
+
+func cleanupOldAuditLogs(db *gorm.DB) {
+	retentionDays := 90
 
 	var setting model.SystemSetting
-	if err := db.Where("\"key\" = ?", "metrics_retention_days").First(&setting).Error; err == nil {
+	if err := db.Where("\"key\" = ?", "audit_retention_days").First(&setting).Error; err == nil {
 		if v, err := strconv.Atoi(setting.Value); err == nil && v > 0 {
 			retentionDays = v
 		}
 	}
 
 	cutoff := time.Now().AddDate(0, 0, -retentionDays)
-	result := db.Where("collected_at < ?", cutoff).Delete(&model.DeviceMetrics{})
+	result := db.Where("created_at < ?", cutoff).Delete(&model.AuditLog{})
 	if result.RowsAffected > 0 {
-		log.Printf("cleaned up %d old metric records (retention: %d days)", result.RowsAffected, retentionDays)
+		log.Printf("cleaned up %d old audit log records (retention: %d days)", result.RowsAffected, retentionDays)
 	}
 }
 
-func cleanupOldAuditLogs(db *gorm.DB) {
+// cleanupDiagnostics fails diagnostics left running by a server restart and
+// deletes the diagnostic history past its retention.
+func cleanupDiagnostics(db *gorm.DB) {
+	now := time.Now()
+	db.Model(&model.DeviceDiagnostic{}).
+		Where("status = ? AND started_at < ?", "running", now.Add(-10*time.Minute)).
+		Updates(map[string]any{"status": "failed", "error_msg": "interrupted", "finished_at": now})
+
 	retentionDays := 90
+	var setting model.SystemSetting
+	if err := db.Where("\"key\" = ?", "diagnostics_retention_days").First(&setting).Error; err == nil {
+		if v, err := strconv.Atoi(setting.Value); err == nil && v > 0 {
+			retentionDays = v
+		}
+	}
+
+	cutoff := now.AddDate(0, 0, -retentionDays)
+	result := db.Where("created_at < ?", cutoff).Delete(&model.DeviceDiagnostic{})
+	if result.RowsAffected > 0 {
+		log.Printf("cleaned up %d old diagnostic records (retention: %d days)", result.RowsAffected, retentionDays)
+	}
+}
 
+// cleanupOldLogs deletes device log entries past logs_retention_days.
+func cleanupOldLogs(db *gorm.DB) {
+	retentionDays := 14
 	var setting model.SystemSetting
-	if err := db.Where("\"key\" = ?", "audit_retention_days").First(&setting).Error; err == nil {
+	if err := db.Where("\"key\" = ?", "logs_retention_days").First(&setting).Error; err == nil {
 		if v, err := strconv.Atoi(setting.Value); err == nil && v > 0 {
 			retentionDays = v
 		}
 	}
 
 	cutoff := time.Now().AddDate(0, 0, -retentionDays)
-	result := db.Where("created_at < ?", cutoff).Delete(&model.AuditLog{})
+	result := db.Where("received_at < ?", cutoff).Delete(&model.DeviceLog{})
 	if result.RowsAffected > 0 {
-		log.Printf("cleaned up %d old audit log records (retention: %d days)", result.RowsAffected, retentionDays)
+		log.Printf("cleaned up %d old device log entries (retention: %d days)", result.RowsAffected, retentionDays)
 	}
 }
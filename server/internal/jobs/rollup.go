@@ -0,0 +1,184 @@
+package jobs
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+)
+
+// MetricsResolution describes one storage tier of device metrics. "raw" is
+// the device_metrics table; the others are rows of device_metrics_rollups.
+type MetricsResolution struct {
+	Name             string
+	Step             time.Duration
+	RetentionKey     string        // system setting holding the retention
+	RetentionUnit    time.Duration // unit of the setting value
+	DefaultRetention int
+}
+
+// MetricsResolutions lists the tiers from finest to coarsest. Raw rows are
+// assumed to arrive every 30s (the agent heartbeat interval).
+var MetricsResolutions = []MetricsResolution{
+	{Name: "raw", Step: 30 * time.Second, RetentionKey: "metrics_raw_retention_hours", RetentionUnit: time.Hour, DefaultRetention: 48},
+	{Name: "1m", Step: time.Minute, RetentionKey: "metrics_1m_retention_days", RetentionUnit: 24 * time.Hour, DefaultRetention: 7},
+	{Name: "1h", Step: time.Hour, RetentionKey: "metrics_1h_retention_days", RetentionUnit: 24 * time.Hour, DefaultRetention: 30},
+	{Name: "1d", Step: 24 * time.Hour, RetentionKey: "metrics_1d_retention_days", RetentionUnit: 24 * time.Hour, DefaultRetention: 730},
+}
+
+// minRawRetention keeps raw rows long enough for the 1m rollup to catch up.
+const minRawRetention = 2 * time.Hour
+
+// MetricsRetention returns the configured retention of a resolution.
+func MetricsRetention(db *gorm.DB, r MetricsResolution) time.Duration {
+	n := r.DefaultRetention
+	var setting model.SystemSetting
+	if err := db.Where("\"key\" = ?", r.RetentionKey).First(&setting).Error; err == nil {
+		if v, err := strconv.Atoi(setting.Value); err == nil && v > 0 {
+			n = v
+		}
+	}
+	retention := time.Duration(n) * r.RetentionUnit
+	if r.Name == "raw" && retention < minRawRetention {
+		retention = minRawRetention
+	}
+	return retention
+}
+
+// StartMetricsRollup aggregates raw heartbeats into 1-minute buckets every
+// minute, and 1-minute buckets into hourly and daily ones every 5 minutes.
+// Buckets are upserted, so the still-open bucket is refreshed on each run.
+func StartMetricsRollup(db *gorm.DB) {
+	go func() {
+		backfillRollups(db)
+
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for tick := 1; ; tick++ {
+			<-ticker.C
+			now := time.Now()
+			rollupMetrics(db, "1m", now.Truncate(time.Minute).Add(-10*time.Minute), now)
+			if tick%5 == 0 {
+				rollupMetrics(db, "1h", now.Truncate(time.Hour).Add(-time.Hour), now)
+				rollupMetrics(db, "1d", startOfDay(now).AddDate(0, 0, -1), now)
+			}
+		}
+	}()
+	log.Println("metrics rollup job started (interval: 1m)")
+}
+
+// backfillRollups builds rollups from existing raw rows the first time the
+// job runs against a database without any.
+func backfillRollups(db *gorm.DB) {
+	var count int64
+	db.Model(&model.DeviceMetricsRollup{}).Count(&count)
+	if count > 0 {
+		return
+	}
+	var oldest model.DeviceMetrics
+	if err := db.Order("collected_at").First(&oldest).Error; err != nil {
+		return
+	}
+
+	now := time.Now()
+	from := startOfDay(oldest.CollectedAt)
+	for day := from; day.Before(now); day = day.AddDate(0, 0, 1) {
+		rollupMetrics(db, "1m", day, day.AddDate(0, 0, 1))
+	}
+	rollupMetrics(db, "1h", from, now)
+	rollupMetrics(db, "1d", from, now)
+	log.Printf("metrics rollups backfilled from %s", from.Format(time.DateOnly))
+}
+
+// startOfDay returns the start of t's day in UTC, the zone the rollup
+// buckets are cut in.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// gaugeRollupColumns are the rollup columns aggregated as min/avg/max/last.
+var gaugeRollupColumns = []struct{ prefix, raw string }{
+	{"cpu", "cpu_usage"},
+	{"mem", "mem_usage"},
+	{"conntrack", "conntrack"},
+}
+
+// lastRollupColumns keep the last value of the bucket.
+var lastRollupColumns = []struct{ column, raw string }{
+	{"rx_bytes", "rx_bytes"},
+	{"tx_bytes", "tx_bytes"},
+	{"mem_total", "mem_total"},
+	{"mem_free", "mem_free"},
+	{"uptime_secs", "uptime_secs"},
+}
+
+// rollupMetrics upserts buckets of the given resolution covering [from, to).
+// 1m buckets are built from raw rows, 1h from 1m and 1d from 1h. from is
+// rounded down in the database so the first bucket is never partial.
+// Buckets are cut in UTC whatever the session time zone.
+func rollupMetrics(db *gorm.DB, resolution string, from, to time.Time) {
+	var source, timeCol, trunc, samples, where string
+	var args []any
+	switch resolution {
+	case "1m":
+		source, timeCol, trunc, samples = "device_metrics", "collected_at", "minute", "count(*)"
+		where = "device_id <> 0 AND collected_at >= date_trunc('minute', ?::timestamptz, 'UTC') AND collected_at < ?"
+		args = []any{from, to}
+	case "1h", "1d":
+		child := "1m"
+		trunc = "hour"
+		if resolution == "1d" {
+			child, trunc = "1h", "day"
+		}
+		source, timeCol, samples = "device_metrics_rollups", "bucket_start", "sum(samples)"
+		where = fmt.Sprintf("resolution = ? AND bucket_start >= date_trunc('%s', ?::timestamptz, 'UTC') AND bucket_start < ?", trunc)
+		args = []any{child, from, to}
+	default:
+		return
+	}
+
+	columns := []string{"device_id", "resolution", "bucket_start", "samples"}
+	selects := []string{"device_id", "'" + resolution + "'", fmt.Sprintf("date_trunc('%s', %s, 'UTC') AS bucket", trunc, timeCol), samples}
+	last := func(col string) string {
+		return fmt.Sprintf("(array_agg(%s ORDER BY %s DESC))[1]", col, timeCol)
+	}
+	for _, g := range gaugeRollupColumns {
+		columns = append(columns, g.prefix+"_min", g.prefix+"_avg", g.prefix+"_max", g.prefix+"_last")
+		if resolution == "1m" {
+			selects = append(selects,
+				fmt.Sprintf("min(%s)", g.raw), fmt.Sprintf("avg(%s)", g.raw), fmt.Sprintf("max(%s)", g.raw), last(g.raw))
+		} else {
+			selects = append(selects,
+				fmt.Sprintf("min(%s_min)", g.prefix),
+				fmt.Sprintf("sum(%s_avg * samples) / NULLIF(sum(samples), 0)", g.prefix),
+				fmt.Sprintf("max(%s_max)", g.prefix),
+				last(g.prefix+"_last"))
+		}
+	}
+	for _, l := range lastRollupColumns {
+		columns = append(columns, l.column)
+		if resolution == "1m" {
+			selects = append(selects, last(l.raw))
+		} else {
+			selects = append(selects, last(l.column))
+		}
+	}
+
+	var updates []string
+	for _, col := range columns[3:] {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+	}
+
+	sql := fmt.Sprintf(
+		"INSERT INTO device_metrics_rollups (%s) SELECT %s FROM %s WHERE %s GROUP BY device_id, bucket "+
+			"ON CONFLICT (device_id, resolution, bucket_start) DO UPDATE SET %s",
+		strings.Join(columns, ", "), strings.Join(selects, ", "), source, where, strings.Join(updates, ", "))
+	if err := db.Exec(sql, args...).Error; err != nil {
+		log.Printf("metrics rollup %s failed: %v", resolution, err)
+	}
+}
@@ -0,0 +1,92 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"gorm.io/gorm"
+)
+
+// StartSilenceJob periodically applies active silences to open alerts, so
+// a scheduled silence also mutes the alerts already open when its window
+// begins, and releases the alerts whose silence has ended.
+func StartSilenceJob(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			applyActiveSilences(db, now)
+			ReleaseEndedSilences(db, now)
+		}
+	}()
+	log.Println("alert silence job started (interval: 1m)")
+}
+
+func applyActiveSilences(db *gorm.DB, now time.Time) {
+	var silences []model.AlertSilence
+	db.Where("starts_at <= ? AND expires_at > ?", now, now).Find(&silences)
+	for _, s := range silences {
+		if n := ApplySilence(db, s); n > 0 {
+			log.Printf("silence %d muted %d open alerts", s.ID, n)
+		}
+	}
+}
+
+// ApplySilence marks the open, not yet silenced alerts matched by s as
+// silenced and returns how many it marked.
+func ApplySilence(db *gorm.DB, s model.AlertSilence) int64 {
+	query := db.Model(&model.Alert{}).Where("resolved = false AND silenced = false")
+	if s.DeviceID != 0 {
+		query = query.Where("device_id = ?", s.DeviceID)
+	}
+	if s.Group != "" {
+		query = query.Where("device_id IN (?)", db.Model(&model.Device{}).Select("id").Where("\"group\" = ?", s.Group))
+	}
+	if s.Metric != "" {
+		query = query.Where("metric = ?", s.Metric)
+	}
+	if s.Severity != "" {
+		query = query.Where("severity = ?", s.Severity)
+	}
+	note := s.Comment
+	if note == "" {
+		note = s.Kind
+	}
+	return query.Updates(map[string]any{"silenced": true, "silence_id": s.ID, "silence_note": note}).RowsAffected
+}
+
+// ReleaseEndedSilences re-checks the open alerts muted by a silence that is
+// no longer active or by a firmware upgrade. An alert another silence or a
+// running upgrade still covers keeps being muted; the rest are unmuted and
+// enter escalation. An unmuted alert outside an incident notifies as a new
+// one would; an incident that has not notified yet does so through
+// notifyIncidents. It returns how many alerts it unmuted.
+func ReleaseEndedSilences(db *gorm.DB, now time.Time) int {
+	var alerts []model.Alert
+	db.Where("resolved = false AND silenced = true AND (silence_id IS NULL OR silence_id NOT IN (?))",
+		db.Model(&model.AlertSilence{}).Select("id").Where("starts_at <= ? AND expires_at > ?", now, now)).
+		Order("id").Find(&alerts)
+	released := 0
+	for _, alert := range alerts {
+		labels := getAlertLabels(db, alert.DeviceID)
+		if silenced, silenceID, note := checkSilenced(db, alert.DeviceID, labels.Group, alert.Metric, alert.Severity, now); silenced {
+			if silenceID != nil || alert.SilenceID != nil {
+				db.Model(&alert).Updates(map[string]any{"silence_id": silenceID, "silence_note": note})
+			}
+			continue
+		}
+		if db.Model(&model.Alert{}).Where("id = ? AND silenced = true", alert.ID).
+			Updates(map[string]any{"silenced": false, "silence_id": nil, "silence_note": ""}).RowsAffected == 0 {
+			continue
+		}
+		released++
+		alert.Silenced, alert.SilenceID, alert.SilenceNote = false, nil, ""
+		log.Printf("alert %d (device=%s metric=%s) no longer silenced", alert.ID, alert.DeviceName, alert.Metric)
+		if alert.IncidentID == nil {
+			dispatchNotification(db, alert)
+		}
+	}
+	return released
+}
@@ -10,14 +10,65 @@ const (
 )
 
 type Alert struct {
-	ID         uint          `json:"id" gorm:"primaryKey"`
-	DeviceID   uint          `json:"device_id" gorm:"index;not null"`
-	DeviceName string        `json:"device_name"`
-	Metric     string        `json:"metric" gorm:"not null"` // cpu, memory, conntrack
-	Value      float64       `json:"value"`
-	Threshold  float64       `json:"threshold"`
-	Severity   AlertSeverity `json:"severity" gorm:"default:warning"`
-	Resolved   bool          `json:"resolved" gorm:"default:false;index"`
-	CreatedAt  time.Time     `json:"created_at"`
-	ResolvedAt *time.Time    `json:"resolved_at"`
+	ID             uint          `json:"id" gorm:"primaryKey"`
+	DeviceID       uint          `json:"device_id" gorm:"index;not null"`
+	DeviceName     string        `json:"device_name"`
+	Metric         string        `json:"metric" gorm:"not null"` // cpu, memory, conntrack
+	Value          float64       `json:"value"`
+	Threshold      float64       `json:"threshold"`
+	Severity       AlertSeverity `json:"severity" gorm:"default:warning"`
+	Resolved       bool          `json:"resolved" gorm:"default:false;index"`
+	Acknowledged   bool          `json:"acknowledged" gorm:"default:false;index"`
+	AckedBy        string        `json:"acked_by"`
+	AckComment     string        `json:"ack_comment"`
+	AckedAt        *time.Time    `json:"acked_at"`
+	Silenced       bool          `json:"silenced" gorm:"default:false;index"`
+	SilenceID      *uint         `json:"silence_id"`
+	SilenceNote    string        `json:"silence_note"`                     // why the alert was muted (silence comment, firmware upgrade)
+	EscalationStep int           `json:"escalation_step" gorm:"default:0"` // number of escalation steps already sent
+	IncidentID     *uint         `json:"incident_id" gorm:"index"`
+	Source         string        `json:"source" gorm:"default:threshold;index"` // threshold, alertmanager
+	Fingerprint    string        `json:"fingerprint" gorm:"index"`              // Alertmanager fingerprint for inbound alerts
+	Description    string        `json:"description"`
+	CreatedAt      time.Time     `json:"created_at"`
+	ResolvedAt     *time.Time    `json:"resolved_at"`
+}
+
+// AlertSilence mutes notifications for alerts matching all non-empty matchers
+// between StartsAt and ExpiresAt. A silence with a future StartsAt doubles as
+// a scheduled maintenance window.
+type AlertSilence struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	DeviceID  uint          `json:"device_id" gorm:"index"` // 0 = any device
+	Group     string        `json:"group"`
+	Metric    string        `json:"metric"`
+	Severity  AlertSeverity `json:"severity"`
+	Kind      string        `json:"kind" gorm:"default:silence"` // silence, maintenance
+	Comment   string        `json:"comment"`
+	CreatedBy string        `json:"created_by"`
+	StartsAt  time.Time     `json:"starts_at" gorm:"index"`
+	ExpiresAt time.Time     `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type IncidentStatus string
+
+const (
+	IncidentOpen     IncidentStatus = "open"
+	IncidentResolved IncidentStatus = "resolved"
+)
+
+// Incident rolls up alerts that share grouping labels (device group, metric,
+// WAN uplink) within a time window so they notify once.
+type Incident struct {
+	ID         uint           `json:"id" gorm:"primaryKey"`
+	GroupKey   string         `json:"group_key" gorm:"index;not null"` // e.g. group=branch|metric=cpu
+	Title      string         `json:"title"`
+	Severity   AlertSeverity  `json:"severity" gorm:"default:warning"`
+	Status     IncidentStatus `json:"status" gorm:"default:open;index"`
+	AlertCount int            `json:"alert_count" gorm:"default:0"`
+	Notified   bool           `json:"notified" gorm:"default:false"` // the incident's notification listing its members has been sent
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	ResolvedAt *time.Time     `json:"resolved_at"`
 }
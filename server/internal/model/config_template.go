@@ -22,9 +22,11 @@ type DeviceConfig struct {
 	ID         uint      `json:"id" gorm:"primaryKey"`
 	DeviceID   uint      `json:"device_id" gorm:"index;not null"`
 	TemplateID *uint     `json:"template_id"`
+	Source     string    `json:"source" gorm:"index"` // Apply handler: firewall, vpn, mwan, dhcp, vlan; empty for pushes
 	Content    string    `json:"content" gorm:"type:text;not null"`
 	Version    int       `json:"version" gorm:"default:1"`
 	AppliedAt  *time.Time `json:"applied_at"`
-	Status     string    `json:"status" gorm:"default:pending"` // pending, applied, failed
+	Status     string    `json:"status" gorm:"default:pending"` // pending, pending_confirm, applied, failed, rolled_back
+	ErrorMsg   string    `json:"error_msg"`
 	CreatedAt  time.Time `json:"created_at"`
 }
@@ -15,23 +15,27 @@ const (
 )
 
 type Device struct {
-	ID           uint           `json:"id" gorm:"primaryKey"`
-	Name         string         `json:"name" gorm:"not null"`
-	MAC          string         `json:"mac" gorm:"uniqueIndex;not null"`
-	IPAddress    string         `json:"ip_address"`
-	Model        string         `json:"model"`
-	Firmware     string         `json:"firmware"`
-	Status       DeviceStatus   `json:"status" gorm:"default:unknown"`
-	Group        string         `json:"group" gorm:"index"`
-	Tags         string         `json:"tags"`
-	UptimeSecs   int64          `json:"uptime_secs"`
-	CPUUsage     float64        `json:"cpu_usage"`
-	MemUsage     float64        `json:"mem_usage"`
-	LastSeenAt   *time.Time     `json:"last_seen_at"`
-	RegisteredAt time.Time      `json:"registered_at" gorm:"autoCreateTime"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+	ID              uint           `json:"id" gorm:"primaryKey"`
+	Name            string         `json:"name" gorm:"not null"`
+	MAC             string         `json:"mac" gorm:"uniqueIndex;not null"`
+	IPAddress       string         `json:"ip_address"`
+	Model           string         `json:"model"`
+	Firmware        string         `json:"firmware"`
+	AgentVersion    string         `json:"agent_version"`
+	ProtocolVersion int            `json:"protocol_version" gorm:"default:0"` // 0: agent predates protocol versioning
+	Capabilities    string         `json:"capabilities"`                      // comma-separated, see package protocol
+	TunnelKey       string         `json:"tunnel_key,omitempty"`              // authorized_keys line the agent's reverse tunnel logs in with
+	Status          DeviceStatus   `json:"status" gorm:"default:unknown"`
+	Group           string         `json:"group" gorm:"index"`
+	Tags            string         `json:"tags"`
+	UptimeSecs      int64          `json:"uptime_secs"`
+	CPUUsage        float64        `json:"cpu_usage"`
+	MemUsage        float64        `json:"mem_usage"`
+	LastSeenAt      *time.Time     `json:"last_seen_at"`
+	RegisteredAt    time.Time      `json:"registered_at" gorm:"autoCreateTime"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 type DeviceMetrics struct {
@@ -48,3 +52,79 @@ type DeviceMetrics struct {
 	LoadAvg     string    `json:"load_avg"`
 	CollectedAt time.Time `json:"collected_at" gorm:"index:idx_metrics_device_time;index:idx_metrics_collected"`
 }
+
+// DeviceMetricsRollup aggregates DeviceMetrics into fixed buckets. Gauges keep
+// min/avg/max/last; counters (rx/tx bytes) and slow-moving values keep the last
+// value of the bucket.
+type DeviceMetricsRollup struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	DeviceID      uint      `json:"device_id" gorm:"uniqueIndex:idx_rollup_bucket;not null"`
+	Resolution    string    `json:"resolution" gorm:"uniqueIndex:idx_rollup_bucket;size:8;not null"` // 1m, 1h, 1d
+	BucketStart   time.Time `json:"bucket_start" gorm:"uniqueIndex:idx_rollup_bucket;index"`
+	Samples       int       `json:"samples"`
+	CPUMin        float64   `json:"cpu_min"`
+	CPUAvg        float64   `json:"cpu_avg"`
+	CPUMax        float64   `json:"cpu_max"`
+	CPULast       float64   `json:"cpu_last"`
+	MemMin        float64   `json:"mem_min"`
+	MemAvg        float64   `json:"mem_avg"`
+	MemMax        float64   `json:"mem_max"`
+	MemLast       float64   `json:"mem_last"`
+	ConntrackMin  float64   `json:"conntrack_min"`
+	ConntrackAvg  float64   `json:"conntrack_avg"`
+	ConntrackMax  float64   `json:"conntrack_max"`
+	ConntrackLast float64   `json:"conntrack_last"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+	MemTotal      int64     `json:"mem_total"`
+	MemFree       int64     `json:"mem_free"`
+	UptimeSecs    int64     `json:"uptime_secs"`
+}
+
+// DeviceInterfaceMetrics holds the counters of one network interface from a
+// heartbeat. Counters are cumulative as reported by the kernel.
+type DeviceInterfaceMetrics struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"index:idx_iface_metrics_device_time;not null"`
+	Interface   string    `json:"interface" gorm:"index:idx_iface_metrics_device_time;size:32;not null"`
+	RxBytes     int64     `json:"rx_bytes"`
+	TxBytes     int64     `json:"tx_bytes"`
+	RxPackets   int64     `json:"rx_packets"`
+	TxPackets   int64     `json:"tx_packets"`
+	RxErrors    int64     `json:"rx_errors"`
+	TxErrors    int64     `json:"tx_errors"`
+	Up          bool      `json:"up"`
+	SpeedMbps   int       `json:"speed_mbps"` // 0 when unknown (wireless, virtual)
+	CollectedAt time.Time `json:"collected_at" gorm:"index:idx_iface_metrics_device_time;index"`
+}
+
+// DeviceFilesystemMetrics holds the usage of one mount point (/overlay, /tmp).
+type DeviceFilesystemMetrics struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"index:idx_fs_metrics_device_time;not null"`
+	Mount       string    `json:"mount" gorm:"size:64;not null"`
+	TotalBytes  int64     `json:"total_bytes"`
+	UsedBytes   int64     `json:"used_bytes"`
+	CollectedAt time.Time `json:"collected_at" gorm:"index:idx_fs_metrics_device_time;index"`
+}
+
+// DeviceThermalMetrics holds the temperature of one thermal zone.
+type DeviceThermalMetrics struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"index:idx_thermal_metrics_device_time;not null"`
+	Zone        string    `json:"zone" gorm:"size:64;not null"`
+	TempCelsius float64   `json:"temp_celsius"`
+	CollectedAt time.Time `json:"collected_at" gorm:"index:idx_thermal_metrics_device_time;index"`
+}
+
+// DeviceWirelessMetrics holds the associated client count of one wireless
+// interface and the radio it belongs to.
+type DeviceWirelessMetrics struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"index:idx_wireless_metrics_device_time;not null"`
+	Radio       string    `json:"radio" gorm:"size:32"`
+	Interface   string    `json:"interface" gorm:"size:32;not null"`
+	SSID        string    `json:"ssid"`
+	Clients     int       `json:"clients"`
+	CollectedAt time.Time `json:"collected_at" gorm:"index:idx_wireless_metrics_device_time;index"`
+}
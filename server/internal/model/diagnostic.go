@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// DeviceDiagnostic is one diagnostic run (ping, traceroute, ...) executed
+// by a device's agent, kept as per-device history.
+type DeviceDiagnostic struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	DeviceID   uint       `json:"device_id" gorm:"index;not null"`
+	Action     string     `json:"action" gorm:"not null"`        // ping, traceroute, nslookup, mtr, iperf3, wget
+	Target     string     `json:"target"`                        // host, iperf3 server or URL
+	Params     string     `json:"params" gorm:"type:text"`       // JSON: the diagnostics.Request sent to the agent
+	Status     string     `json:"status" gorm:"default:running"` // running, success, failed
+	Output     string     `json:"output" gorm:"type:text"`       // raw command output
+	Result     string     `json:"result" gorm:"type:text"`       // JSON: structured result, e.g. {"loss_percent":0,"avg_ms":9.8,...}
+	ErrorMsg   string     `json:"error_msg"`
+	UserID     uint       `json:"user_id"`
+	Username   string     `json:"username"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"index"`
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// NotificationChannel is a named notification target used by escalation steps.
+// Names are unique among the records that are not deleted, so a deleted
+// name can be used again; the same holds for policies and schedules.
+type NotificationChannel struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	Name      string         `json:"name" gorm:"uniqueIndex:idx_notification_channels_live_name,where:deleted_at IS NULL;not null"`
+	Type      string         `json:"type" gorm:"not null"` // webhook, email, log
+	Target    string         `json:"target"`               // webhook URL or comma-separated email addresses
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+type EscalationPolicy struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	Name      string         `json:"name" gorm:"uniqueIndex:idx_escalation_policies_live_name,where:deleted_at IS NULL;not null"`
+	Severity  AlertSeverity  `json:"severity"`               // empty = any severity
+	Group     string         `json:"group"`                  // empty = any device group
+	Steps     string         `json:"steps" gorm:"type:text"` // JSON: [{"after_minutes":0,"channel_id":1},{"after_minutes":15,"schedule_id":2}]
+	Enabled   bool           `json:"enabled" gorm:"default:true"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// OnCallSchedule rotates through Users every RotationHours starting at StartAt.
+type OnCallSchedule struct {
+	ID            uint           `json:"id" gorm:"primaryKey"`
+	Name          string         `json:"name" gorm:"uniqueIndex:idx_on_call_schedules_live_name,where:deleted_at IS NULL;not null"`
+	Users         string         `json:"users"` // comma-separated usernames in rotation order
+	RotationHours int            `json:"rotation_hours" gorm:"default:168"`
+	StartAt       time.Time      `json:"start_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// AlertEscalation records each escalation step sent for an alert.
+type AlertEscalation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	AlertID   uint      `json:"alert_id" gorm:"index;not null"`
+	PolicyID  uint      `json:"policy_id"`
+	Step      int       `json:"step"`
+	Channel   string    `json:"channel"`   // channel name or schedule name
+	Recipient string    `json:"recipient"` // webhook URL, email address or on-call username
+	Status    string    `json:"status"`    // sent, failed
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -25,7 +25,8 @@ type FirmwareUpgrade struct {
 	ID         uint       `json:"id" gorm:"primaryKey"`
 	DeviceID   uint       `json:"device_id" gorm:"index;not null"`
 	FirmwareID uint       `json:"firmware_id" gorm:"not null"`
-	Status     string     `json:"status" gorm:"default:pending"` // pending, downloading, upgrading, success, failed
+	Status     string     `json:"status" gorm:"default:pending"` // pending, downloading, verifying, upgrading, success, failed
+	Progress   int        `json:"progress"`                      // 0-100, reported by agents with upgrade.progress
 	StartedAt  *time.Time `json:"started_at"`
 	FinishedAt *time.Time `json:"finished_at"`
 	ErrorMsg   string     `json:"error_msg"`
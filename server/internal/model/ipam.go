@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// IPAM pool purposes: what may allocate from a pool.
+const (
+	IPPoolAny  = "any"
+	IPPoolVLAN = "vlan"
+	IPPoolVPN  = "vpn"
+)
+
+// IPPool is a supernet that site VLAN and WireGuard tunnel subnets are
+// allocated from. Pools do not overlap each other.
+type IPPool struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"uniqueIndex;not null"`
+	CIDR        string    `json:"cidr" gorm:"not null"`             // 10.20.0.0/16
+	PrefixLen   int       `json:"prefix_len" gorm:"not null"`       // default size of allocations: 24
+	Purpose     string    `json:"purpose" gorm:"index;default:any"` // vlan, vpn, any
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// IPAllocation is a subnet taken from an IPPool by a VLAN or a WireGuard
+// interface, or reserved by hand. It is released with its VLAN or
+// interface.
+type IPAllocation struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	PoolID      uint      `json:"pool_id" gorm:"uniqueIndex:idx_alloc_pool_cidr;not null"`
+	CIDR        string    `json:"cidr" gorm:"uniqueIndex:idx_alloc_pool_cidr;not null"`
+	DeviceID    *uint     `json:"device_id" gorm:"index"`
+	Resource    string    `json:"resource" gorm:"index:idx_alloc_resource"` // vlan, vpn_interface; empty when reserved by hand
+	ResourceID  uint      `json:"resource_id" gorm:"index:idx_alloc_resource"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
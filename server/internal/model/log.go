@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// DeviceLog is one syslog entry of a device, either fetched on demand with
+// logread or received by the syslog receiver. DeviceID is 0 for syslog
+// senders that match no device.
+type DeviceLog struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DeviceID   uint      `json:"device_id" gorm:"index:idx_device_logs_device_time"`
+	Source     string    `json:"source" gorm:"size:16;not null"` // logread, syslog
+	SourceIP   string    `json:"source_ip" gorm:"size:64"`
+	Hostname   string    `json:"hostname" gorm:"size:255"`
+	Facility   int       `json:"facility"`                 // 0-23, e.g. 3 = daemon
+	Severity   int       `json:"severity" gorm:"index"`    // 0 emerg … 7 debug
+	Tag        string    `json:"tag" gorm:"size:64;index"` // app name, e.g. nexusgate, dnsmasq
+	PID        string    `json:"pid" gorm:"size:32"`
+	Message    string    `json:"message" gorm:"type:text"`
+	LoggedAt   time.Time `json:"logged_at" gorm:"index:idx_device_logs_device_time;index"`
+	ReceivedAt time.Time `json:"received_at" gorm:"index"`
+}
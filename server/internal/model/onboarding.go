@@ -0,0 +1,64 @@
+package model
+
+import "time"
+
+// Onboarding job and host states. A host moves through connecting,
+// installing, configuring, starting and waiting (for the agent to register)
+// to registered, or stops at failed or skipped.
+const (
+	OnboardingRunning  = "running"
+	OnboardingFinished = "finished"
+	OnboardingCanceled = "canceled"
+
+	OnboardingHostPending     = "pending"
+	OnboardingHostConnecting  = "connecting"
+	OnboardingHostInstalling  = "installing"
+	OnboardingHostConfiguring = "configuring"
+	OnboardingHostStarting    = "starting"
+	OnboardingHostWaiting     = "waiting"
+	OnboardingHostRegistered  = "registered"
+	OnboardingHostFailed      = "failed"
+	OnboardingHostSkipped     = "skipped"
+)
+
+// OnboardingJob brings routers without the agent under management over SSH:
+// one address, or every address of a CIDR that accepts SSH connections.
+// The login is kept in memory while the job runs and stored as the
+// device's credential once its agent registers.
+type OnboardingJob struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	Target     string     `json:"target" gorm:"not null"` // IP address or CIDR
+	SSHUser    string     `json:"ssh_user"`
+	SSHPort    int        `json:"ssh_port"`
+	UseKey     bool       `json:"use_key"`                // log in with the server key
+	Agent      string     `json:"agent" gorm:"type:text"` // JSON: onboard.Agent
+	Status     string     `json:"status" gorm:"index"`    // running, finished, canceled
+	Scanned    int        `json:"scanned"`                // addresses in the target
+	Hosts      int        `json:"hosts"`                  // hosts tried (answering on the SSH port)
+	Registered int        `json:"registered"`
+	Failed     int        `json:"failed"`
+	UserID     uint       `json:"user_id"`
+	Username   string     `json:"username"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	CreatedAt  time.Time  `json:"created_at" gorm:"index"`
+}
+
+// OnboardingHost tracks one host of an onboarding job.
+type OnboardingHost struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	JobID      uint       `json:"job_id" gorm:"index;not null"`
+	Address    string     `json:"address" gorm:"not null"`
+	Status     string     `json:"status" gorm:"default:pending"`
+	ErrorMsg   string     `json:"error_msg"`
+	Hostname   string     `json:"hostname"`
+	Model      string     `json:"model"`
+	Firmware   string     `json:"firmware"`
+	MAC        string     `json:"mac"`
+	HostKey    string     `json:"host_key"`                // presented on login, pinned for the device
+	Output     string     `json:"output" gorm:"type:text"` // opkg output
+	DeviceID   *uint      `json:"device_id"`               // the registered device
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
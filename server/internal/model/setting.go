@@ -2,10 +2,16 @@ package model
 
 import "time"
 
+// SecretSettingKeys are the settings whose value is encrypted at rest and
+// left out of audit details.
+var SecretSettingKeys = map[string]bool{
+	"smtp_pass": true,
+}
+
 type SystemSetting struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	Key       string    `json:"key" gorm:"uniqueIndex;not null"`
-	Value     string    `json:"value" gorm:"type:text"`
+	Value     string    `json:"value" gorm:"type:text;serializer:setting"` // encrypted for SecretSettingKeys
 	Category  string    `json:"category" gorm:"index;default:general"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -0,0 +1,60 @@
+package model
+
+import "time"
+
+// DeviceCredential is the SSH login the server uses for web terminal
+// sessions, commands and file transfers to a device.
+type DeviceCredential struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DeviceID    uint      `json:"device_id" gorm:"uniqueIndex;not null"`
+	Username    string    `json:"username" gorm:"not null"`
+	Password    string    `json:"-" gorm:"serializer:secret"` // encrypted at rest
+	Port        int       `json:"port" gorm:"default:22"`
+	HostKey     string    `json:"host_key"`     // pinned on first connection (authorized_keys format)
+	KeyDeployed bool      `json:"key_deployed"` // server key installed in /etc/dropbear/authorized_keys
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ShellSession is one web terminal session, kept for audit with its
+// asciicast recording.
+type ShellSession struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	DeviceID  uint       `json:"device_id" gorm:"index;not null"`
+	UserID    uint       `json:"user_id" gorm:"index"`
+	Username  string     `json:"username"`
+	Transport string     `json:"transport"` // ssh, tunnel
+	ClientIP  string     `json:"client_ip"`
+	Recording string     `json:"-"` // path of the .cast file
+	BytesOut  int64      `json:"bytes_out"`
+	EndReason string     `json:"end_reason"` // closed, exited, idle, time_limit, error
+	StartedAt time.Time  `json:"started_at" gorm:"index"`
+	EndedAt   *time.Time `json:"ended_at"`
+}
+
+// Tunnel session states.
+const (
+	TunnelSessionActive = "active"
+	TunnelSessionClosed = "closed"
+)
+
+// TunnelSession grants one user access to a device-local port through the
+// device's reverse tunnel, relayed from a server port reserved for the
+// session.
+type TunnelSession struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	DeviceID    uint       `json:"device_id" gorm:"index;not null"`
+	UserID      uint       `json:"user_id" gorm:"index"`
+	Username    string     `json:"username"`
+	DevicePort  int        `json:"device_port"`                        // 22, 80 or 443
+	ListenPort  int        `json:"listen_port"`                        // server port relaying to it
+	AllowedIP   string     `json:"allowed_ip"`                         // only connections from this address are relayed
+	Status      string     `json:"status" gorm:"index;default:active"` // active, closed
+	CloseReason string     `json:"close_reason"`                       // closed, expired, tunnel_closed, shutdown
+	Connections int64      `json:"connections"`
+	BytesIn     int64      `json:"bytes_in"` // client to device
+	BytesOut    int64      `json:"bytes_out"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"index"`
+	ClosedAt    *time.Time `json:"closed_at"`
+}
@@ -10,11 +10,13 @@ type WireGuardInterface struct {
 	ID         uint           `json:"id" gorm:"primaryKey"`
 	DeviceID   uint           `json:"device_id" gorm:"uniqueIndex:idx_wg_device_name;not null"`
 	Name       string         `json:"name" gorm:"uniqueIndex:idx_wg_device_name;not null"`       // e.g. wg0
-	PrivateKey string         `json:"-" gorm:"not null"`
+	PrivateKey string         `json:"-" gorm:"not null;serializer:secret"` // encrypted at rest
 	PublicKey  string         `json:"public_key"`
 	Address    string         `json:"address"`                     // e.g. 10.99.0.1/24
 	ListenPort int            `json:"listen_port" gorm:"default:51820"`
 	Enabled    bool           `json:"enabled" gorm:"default:true"`
+	KeyRotatedAt *time.Time   `json:"key_rotated_at"`              // when the server last generated the key pair
+	NetworkID  *uint          `json:"network_id" gorm:"index"`     // generated for a VPNNetwork member
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
@@ -25,7 +27,7 @@ type WireGuardPeer struct {
 	InterfaceID   uint           `json:"interface_id" gorm:"uniqueIndex:idx_peer_iface_pubkey;not null"`
 	Description   string         `json:"description"`
 	PublicKey     string         `json:"public_key" gorm:"uniqueIndex:idx_peer_iface_pubkey;not null"`
-	PresharedKey  string         `json:"-"`
+	PresharedKey  string         `json:"-" gorm:"serializer:secret"` // encrypted at rest
 	AllowedIPs    string         `json:"allowed_ips"`    // comma-separated CIDRs
 	Endpoint      string         `json:"endpoint"`       // host:port
 	Keepalive     int            `json:"keepalive" gorm:"default:25"`
@@ -33,7 +35,70 @@ type WireGuardPeer struct {
 	LastHandshake *time.Time     `json:"last_handshake"`
 	TxBytes       int64          `json:"tx_bytes"`
 	RxBytes       int64          `json:"rx_bytes"`
+	NetworkID     *uint          `json:"network_id" gorm:"index"` // generated for a VPNNetwork member
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 }
+
+// VPN network topologies and member roles.
+const (
+	VPNTopologyHubSpoke = "hub_spoke"
+	VPNTopologyMesh     = "mesh"
+
+	VPNRoleHub   = "hub"
+	VPNRoleSpoke = "spoke"
+	VPNRolePeer  = "peer" // mesh member
+)
+
+// VPNNetwork is a site-to-site WireGuard network. The server generates an
+// interface on every member device and the peers between them, and keeps
+// them in step with the members.
+type VPNNetwork struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name" gorm:"uniqueIndex;not null"`
+	Topology    string    `json:"topology" gorm:"not null;default:hub_spoke"` // hub_spoke, mesh
+	Interface   string    `json:"interface" gorm:"not null;default:wg1"`      // interface name on the members
+	Subnet      string    `json:"subnet" gorm:"not null"`                     // tunnel subnet: 10.99.0.0/24
+	ListenPort  int       `json:"listen_port" gorm:"default:51820"`
+	Keepalive   int       `json:"keepalive" gorm:"default:25"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type VPNNetworkMember struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	NetworkID uint      `json:"network_id" gorm:"uniqueIndex:idx_vpn_member;not null"`
+	DeviceID  uint      `json:"device_id" gorm:"uniqueIndex:idx_vpn_member;not null"`
+	Role      string    `json:"role" gorm:"default:spoke"` // hub, spoke; peer in a mesh
+	Address   string    `json:"address"`                   // tunnel address: 10.99.0.2; the next free one if empty
+	Endpoint  string    `json:"endpoint"`                  // host:port the others reach it at; empty behind NAT
+	Routes    string    `json:"routes"`                    // comma-separated LAN prefixes routed to it
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Key rotation states. A rotation runs until the devices have confirmed
+// the new key (applied), the old key was restored after a remote device
+// did not take it (reverted), or it could not finish either way (failed).
+const (
+	KeyRotationRunning  = "running"
+	KeyRotationApplied  = "applied"
+	KeyRotationReverted = "reverted"
+	KeyRotationFailed   = "failed"
+)
+
+// WireGuardKeyRotation is one key rotation of an interface, started by a
+// user or the rotation job, while it is pushed to the devices involved.
+type WireGuardKeyRotation struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	InterfaceID uint       `json:"interface_id" gorm:"index;not null"`
+	Status      string     `json:"status" gorm:"index"`      // running, applied, reverted, failed
+	Results     string     `json:"results" gorm:"type:text"` // JSON: the apply result of every device pushed to
+	ErrorMsg    string     `json:"error_msg"`
+	UserID      uint       `json:"user_id"`
+	Username    string     `json:"username"` // "system" for the rotation job
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
@@ -3,13 +3,17 @@ package mqtt
 import (
 	"encoding/json"
 	"log"
+	"strings"
 	"time"
 
 	pahomqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nexusgate/nexusgate/internal/config"
-	"github.com/nexusgate/nexusgate/internal/jobs"
+	"github.com/nexusgate/nexusgate/internal/diagnostics"
+	"github.com/nexusgate/nexusgate/internal/ingest"
 	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
 	"github.com/nexusgate/nexusgate/internal/ws"
+	"github.com/prometheus/client_golang/prometheus"
 	"gorm.io/gorm"
 )
 
@@ -33,147 +37,215 @@ func NewClient(cfg *config.Config) (pahomqtt.Client, error) {
 	return client, nil
 }
 
-// SubscribeDeviceStatus listens for heartbeat messages from agents and updates device status.
-// It also broadcasts status updates to connected WebSocket clients via the hub.
-func SubscribeDeviceStatus(client pahomqtt.Client, db *gorm.DB, hub *ws.Hub) {
-	client.Subscribe("nexusgate/devices/+/status", 1, func(_ pahomqtt.Client, msg pahomqtt.Message) {
-		var payload struct {
-			MAC        string  `json:"mac"`
-			CPUUsage   float64 `json:"cpu_usage"`
-			MemUsage   float64 `json:"mem_usage"`
-			MemTotal   int64   `json:"mem_total"`
-			MemFree    int64   `json:"mem_free"`
-			RxBytes    int64   `json:"rx_bytes"`
-			TxBytes    int64   `json:"tx_bytes"`
-			Conntrack  int     `json:"conntrack"`
-			UptimeSecs int64   `json:"uptime_secs"`
-			LoadAvg    string  `json:"load_avg"`
-		}
-		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
-			log.Printf("invalid status payload: %v", err)
-			return
-		}
+// Message metrics, labelled by payload schema (status, config_ack, upgrade_ack, rpc_response, diagnostic_progress).
+var (
+	receivedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nexusgate_mqtt_messages_received_total", Help: "Agent messages received over MQTT",
+	}, []string{"topic"})
+	rejectedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nexusgate_mqtt_messages_rejected_total", Help: "Agent messages rejected by payload schema validation",
+	}, []string{"topic"})
+)
+
+func init() {
+	for _, topic := range []string{"status", "config_ack", "upgrade_ack", "rpc_response", "diagnostic_progress"} {
+		receivedMessages.WithLabelValues(topic)
+		rejectedMessages.WithLabelValues(topic)
+	}
+}
+
+// Collectors returns the MQTT message metrics for the /metrics registry.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{receivedMessages, rejectedMessages, rpcCalls, rpcDuration}
+}
+
+// topicSchema returns the schema name and device MAC of a device topic,
+// e.g. "config_ack" and the MAC for nexusgate/devices/{mac}/config/ack.
+func topicSchema(topic string) (name, mac string) {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) < 4 {
+		return "", ""
+	}
+	return strings.ReplaceAll(parts[3], "/", "_"), parts[2]
+}
 
-		now := time.Now()
-		if err := db.Model(&model.Device{}).Where("mac = ?", payload.MAC).Updates(map[string]any{
-			"status":       model.StatusOnline,
-			"cpu_usage":    payload.CPUUsage,
-			"mem_usage":    payload.MemUsage,
-			"uptime_secs":  payload.UptimeSecs,
-			"last_seen_at": &now,
-		}).Error; err != nil {
-			log.Printf("failed to update device status for MAC %s: %v", payload.MAC, err)
+// validated wraps a handler so that only payloads matching the published
+// schema of the topic reach it. Rejected messages are logged and counted.
+func validated(handle func(client pahomqtt.Client, mac string, payload []byte)) pahomqtt.MessageHandler {
+	return func(client pahomqtt.Client, msg pahomqtt.Message) {
+		name, mac := topicSchema(msg.Topic())
+		receivedMessages.WithLabelValues(name).Inc()
+		if err := protocol.Validate(name, msg.Payload()); err != nil {
+			rejectedMessages.WithLabelValues(name).Inc()
+			log.Printf("rejected message on %s: %v", msg.Topic(), err)
+			return
 		}
+		handle(client, mac, msg.Payload())
+	}
+}
 
-		// Look up device ID for metrics record
-		var device model.Device
-		var deviceID uint
-		if err := db.Select("id").Where("mac = ?", payload.MAC).First(&device).Error; err == nil {
-			deviceID = device.ID
-		}
-
-		if err := db.Create(&model.DeviceMetrics{
-			DeviceID:    deviceID,
-			CPUUsage:    payload.CPUUsage,
-			MemUsage:    payload.MemUsage,
-			MemTotal:    payload.MemTotal,
-			MemFree:     payload.MemFree,
-			RxBytes:     payload.RxBytes,
-			TxBytes:     payload.TxBytes,
-			Conntrack:   payload.Conntrack,
-			UptimeSecs:  payload.UptimeSecs,
-			LoadAvg:     payload.LoadAvg,
-			CollectedAt: now,
-		}).Error; err != nil {
-			log.Printf("failed to create device metrics for MAC %s: %v", payload.MAC, err)
-		}
-
-		// Evaluate alert thresholds
-		jobs.EvaluateDeviceAlerts(db, hub, deviceID, payload.MAC, payload.CPUUsage, payload.MemUsage, payload.Conntrack)
-
-		// Broadcast to WebSocket clients
-		if hub != nil {
-			hub.Broadcast("device_status", map[string]any{
-				"mac":         payload.MAC,
-				"device_id":   deviceID,
-				"cpu_usage":   payload.CPUUsage,
-				"mem_usage":   payload.MemUsage,
-				"rx_bytes":    payload.RxBytes,
-				"tx_bytes":    payload.TxBytes,
-				"conntrack":   payload.Conntrack,
-				"uptime_secs": payload.UptimeSecs,
-				"load_avg":    payload.LoadAvg,
-				"status":      "online",
-			})
+// SubscribeDeviceStatus listens for heartbeat messages from agents and hands
+// them to the ingestion pipeline, which updates devices, stores metrics,
+// evaluates alerts and broadcasts to WebSocket clients in batches.
+func SubscribeDeviceStatus(client pahomqtt.Client, pipeline *ingest.Pipeline) {
+	client.Subscribe("nexusgate/devices/+/status", 1, validated(func(_ pahomqtt.Client, mac string, payload []byte) {
+		if err := pipeline.SubmitJSON(payload); err != nil {
+			log.Printf("heartbeat from %s dropped: %v", mac, err)
 		}
-	})
+	}))
 }
 
 // SubscribeConfigACK listens for config apply acknowledgements from agents.
 // Topic: nexusgate/devices/+/config/ack
-// Payload: {"config_id": 123, "status": "applied"|"failed", "error": "..."}
+// Payload: {"config_id": 123, "status": "applied"|"failed"|"pending_confirm"|"rolled_back", "error": "..."}
+//
+// Agents with the config.confirm capability acknowledge "pending_confirm"
+// after applying; the server answers with a confirm_config command, and the
+// agent rolls back ("rolled_back") if that does not arrive in time.
 func SubscribeConfigACK(client pahomqtt.Client, db *gorm.DB, hub *ws.Hub) {
-	client.Subscribe("nexusgate/devices/+/config/ack", 1, func(_ pahomqtt.Client, msg pahomqtt.Message) {
+	client.Subscribe("nexusgate/devices/+/config/ack", 1, validated(func(client pahomqtt.Client, mac string, raw []byte) {
 		var payload struct {
 			ConfigID uint   `json:"config_id"`
-			Status   string `json:"status"` // applied, failed
+			Status   string `json:"status"`
 			Error    string `json:"error"`
 		}
-		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		if err := json.Unmarshal(raw, &payload); err != nil {
 			log.Printf("invalid config ack payload: %v", err)
 			return
 		}
 
-		now := time.Now()
-		updates := map[string]any{"status": payload.Status, "applied_at": &now}
-		if err := db.Model(&model.DeviceConfig{}).Where("id = ?", payload.ConfigID).Updates(updates).Error; err != nil {
-			log.Printf("failed to update config %d status: %v", payload.ConfigID, err)
+		var device model.Device
+		if err := db.Where("mac = ?", mac).First(&device).Error; err != nil {
+			log.Printf("config ack from unknown device %s", mac)
+			return
+		}
+
+		updates := map[string]any{"status": payload.Status, "error_msg": payload.Error}
+		if payload.Status == "applied" {
+			now := time.Now()
+			updates["applied_at"] = &now
+		}
+		result := db.Model(&model.DeviceConfig{}).Where("id = ? AND device_id = ?", payload.ConfigID, device.ID).Updates(updates)
+		if result.Error != nil {
+			log.Printf("failed to update config %d status: %v", payload.ConfigID, result.Error)
+		} else if result.RowsAffected == 0 {
+			log.Printf("config ack from %s for unknown config %d", mac, payload.ConfigID)
+			return
 		}
 
 		log.Printf("config %d status -> %s", payload.ConfigID, payload.Status)
 
+		if payload.Status == "pending_confirm" {
+			if err := protocol.PublishCommand(client, device, "confirm_config", map[string]any{"config_id": payload.ConfigID}); err != nil {
+				log.Printf("failed to confirm config %d on %s: %v", payload.ConfigID, device.Name, err)
+			}
+		}
+
 		if hub != nil {
 			hub.Broadcast("config_ack", map[string]any{
 				"config_id": payload.ConfigID,
+				"device_id": device.ID,
 				"status":    payload.Status,
 				"error":     payload.Error,
 			})
 		}
-	})
+	}))
 }
 
 // SubscribeUpgradeACK listens for firmware upgrade acknowledgements from agents.
 // Topic: nexusgate/devices/+/upgrade/ack
 // Payload: {"upgrade_id": 123, "status": "success"|"failed", "error": "..."}
+//
+// Agents with the upgrade.progress capability also report the intermediate
+// stages "downloading", "verifying" and "upgrading" with a progress percentage.
 func SubscribeUpgradeACK(client pahomqtt.Client, db *gorm.DB, hub *ws.Hub) {
-	client.Subscribe("nexusgate/devices/+/upgrade/ack", 1, func(_ pahomqtt.Client, msg pahomqtt.Message) {
+	client.Subscribe("nexusgate/devices/+/upgrade/ack", 1, validated(func(_ pahomqtt.Client, mac string, raw []byte) {
 		var payload struct {
 			UpgradeID uint   `json:"upgrade_id"`
-			Status    string `json:"status"` // success, failed
+			Status    string `json:"status"`
+			Progress  *int   `json:"progress"`
 			Error     string `json:"error"`
 		}
-		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+		if err := json.Unmarshal(raw, &payload); err != nil {
 			log.Printf("invalid upgrade ack payload: %v", err)
 			return
 		}
 
-		now := time.Now()
-		updates := map[string]any{"status": payload.Status, "finished_at": &now}
+		var deviceID uint
+		if err := db.Model(&model.Device{}).Where("mac = ?", mac).Pluck("id", &deviceID).Error; err != nil || deviceID == 0 {
+			log.Printf("upgrade ack from unknown device %s", mac)
+			return
+		}
+
+		updates := map[string]any{"status": payload.Status}
+		switch payload.Status {
+		case "success", "failed":
+			now := time.Now()
+			updates["finished_at"] = &now
+			if payload.Status == "success" {
+				updates["progress"] = 100
+			}
+		}
+		if payload.Progress != nil {
+			updates["progress"] = *payload.Progress
+		}
 		if payload.Error != "" {
 			updates["error_msg"] = payload.Error
 		}
-		if err := db.Model(&model.FirmwareUpgrade{}).Where("id = ?", payload.UpgradeID).Updates(updates).Error; err != nil {
+		if err := db.Model(&model.FirmwareUpgrade{}).Where("id = ? AND device_id = ?", payload.UpgradeID, deviceID).Updates(updates).Error; err != nil {
 			log.Printf("failed to update upgrade %d status: %v", payload.UpgradeID, err)
 		}
 
 		log.Printf("upgrade %d status -> %s", payload.UpgradeID, payload.Status)
 
 		if hub != nil {
-			hub.Broadcast("upgrade_ack", map[string]any{
+			msg := map[string]any{
 				"upgrade_id": payload.UpgradeID,
+				"device_id":  deviceID,
 				"status":     payload.Status,
 				"error":      payload.Error,
-			})
+			}
+			if p, ok := updates["progress"]; ok {
+				msg["progress"] = p
+			}
+			hub.Broadcast("upgrade_ack", msg)
+		}
+	}))
+}
+
+// SubscribeDiagnosticProgress relays the output of running diagnostics to
+// WebSocket clients as it is produced, one line at a time, together with
+// the line's parsed form (a ping reply, a traceroute hop) where it has one.
+// Topic: nexusgate/devices/+/diagnostic/progress
+// Payload: {"diagnostic_id": 12, "line": "64 bytes from 1.1.1.1: seq=0 ttl=57 time=9.8 ms"}
+func SubscribeDiagnosticProgress(client pahomqtt.Client, db *gorm.DB, hub *ws.Hub) {
+	client.Subscribe("nexusgate/devices/+/diagnostic/progress", 1, validated(func(_ pahomqtt.Client, mac string, raw []byte) {
+		var payload struct {
+			DiagnosticID uint   `json:"diagnostic_id"`
+			Line         string `json:"line"`
+		}
+		if err := json.Unmarshal(raw, &payload); err != nil || hub == nil {
+			return
+		}
+
+		var diag model.DeviceDiagnostic
+		err := db.Select("device_diagnostics.id, device_diagnostics.device_id, device_diagnostics.action").
+			Joins("JOIN devices ON devices.id = device_diagnostics.device_id").
+			Where("device_diagnostics.id = ? AND devices.mac = ? AND device_diagnostics.status = ?", payload.DiagnosticID, mac, "running").
+			First(&diag).Error
+		if err != nil {
+			return // finished, unknown, or belongs to another device
+		}
+
+		msg := map[string]any{
+			"diagnostic_id": diag.ID,
+			"device_id":     diag.DeviceID,
+			"action":        diag.Action,
+			"line":          payload.Line,
+		}
+		if parsed := diagnostics.ParseLine(diag.Action, payload.Line); parsed != nil {
+			msg["parsed"] = parsed
 		}
-	})
+		hub.Broadcast("diagnostic_progress", msg)
+	}))
 }
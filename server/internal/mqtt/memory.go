@@ -0,0 +1,164 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MemoryBroker is an in-process stand-in for an MQTT broker. Its clients
+// implement pahomqtt.Client, so code written against paho (subscriptions,
+// RPC, simulated agents) can be exercised without Mosquitto. Messages are
+// delivered asynchronously; retained messages and QoS are not emulated.
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	subs []memorySubscription
+}
+
+type memorySubscription struct {
+	client *memoryClient
+	filter string
+	handle pahomqtt.MessageHandler
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+// Client returns a new connected client of the broker.
+func (b *MemoryBroker) Client() pahomqtt.Client {
+	c := &memoryClient{broker: b}
+	c.connected.Store(true)
+	return c
+}
+
+func (b *MemoryBroker) publish(topic string, payload []byte) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		if s.client.connected.Load() && topicMatches(s.filter, topic) {
+			msg := &memoryMessage{topic: topic, payload: payload}
+			go s.handle(s.client, msg)
+		}
+	}
+}
+
+// topicMatches reports whether an MQTT topic filter (with + and #
+// wildcards) matches a topic.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+type memoryClient struct {
+	broker    *MemoryBroker
+	connected atomic.Bool
+}
+
+func (c *memoryClient) IsConnected() bool      { return c.connected.Load() }
+func (c *memoryClient) IsConnectionOpen() bool { return c.connected.Load() }
+
+func (c *memoryClient) Connect() pahomqtt.Token {
+	c.connected.Store(true)
+	return memoryToken{}
+}
+
+func (c *memoryClient) Disconnect(uint) {
+	c.connected.Store(false)
+	c.Unsubscribe()
+}
+
+func (c *memoryClient) Publish(topic string, _ byte, _ bool, payload interface{}) pahomqtt.Token {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = append([]byte(nil), p...)
+	case string:
+		b = []byte(p)
+	}
+	c.broker.publish(topic, b)
+	return memoryToken{}
+}
+
+func (c *memoryClient) Subscribe(topic string, _ byte, callback pahomqtt.MessageHandler) pahomqtt.Token {
+	c.broker.mu.Lock()
+	c.broker.subs = append(c.broker.subs, memorySubscription{client: c, filter: topic, handle: callback})
+	c.broker.mu.Unlock()
+	return memoryToken{}
+}
+
+func (c *memoryClient) SubscribeMultiple(filters map[string]byte, callback pahomqtt.MessageHandler) pahomqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return memoryToken{}
+}
+
+// Unsubscribe removes the given subscriptions of the client, or all of them
+// when no topic is given.
+func (c *memoryClient) Unsubscribe(topics ...string) pahomqtt.Token {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	kept := c.broker.subs[:0]
+	for _, s := range c.broker.subs {
+		if s.client == c && (len(topics) == 0 || contains(topics, s.filter)) {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	c.broker.subs = kept
+	return memoryToken{}
+}
+
+func (c *memoryClient) AddRoute(topic string, callback pahomqtt.MessageHandler) {
+	c.Subscribe(topic, 0, callback)
+}
+
+func (c *memoryClient) OptionsReader() pahomqtt.ClientOptionsReader {
+	return pahomqtt.NewOptionsReader(pahomqtt.NewClientOptions())
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryToken struct{}
+
+func (memoryToken) Wait() bool                     { return true }
+func (memoryToken) WaitTimeout(time.Duration) bool { return true }
+func (memoryToken) Error() error                   { return nil }
+func (memoryToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+type memoryMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *memoryMessage) Duplicate() bool   { return false }
+func (m *memoryMessage) Qos() byte         { return 1 }
+func (m *memoryMessage) Retained() bool    { return false }
+func (m *memoryMessage) Topic() string     { return m.topic }
+func (m *memoryMessage) MessageID() uint16 { return 0 }
+func (m *memoryMessage) Payload() []byte   { return m.payload }
+func (m *memoryMessage) Ack()              {}
@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultRPCTimeout bounds calls whose context has no deadline.
+const DefaultRPCTimeout = 30 * time.Second
+
+// ErrRPCTimeout is returned when the device does not answer before the
+// deadline.
+var ErrRPCTimeout = errors.New("device did not reply before the deadline")
+
+// RPCError is an error reported by the agent for a call.
+type RPCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// rpcResponse is the payload of nexusgate/devices/{mac}/rpc/response.
+type rpcResponse struct {
+	RequestID string          `json:"request_id"`
+	Result    json.RawMessage `json:"result"`
+	Error     *RPCError       `json:"error"`
+}
+
+type pendingCall struct {
+	mac   string
+	reply chan rpcResponse
+}
+
+var (
+	rpcCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nexusgate_mqtt_rpc_calls_total", Help: "RPC calls to devices by method and result (ok, error, timeout, publish_failed)",
+	}, []string{"method", "result"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "nexusgate_mqtt_rpc_duration_seconds", Help: "Time until a device answered an RPC call",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"method"})
+)
+
+// RPC sends commands with a request ID and a deadline on the command topic
+// and matches the replies agents publish on nexusgate/devices/{mac}/rpc/response.
+//
+// Request:  {"v":1,"action":"<method>","request_id":"<hex>","deadline":<unix>,"params":{...}}
+// Response: {"v":1,"request_id":"<hex>","result":{...}} or {"request_id":"<hex>","error":{"code":"...","message":"..."}}
+type RPC struct {
+	client pahomqtt.Client
+
+	mu      sync.Mutex
+	pending map[string]pendingCall
+}
+
+// NewRPC subscribes to RPC responses and returns the caller.
+func NewRPC(client pahomqtt.Client) *RPC {
+	r := &RPC{client: client, pending: make(map[string]pendingCall)}
+	client.Subscribe("nexusgate/devices/+/rpc/response", 1, validated(func(_ pahomqtt.Client, mac string, payload []byte) {
+		var resp rpcResponse
+		if err := json.Unmarshal(payload, &resp); err != nil {
+			return
+		}
+		r.mu.Lock()
+		call, ok := r.pending[resp.RequestID]
+		if ok && call.mac == mac {
+			delete(r.pending, resp.RequestID)
+		}
+		r.mu.Unlock()
+		if !ok {
+			return // late reply of a call that timed out
+		}
+		if call.mac != mac {
+			log.Printf("rpc response %s from %s ignored: call was sent to %s", resp.RequestID, mac, call.mac)
+			return
+		}
+		call.reply <- resp
+	}))
+	return r
+}
+
+// Call invokes method on the agent of the device with the given MAC and
+// waits for its reply until ctx is done (DefaultRPCTimeout without a
+// deadline). params must marshal to a JSON object or be nil. Agent-side
+// failures are returned as *RPCError, missing replies as ErrRPCTimeout.
+func (r *RPC) Call(ctx context.Context, mac, method string, params any) (json.RawMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRPCTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	if params == nil {
+		params = map[string]any{}
+	}
+	id := newRequestID()
+	payload, err := json.Marshal(map[string]any{
+		"v":          protocol.Version,
+		"action":     method,
+		"request_id": id,
+		"deadline":   deadline.Unix(),
+		"params":     params,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	call := pendingCall{mac: mac, reply: make(chan rpcResponse, 1)}
+	r.mu.Lock()
+	r.pending[id] = call
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if r.client == nil || !r.client.IsConnected() {
+		rpcCalls.WithLabelValues(method, "publish_failed").Inc()
+		return nil, fmt.Errorf("MQTT not connected")
+	}
+	token := r.client.Publish(protocol.CommandTopic(mac), 1, false, payload)
+	if !token.WaitTimeout(protocol.PublishTimeout) || token.Error() != nil {
+		rpcCalls.WithLabelValues(method, "publish_failed").Inc()
+		if token.Error() != nil {
+			return nil, fmt.Errorf("MQTT publish failed: %w", token.Error())
+		}
+		return nil, fmt.Errorf("MQTT publish timed out")
+	}
+
+	select {
+	case resp := <-call.reply:
+		rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if resp.Error != nil {
+			rpcCalls.WithLabelValues(method, "error").Inc()
+			return nil, resp.Error
+		}
+		rpcCalls.WithLabelValues(method, "ok").Inc()
+		return resp.Result, nil
+	case <-ctx.Done():
+		rpcCalls.WithLabelValues(method, "timeout").Inc()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrRPCTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Pending returns the number of calls waiting for a reply.
+func (r *RPC) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
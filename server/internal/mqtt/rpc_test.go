@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+)
+
+const testMAC = "AA:BB:CC:00:11:22"
+
+// rpcRequest is the command payload of an RPC call as the agent sees it.
+type rpcRequest struct {
+	V         int             `json:"v"`
+	Action    string          `json:"action"`
+	RequestID string          `json:"request_id"`
+	Deadline  int64           `json:"deadline"`
+	Params    json.RawMessage `json:"params"`
+}
+
+// fakeAgent answers the commands of mac through answer, which returns the
+// response payload to publish (nil for none) and the MAC to publish it as.
+func fakeAgent(t *testing.T, broker *MemoryBroker, mac string, answer func(req rpcRequest) (reply any, from string)) <-chan rpcRequest {
+	t.Helper()
+	requests := make(chan rpcRequest, 4)
+	client := broker.Client()
+	client.Subscribe(protocol.CommandTopic(mac), 1, func(c pahomqtt.Client, msg pahomqtt.Message) {
+		var req rpcRequest
+		if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+			t.Errorf("agent: invalid command %s: %v", msg.Payload(), err)
+			return
+		}
+		requests <- req
+		reply, from := answer(req)
+		if reply == nil {
+			return
+		}
+		payload, _ := json.Marshal(reply)
+		c.Publish("nexusgate/devices/"+from+"/rpc/response", 1, false, payload)
+	})
+	t.Cleanup(func() { client.Disconnect(0) })
+	return requests
+}
+
+func TestRPCCall(t *testing.T) {
+	broker := NewMemoryBroker()
+	requests := fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		return map[string]any{"v": 1, "request_id": req.RequestID, "result": map[string]any{"echo": req.Params}}, testMAC
+	})
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	result, err := rpc.Call(ctx, testMAC, "system_info", map[string]any{"verbose": true})
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if string(result) != `{"echo":{"verbose":true}}` {
+		t.Errorf("Call() = %s", result)
+	}
+
+	req := <-requests
+	if req.V != protocol.Version || req.Action != "system_info" || len(req.RequestID) != 32 || req.Deadline != deadline.Unix() {
+		t.Errorf("request = %+v, want v=%d action=system_info deadline=%d", req, protocol.Version, deadline.Unix())
+	}
+	if rpc.Pending() != 0 {
+		t.Errorf("Pending() = %d after the reply", rpc.Pending())
+	}
+}
+
+func TestRPCCallNilParams(t *testing.T) {
+	broker := NewMemoryBroker()
+	requests := fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		return map[string]any{"request_id": req.RequestID, "result": nil}, testMAC
+	})
+	rpc := NewRPC(broker.Client())
+
+	if _, err := rpc.Call(context.Background(), testMAC, "ping", nil); err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+	if req := <-requests; string(req.Params) != "{}" {
+		t.Errorf("params = %s, want {}", req.Params)
+	}
+}
+
+func TestRPCCallAgentError(t *testing.T) {
+	broker := NewMemoryBroker()
+	fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		return map[string]any{"request_id": req.RequestID, "error": map[string]any{"code": "unsupported", "message": "no such action"}}, testMAC
+	})
+	rpc := NewRPC(broker.Client())
+
+	_, err := rpc.Call(context.Background(), testMAC, "frobnicate", nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != "unsupported" || err.Error() != "unsupported: no such action" {
+		t.Fatalf("Call() error = %v, want RPCError unsupported", err)
+	}
+}
+
+func TestRPCCallDeadline(t *testing.T) {
+	broker := NewMemoryBroker()
+	requests := fakeAgent(t, broker, testMAC, func(rpcRequest) (any, string) { return nil, "" })
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := rpc.Call(ctx, testMAC, "system_info", nil)
+	if !errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Call() error = %v, want ErrRPCTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Call() returned after %s", elapsed)
+	}
+	<-requests
+	if rpc.Pending() != 0 {
+		t.Errorf("Pending() = %d after the deadline", rpc.Pending())
+	}
+}
+
+func TestRPCCallCanceled(t *testing.T) {
+	broker := NewMemoryBroker()
+	fakeAgent(t, broker, testMAC, func(rpcRequest) (any, string) { return nil, "" })
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := rpc.Call(ctx, testMAC, "system_info", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Call() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestRPCLateResponse(t *testing.T) {
+	broker := NewMemoryBroker()
+	late := make(chan string, 1)
+	fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		late <- req.RequestID
+		return nil, ""
+	})
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rpc.Call(ctx, testMAC, "system_info", nil); !errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Call() error = %v, want ErrRPCTimeout", err)
+	}
+
+	// The reply arrives after the caller gave up: it is dropped and does
+	// not leave anything pending or answer a later call.
+	agent := broker.Client()
+	payload, _ := json.Marshal(map[string]any{"request_id": <-late, "result": "stale"})
+	agent.Publish("nexusgate/devices/"+testMAC+"/rpc/response", 1, false, payload)
+	time.Sleep(50 * time.Millisecond)
+	if rpc.Pending() != 0 {
+		t.Errorf("Pending() = %d after a late reply", rpc.Pending())
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if result, err := rpc.Call(ctx, testMAC, "system_info", nil); !errors.Is(err, ErrRPCTimeout) {
+		t.Errorf("next Call() = %s, %v; want ErrRPCTimeout", result, err)
+	}
+}
+
+func TestRPCResponseFromOtherDevice(t *testing.T) {
+	const other = "AA:BB:CC:00:11:33"
+	broker := NewMemoryBroker()
+	requests := fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		return map[string]any{"request_id": req.RequestID, "result": "spoofed"}, other
+	})
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := rpc.Call(ctx, testMAC, "system_info", nil)
+	if !errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Call() = %s, %v; want the reply of %s ignored", result, err, other)
+	}
+	<-requests
+}
+
+func TestRPCResponseFromOtherDeviceKeepsCall(t *testing.T) {
+	const other = "AA:BB:CC:00:11:33"
+	broker := NewMemoryBroker()
+	fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		// A device that guessed the request ID answers first, then the
+		// addressed one.
+		spoofed, _ := json.Marshal(map[string]any{"request_id": req.RequestID, "result": "spoofed"})
+		broker.Client().Publish("nexusgate/devices/"+other+"/rpc/response", 1, false, spoofed)
+		time.Sleep(20 * time.Millisecond)
+		return map[string]any{"request_id": req.RequestID, "result": "genuine"}, testMAC
+	})
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := rpc.Call(ctx, testMAC, "system_info", nil)
+	if err != nil || string(result) != `"genuine"` {
+		t.Fatalf("Call() = %s, %v; want the reply of %s", result, err, testMAC)
+	}
+}
+
+func TestRPCInvalidResponse(t *testing.T) {
+	broker := NewMemoryBroker()
+	fakeAgent(t, broker, testMAC, func(req rpcRequest) (any, string) {
+		// Fails the rpc_response schema: request IDs are lowercase hex
+		return map[string]any{"request_id": "NOT-AN-ID", "result": 1}, testMAC
+	})
+	rpc := NewRPC(broker.Client())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := rpc.Call(ctx, testMAC, "system_info", nil); !errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Call() error = %v, want ErrRPCTimeout", err)
+	}
+}
+
+func TestRPCNotConnected(t *testing.T) {
+	broker := NewMemoryBroker()
+	client := broker.Client()
+	rpc := NewRPC(client)
+	client.Disconnect(0)
+
+	if _, err := rpc.Call(context.Background(), testMAC, "system_info", nil); err == nil || errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Call() error = %v, want a connection error", err)
+	}
+	if rpc.Pending() != 0 {
+		t.Errorf("Pending() = %d", rpc.Pending())
+	}
+}
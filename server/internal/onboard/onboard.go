@@ -0,0 +1,190 @@
+package onboard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/uci"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ConfigPath is the agent's UCI config, see packages/nexusgate-agent.
+const ConfigPath = "/etc/config/nexusgate"
+
+// DefaultPackage installs the agent from the opkg feeds configured on the
+// device.
+const DefaultPackage = "nexusgate-agent"
+
+// ErrNotOpenWrt is returned by Collect for hosts that do not run OpenWrt.
+var ErrNotOpenWrt = errors.New("not an OpenWrt device (no /etc/openwrt_release)")
+
+// macCommand prints the MAC the agent registers with (get_mac in
+// nexusgate-agent.sh), which is how the registered device is recognised.
+const macCommand = "cat /sys/class/net/br-lan/address 2>/dev/null || cat /sys/class/net/eth0/address 2>/dev/null"
+
+// installedMarker is printed by the install command when the agent is
+// already installed.
+const installedMarker = "nexusgate-agent already installed"
+
+var (
+	hostPattern    = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.:-]*[A-Za-z0-9])?$`)
+	packagePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+:/?=&%~-]*$`)
+	namePattern    = regexp.MustCompile(`^[A-Za-z0-9._ -]{0,64}$`)
+)
+
+// Agent is how the agent is installed and configured on a host.
+type Agent struct {
+	Package           string `json:"package"`     // name in the device's opkg feeds, or an .ipk URL
+	ServerURL         string `json:"server_url"`  // server the agent registers with
+	MQTTBroker        string `json:"mqtt_broker"` // broker host as reachable from the device
+	MQTTPort          int    `json:"mqtt_port"`
+	HeartbeatInterval int    `json:"heartbeat_interval"`
+	DeviceName        string `json:"device_name,omitempty"` // the hostname when empty
+}
+
+// Normalize validates the agent settings and fills in defaults. The values
+// end up in a UCI file and a shell command, so they are checked strictly.
+func (a *Agent) Normalize() error {
+	if a.Package == "" {
+		a.Package = DefaultPackage
+	}
+	if !packagePattern.MatchString(a.Package) {
+		return errors.New("package must be a package name or an .ipk URL")
+	}
+	u, err := url.Parse(a.ServerURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(a.ServerURL, "'\n ") {
+		return errors.New("server_url must be an http(s) URL the devices can reach")
+	}
+	a.ServerURL = strings.TrimRight(a.ServerURL, "/")
+	if a.MQTTBroker == "" {
+		a.MQTTBroker = u.Hostname()
+	}
+	if !hostPattern.MatchString(a.MQTTBroker) {
+		return errors.New("mqtt_broker must be a hostname or IP address")
+	}
+	if a.MQTTPort == 0 {
+		a.MQTTPort = 1883
+	}
+	if a.MQTTPort < 1 || a.MQTTPort > 65535 {
+		return errors.New("mqtt_port must be between 1 and 65535")
+	}
+	if a.HeartbeatInterval == 0 {
+		a.HeartbeatInterval = 30
+	}
+	if a.HeartbeatInterval < 5 || a.HeartbeatInterval > 3600 {
+		return errors.New("heartbeat_interval must be between 5 and 3600 seconds")
+	}
+	if !namePattern.MatchString(a.DeviceName) {
+		return errors.New("device_name may only contain letters, digits, space, '.', '_' and '-'")
+	}
+	return nil
+}
+
+// Config renders the agent's UCI config file, the same settings as the
+// packaged nexusgate.conf.
+func (a Agent) Config() string {
+	pkg := uci.NewPackage("nexusgate")
+	pkg.Add("agent", "settings").
+		Set("enabled", "1").
+		Set("server_url", a.ServerURL).
+		Set("mqtt_broker", a.MQTTBroker).
+		Set("mqtt_port", strconv.Itoa(a.MQTTPort)).
+		Set("heartbeat_interval", strconv.Itoa(a.HeartbeatInterval)).
+		Set("device_name", a.DeviceName)
+	return "# NexusGate Agent UCI Configuration (written by server onboarding)\n\n" + pkg.File()
+}
+
+// SystemInfo is what Collect learns about a host.
+type SystemInfo struct {
+	Hostname string `json:"hostname"`
+	Model    string `json:"model"`
+	Firmware string `json:"firmware"`
+	Uptime   int64  `json:"uptime"`
+	Kernel   string `json:"kernel"`
+	MAC      string `json:"mac"`
+}
+
+// exitStatus reports whether err is a command that ran and failed, as
+// opposed to a broken connection.
+func exitStatus(err error) bool {
+	var exit *gossh.ExitError
+	return errors.As(err, &exit)
+}
+
+// Collect checks that the host runs OpenWrt and reads its system info and
+// the MAC the agent will register with.
+func Collect(ctx context.Context, conn *gossh.Client) (SystemInfo, error) {
+	var info SystemInfo
+	if _, err := ssh.Exec(ctx, conn, "test -f /etc/openwrt_release", 1024); err != nil {
+		if exitStatus(err) {
+			return info, ErrNotOpenWrt
+		}
+		return info, err
+	}
+	out, err := ssh.Exec(ctx, conn, ssh.SystemInfoCommand, 4096)
+	if err != nil {
+		return info, fmt.Errorf("system info: %w", err)
+	}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return info, fmt.Errorf("system info: unexpected output %q", strings.TrimSpace(out))
+	}
+	out, err = ssh.Exec(ctx, conn, macCommand, 1024)
+	if err != nil && !exitStatus(err) {
+		return info, err
+	}
+	mac, perr := net.ParseMAC(strings.TrimSpace(out))
+	if perr != nil || mac.String() == "00:00:00:00:00:00" {
+		return info, errors.New("no MAC address on br-lan or eth0")
+	}
+	info.MAC = strings.TrimSpace(out)
+	return info, nil
+}
+
+// Install installs the agent package unless the agent is installed already,
+// returning the opkg output.
+func Install(ctx context.Context, conn *gossh.Client, a Agent) (output string, already bool, err error) {
+	command := fmt.Sprintf("if opkg list-installed | grep -q '^nexusgate-agent '; then echo %s; exit 0; fi; opkg update >/dev/null 2>&1; opkg install %s 2>&1",
+		ssh.ShellQuote(installedMarker), ssh.ShellQuote(a.Package))
+	out, err := ssh.Exec(ctx, conn, command, 64*1024)
+	if err != nil {
+		if exitStatus(err) {
+			return out, false, fmt.Errorf("opkg install %s failed: %s", a.Package, lastLine(out))
+		}
+		return out, false, err
+	}
+	return out, strings.TrimSpace(out) == installedMarker, nil
+}
+
+// Configure writes the agent config. Settings a previous install made in
+// the file are replaced.
+func Configure(ctx context.Context, conn *gossh.Client, a Agent) error {
+	config := a.Config()
+	_, err := ssh.Upload(ctx, conn, ConfigPath, strings.NewReader(config), int64(len(config)), 0o644)
+	return err
+}
+
+// Start enables the agent at boot and (re)starts it so that it registers
+// with the configured server.
+func Start(ctx context.Context, conn *gossh.Client) error {
+	_, err := ssh.Exec(ctx, conn, "/etc/init.d/nexusgate-agent enable && /etc/init.d/nexusgate-agent restart", 4096)
+	return err
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = strings.TrimSpace(s[i+1:])
+	}
+	if s == "" {
+		return "no output"
+	}
+	return s
+}
@@ -0,0 +1,274 @@
+package onboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/ssh"
+	"github.com/nexusgate/nexusgate/internal/ssh/sshtest"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const systemInfo = `{"hostname":"gw-01","model":"GL.iNet GL-MT3000","firmware":"r23809-234f1a2efa","uptime":5123,"kernel":"5.15.150"}`
+
+// router is a stock OpenWrt device as the onboarding commands see it.
+type router struct {
+	notOpenWrt bool
+	info       string // output of the system info command
+	mac        string // br-lan address; the command fails when empty
+	installed  bool
+	opkgError  string // opkg install fails with this output
+	startError string
+}
+
+func (r router) exec(command string, _ io.Reader, stdout, stderr io.Writer) int {
+	switch {
+	case command == "test -f /etc/openwrt_release":
+		if r.notOpenWrt {
+			return 1
+		}
+		return 0
+	case command == ssh.SystemInfoCommand:
+		io.WriteString(stdout, r.info+"\n")
+		return 0
+	case command == macCommand:
+		if r.mac == "" {
+			return 1
+		}
+		io.WriteString(stdout, r.mac+"\n")
+		return 0
+	case strings.HasPrefix(command, "if opkg list-installed"):
+		if r.installed {
+			io.WriteString(stdout, installedMarker+"\n")
+			return 0
+		}
+		if r.opkgError != "" {
+			io.WriteString(stdout, r.opkgError)
+			return 255
+		}
+		io.WriteString(stdout, "Installing nexusgate-agent (1.2.0-1) to root...\nConfiguring nexusgate-agent.\n")
+		return 0
+	case strings.HasPrefix(command, "/etc/init.d/nexusgate-agent enable"):
+		if r.startError != "" {
+			io.WriteString(stderr, r.startError)
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(stderr, "sh: unexpected command %q\n", command)
+	return 127
+}
+
+// dial logs in to a fake router as root.
+func dial(t *testing.T, r router, mode sshtest.SFTPMode) (*sshtest.Server, *gossh.Client) {
+	t.Helper()
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "admin"
+	s.SFTP = mode
+	s.Exec = func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.HasPrefix(command, "scp ") {
+			return s.SCP(command, stdin, stdout, stderr)
+		}
+		return r.exec(command, stdin, stdout, stderr)
+	}
+	s.Start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := &ssh.Client{Host: s.Host(), Port: s.Port(), User: "root", Password: "admin", HostKeyCallback: gossh.FixedHostKey(s.HostKey.PublicKey())}
+	conn, err := client.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+func TestCollect(t *testing.T) {
+	tests := []struct {
+		name    string
+		router  router
+		want    SystemInfo
+		wantErr string
+	}{
+		{
+			name:   "OpenWrt",
+			router: router{info: systemInfo, mac: "94:83:c4:01:02:03"},
+			want: SystemInfo{Hostname: "gw-01", Model: "GL.iNet GL-MT3000", Firmware: "r23809-234f1a2efa", Uptime: 5123,
+				Kernel: "5.15.150", MAC: "94:83:c4:01:02:03"},
+		},
+		{name: "not OpenWrt", router: router{notOpenWrt: true}, wantErr: ErrNotOpenWrt.Error()},
+		{name: "system info not JSON", router: router{info: "uci: Entry not found"}, wantErr: `system info: unexpected output "uci: Entry not found"`},
+		{name: "no br-lan or eth0", router: router{info: systemInfo}, wantErr: "no MAC address on br-lan or eth0"},
+		{name: "zero MAC", router: router{info: systemInfo, mac: "00:00:00:00:00:00"}, wantErr: "no MAC address on br-lan or eth0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, conn := dial(t, tt.router, sshtest.SFTPServe)
+			got, err := Collect(context.Background(), conn)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Collect() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Collect() = %+v, %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectNotOpenWrtIsNotAConnectionError(t *testing.T) {
+	_, conn := dial(t, router{notOpenWrt: true}, sshtest.SFTPServe)
+	if _, err := Collect(context.Background(), conn); !errors.Is(err, ErrNotOpenWrt) {
+		t.Fatalf("Collect() error = %v, want ErrNotOpenWrt", err)
+	}
+	conn.Close()
+	if _, err := Collect(context.Background(), conn); err == nil || errors.Is(err, ErrNotOpenWrt) {
+		t.Errorf("Collect() on a closed connection = %v, want a connection error", err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	agent := Agent{Package: "https://feeds.example.com/nexusgate-agent_1.2.0-1_all.ipk"}
+	tests := []struct {
+		name        string
+		router      router
+		wantAlready bool
+		wantErr     string
+	}{
+		{name: "fresh install", router: router{}},
+		{name: "already installed", router: router{installed: true}, wantAlready: true},
+		{
+			name:    "opkg fails",
+			router:  router{opkgError: "Unknown package 'nexusgate-agent'.\nCollected errors:\n * opkg_install_cmd: Cannot install package nexusgate-agent.\n"},
+			wantErr: "opkg install " + agent.Package + " failed: * opkg_install_cmd: Cannot install package nexusgate-agent.",
+		},
+		{name: "opkg fails silently", router: router{opkgError: "\n"}, wantErr: "opkg install " + agent.Package + " failed: no output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, conn := dial(t, tt.router, sshtest.SFTPServe)
+			out, already, err := Install(context.Background(), conn, agent)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("Install() error = %v, want %q", err, tt.wantErr)
+				}
+				if out != tt.router.opkgError {
+					t.Errorf("Install() output = %q, want the opkg output", out)
+				}
+				return
+			}
+			if err != nil || already != tt.wantAlready || out == "" {
+				t.Errorf("Install() = %q, %v, %v; want already=%v", out, already, err, tt.wantAlready)
+			}
+			if cmds := s.Commands(); len(cmds) != 1 || !strings.HasSuffix(cmds[0], "opkg install '"+agent.Package+"' 2>&1") {
+				t.Errorf("commands = %q", cmds)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	agent := Agent{ServerURL: "https://nexusgate.example.com/", DeviceName: "branch 7"}
+	if err := agent.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []sshtest.SFTPMode{sshtest.SFTPServe, sshtest.SFTPExit} {
+		s, conn := dial(t, router{}, mode)
+		if err := Configure(context.Background(), conn, agent); err != nil {
+			t.Fatalf("Configure() error = %v", err)
+		}
+		data, perm, ok := s.ReadFile(ConfigPath)
+		if !ok || string(data) != agent.Config() || perm != 0o644 {
+			t.Errorf("%s = %q (mode %o), want\n%s", ConfigPath, data, perm, agent.Config())
+		}
+		for _, line := range []string{"option server_url 'https://nexusgate.example.com'", "option mqtt_broker 'nexusgate.example.com'", "option device_name 'branch 7'"} {
+			if !strings.Contains(string(data), line) {
+				t.Errorf("config lacks %q", line)
+			}
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	s, conn := dial(t, router{}, sshtest.SFTPServe)
+	if err := Start(context.Background(), conn); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if cmds := s.Commands(); len(cmds) != 1 || cmds[0] != "/etc/init.d/nexusgate-agent enable && /etc/init.d/nexusgate-agent restart" {
+		t.Errorf("commands = %q", cmds)
+	}
+
+	_, conn = dial(t, router{startError: "/etc/init.d/nexusgate-agent: not found"}, sshtest.SFTPServe)
+	if err := Start(context.Background(), conn); err == nil || !strings.Contains(err.Error(), "nexusgate-agent: not found") {
+		t.Errorf("Start() error = %v", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		agent   Agent
+		want    Agent
+		wantErr bool
+	}{
+		{
+			agent: Agent{ServerURL: "http://10.0.0.5:8080/"},
+			want:  Agent{Package: DefaultPackage, ServerURL: "http://10.0.0.5:8080", MQTTBroker: "10.0.0.5", MQTTPort: 1883, HeartbeatInterval: 30},
+		},
+		{
+			agent: Agent{Package: "nexusgate-agent", ServerURL: "https://ng.example.com", MQTTBroker: "mqtt.example.com", MQTTPort: 8883, HeartbeatInterval: 60},
+			want:  Agent{Package: "nexusgate-agent", ServerURL: "https://ng.example.com", MQTTBroker: "mqtt.example.com", MQTTPort: 8883, HeartbeatInterval: 60},
+		},
+		{agent: Agent{ServerURL: "ftp://ng.example.com"}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com/x'; reboot; '"}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com", Package: "pkg; reboot"}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com", MQTTBroker: "mqtt.example.com;"}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com", MQTTPort: 70000}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com", HeartbeatInterval: 1}, wantErr: true},
+		{agent: Agent{ServerURL: "https://ng.example.com", DeviceName: "it's"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got := tt.agent
+		err := got.Normalize()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Normalize(%+v) error = %v, want error %v", tt.agent, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("Normalize(%+v) = %+v, want %+v", tt.agent, got, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		target  string
+		first   string
+		count   int
+		wantErr bool
+	}{
+		{target: "192.168.1.1", first: "192.168.1.1", count: 1},
+		{target: " 192.168.1.0/30 ", first: "192.168.1.1", count: 2},
+		{target: "192.168.1.0/31", first: "192.168.1.0", count: 2},
+		{target: "10.0.0.0/22", first: "10.0.0.1", count: 1022},
+		{target: "10.0.0.0/21", wantErr: true},
+		{target: "router.lan", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Expand(%q) error = %v", tt.target, err)
+			continue
+		}
+		if err == nil && (len(got) != tt.count || got[0] != netip.MustParseAddr(tt.first)) {
+			t.Errorf("Expand(%q) = %d addresses from %v, want %d from %s", tt.target, len(got), got[0], tt.count, tt.first)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package onboard brings routers that run stock OpenWrt without
+// nexusgate-agent under management over SSH: it finds hosts, collects their
+// system info, installs and configures the agent and starts it.
+package onboard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxHosts caps the addresses a single target may expand to (an IPv4 /22).
+const MaxHosts = 1024
+
+// probeConcurrency is the number of hosts Probe dials at once.
+const probeConcurrency = 64
+
+// Expand turns an IP address or CIDR prefix into the addresses to try. The
+// network and broadcast addresses of IPv4 prefixes shorter than /31 are left
+// out.
+func Expand(target string) ([]netip.Addr, error) {
+	target = strings.TrimSpace(target)
+	if !strings.Contains(target, "/") {
+		addr, err := netip.ParseAddr(target)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid target %q: want an IP address or CIDR", target)
+		}
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	prefix, err := netip.ParsePrefix(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: want an IP address or CIDR", target)
+	}
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 10 {
+		return nil, fmt.Errorf("target %s spans more than %d addresses", prefix, MaxHosts)
+	}
+	var addrs []netip.Addr
+	for a := prefix.Addr(); a.IsValid() && prefix.Contains(a); a = a.Next() {
+		addrs = append(addrs, a)
+	}
+	if prefix.Addr().Is4() && hostBits >= 2 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs, nil
+}
+
+// Probe returns, in order, the addresses that accept a TCP connection on
+// port within timeout.
+func Probe(ctx context.Context, addrs []netip.Addr, port int, timeout time.Duration) []netip.Addr {
+	open := make([]bool, len(addrs))
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d := net.Dialer{Timeout: timeout}
+			conn, err := d.DialContext(ctx, "tcp", netip.AddrPortFrom(addr, uint16(port)).String())
+			if err == nil {
+				conn.Close()
+				open[i] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	var found []netip.Addr
+	for i, ok := range open {
+		if ok {
+			found = append(found, addrs[i])
+		}
+	}
+	return found
+}
@@ -0,0 +1,158 @@
+// Package protocol defines the MQTT protocol spoken between the server and
+// nexusgate-agent: its version, the capabilities an agent can advertise at
+// registration and the JSON Schemas of each topic payload.
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/model"
+)
+
+// Version is the protocol version implemented by this server. Messages carry
+// it in the "v" field; agents registering without one speak version 0, the
+// unversioned protocol of agent 1.0.
+const Version = 1
+
+// Capabilities an agent may advertise. Commands are gated by "command.<action>".
+const (
+	CapHeartbeatDetails = "heartbeat.details" // interfaces, filesystems, thermal and wireless in status
+	CapConfigAck        = "config.ack"        // acknowledges config pushes on config/ack
+	CapConfigConfirm    = "config.confirm"    // rolls back a config unless confirmed in time
+	CapUpgradeAck       = "upgrade.ack"       // acknowledges upgrades on upgrade/ack
+	CapUpgradeProgress  = "upgrade.progress"  // reports download/verify/flash stages on upgrade/ack
+	CapRPC              = "rpc"               // answers commands carrying a request_id on rpc/response
+	CapTunnel           = "tunnel"            // registers a tunnel_key and dials the reverse tunnel on tunnel_open
+
+	CapCommandReboot        = "command.reboot"
+	CapCommandUpgrade       = "command.upgrade"
+	CapCommandConfirmConfig = "command.confirm_config"
+	CapCommandPing          = "command.ping"
+	CapCommandSystemInfo    = "command.system_info"
+	CapCommandDiagnostic    = "command.diagnostic" // together with "diagnostic.<action>" per installed tool
+	CapCommandLogread       = "command.logread"
+	CapCommandSyslogForward = "command.syslog_forward"
+	CapCommandUCIExport     = "command.uci_export"
+	CapCommandTunnelOpen    = "command.tunnel_open"
+	CapCommandTunnelClose   = "command.tunnel_close"
+)
+
+// LegacyCapabilities are assumed for agents that registered without a
+// protocol version.
+var LegacyCapabilities = []string{CapConfigAck, CapUpgradeAck, CapCommandReboot, CapCommandUpgrade}
+
+var capabilityPattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// NormalizeCapabilities validates, dedupes and sorts advertised capabilities
+// and joins them for storage in model.Device.Capabilities.
+func NormalizeCapabilities(caps []string) (string, error) {
+	seen := make(map[string]bool, len(caps))
+	out := make([]string, 0, len(caps))
+	for _, c := range caps {
+		c = strings.TrimSpace(c)
+		if !capabilityPattern.MatchString(c) || len(c) > 64 {
+			return "", fmt.Errorf("invalid capability %q", c)
+		}
+		if !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out)
+	return strings.Join(out, ","), nil
+}
+
+// Capabilities returns the capabilities of a device.
+func Capabilities(d model.Device) []string {
+	if d.ProtocolVersion == 0 {
+		return LegacyCapabilities
+	}
+	if d.Capabilities == "" {
+		return nil
+	}
+	return strings.Split(d.Capabilities, ",")
+}
+
+// Supports reports whether a device advertised a capability.
+func Supports(d model.Device, capability string) bool {
+	for _, c := range Capabilities(d) {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnsupported is returned when a device lacks the capability a message
+// requires.
+var ErrUnsupported = errors.New("not supported by the device agent")
+
+// Require returns an error wrapping ErrUnsupported unless the device
+// supports the capability.
+func Require(d model.Device, capability string) error {
+	if Supports(d, capability) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w (protocol v%d, agent %q)", capability, ErrUnsupported, d.ProtocolVersion, d.AgentVersion)
+}
+
+// RequireRPC returns an error wrapping ErrUnsupported unless the device
+// answers RPC calls of the given method.
+func RequireRPC(d model.Device, method string) error {
+	if err := Require(d, CapRPC); err != nil {
+		return err
+	}
+	return Require(d, "command."+method)
+}
+
+// PublishTimeout bounds how long publishing a message may block.
+const PublishTimeout = 5 * time.Second
+
+// CommandTopic returns the command topic of a device.
+func CommandTopic(mac string) string {
+	return fmt.Sprintf("nexusgate/devices/%s/command", mac)
+}
+
+// PublishCommand sends a command to a device after checking that its agent
+// supports the action. fields are merged into the payload next to "v" and
+// "action".
+func PublishCommand(client pahomqtt.Client, d model.Device, action string, fields map[string]any) error {
+	if err := Require(d, "command."+action); err != nil {
+		return err
+	}
+	if client == nil || !client.IsConnected() {
+		return fmt.Errorf("MQTT not connected")
+	}
+	msg := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		msg[k] = v
+	}
+	msg["v"] = Version
+	msg["action"] = action
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	token := client.Publish(CommandTopic(d.MAC), 1, false, payload)
+	if !token.WaitTimeout(PublishTimeout) {
+		return fmt.Errorf("MQTT publish timed out")
+	}
+	return token.Error()
+}
+
+// UpgradeFields returns the fields of an upgrade command. Agents with
+// upgrade.progress are asked to report the intermediate stages.
+func UpgradeFields(d model.Device, upgradeID uint, url, sha256, version string) map[string]any {
+	fields := map[string]any{"upgrade_id": upgradeID, "url": url, "sha256": sha256, "version": version}
+	if Supports(d, CapUpgradeProgress) {
+		fields["report_progress"] = true
+	}
+	return fields
+}
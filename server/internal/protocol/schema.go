@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Payload schemas, one per topic, named after the topic suffix with "/"
+// replaced by "_" (status, config, config_ack, upgrade_ack, command).
+//
+//go:embed schemas/*.json
+var schemaFS embed.FS
+
+var schemas = loadSchemas()
+
+// schema is the subset of JSON Schema (draft 2020-12) used by the payload
+// schemas: type, properties, required, additionalProperties, items, enum,
+// minimum, maximum, minLength, maxLength, maxItems and pattern.
+type schema struct {
+	Type                 schemaTypes        `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []any              `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	MaxItems             *int               `json:"maxItems"`
+	Pattern              string             `json:"pattern"`
+
+	additional *schema // parsed additionalProperties schema
+	closed     bool    // additionalProperties: false
+	pattern    *regexp.Regexp
+	raw        []byte
+}
+
+// schemaTypes accepts "type" as a string or a list of strings.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*t = many
+	return nil
+}
+
+func loadSchemas() map[string]*schema {
+	entries, err := schemaFS.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	out := make(map[string]*schema, len(entries))
+	for _, e := range entries {
+		raw, err := schemaFS.ReadFile("schemas/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		var s schema
+		if err := json.Unmarshal(raw, &s); err != nil {
+			panic(fmt.Sprintf("protocol schema %s: %v", e.Name(), err))
+		}
+		if err := s.compile(); err != nil {
+			panic(fmt.Sprintf("protocol schema %s: %v", e.Name(), err))
+		}
+		s.raw = raw
+		out[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = &s
+	}
+	return out
+}
+
+func (s *schema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	switch trimmed := bytes.TrimSpace(s.AdditionalProperties); {
+	case len(trimmed) == 0, bytes.Equal(trimmed, []byte("true")):
+	case bytes.Equal(trimmed, []byte("false")):
+		s.closed = true
+	default:
+		s.additional = &schema{}
+		if err := json.Unmarshal(trimmed, s.additional); err != nil {
+			return err
+		}
+		if err := s.additional.compile(); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// SchemaNames returns the names of the published schemas.
+func SchemaNames() []string {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Schema returns the JSON Schema document with the given name.
+func Schema(name string) ([]byte, bool) {
+	s, ok := schemas[name]
+	if !ok {
+		return nil, false
+	}
+	return s.raw, true
+}
+
+// ValidationError describes the first violation found in a payload.
+type ValidationError struct {
+	Path    string // JSON pointer-like path, "" for the root
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks a payload against the named schema.
+func Validate(name string, payload []byte) error {
+	s, ok := schemas[name]
+	if !ok {
+		return fmt.Errorf("unknown schema %q", name)
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return &ValidationError{Message: "invalid JSON: " + err.Error()}
+	}
+	if dec.More() {
+		return &ValidationError{Message: "trailing data after JSON value"}
+	}
+	return s.validate("", v)
+}
+
+func (s *schema) validate(at string, v any) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: at, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		return fail("expected %s, got %s", strings.Join(s.Type, " or "), jsonType(v))
+	}
+	if len(s.Enum) > 0 && !s.enumContains(v) {
+		return fail("value not allowed")
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fail("must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fail("must be <= %v", *s.Maximum)
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match %s", s.Pattern)
+		}
+	case []any:
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s/%d", at, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := s.Properties[k]
+			if child == nil {
+				if s.closed {
+					return fail("unexpected property %q", k)
+				}
+				child = s.additional
+			}
+			if child != nil {
+				if err := child.validate(at+"/"+k, v[k]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t schemaTypes) match(v any) bool {
+	for _, name := range t {
+		switch name {
+		case "object":
+			if _, ok := v.(map[string]any); ok {
+				return true
+			}
+		case "array":
+			if _, ok := v.([]any); ok {
+				return true
+			}
+		case "string":
+			if _, ok := v.(string); ok {
+				return true
+			}
+		case "boolean":
+			if _, ok := v.(bool); ok {
+				return true
+			}
+		case "null":
+			if v == nil {
+				return true
+			}
+		case "number":
+			if _, ok := v.(json.Number); ok {
+				return true
+			}
+		case "integer":
+			if n, ok := v.(json.Number); ok {
+				if f, err := n.Float64(); err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (s *schema) enumContains(v any) bool {
+	for _, e := range s.Enum {
+		switch e := e.(type) {
+		case float64:
+			if n, ok := v.(json.Number); ok {
+				if f, err := n.Float64(); err == nil && f == e {
+					return true
+				}
+			}
+		default:
+			if e == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const (
+		requestID = "0123456789abcdef0123456789abcdef"
+		sha256    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	)
+	long := strings.Repeat("x", 4097)
+
+	tests := []struct {
+		schema  string
+		name    string
+		payload string
+		path    string // path of the expected ValidationError; "-" when valid
+	}{
+		// Payloads of agent 1.0 and server 1.0, without "v"
+		{"status", "legacy heartbeat", `{"mac":"AA:BB:CC:00:11:22","cpu_usage":12.5,"mem_usage":40.0,"mem_total":251904,"mem_free":151040,"rx_bytes":123456789,"tx_bytes":98765,"conntrack":311,"uptime_secs":86400,"load_avg":"0.08 0.03 0.01"}`, "-"},
+		{"status", "legacy heartbeat with zero usage", `{"mac":"aa:bb:cc:00:11:22","cpu_usage":0,"mem_usage":0.0,"mem_total":0,"mem_free":0,"rx_bytes":0,"tx_bytes":0,"conntrack":0,"uptime_secs":0,"load_avg":""}`, "-"},
+		{"config_ack", "legacy applied with empty error", `{"config_id":7,"status":"applied","error":""}`, "-"},
+		{"config_ack", "legacy failed", `{"config_id":7,"status":"failed","error":"uci commit failed"}`, "-"},
+		{"upgrade_ack", "legacy success", `{"upgrade_id":3,"status":"success"}`, "-"},
+		{"upgrade_ack", "legacy failed", `{"upgrade_id":3,"status":"failed","error":"download or verification failed"}`, "-"},
+		{"config", "legacy push", `{"config_id":7,"content":"config system\n\toption hostname 'gw'\n"}`, "-"},
+		{"command", "legacy reboot", `{"action":"reboot"}`, "-"},
+		{"command", "legacy upgrade", `{"action":"upgrade","url":"http://server/firmware/1/download","sha256":"` + sha256 + `","version":"23.05.3","upgrade_id":3}`, "-"},
+
+		// Version 1 payloads
+		{"status", "heartbeat with details", `{"v":1,"mac":"AA:BB:CC:00:11:22","cpu_usage":3,"interfaces":[{"name":"eth0","rx_bytes":1,"up":true,"speed":-1}],"filesystems":[{"mount":"/overlay","total_kb":1024,"used_kb":12}],"thermal":[{"zone":"cpu-thermal","temp":-5000}],"wireless":[{"radio":"radio0","interface":"wlan0","ssid":"corp","clients":4}]}`, "-"},
+		{"config_ack", "pending confirm", `{"v":1,"config_id":9,"status":"pending_confirm"}`, "-"},
+		{"upgrade_ack", "progress", `{"v":1,"upgrade_id":3,"status":"downloading","progress":40}`, "-"},
+		{"config", "push with confirm timeout", `{"v":1,"config_id":9,"content":"","confirm_timeout":120}`, "-"},
+		{"command", "rpc with params", `{"v":1,"action":"system_info","request_id":"` + requestID + `","deadline":1700000000,"params":{"any":["thing"]}}`, "-"},
+		{"command", "tunnel open", `{"v":1,"action":"tunnel_open","host":"server","port":2222,"user":"tunnel","forwards":[22,80]}`, "-"},
+		{"command", "upgrade without checksum", `{"action":"upgrade","url":"http://server/fw","sha256":"","upgrade_id":1}`, "-"},
+		{"rpc_response", "result", `{"v":1,"request_id":"` + requestID + `","result":{"uptime":5}}`, "-"},
+		{"rpc_response", "null result", `{"request_id":"` + requestID + `","result":null}`, "-"},
+		{"rpc_response", "error", `{"request_id":"` + requestID + `","error":{"code":"unsupported","message":"no such action"}}`, "-"},
+		{"diagnostic_progress", "line", `{"v":1,"diagnostic_id":4,"line":"64 bytes from 8.8.8.8: seq=0 ttl=117 time=9.812 ms"}`, "-"},
+		{"status", "unknown properties are allowed", `{"mac":"AA:BB:CC:00:11:22","future_field":{"a":1}}`, "-"},
+
+		// Rejected payloads
+		{"status", "not JSON", `{"mac":`, ""},
+		{"status", "trailing data", `{"mac":"AA:BB:CC:00:11:22"} {}`, ""},
+		{"status", "not an object", `["AA:BB:CC:00:11:22"]`, ""},
+		{"status", "missing mac", `{"cpu_usage":1}`, ""},
+		{"status", "malformed mac", `{"mac":"AABBCC001122"}`, "/mac"},
+		{"status", "cpu above 100", `{"mac":"AA:BB:CC:00:11:22","cpu_usage":100.5}`, "/cpu_usage"},
+		{"status", "negative counter", `{"mac":"AA:BB:CC:00:11:22","rx_bytes":-1}`, "/rx_bytes"},
+		{"status", "fractional integer", `{"mac":"AA:BB:CC:00:11:22","mem_total":1.5}`, "/mem_total"},
+		{"status", "number as string", `{"mac":"AA:BB:CC:00:11:22","cpu_usage":"12.5"}`, "/cpu_usage"},
+		{"status", "interface without name", `{"mac":"AA:BB:CC:00:11:22","interfaces":[{"rx_bytes":1}]}`, "/interfaces/0"},
+		{"status", "interface speed below -1", `{"mac":"AA:BB:CC:00:11:22","interfaces":[{"name":"eth0"},{"name":"eth1","speed":-2}]}`, "/interfaces/1/speed"},
+		{"status", "too many filesystems", `{"mac":"AA:BB:CC:00:11:22","filesystems":[` + strings.TrimSuffix(strings.Repeat(`{"mount":"/"},`, 65), ",") + `]}`, "/filesystems"},
+		{"status", "thermal without temp", `{"mac":"AA:BB:CC:00:11:22","thermal":[{"zone":"cpu"}]}`, "/thermal/0"},
+		{"status", "negative protocol version", `{"v":-1,"mac":"AA:BB:CC:00:11:22"}`, "/v"},
+		{"config_ack", "unknown status", `{"config_id":7,"status":"done"}`, "/status"},
+		{"config_ack", "config id 0", `{"config_id":0,"status":"applied"}`, "/config_id"},
+		{"config_ack", "error too long", `{"config_id":7,"status":"failed","error":"` + long + `"}`, "/error"},
+		{"upgrade_ack", "progress above 100", `{"upgrade_id":3,"status":"downloading","progress":101}`, "/progress"},
+		{"upgrade_ack", "missing status", `{"upgrade_id":3}`, ""},
+		{"config", "confirm timeout too short", `{"config_id":1,"content":"","confirm_timeout":5}`, "/confirm_timeout"},
+		{"config", "missing content", `{"config_id":1}`, ""},
+		{"command", "uppercase action", `{"action":"Reboot"}`, "/action"},
+		{"command", "short checksum", `{"action":"upgrade","sha256":"abc"}`, "/sha256"},
+		{"command", "port out of range", `{"action":"tunnel_open","port":70000}`, "/port"},
+		{"command", "forward 0", `{"action":"tunnel_open","forwards":[22,0]}`, "/forwards/1"},
+		{"rpc_response", "uppercase request id", `{"request_id":"` + strings.ToUpper(requestID) + `"}`, "/request_id"},
+		{"rpc_response", "error without code", `{"request_id":"` + requestID + `","error":{"message":"x"}}`, "/error"},
+		{"rpc_response", "error as string", `{"request_id":"` + requestID + `","error":"boom"}`, "/error"},
+		{"diagnostic_progress", "line too long", `{"diagnostic_id":4,"line":"` + long + `"}`, "/line"},
+	}
+
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		t.Run(tt.schema+"/"+tt.name, func(t *testing.T) {
+			err := Validate(tt.schema, []byte(tt.payload))
+			if tt.path == "-" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want valid", err)
+				}
+				covered[tt.schema] = true
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Validate() = %v, want a ValidationError", err)
+			}
+			if verr.Path != tt.path {
+				t.Errorf("error path = %q, want %q (%v)", verr.Path, tt.path, verr)
+			}
+		})
+	}
+	for _, name := range SchemaNames() {
+		if !covered[name] {
+			t.Errorf("schema %s has no valid payload test", name)
+		}
+	}
+}
+
+func TestValidateUnknownSchema(t *testing.T) {
+	err := Validate("heartbeat", []byte(`{}`))
+	if err == nil {
+		t.Fatal("Validate() of an unknown schema succeeded")
+	}
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		t.Errorf("Validate() = %v, want a plain error for an unknown schema", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	want := []string{"command", "config", "config_ack", "diagnostic_progress", "rpc_response", "status", "upgrade_ack"}
+	names := SchemaNames()
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("SchemaNames() = %v, want %v", names, want)
+	}
+	for _, name := range names {
+		raw, ok := Schema(name)
+		if !ok || !strings.Contains(string(raw), `"$id": "https://nexusgate.io/schemas/agent/`+name+`.json"`) {
+			t.Errorf("Schema(%q) = %q, %v", name, raw, ok)
+		}
+	}
+	if _, ok := Schema("missing"); ok {
+		t.Error(`Schema("missing") found a document`)
+	}
+}
@@ -0,0 +1,131 @@
+package secret
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalKMS holds 32-byte master keys in memory. The first one wraps new
+// data keys; the others only unwrap, which lets values sealed with a
+// retired master key be read until they are re-encrypted.
+type LocalKMS struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewLocalKMS returns a KMS with master key current and any number of
+// previous ones.
+func NewLocalKMS(current []byte, previous ...[]byte) (*LocalKMS, error) {
+	k := &LocalKMS{keys: map[string][]byte{}}
+	for i, key := range append([][]byte{current}, previous...) {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("secret: master key must be 32 bytes, got %d", len(key))
+		}
+		id := keyID(key)
+		if i == 0 {
+			k.current = id
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+// LoadLocalKMS builds a LocalKMS from configuration. The master key is key
+// when set, base64-encoded; otherwise it is read from path, generating a
+// new one there if the file does not exist. previous are retired master
+// keys, base64-encoded.
+func LoadLocalKMS(key, path string, previous []string) (*LocalKMS, error) {
+	var current []byte
+	var err error
+	if key != "" {
+		if current, err = decodeKey(key); err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+	} else if current, err = loadOrGenerateKey(path); err != nil {
+		return nil, err
+	}
+	var old [][]byte
+	for i, p := range previous {
+		k, err := decodeKey(p)
+		if err != nil {
+			return nil, fmt.Errorf("previous master key %d: %w", i+1, err)
+		}
+		old = append(old, k)
+	}
+	return NewLocalKMS(current, old...)
+}
+
+func (k *LocalKMS) KeyID() string {
+	return k.current
+}
+
+func (k *LocalKMS) WrapKey(_ context.Context, dataKey []byte) ([]byte, error) {
+	return encrypt(k.keys[k.current], dataKey)
+}
+
+func (k *LocalKMS) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("secret: unknown master key %s", keyID)
+	}
+	return decrypt(key, wrapped)
+}
+
+// keyID is the start of the key's SHA-256, so IDs need no configuration
+// and a wrong key is told apart from corrupt data.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey returns a new base64-encoded master key.
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("not valid base64")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func loadOrGenerateKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		s, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(s + "\n")
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("master key %s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,167 @@
+// Package secret encrypts values stored in the database with envelope
+// encryption: every value gets its own random data key, which is wrapped
+// by a master key held by a KMS. A sealed value is a string
+//
+//	enc:v1:<master key ID>:<wrapped data key>:<nonce and ciphertext>
+//
+// with both binary parts in unpadded base64. Empty values stay empty, so
+// "is set" checks keep working in SQL.
+package secret
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const prefix = "enc:v1:"
+
+// KMS wraps and unwraps data keys with master keys it never hands out.
+// LocalKMS keeps them in memory; a cloud KMS can implement the same
+// interface.
+type KMS interface {
+	// KeyID names the master key new data keys are wrapped with. It must
+	// not contain ':'.
+	KeyID() string
+	// WrapKey encrypts a data key with the current master key.
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped with the master key keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	// ErrNoKMS is returned when a value is sealed or opened before SetKMS.
+	ErrNoKMS = errors.New("secret: no KMS configured")
+	// ErrMalformed is returned for a value that looks sealed but does not
+	// parse.
+	ErrMalformed = errors.New("secret: malformed sealed value")
+)
+
+var kms KMS
+
+// SetKMS sets the KMS used by Seal, Open and the GORM serializer. Call it
+// once at startup, before the database is used.
+func SetKMS(k KMS) {
+	kms = k
+}
+
+// CurrentKeyID returns the ID of the master key values are sealed with.
+func CurrentKeyID() string {
+	if kms == nil {
+		return ""
+	}
+	return kms.KeyID()
+}
+
+// IsSealed reports whether s is a sealed value.
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// KeyIDOf returns the master key ID a sealed value was sealed with.
+func KeyIDOf(s string) string {
+	if !IsSealed(s) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(s, prefix), ":")
+	return id
+}
+
+// Seal encrypts plaintext under a new data key. The empty string is
+// returned unchanged.
+func Seal(ctx context.Context, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if kms == nil {
+		return "", ErrNoKMS
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	wrapped, err := kms.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := encrypt(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return prefix + kms.KeyID() + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// Open decrypts a sealed value. Values that are not sealed, such as rows
+// written before encryption was enabled, are returned unchanged.
+func Open(ctx context.Context, s string) (string, error) {
+	if !IsSealed(s) {
+		return s, nil
+	}
+	if kms == nil {
+		return "", ErrNoKMS
+	}
+	parts := strings.Split(strings.TrimPrefix(s, prefix), ":")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	enc := base64.RawStdEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	dataKey, err := kms.UnwrapKey(ctx, parts[0], wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := decrypt(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// encrypt seals data with AES-256-GCM and prepends the nonce.
+func encrypt(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func decrypt(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	out, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("secret: decryption failed: %w", err)
+	}
+	return out, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,153 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// useKMS sets a LocalKMS with the given master keys for the test.
+func useKMS(t *testing.T, current []byte, previous ...[]byte) *LocalKMS {
+	t.Helper()
+	k, err := NewLocalKMS(current, previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKMS(k)
+	t.Cleanup(func() { SetKMS(nil) })
+	return k
+}
+
+func masterKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestSealOpen(t *testing.T) {
+	k := useKMS(t, masterKey(1))
+	ctx := context.Background()
+	for _, plaintext := range []string{"hunter2", "with:colons:inside", "enc:v1:looks-sealed", "办公室 Wi-Fi ✓", strings.Repeat("x", 4096)} {
+		sealed, err := Seal(ctx, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsSealed(sealed) || KeyIDOf(sealed) != k.KeyID() || strings.Contains(sealed, plaintext) {
+			t.Errorf("Seal(%.20q) = %.40q, want it sealed with key %s", plaintext, sealed, k.KeyID())
+		}
+		again, _ := Seal(ctx, plaintext)
+		if again == sealed {
+			t.Errorf("Seal(%.20q) twice gave the same value", plaintext)
+		}
+		got, err := Open(ctx, sealed)
+		if err != nil || got != plaintext {
+			t.Errorf("Open(Seal(%.20q)) = %.20q, %v", plaintext, got, err)
+		}
+	}
+
+	if sealed, err := Seal(ctx, ""); sealed != "" || err != nil {
+		t.Errorf(`Seal("") = %q, %v; want it empty`, sealed, err)
+	}
+	for _, plain := range []string{"", "not sealed", "enc:v2:x"} {
+		if got, err := Open(ctx, plain); got != plain || err != nil {
+			t.Errorf("Open(%q) = %q, %v; want it unchanged", plain, got, err)
+		}
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	ctx := context.Background()
+	useKMS(t, masterKey(1))
+	sealed, err := Seal(ctx, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(sealed, prefix), ":")
+	// tamper flips a bit of the i-th binary part.
+	tamper := func(i int) string {
+		enc := base64.RawStdEncoding
+		b, err := enc.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 1
+		p := append([]string{}, parts...)
+		p[i] = enc.EncodeToString(b)
+		return prefix + strings.Join(p, ":")
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr error  // matched with errors.Is when set
+		wantMsg string // contained in the error otherwise
+	}{
+		{name: "unknown key ID", value: prefix + "0123456789abcdef:" + parts[1] + ":" + parts[2], wantMsg: "unknown master key 0123456789abcdef"},
+		{name: "tampered ciphertext", value: tamper(2), wantMsg: "decryption failed"},
+		{name: "tampered data key", value: tamper(1), wantMsg: "decryption failed"},
+		{name: "truncated ciphertext", value: prefix + parts[0] + ":" + parts[1] + ":AAAA", wantErr: ErrMalformed},
+		{name: "missing part", value: prefix + parts[0] + ":" + parts[1], wantErr: ErrMalformed},
+		{name: "extra part", value: sealed + ":x", wantErr: ErrMalformed},
+		{name: "bad base64", value: prefix + parts[0] + ":!!:" + parts[2], wantErr: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Open(ctx, tt.value)
+			switch {
+			case err == nil:
+				t.Errorf("Open() = %q, want an error", got)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("Open() = %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && !strings.Contains(err.Error(), tt.wantMsg):
+				t.Errorf("Open() = %v, want %q", err, tt.wantMsg)
+			}
+		})
+	}
+
+	SetKMS(nil)
+	if _, err := Open(ctx, sealed); !errors.Is(err, ErrNoKMS) {
+		t.Errorf("Open() without a KMS = %v, want ErrNoKMS", err)
+	}
+	if _, err := Seal(ctx, "hunter2"); !errors.Is(err, ErrNoKMS) {
+		t.Errorf("Seal() without a KMS = %v, want ErrNoKMS", err)
+	}
+}
+
+func TestLocalKMSPreviousKeys(t *testing.T) {
+	ctx := context.Background()
+	old := useKMS(t, masterKey(1))
+	sealed, err := Seal(ctx, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After a master key rotation the old key still opens values it sealed,
+	// and new values are sealed with the new key.
+	current := useKMS(t, masterKey(2), masterKey(3), masterKey(1))
+	if current.KeyID() == old.KeyID() || KeyIDOf(sealed) != old.KeyID() {
+		t.Fatalf("key IDs: old %s, current %s, sealed with %s", old.KeyID(), current.KeyID(), KeyIDOf(sealed))
+	}
+	if got, err := Open(ctx, sealed); err != nil || got != "hunter2" {
+		t.Errorf("Open() with a previous key = %q, %v", got, err)
+	}
+	resealed, err := Seal(ctx, "hunter2")
+	if err != nil || KeyIDOf(resealed) != current.KeyID() {
+		t.Errorf("Seal() = %q, %v; want it sealed with the current key %s", resealed, err, current.KeyID())
+	}
+
+	// Once the old key is dropped, its values no longer open.
+	useKMS(t, masterKey(2))
+	if _, err := Open(ctx, sealed); err == nil || !strings.Contains(err.Error(), "unknown master key") {
+		t.Errorf("Open() after dropping the old key = %v, want unknown master key", err)
+	}
+	if got, err := Open(ctx, resealed); err != nil || got != "hunter2" {
+		t.Errorf("Open() with the current key = %q, %v", got, err)
+	}
+
+	for _, size := range []int{0, 16, 31, 33} {
+		if _, err := NewLocalKMS(make([]byte, 32), make([]byte, size)); err == nil {
+			t.Errorf("NewLocalKMS() with a %d-byte previous key succeeded", size)
+		}
+	}
+}
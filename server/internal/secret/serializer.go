@@ -0,0 +1,103 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+func init() {
+	schema.RegisterSerializer("secret", Serializer{})
+}
+
+// Serializer is a GORM serializer for string fields that seals values on
+// write and opens them on read, so models keep plain strings:
+//
+//	PrivateKey string `gorm:"serializer:secret"`
+//
+// Values already in plaintext are read as they are. Queries that compare a
+// sealed column to a value cannot match, since every write uses a new data
+// key; load the rows and compare in Go instead.
+//
+// Reads go by the stored value alone: sealed values are opened, values
+// marked with the "plain:" prefix lose it and any other value is read as
+// it is.
+type Serializer struct {
+	// Plain, when set, reports that the value of record dst is not secret
+	// and is stored as it is. A plain value that looks sealed or marked is
+	// stored with the "plain:" prefix, so it reads back unchanged.
+	Plain func(dst reflect.Value) bool
+}
+
+// plainPrefix marks a plain value that would otherwise read as sealed.
+const plainPrefix = "plain:"
+
+func (s Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var v string
+	switch dv := dbValue.(type) {
+	case nil:
+	case string:
+		v = dv
+	case []byte:
+		v = string(dv)
+	default:
+		return fmt.Errorf("secret: cannot scan %T into %s", dbValue, field.Name)
+	}
+	if strings.HasPrefix(v, plainPrefix) {
+		field.ReflectValueOf(ctx, dst).SetString(strings.TrimPrefix(v, plainPrefix))
+		return nil
+	}
+	plaintext, err := Open(ctx, v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+func (s Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	v, _ := fieldValue.(string)
+	if s.Plain != nil && s.Plain(dst) {
+		if IsSealed(v) || strings.HasPrefix(v, plainPrefix) {
+			return plainPrefix + v, nil
+		}
+		return v, nil
+	}
+	return Seal(ctx, v)
+}
+
+// Sensitive reports whether v, a statement variable, is a field value
+// written through Serializer that is sealed. Loggers use it to leave such
+// values out.
+func Sensitive(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return false
+	}
+	// GORM passes serialized fields as its unexported serializer type,
+	// which carries the field and the record.
+	fv := rv.Elem().FieldByName("Field")
+	if !fv.IsValid() || !fv.CanInterface() {
+		return false
+	}
+	field, ok := fv.Interface().(*schema.Field)
+	if !ok || field == nil {
+		return false
+	}
+	s, ok := field.Serializer.(Serializer)
+	if !ok {
+		return false
+	}
+	if s.Plain == nil {
+		return true
+	}
+	dst := rv.Elem().FieldByName("Destination")
+	if !dst.IsValid() || !dst.CanInterface() {
+		return true
+	}
+	d, ok := dst.Interface().(reflect.Value)
+	return !ok || !s.Plain(d)
+}
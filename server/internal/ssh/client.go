@@ -2,64 +2,205 @@ package ssh
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// DefaultOutputLimit caps the output Run keeps from a command.
+const DefaultOutputLimit = 1 << 20
+
+// ErrOutputLimit is returned by Exec when a command wrote more than the
+// limit; the output returned with it is truncated.
+var ErrOutputLimit = errors.New("command output exceeds limit")
+
+// Client describes how to log in to a device. The server-managed key is
+// offered before the password; either may be empty.
 type Client struct {
 	Host     string
 	Port     int
 	User     string
 	Password string
+	Signer   ssh.Signer
+
+	// HostKeyCallback verifies the device's host key, usually PinHostKey.
+	// Connections are refused while it is nil.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// DialContext opens the transport, e.g. a channel of the reverse
+	// tunnel; a TCP connection to Host:Port when nil.
+	DialContext func(ctx context.Context) (net.Conn, error)
 }
 
 func NewClient(host string, port int, user, password string) *Client {
 	return &Client{Host: host, Port: port, User: user, Password: password}
 }
 
-func (c *Client) Run(command string) (string, error) {
-	config := &ssh.ClientConfig{
-		User: c.User,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(c.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+func (c *Client) addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+func (c *Client) config() (*ssh.ClientConfig, error) {
+	if c.HostKeyCallback == nil {
+		return nil, errors.New("ssh: no host key policy configured")
+	}
+	var auth []ssh.AuthMethod
+	if c.Signer != nil {
+		auth = append(auth, ssh.PublicKeys(c.Signer))
+	}
+	if c.Password != "" {
+		auth = append(auth, ssh.Password(c.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("ssh: no key or password to log in with")
+	}
+	return &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            auth,
+		HostKeyCallback: c.HostKeyCallback,
 		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// Dial opens the transport and logs in.
+func (c *Client) Dial(ctx context.Context) (*ssh.Client, error) {
+	if _, err := c.config(); err != nil {
+		return nil, err
+	}
+	var nc net.Conn
+	var err error
+	if c.DialContext != nil {
+		nc, err = c.DialContext(ctx)
+	} else {
+		nc, err = (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", c.addr())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh dial failed: %w", err)
+	}
+	return c.Connect(ctx, nc)
+}
+
+// Connect runs the SSH handshake over an established connection, such as a
+// channel of the reverse tunnel. The connection is closed if ctx ends first.
+func (c *Client) Connect(ctx context.Context, nc net.Conn) (*ssh.Client, error) {
+	config, err := c.config()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	type result struct {
+		client *ssh.Client
+		err    error
 	}
+	done := make(chan result, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewClientConn(nc, c.addr(), config)
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		done <- result{ssh.NewClient(conn, chans, reqs), nil}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("ssh handshake failed: %w", r.err)
+		}
+		return r.client, nil
+	case <-ctx.Done():
+		nc.Close()
+		return nil, ctx.Err()
+	}
+}
 
-	addr := fmt.Sprintf("%s:%d", c.Host, c.Port)
-	conn, err := ssh.Dial("tcp", addr, config)
+// Run dials, runs one command and disconnects. Use a Manager to reuse the
+// connection across commands.
+func (c *Client) Run(ctx context.Context, command string) (string, error) {
+	conn, err := c.Dial(ctx)
 	if err != nil {
-		return "", fmt.Errorf("ssh dial failed: %w", err)
+		return "", err
 	}
 	defer conn.Close()
+	return Exec(ctx, conn, command, DefaultOutputLimit)
+}
+
+// RunUCI executes a UCI command on an OpenWrt device.
+func (c *Client) RunUCI(ctx context.Context, uciCmd string) (string, error) {
+	return c.Run(ctx, fmt.Sprintf("uci %s", uciCmd))
+}
+
+// GetSystemInfo retrieves basic system info from an OpenWrt device.
+func (c *Client) GetSystemInfo(ctx context.Context) (string, error) {
+	return c.Run(ctx, SystemInfoCommand)
+}
+
+// SystemInfoCommand prints hostname, model, firmware, uptime and kernel as
+// JSON.
+const SystemInfoCommand = `echo "{\"hostname\":\"$(uci get system.@system[0].hostname)\",\"model\":\"$(cat /tmp/sysinfo/model 2>/dev/null)\",\"firmware\":\"$(cat /etc/openwrt_release | grep DISTRIB_REVISION | cut -d\\' -f2)\",\"uptime\":$(cat /proc/uptime | cut -d' ' -f1 | cut -d. -f1),\"kernel\":\"$(uname -r)\"}"`
 
+// Exec runs a command in a new session of conn and returns its stdout.
+// Output beyond limit bytes is discarded and reported as ErrOutputLimit.
+// The command is killed when ctx ends.
+func Exec(ctx context.Context, conn *ssh.Client, command string, limit int) (string, error) {
 	session, err := conn.NewSession()
 	if err != nil {
 		return "", fmt.Errorf("ssh session failed: %w", err)
 	}
 	defer session.Close()
 
-	var stdout, stderr bytes.Buffer
-	session.Stdout = &stdout
-	session.Stderr = &stderr
-
-	if err := session.Run(command); err != nil {
-		return "", fmt.Errorf("command failed: %w, stderr: %s", err, stderr.String())
+	stdout := &limitedBuffer{limit: limit}
+	stderr := &limitedBuffer{limit: 4096}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return "", fmt.Errorf("command failed to start: %w", err)
 	}
 
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// dropbear ignores signals on sessions without a PTY; closing the
+		// channel makes it hang up on the command.
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return "", ctx.Err()
+	}
+	if err != nil {
+		return stdout.String(), fmt.Errorf("command failed: %w, stderr: %s", err, stderr.String())
+	}
+	if stdout.truncated {
+		return stdout.String(), ErrOutputLimit
+	}
 	return stdout.String(), nil
 }
 
-// RunUCI executes a UCI command on an OpenWrt device.
-func (c *Client) RunUCI(uciCmd string) (string, error) {
-	return c.Run(fmt.Sprintf("uci %s", uciCmd))
+// limitedBuffer keeps the first limit bytes written to it. The buffer is not
+// embedded so that io.Copy cannot bypass Write through ReadFrom.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
 }
 
-// GetSystemInfo retrieves basic system info from an OpenWrt device.
-func (c *Client) GetSystemInfo() (string, error) {
-	cmd := `echo "{\"hostname\":\"$(uci get system.@system[0].hostname)\",\"model\":\"$(cat /tmp/sysinfo/model 2>/dev/null)\",\"firmware\":\"$(cat /etc/openwrt_release | grep DISTRIB_REVISION | cut -d\\' -f2)\",\"uptime\":$(cat /proc/uptime | cut -d' ' -f1 | cut -d. -f1),\"kernel\":\"$(uname -r)\"}"`
-	return c.Run(cmd)
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
 }
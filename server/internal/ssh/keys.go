@@ -0,0 +1,85 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LoadOrGenerateKey reads a private key, generating an ed25519 key with the
+// given comment if the file does not exist.
+func LoadOrGenerateKey(path, comment string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, comment)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("ssh key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// AuthorizedKey formats a public key as an authorized_keys line with a
+// comment.
+func AuthorizedKey(key ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// HostKeyMismatchError is returned by a PinHostKey callback when a device
+// presents a host key other than the pinned one.
+type HostKeyMismatchError struct {
+	Pinned    string // SHA256 fingerprints
+	Presented string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key changed: pinned %s, presented %s", e.Pinned, e.Presented)
+}
+
+// PinHostKey returns a trust-on-first-use host key callback. pinned is the
+// known key in authorized_keys format; when it is empty the presented key is
+// handed to learn, which stores it, and accepted unless learn fails.
+func PinHostKey(pinned string, learn func(key ssh.PublicKey) error) ssh.HostKeyCallback {
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		if pinned == "" {
+			return learn(key)
+		}
+		known, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pinned))
+		if err != nil {
+			return fmt.Errorf("pinned host key: %w", err)
+		}
+		if known.Type() != key.Type() || string(known.Marshal()) != string(key.Marshal()) {
+			return &HostKeyMismatchError{Pinned: ssh.FingerprintSHA256(known), Presented: ssh.FingerprintSHA256(key)}
+		}
+		return nil
+	}
+}
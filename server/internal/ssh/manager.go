@@ -0,0 +1,197 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Manager shares one SSH connection per key (usually a device) between
+// callers, since every command and transfer can run in its own session of
+// the same connection. Connections unused for IdleTimeout are closed.
+type Manager struct {
+	// Signer is the server-managed key offered to devices.
+	Signer      ssh.Signer
+	IdleTimeout time.Duration
+	OutputLimit int
+
+	mu    sync.Mutex
+	conns map[string]*managedConn
+	done  chan struct{}
+}
+
+type managedConn struct {
+	ready    chan struct{} // closed once the dial finished
+	client   *ssh.Client
+	err      error
+	users    int
+	lastUsed time.Time
+}
+
+// NewManager starts a manager; Close releases its connections.
+func NewManager(signer ssh.Signer, idleTimeout time.Duration) *Manager {
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+	m := &Manager{
+		Signer:      signer,
+		IdleTimeout: idleTimeout,
+		OutputLimit: DefaultOutputLimit,
+		conns:       make(map[string]*managedConn),
+		done:        make(chan struct{}),
+	}
+	go m.reapIdle()
+	return m
+}
+
+// Get returns the connection for key, calling dial if there is none or it
+// broke. Concurrent callers for the same key wait for a single dial. Call
+// the returned release func when done with the connection.
+func (m *Manager) Get(ctx context.Context, key string, dial func(context.Context) (*ssh.Client, error)) (*ssh.Client, func(), error) {
+	for {
+		m.mu.Lock()
+		mc := m.conns[key]
+		if mc == nil {
+			mc = &managedConn{ready: make(chan struct{})}
+			m.conns[key] = mc
+			m.mu.Unlock()
+			mc.client, mc.err = dial(ctx)
+			m.mu.Lock()
+			mc.lastUsed = time.Now()
+			if mc.err != nil {
+				delete(m.conns, key)
+			}
+			close(mc.ready)
+			m.mu.Unlock()
+		} else {
+			m.mu.Unlock()
+		}
+
+		select {
+		case <-mc.ready:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		if mc.err != nil {
+			return nil, nil, mc.err
+		}
+		if !alive(mc.client) {
+			m.drop(key, mc)
+			continue
+		}
+		m.mu.Lock()
+		mc.users++
+		mc.lastUsed = time.Now()
+		m.mu.Unlock()
+		var once sync.Once
+		return mc.client, func() {
+			once.Do(func() {
+				m.mu.Lock()
+				mc.users--
+				mc.lastUsed = time.Now()
+				m.mu.Unlock()
+			})
+		}, nil
+	}
+}
+
+// alive checks the connection with a keepalive request; any reply will do.
+func alive(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+// Run runs a command on the connection for key, limited to OutputLimit
+// bytes of output.
+func (m *Manager) Run(ctx context.Context, key string, dial func(context.Context) (*ssh.Client, error), command string) (string, error) {
+	client, release, err := m.Get(ctx, key, dial)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return Exec(ctx, client, command, m.OutputLimit)
+}
+
+// Drop closes the connection for key, e.g. after its credentials changed.
+func (m *Manager) Drop(key string) {
+	m.mu.Lock()
+	mc := m.conns[key]
+	m.mu.Unlock()
+	if mc != nil {
+		m.drop(key, mc)
+	}
+}
+
+func (m *Manager) drop(key string, mc *managedConn) {
+	m.mu.Lock()
+	if m.conns[key] == mc {
+		delete(m.conns, key)
+	}
+	m.mu.Unlock()
+	<-mc.ready
+	if mc.client != nil {
+		mc.client.Close()
+	}
+}
+
+// Len is the number of open connections.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+func (m *Manager) reapIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*ssh.Client
+		m.mu.Lock()
+		for key, mc := range m.conns {
+			select {
+			case <-mc.ready:
+			default:
+				continue // still dialing
+			}
+			if mc.users == 0 && time.Since(mc.lastUsed) > m.IdleTimeout {
+				delete(m.conns, key)
+				idle = append(idle, mc.client)
+			}
+		}
+		m.mu.Unlock()
+		for _, c := range idle {
+			c.Close()
+		}
+	}
+}
+
+// Close closes all connections and stops the manager.
+func (m *Manager) Close() {
+	close(m.done)
+	m.mu.Lock()
+	conns := m.conns
+	m.conns = make(map[string]*managedConn)
+	m.mu.Unlock()
+	for _, mc := range conns {
+		<-mc.ready
+		if mc.client != nil {
+			mc.client.Close()
+		}
+	}
+}
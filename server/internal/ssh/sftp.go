@@ -0,0 +1,256 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A minimal SFTP version 3 client (draft-ietf-secsh-filexfer-02) for whole
+// file transfers: one request in flight at a time.
+
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpOpen    = 3
+	sftpClose   = 4
+	sftpRead    = 5
+	sftpWrite   = 6
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpData    = 103
+
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+
+	sftpAttrPermissions = 0x04
+
+	sftpStatusOK  = 0
+	sftpStatusEOF = 1
+
+	// Servers must accept packets of 34000 bytes; stay below.
+	sftpChunk = 32 * 1024
+)
+
+// errNoSFTP means the device has no SFTP server.
+var errNoSFTP = errors.New("sftp subsystem not available")
+
+type sftpClient struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+	stop    func() bool
+	id      uint32
+}
+
+func openSFTP(ctx context.Context, conn *ssh.Client) (*sftpClient, error) {
+	session, stdin, stdout, stop, err := startSession(ctx, conn, "", "sftp")
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpClient{session: session, w: stdin, r: stdout, stop: stop}
+	err = c.send(sftpInit, u32(3))
+	var typ byte
+	if err == nil {
+		typ, _, err = c.recv()
+	}
+	if errors.Is(err, io.EOF) {
+		// dropbear accepts the subsystem and then fails to run sftp-server;
+		// the session may end before the init is even written.
+		c.Close()
+		return nil, errNoSFTP
+	}
+	if err != nil || typ != sftpVersion {
+		c.Close()
+		if err == nil {
+			err = fmt.Errorf("sftp: unexpected packet %d", typ)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *sftpClient) Close() error {
+	c.stop()
+	c.w.Close()
+	return c.session.Close()
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func sftpString(s string) []byte {
+	return append(u32(uint32(len(s))), s...)
+}
+
+// send writes a packet; init carries the version instead of a request id.
+func (c *sftpClient) send(typ byte, fields ...[]byte) error {
+	body := []byte{typ}
+	if typ != sftpInit {
+		c.id++
+		body = append(body, u32(c.id)...)
+	}
+	for _, f := range fields {
+		body = append(body, f...)
+	}
+	if _, err := c.w.Write(append(u32(uint32(len(body))), body...)); err != nil {
+		return fmt.Errorf("sftp: %w", err)
+	}
+	return nil
+}
+
+// recv reads a response and checks its request id; the payload follows the
+// id.
+func (c *sftpClient) recv() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 1 || n > 256*1024 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, fmt.Errorf("sftp: %w", err)
+	}
+	typ, body := body[0], body[1:]
+	if typ == sftpVersion {
+		return typ, body, nil
+	}
+	if len(body) < 4 || binary.BigEndian.Uint32(body) != c.id {
+		return 0, nil, errors.New("sftp: response out of sequence")
+	}
+	return typ, body[4:], nil
+}
+
+// status turns a STATUS payload into an error; nil for OK, io.EOF for EOF.
+func status(payload []byte) error {
+	if len(payload) < 4 {
+		return errors.New("sftp: short status")
+	}
+	code := binary.BigEndian.Uint32(payload)
+	switch code {
+	case sftpStatusOK:
+		return nil
+	case sftpStatusEOF:
+		return io.EOF
+	}
+	msg := ""
+	if len(payload) >= 8 {
+		if l := binary.BigEndian.Uint32(payload[4:]); int(l) <= len(payload)-8 {
+			msg = string(payload[8 : 8+l])
+		}
+	}
+	return fmt.Errorf("sftp: %s (code %d)", msg, code)
+}
+
+// call sends a request and expects want or a STATUS reply.
+func (c *sftpClient) call(want byte, typ byte, fields ...[]byte) ([]byte, error) {
+	if err := c.send(typ, fields...); err != nil {
+		return nil, err
+	}
+	rtyp, payload, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if rtyp == sftpStatus {
+		if err := status(payload); err != nil || want == sftpStatus {
+			return nil, err
+		}
+		return nil, errors.New("sftp: unexpected status OK")
+	}
+	if rtyp != want {
+		return nil, fmt.Errorf("sftp: unexpected packet %d", rtyp)
+	}
+	return payload, nil
+}
+
+func (c *sftpClient) open(remotePath string, flags uint32, perm os.FileMode) ([]byte, error) {
+	attrs := u32(0)
+	if flags&sftpFlagCreate != 0 {
+		attrs = append(u32(sftpAttrPermissions), u32(uint32(perm.Perm()))...)
+	}
+	payload, err := c.call(sftpHandle, sftpOpen, sftpString(remotePath), u32(flags), attrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) > len(payload)-4 {
+		return nil, errors.New("sftp: malformed handle")
+	}
+	return payload[4 : 4+binary.BigEndian.Uint32(payload)], nil
+}
+
+func (c *sftpClient) closeHandle(handle []byte) error {
+	_, err := c.call(sftpStatus, sftpClose, sftpString(string(handle)))
+	return err
+}
+
+func (c *sftpClient) upload(remotePath string, r io.Reader, perm os.FileMode) error {
+	handle, err := c.open(remotePath, sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc, perm)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, sftpChunk)
+	var offset uint64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := c.call(sftpStatus, sftpWrite, sftpString(string(handle)), u64(offset), sftpString(string(buf[:n]))); err != nil {
+				c.closeHandle(handle)
+				return err
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			c.closeHandle(handle)
+			return rerr
+		}
+	}
+	return c.closeHandle(handle)
+}
+
+func (c *sftpClient) download(remotePath string, w io.Writer, limit int64) (int64, error) {
+	handle, err := c.open(remotePath, sftpFlagRead, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer c.closeHandle(handle)
+	var total int64
+	for {
+		payload, err := c.call(sftpData, sftpRead, sftpString(string(handle)), u64(uint64(total)), u32(sftpChunk))
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) > len(payload)-4 {
+			return total, errors.New("sftp: malformed data")
+		}
+		data := payload[4 : 4+binary.BigEndian.Uint32(payload)]
+		if total+int64(len(data)) > limit {
+			return total, ErrFileTooLarge
+		}
+		if _, err := w.Write(data); err != nil {
+			return total, err
+		}
+		total += int64(len(data))
+	}
+}
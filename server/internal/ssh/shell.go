@@ -0,0 +1,63 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Shell is an interactive login shell on a pseudo-terminal. Output carries
+// both stdout and stderr, as the PTY merges them.
+type Shell struct {
+	session *ssh.Session
+	Input   io.WriteCloser
+	Output  io.Reader
+}
+
+// StartShell requests a PTY of the given size and starts a login shell.
+func StartShell(client *ssh.Client, term string, cols, rows int) (*Shell, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("ssh session failed: %w", err)
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 38400,
+		ssh.TTY_OP_OSPEED: 38400,
+	}
+	if err := session.RequestPty(term, rows, cols, modes); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("pty request failed: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Shell(); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("shell failed: %w", err)
+	}
+	return &Shell{session: session, Input: stdin, Output: stdout}, nil
+}
+
+// Resize changes the PTY size.
+func (s *Shell) Resize(cols, rows int) error {
+	return s.session.WindowChange(rows, cols)
+}
+
+// Wait blocks until the shell exits.
+func (s *Shell) Wait() error {
+	return s.session.Wait()
+}
+
+// Close ends the session.
+func (s *Shell) Close() error {
+	return s.session.Close()
+}
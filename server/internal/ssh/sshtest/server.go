@@ -0,0 +1,581 @@
+// Package sshtest runs an in-process SSH server for tests, standing in for
+// a device: password and key logins, exec requests, SCP and an SFTP
+// subsystem over an in-memory file system.
+package sshtest
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPMode selects how the server answers the sftp subsystem.
+type SFTPMode int
+
+const (
+	// SFTPServe runs the SFTP server.
+	SFTPServe SFTPMode = iota
+	// SFTPReject refuses the subsystem request, like OpenSSH without a
+	// Subsystem line.
+	SFTPReject
+	// SFTPExit accepts the request and ends the session, like dropbear
+	// without sftp-server installed.
+	SFTPExit
+)
+
+// ExecFunc runs the command of an exec request and returns its exit status.
+type ExecFunc func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// Server is an SSH server on a loopback port. Configure it between
+// NewUnstartedServer and Start.
+type Server struct {
+	HostKey  ssh.Signer
+	User     string // accepted login; any user when empty
+	Password string // accepted password; passwords are refused when empty
+
+	// AuthorizedKeys are the public keys accepted for login.
+	AuthorizedKeys []ssh.PublicKey
+
+	// Exec runs commands; nil runs scp through SCP and fails anything else
+	// with status 127.
+	Exec ExecFunc
+
+	SFTP SFTPMode
+
+	// ReadChunk caps the data of SFTP read replies, to exercise short
+	// reads; no cap when 0.
+	ReadChunk int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	files    map[string]*file
+	commands []string
+	logins   int
+}
+
+type file struct {
+	data []byte
+	mode os.FileMode
+}
+
+// NewUnstartedServer returns a server with a fresh ed25519 host key.
+func NewUnstartedServer(t testing.TB) *Server {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{HostKey: signer, conns: map[net.Conn]bool{}, files: map[string]*file{}}
+}
+
+// NewServer starts a server that accepts user root with password, closed
+// when the test ends.
+func NewServer(t testing.TB, password string) *Server {
+	t.Helper()
+	s := NewUnstartedServer(t)
+	s.User = "root"
+	s.Password = password
+	s.Start(t)
+	return s
+}
+
+// Start listens on a loopback port; the server is closed when the test
+// ends.
+func (s *Server) Start(t testing.TB) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.Password != "" && string(password) == s.Password && s.userOK(meta.User()) {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range s.AuthorizedKeys {
+				if string(k.Marshal()) == string(key.Marshal()) && s.userOK(meta.User()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(s.HostKey)
+	s.wg.Add(1)
+	go s.serve(config)
+	t.Cleanup(s.Close)
+}
+
+func (s *Server) userOK(user string) bool {
+	return s.User == "" || user == s.User
+}
+
+// Host and Port are where the server listens.
+func (s *Server) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and drops its connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// WriteFile stores a file in the server's file system.
+func (s *Server) WriteFile(name string, data []byte, mode os.FileMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = &file{data: append([]byte(nil), data...), mode: mode}
+}
+
+// ReadFile returns a file of the server's file system.
+func (s *Server) ReadFile(name string) ([]byte, os.FileMode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, 0, false
+	}
+	return append([]byte(nil), f.data...), f.mode, true
+}
+
+// Commands returns the commands of the exec requests served so far.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Logins returns the number of successful logins.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *Server) serve(config *ssh.ServerConfig) {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[nc] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, nc)
+				s.mu.Unlock()
+				nc.Close()
+			}()
+			s.handleConn(nc, config)
+		}()
+	}
+}
+
+func (s *Server) handleConn(nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.mu.Lock()
+	s.logins++
+	s.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(ch, reqs)
+		}()
+	}
+}
+
+func (s *Server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		var name struct{ Value string }
+		switch req.Type {
+		case "exec", "subsystem":
+			if err := ssh.Unmarshal(req.Payload, &name); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+		default:
+			// env, pty-req, signal...
+			req.Reply(false, nil)
+			continue
+		}
+		if req.Type == "subsystem" {
+			if name.Value != "sftp" || s.SFTP == SFTPReject {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			if s.SFTP == SFTPExit {
+				fmt.Fprintln(ch.Stderr(), "sftp-server: not found")
+				exit(ch, 127)
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			s.serveSFTP(ch)
+			exit(ch, 0)
+			return
+		}
+
+		req.Reply(true, nil)
+		s.mu.Lock()
+		s.commands = append(s.commands, name.Value)
+		s.mu.Unlock()
+		go ssh.DiscardRequests(reqs)
+		run := s.Exec
+		if run == nil {
+			run = s.defaultExec
+		}
+		exit(ch, run(name.Value, ch, ch, ch.Stderr()))
+		return
+	}
+}
+
+func exit(ch ssh.Channel, code int) {
+	ch.CloseWrite()
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+}
+
+func (s *Server) defaultExec(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if strings.HasPrefix(command, "scp ") {
+		return s.SCP(command, stdin, stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "sh: %s: not found\n", strings.Fields(command + " x")[0])
+	return 127
+}
+
+// SCP runs "scp -t path" or "scp -f path" against the server's file
+// system, for Exec functions that handle other commands themselves.
+func (s *Server) SCP(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fields := strings.SplitN(command, " ", 3)
+	if len(fields) != 3 || fields[0] != "scp" {
+		fmt.Fprintln(stderr, "usage: scp -t|-f path")
+		return 1
+	}
+	name, err := unquote(fields[2])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	r := bufio.NewReader(stdin)
+	switch fields[1] {
+	case "-t":
+		return s.scpSink(name, r, stdout)
+	case "-f":
+		return s.scpSource(name, r, stdout)
+	}
+	fmt.Fprintln(stderr, "usage: scp -t|-f path")
+	return 1
+}
+
+// unquote reverses a single-quoted POSIX shell word.
+func unquote(word string) (string, error) {
+	if !strings.HasPrefix(word, "'") || !strings.HasSuffix(word, "'") || len(word) < 2 {
+		return "", fmt.Errorf("scp: unquoted path %s", word)
+	}
+	return strings.ReplaceAll(word[1:len(word)-1], `'\''`, "'"), nil
+}
+
+func scpError(w io.Writer, format string, args ...any) int {
+	fmt.Fprintf(w, "\x01scp: "+format+"\n", args...)
+	return 1
+}
+
+func (s *Server) scpSink(name string, r *bufio.Reader, w io.Writer) int {
+	s.mu.Lock()
+	f, exists := s.files[name]
+	denied := exists && f.mode&0o200 == 0
+	s.mu.Unlock()
+	if denied {
+		return scpError(w, "%s: Permission denied", name)
+	}
+	w.Write([]byte{0})
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 1
+	}
+	// C<mode> <size> <name>
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 3)
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "C") {
+		return scpError(w, "protocol error: %q", header)
+	}
+	mode, err1 := strconv.ParseUint(parts[0][1:], 8, 32)
+	size, err2 := strconv.ParseInt(parts[1], 10, 64)
+	if err1 != nil || err2 != nil || size < 0 {
+		return scpError(w, "protocol error: %q", header)
+	}
+	w.Write([]byte{0})
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 1
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	s.WriteFile(name, data, os.FileMode(mode))
+	w.Write([]byte{0})
+	return 0
+}
+
+func (s *Server) scpSource(name string, r *bufio.Reader, w io.Writer) int {
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	data, mode, ok := s.ReadFile(name)
+	switch {
+	case !ok:
+		return scpError(w, "%s: No such file or directory", name)
+	case mode&0o400 == 0:
+		return scpError(w, "%s: Permission denied", name)
+	}
+	base := name[strings.LastIndex(name, "/")+1:]
+	fmt.Fprintf(w, "C%04o %d %s\n", mode.Perm(), len(data), base)
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	w.Write(data)
+	w.Write([]byte{0})
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	return 0
+}
+
+// SFTP version 3, the subset the client uses.
+
+const (
+	fxpInit    = 1
+	fxpVersion = 2
+	fxpOpen    = 3
+	fxpClose   = 4
+	fxpRead    = 5
+	fxpWrite   = 6
+	fxpStatus  = 101
+	fxpHandle  = 102
+	fxpData    = 103
+
+	fxfRead   = 0x01
+	fxfWrite  = 0x02
+	fxfCreate = 0x08
+	fxfTrunc  = 0x10
+
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// packet decodes the fields of an SFTP request.
+type packet struct {
+	b   []byte
+	err bool
+}
+
+func (p *packet) u32() uint32 {
+	if len(p.b) < 4 {
+		p.err = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *packet) u64() uint64 {
+	return uint64(p.u32())<<32 | uint64(p.u32())
+}
+
+func (p *packet) str() string {
+	n := p.u32()
+	if p.err || int(n) > len(p.b) {
+		p.err = true
+		return ""
+	}
+	v := string(p.b[:n])
+	p.b = p.b[n:]
+	return v
+}
+
+func sftpString(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+func (s *Server) serveSFTP(ch ssh.Channel) {
+	r := bufio.NewReader(ch)
+	reply := func(typ byte, id uint32, fields ...[]byte) {
+		body := []byte{typ}
+		if typ != fxpVersion {
+			body = binary.BigEndian.AppendUint32(body, id)
+		}
+		for _, f := range fields {
+			body = append(body, f...)
+		}
+		ch.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...))
+	}
+	status := func(id uint32, code uint32, msg string) {
+		reply(fxpStatus, id, binary.BigEndian.AppendUint32(nil, code), sftpString(msg), sftpString(""))
+	}
+
+	type handle struct {
+		name  string
+		flags uint32
+	}
+	handles := map[string]handle{}
+	for n := 0; ; n++ {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(r, body); err != nil || len(body) == 0 {
+			return
+		}
+		p := &packet{b: body[1:]}
+		if body[0] == fxpInit {
+			reply(fxpVersion, 0, binary.BigEndian.AppendUint32(nil, 3))
+			continue
+		}
+		id := p.u32()
+		switch body[0] {
+		case fxpOpen:
+			name, flags := p.str(), p.u32()
+			var perm uint32 = 0o644
+			if attrs := p.u32(); attrs&0x04 != 0 {
+				perm = p.u32()
+			}
+			if p.err {
+				status(id, fxBadMessage, "Bad message")
+				continue
+			}
+			s.mu.Lock()
+			f, exists := s.files[name]
+			code := uint32(fxOK)
+			switch {
+			case !exists && flags&fxfCreate == 0:
+				code = fxNoSuchFile
+			case exists && flags&fxfRead != 0 && f.mode&0o400 == 0,
+				exists && flags&fxfWrite != 0 && f.mode&0o200 == 0:
+				code = fxPermissionDenied
+			case !exists:
+				s.files[name] = &file{mode: os.FileMode(perm)}
+			case flags&fxfTrunc != 0:
+				f.data = nil
+			}
+			s.mu.Unlock()
+			switch code {
+			case fxNoSuchFile:
+				status(id, code, "No such file")
+				continue
+			case fxPermissionDenied:
+				status(id, code, "Permission denied")
+				continue
+			}
+			h := strconv.Itoa(n)
+			handles[h] = handle{name: name, flags: flags}
+			reply(fxpHandle, id, sftpString(h))
+
+		case fxpRead:
+			h, offset, length := handles[p.str()], p.u64(), p.u32()
+			if p.err || h.flags&fxfRead == 0 {
+				status(id, fxFailure, "Bad handle")
+				continue
+			}
+			data, _, _ := s.ReadFile(h.name)
+			if offset >= uint64(len(data)) {
+				status(id, fxEOF, "End of file")
+				continue
+			}
+			data = data[offset:]
+			if s.ReadChunk > 0 {
+				length = min(length, uint32(s.ReadChunk))
+			}
+			if uint32(len(data)) > length {
+				data = data[:length]
+			}
+			reply(fxpData, id, sftpString(string(data)))
+
+		case fxpWrite:
+			h, offset, data := handles[p.str()], p.u64(), p.str()
+			if p.err || h.flags&fxfWrite == 0 {
+				status(id, fxFailure, "Bad handle")
+				continue
+			}
+			s.mu.Lock()
+			f := s.files[h.name]
+			if end := int(offset) + len(data); end > len(f.data) {
+				f.data = append(f.data, make([]byte, end-len(f.data))...)
+			}
+			copy(f.data[offset:], data)
+			s.mu.Unlock()
+			status(id, fxOK, "Success")
+
+		case fxpClose:
+			h := p.str()
+			if _, ok := handles[h]; !ok || p.err {
+				status(id, fxFailure, "Bad handle")
+				continue
+			}
+			delete(handles, h)
+			status(id, fxOK, "Success")
+
+		default:
+			status(id, fxOpUnsupported, "Operation unsupported")
+		}
+	}
+}
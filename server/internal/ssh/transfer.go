@@ -0,0 +1,186 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transfer protocols reported by Upload and Download.
+const (
+	ProtocolSFTP = "sftp"
+	ProtocolSCP  = "scp"
+)
+
+// ErrFileTooLarge is returned by Download when the file exceeds the limit.
+var ErrFileTooLarge = errors.New("file exceeds size limit")
+
+// Upload writes size bytes from r to the file at remotePath, over SFTP or,
+// on devices without an SFTP server (stock dropbear), SCP. It returns the
+// protocol used.
+func Upload(ctx context.Context, conn *ssh.Client, remotePath string, r io.Reader, size int64, mode os.FileMode) (string, error) {
+	sftp, err := openSFTP(ctx, conn)
+	if errors.Is(err, errNoSFTP) {
+		return ProtocolSCP, scpUpload(ctx, conn, remotePath, r, size, mode)
+	}
+	if err != nil {
+		return ProtocolSFTP, err
+	}
+	defer sftp.Close()
+	return ProtocolSFTP, sftp.upload(remotePath, io.LimitReader(r, size), mode)
+}
+
+// Download copies the file at remotePath to w, failing with ErrFileTooLarge
+// beyond limit bytes. It returns the bytes copied and the protocol used.
+func Download(ctx context.Context, conn *ssh.Client, remotePath string, w io.Writer, limit int64) (int64, string, error) {
+	sftp, err := openSFTP(ctx, conn)
+	if errors.Is(err, errNoSFTP) {
+		n, err := scpDownload(ctx, conn, remotePath, w, limit)
+		return n, ProtocolSCP, err
+	}
+	if err != nil {
+		return 0, ProtocolSFTP, err
+	}
+	defer sftp.Close()
+	n, err := sftp.download(remotePath, w, limit)
+	return n, ProtocolSFTP, err
+}
+
+// ShellQuote quotes s for a POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// startSession starts command, or the sftp subsystem if subsystem is set,
+// with pipes; the session is closed when ctx ends.
+func startSession(ctx context.Context, conn *ssh.Client, command, subsystem string) (*ssh.Session, io.WriteCloser, *bufio.Reader, func() bool, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("ssh session failed: %w", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, nil, nil, nil, err
+	}
+	if subsystem != "" {
+		if err := session.RequestSubsystem(subsystem); err != nil {
+			session.Close()
+			return nil, nil, nil, nil, errNoSFTP
+		}
+	} else if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, nil, nil, nil, fmt.Errorf("%s: %w", command, err)
+	}
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	return session, stdin, bufio.NewReader(stdout), stop, nil
+}
+
+// SCP (the rcp protocol): every message from the sender is answered with a
+// status byte, 0 for OK or 1/2 followed by an error line.
+
+func scpAck(r *bufio.Reader) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("scp: %w", err)
+	}
+	if b == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return scpError(msg)
+}
+
+// scpError reports an error line of the remote scp, which already starts
+// with "scp: ".
+func scpError(msg string) error {
+	return fmt.Errorf("scp: %s", strings.TrimPrefix(strings.TrimSpace(msg), "scp: "))
+}
+
+func scpUpload(ctx context.Context, conn *ssh.Client, remotePath string, r io.Reader, size int64, mode os.FileMode) error {
+	session, stdin, stdout, stop, err := startSession(ctx, conn, "scp -t "+ShellQuote(remotePath), "")
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer session.Close()
+
+	if err := scpAck(stdout); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdin, "C%04o %d %s\n", mode.Perm(), size, path.Base(remotePath))
+	if err := scpAck(stdout); err != nil {
+		return err
+	}
+	if n, err := io.CopyN(stdin, r, size); err != nil {
+		return fmt.Errorf("scp: wrote %d of %d bytes: %w", n, size, err)
+	}
+	stdin.Write([]byte{0})
+	if err := scpAck(stdout); err != nil {
+		return err
+	}
+	stdin.Close()
+	if err := session.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("scp: %w", err)
+	}
+	return ctx.Err()
+}
+
+func scpDownload(ctx context.Context, conn *ssh.Client, remotePath string, w io.Writer, limit int64) (int64, error) {
+	session, stdin, stdout, stop, err := startSession(ctx, conn, "scp -f "+ShellQuote(remotePath), "")
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+	defer session.Close()
+
+	stdin.Write([]byte{0})
+	header, err := stdout.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("scp: %w", err)
+	}
+	switch header[0] {
+	case 'C':
+	case 1, 2:
+		return 0, scpError(header[1:])
+	default:
+		return 0, fmt.Errorf("scp: unexpected %q", strings.TrimSpace(header))
+	}
+	// C<mode> <size> <name>
+	fields := strings.SplitN(strings.TrimSpace(header[1:]), " ", 3)
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("scp: malformed header %q", header)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("scp: malformed size %q", fields[1])
+	}
+	if size > limit {
+		return 0, ErrFileTooLarge
+	}
+	stdin.Write([]byte{0})
+	n, err := io.CopyN(w, stdout, size)
+	if err != nil {
+		return n, fmt.Errorf("scp: read %d of %d bytes: %w", n, size, err)
+	}
+	if err := scpAck(stdout); err != nil {
+		return n, err
+	}
+	stdin.Write([]byte{0})
+	stdin.Close()
+	session.Wait()
+	return n, ctx.Err()
+}
@@ -0,0 +1,303 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// dialTest logs in to s as root with password "secret".
+func dialTest(t *testing.T, s *sshtest.Server) *ssh.Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &Client{Host: s.Host(), Port: s.Port(), User: "root", Password: "secret", HostKeyCallback: ssh.FixedHostKey(s.HostKey.PublicKey())}
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func startServer(t *testing.T, mode sshtest.SFTPMode, readChunk int) *sshtest.Server {
+	t.Helper()
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "secret"
+	s.SFTP, s.ReadChunk = mode, readChunk
+	s.Start(t)
+	return s
+}
+
+// testData spans several SFTP chunks and does not end on a chunk boundary.
+func testData() []byte {
+	data := make([]byte, 3*sftpChunk+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      sshtest.SFTPMode
+		readChunk int
+		protocol  string
+	}{
+		{"sftp", sshtest.SFTPServe, 0, ProtocolSFTP},
+		{"sftp with short reads", sshtest.SFTPServe, 1000, ProtocolSFTP},
+		{"scp when the subsystem is refused", sshtest.SFTPReject, 0, ProtocolSCP},
+		{"scp when sftp-server is missing", sshtest.SFTPExit, 0, ProtocolSCP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, tt.mode, tt.readChunk)
+			conn := dialTest(t, s)
+			ctx := context.Background()
+			data := testData()
+			const remote = "/tmp/it's a file.bin"
+
+			protocol, err := Upload(ctx, conn, remote, bytes.NewReader(data), int64(len(data)), 0o600)
+			if err != nil || protocol != tt.protocol {
+				t.Fatalf("Upload() = %q, %v; want %q", protocol, err, tt.protocol)
+			}
+			stored, mode, ok := s.ReadFile(remote)
+			if !ok || !bytes.Equal(stored, data) || mode != 0o600 {
+				t.Fatalf("stored %d bytes, mode %o; want %d bytes, mode 600", len(stored), mode, len(data))
+			}
+
+			var buf bytes.Buffer
+			n, protocol, err := Download(ctx, conn, remote, &buf, int64(len(data)))
+			if err != nil || protocol != tt.protocol || n != int64(len(data)) {
+				t.Fatalf("Download() = %d, %q, %v; want %d, %q", n, protocol, err, len(data), tt.protocol)
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Error("downloaded data differs from the upload")
+			}
+
+			// Uploads truncate and replace the file
+			if _, err := Upload(ctx, conn, remote, strings.NewReader("short"), 5, 0o644); err != nil {
+				t.Fatalf("second Upload() error = %v", err)
+			}
+			if stored, _, _ := s.ReadFile(remote); string(stored) != "short" {
+				t.Errorf("after second upload file = %q", stored)
+			}
+		})
+	}
+}
+
+func TestUploadEmpty(t *testing.T) {
+	for _, mode := range []sshtest.SFTPMode{sshtest.SFTPServe, sshtest.SFTPReject} {
+		s := startServer(t, mode, 0)
+		conn := dialTest(t, s)
+		if _, err := Upload(context.Background(), conn, "/etc/empty", strings.NewReader(""), 0, 0o644); err != nil {
+			t.Fatalf("Upload() error = %v", err)
+		}
+		if data, _, ok := s.ReadFile("/etc/empty"); !ok || len(data) != 0 {
+			t.Errorf("file = %q, %v; want an empty file", data, ok)
+		}
+	}
+}
+
+func TestDownloadTooLarge(t *testing.T) {
+	for _, mode := range []sshtest.SFTPMode{sshtest.SFTPServe, sshtest.SFTPReject} {
+		s := startServer(t, mode, 0)
+		conn := dialTest(t, s)
+		data := testData()
+		s.WriteFile("/tmp/big", data, 0o644)
+
+		var buf bytes.Buffer
+		n, protocol, err := Download(context.Background(), conn, "/tmp/big", &buf, int64(len(data)-1))
+		if !errors.Is(err, ErrFileTooLarge) {
+			t.Errorf("%s: Download() error = %v, want ErrFileTooLarge", protocol, err)
+		}
+		if n > int64(len(data)-1) || int64(buf.Len()) != n {
+			t.Errorf("%s: Download() wrote %d bytes and reported %d", protocol, buf.Len(), n)
+		}
+		if n, _, err := Download(context.Background(), conn, "/tmp/big", io.Discard, int64(len(data))); err != nil || n != int64(len(data)) {
+			t.Errorf("%s: Download() at the limit = %d, %v", protocol, n, err)
+		}
+	}
+}
+
+func TestTransferErrors(t *testing.T) {
+	tests := []struct {
+		mode     sshtest.SFTPMode
+		upload   bool
+		path     string
+		wantErr  string
+		protocol string
+	}{
+		{sshtest.SFTPServe, false, "/tmp/missing", "sftp: No such file (code 2)", ProtocolSFTP},
+		{sshtest.SFTPServe, false, "/tmp/write-only", "sftp: Permission denied (code 3)", ProtocolSFTP},
+		{sshtest.SFTPServe, true, "/tmp/read-only", "sftp: Permission denied (code 3)", ProtocolSFTP},
+		{sshtest.SFTPReject, false, "/tmp/missing", "scp: /tmp/missing: No such file or directory", ProtocolSCP},
+		{sshtest.SFTPReject, false, "/tmp/write-only", "scp: /tmp/write-only: Permission denied", ProtocolSCP},
+		{sshtest.SFTPReject, true, "/tmp/read-only", "scp: /tmp/read-only: Permission denied", ProtocolSCP},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s upload=%v %s", tt.protocol, tt.upload, tt.path), func(t *testing.T) {
+			s := startServer(t, tt.mode, 0)
+			s.WriteFile("/tmp/write-only", []byte("x"), 0o200)
+			s.WriteFile("/tmp/read-only", []byte("x"), 0o444)
+			conn := dialTest(t, s)
+
+			var protocol string
+			var err error
+			if tt.upload {
+				protocol, err = Upload(context.Background(), conn, tt.path, strings.NewReader("new"), 3, 0o644)
+			} else {
+				_, protocol, err = Download(context.Background(), conn, tt.path, io.Discard, 1024)
+			}
+			if err == nil || err.Error() != tt.wantErr || protocol != tt.protocol {
+				t.Errorf("error = %v (%s), want %q (%s)", err, protocol, tt.wantErr, tt.protocol)
+			}
+			if data, _, _ := s.ReadFile("/tmp/read-only"); string(data) != "x" {
+				t.Errorf("read-only file changed to %q", data)
+			}
+		})
+	}
+}
+
+func TestSCPDownloadProtocolErrors(t *testing.T) {
+	tests := []struct {
+		reply   string
+		wantErr string
+	}{
+		{"C0644 12\n", `scp: malformed header "C0644 12\n"`},
+		{"C0644 -1 file\n", `scp: malformed size "-1"`},
+		{"D0755 0 dir\n", `scp: unexpected "D0755 0 dir"`},
+		{"\x02scp: fatal\n", "scp: fatal"},
+		{"C0644 10 file\nshort", "scp: read 5 of 10 bytes: EOF"},
+		{"C0644 2 file\nok\x01scp: write failed\n", "scp: write failed"},
+	}
+	for _, tt := range tests {
+		conn := dialScripted(t, tt.reply)
+		_, protocol, err := Download(context.Background(), conn, "/tmp/file", io.Discard, 1024)
+		if err == nil || err.Error() != tt.wantErr || protocol != ProtocolSCP {
+			t.Errorf("reply %q: error = %v (%s), want %q", tt.reply, err, protocol, tt.wantErr)
+		}
+	}
+}
+
+// dialScripted logs in to a server without SFTP whose scp writes reply
+// after the first acknowledgement and exits, whatever the command.
+func dialScripted(t *testing.T, reply string) *ssh.Client {
+	t.Helper()
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "secret"
+	s.SFTP = sshtest.SFTPReject
+	s.Exec = func(_ string, stdin io.Reader, stdout, _ io.Writer) int {
+		var ack [1]byte
+		if _, err := stdin.Read(ack[:]); err != nil {
+			return 1
+		}
+		io.WriteString(stdout, reply)
+		return 1
+	}
+	s.Start(t)
+	return dialTest(t, s)
+}
+
+func TestSCPUploadNotAcknowledged(t *testing.T) {
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "secret"
+	s.SFTP = sshtest.SFTPExit
+	s.Exec = func(_ string, _ io.Reader, _, stderr io.Writer) int {
+		io.WriteString(stderr, "sh: scp: not found\n")
+		return 127
+	}
+	s.Start(t)
+	conn := dialTest(t, s)
+
+	protocol, err := Upload(context.Background(), conn, "/tmp/file", strings.NewReader("data"), 4, 0o644)
+	if err == nil || err.Error() != "scp: EOF" || protocol != ProtocolSCP {
+		t.Errorf("Upload() = %q, %v; want scp: EOF", protocol, err)
+	}
+	if got := s.Commands(); len(got) != 1 || got[0] != "scp -t '/tmp/file'" {
+		t.Errorf("commands = %q", got)
+	}
+}
+
+func TestUploadCanceled(t *testing.T) {
+	s := startServer(t, sshtest.SFTPServe, 0)
+	conn := dialTest(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	r, w := io.Pipe()
+	defer w.Close()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Upload(ctx, conn, "/tmp/stalled", r, 1<<20, 0o644)
+		done <- err
+	}()
+	w.Write(make([]byte, sftpChunk))
+	select {
+	case err := <-done:
+		t.Fatalf("Upload() returned %v before the reader ended", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The session is gone: the next write fails instead of hanging.
+	w.Write(make([]byte, sftpChunk))
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Upload() succeeded after cancellation")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upload() still running after cancellation")
+	}
+}
+
+func TestExec(t *testing.T) {
+	s := sshtest.NewUnstartedServer(t)
+	s.User, s.Password = "root", "secret"
+	s.Exec = func(command string, _ io.Reader, stdout, stderr io.Writer) int {
+		switch command {
+		case "echo hi":
+			io.WriteString(stdout, "hi\n")
+			return 0
+		case "yes":
+			io.WriteString(stdout, strings.Repeat("y\n", 100))
+			return 0
+		}
+		io.WriteString(stderr, "not found")
+		return 127
+	}
+	s.Start(t)
+	conn := dialTest(t, s)
+	ctx := context.Background()
+
+	if out, err := Exec(ctx, conn, "echo hi", 1024); err != nil || out != "hi\n" {
+		t.Errorf("Exec(echo) = %q, %v", out, err)
+	}
+	if out, err := Exec(ctx, conn, "yes", 10); !errors.Is(err, ErrOutputLimit) || out != "y\ny\ny\ny\ny\n" {
+		t.Errorf("Exec(yes) = %q, %v; want 10 bytes and ErrOutputLimit", out, err)
+	}
+	if _, err := Exec(ctx, conn, "false", 1024); err == nil || !strings.Contains(err.Error(), "stderr: not found") {
+		t.Errorf("Exec(false) error = %v", err)
+	}
+}
+
+func TestDialWrongPassword(t *testing.T) {
+	s := startServer(t, sshtest.SFTPServe, 0)
+	c := &Client{Host: s.Host(), Port: s.Port(), User: "root", Password: "wrong", HostKeyCallback: ssh.FixedHostKey(s.HostKey.PublicKey())}
+	if conn, err := c.Dial(context.Background()); err == nil {
+		conn.Close()
+		t.Fatal("Dial() with a wrong password succeeded")
+	}
+	c.HostKeyCallback = nil
+	if _, err := c.Dial(context.Background()); err == nil || !strings.Contains(err.Error(), "no host key policy") {
+		t.Errorf("Dial() without a host key policy = %v", err)
+	}
+}
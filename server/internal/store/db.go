@@ -1,6 +1,9 @@
 package store
 
 import (
+	"fmt"
+	"log"
+
 	"github.com/nexusgate/nexusgate/internal/config"
 	"github.com/nexusgate/nexusgate/internal/model"
 	"gorm.io/driver/postgres"
@@ -10,7 +13,7 @@ import (
 
 func InitDB(cfg *config.Config) (*gorm.DB, error) {
 	db, err := gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger: redactLogger{logger.Default.LogMode(logger.Info)},
 	})
 	if err != nil {
 		return nil, err
@@ -26,11 +29,26 @@ func InitDB(cfg *config.Config) (*gorm.DB, error) {
 	return db, nil
 }
 
-func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+// AutoMigrate creates and updates the schema, then sets up TimescaleDB for
+// device metrics when timescale ("auto" or "off") allows it and the
+// extension is usable. It returns the capabilities detected.
+func AutoMigrate(db *gorm.DB, timescale string) (Capabilities, error) {
+	caps := DetectCapabilities(db, timescale)
+	if err := db.AutoMigrate(
 		&model.User{},
 		&model.Device{},
-		&model.DeviceMetrics{},
+		&model.DeviceMetricsRollup{},
+		&model.DeviceInterfaceMetrics{},
+		&model.DeviceFilesystemMetrics{},
+		&model.DeviceThermalMetrics{},
+		&model.DeviceWirelessMetrics{},
+		&model.DeviceDiagnostic{},
+		&model.DeviceLog{},
+		&model.DeviceCredential{},
+		&model.ShellSession{},
+		&model.TunnelSession{},
+		&model.OnboardingJob{},
+		&model.OnboardingHost{},
 		&model.ConfigTemplate{},
 		&model.DeviceConfig{},
 		&model.AuditLog{},
@@ -38,6 +56,9 @@ func AutoMigrate(db *gorm.DB) error {
 		&model.FirewallRule{},
 		&model.WireGuardInterface{},
 		&model.WireGuardPeer{},
+		&model.WireGuardKeyRotation{},
+		&model.VPNNetwork{},
+		&model.VPNNetworkMember{},
 		&model.Firmware{},
 		&model.FirmwareUpgrade{},
 		&model.WANInterface{},
@@ -46,7 +67,79 @@ func AutoMigrate(db *gorm.DB) error {
 		&model.DHCPPool{},
 		&model.StaticLease{},
 		&model.VLAN{},
+		&model.IPPool{},
+		&model.IPAllocation{},
 		&model.SystemSetting{},
 		&model.Alert{},
-	)
+		&model.AlertSilence{},
+		&model.Incident{},
+		&model.NotificationChannel{},
+		&model.EscalationPolicy{},
+		&model.OnCallSchedule{},
+		&model.AlertEscalation{},
+	); err != nil {
+		return caps, err
+	}
+	if err := migrateDeviceMetrics(db); err != nil {
+		return caps, err
+	}
+	if err := dropReplacedIndexes(db); err != nil {
+		return caps, err
+	}
+
+	if caps.Timescale {
+		if err := SetupTimescale(db); err != nil {
+			log.Printf("warning: TimescaleDB setup failed, using plain Postgres: %v", err)
+			caps.Timescale = false
+		} else {
+			log.Printf("TimescaleDB %s enabled for device metrics", caps.TimescaleVersion)
+		}
+	}
+	return caps, nil
+}
+
+// replacedIndexes are indexes an earlier schema created that AutoMigrate
+// does not remove by itself. The unique name indexes became partial ones
+// that ignore soft-deleted rows.
+var replacedIndexes = []struct {
+	model interface{}
+	name  string
+}{
+	{&model.NotificationChannel{}, "idx_notification_channels_name"},
+	{&model.EscalationPolicy{}, "idx_escalation_policies_name"},
+	{&model.OnCallSchedule{}, "idx_on_call_schedules_name"},
+}
+
+func dropReplacedIndexes(db *gorm.DB) error {
+	for _, idx := range replacedIndexes {
+		if db.Migrator().HasIndex(idx.model, idx.name) {
+			if err := db.Migrator().DropIndex(idx.model, idx.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateDeviceMetrics migrates device_metrics. Once it is a hypertable,
+// AutoMigrate's ALTERs are not allowed on its compressed chunks, so only
+// missing columns are added.
+func migrateDeviceMetrics(db *gorm.DB) error {
+	if !isHypertable(db, "device_metrics") {
+		return db.AutoMigrate(&model.DeviceMetrics{})
+	}
+	m := db.Migrator()
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&model.DeviceMetrics{}); err != nil {
+		return err
+	}
+	for _, name := range stmt.Schema.DBNames {
+		if m.HasColumn(&model.DeviceMetrics{}, name) {
+			continue
+		}
+		if err := m.AddColumn(&model.DeviceMetrics{}, name); err != nil {
+			return fmt.Errorf("device_metrics: add column %s: %w", name, err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/secret"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+func init() {
+	// SystemSetting.Value is only sealed for the secret keys. Reading it
+	// does not depend on the key, which may be scanned after the value.
+	schema.RegisterSerializer("setting", secret.Serializer{Plain: func(dst reflect.Value) bool {
+		key := reflect.Indirect(dst).FieldByName("Key")
+		return !key.IsValid() || !model.SecretSettingKeys[key.String()]
+	}})
+}
+
+// secretColumns are the columns written through a secret serializer.
+var secretColumns = []struct {
+	model  interface{}
+	column string
+	scope  func(db *gorm.DB) *gorm.DB
+}{
+	{&model.WireGuardInterface{}, "private_key", nil},
+	{&model.WireGuardPeer{}, "preshared_key", nil},
+	{&model.DeviceCredential{}, "password", nil},
+	{&model.SystemSetting{}, "value", func(db *gorm.DB) *gorm.DB {
+		keys := make([]string, 0, len(model.SecretSettingKeys))
+		for k := range model.SecretSettingKeys {
+			keys = append(keys, k)
+		}
+		return db.Where("\"key\" IN ?", keys)
+	}},
+}
+
+// SealSecrets encrypts secret values stored in plaintext and re-encrypts
+// those sealed with a master key other than the current one, including
+// soft-deleted rows. With all set every value is re-encrypted under a new
+// data key. It returns the number of values written.
+func SealSecrets(db *gorm.DB, all bool) (int, error) {
+	ctx := context.Background()
+	current := secret.CurrentKeyID()
+	written := 0
+	for _, col := range secretColumns {
+		var rows []struct {
+			ID    uint
+			Value string
+		}
+		q := db.Model(col.model).Unscoped().Select("id, " + col.column + " AS value").Where(col.column + " <> ''")
+		if col.scope != nil {
+			q = col.scope(q)
+		}
+		if err := q.Scan(&rows).Error; err != nil {
+			return written, err
+		}
+		for _, r := range rows {
+			if !all && secret.KeyIDOf(r.Value) == current {
+				continue
+			}
+			plaintext, err := secret.Open(ctx, r.Value)
+			if err != nil {
+				return written, fmt.Errorf("%s of row %d: %w", col.column, r.ID, err)
+			}
+			sealed, err := secret.Seal(ctx, plaintext)
+			if err != nil {
+				return written, err
+			}
+			// A column update bypasses the serializer, so the value is
+			// written as sealed here.
+			if err := db.Model(col.model).Unscoped().Where("id = ?", r.ID).UpdateColumn(col.column, sealed).Error; err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	return written, nil
+}
+
+// redactLogger keeps secret values out of logged SQL: fields written
+// through a secret serializer and sealed strings are replaced.
+type redactLogger struct {
+	logger.Interface
+}
+
+func (l redactLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return redactLogger{l.Interface.LogMode(level)}
+}
+
+func (l redactLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if f, ok := l.Interface.(gorm.ParamsFilter); ok {
+		sql, params = f.ParamsFilter(ctx, sql, params...)
+	}
+	out := make([]interface{}, len(params))
+	for i, p := range params {
+		if s, ok := p.(string); (ok && secret.IsSealed(s)) || secret.Sensitive(p) {
+			p = "[redacted]"
+		}
+		out[i] = p
+	}
+	return sql, out
+}
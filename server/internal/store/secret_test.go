@@ -0,0 +1,171 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/secret"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+func TestSettingSerializer(t *testing.T) {
+	kms, err := secret.NewLocalKMS(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.SetKMS(kms)
+	ctx := context.Background()
+	sealed, err := secret.Seal(ctx, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := schema.Parse(&model.SystemSetting{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := s.LookUpField("Value")
+
+	// The key column may be scanned after the value, so reads must not
+	// depend on it.
+	tests := []struct {
+		key     string
+		stored  interface{}
+		want    string
+		wantErr bool
+	}{
+		{key: "smtp_pass", stored: sealed, want: "hunter2"},
+		{key: "", stored: sealed, want: "hunter2"},
+		{key: "smtp_pass", stored: []byte(sealed), want: "hunter2"},
+		{key: "smtp_pass", stored: "hunter2", want: "hunter2"}, // not sealed yet
+		{key: "smtp_pass", stored: "enc:v1:bogus", wantErr: true},
+		{key: "smtp_host", stored: "mail.example.com", want: "mail.example.com"},
+		{key: "banner", stored: "plain:enc:v1:not-a-secret", want: "enc:v1:not-a-secret"},
+		{key: "", stored: "plain:enc:v1:not-a-secret", want: "enc:v1:not-a-secret"},
+		{key: "banner", stored: "plain:plain:x", want: "plain:x"},
+		{key: "banner", stored: nil, want: ""},
+	}
+	for _, tt := range tests {
+		got := model.SystemSetting{Key: tt.key}
+		err := field.Serializer.Scan(ctx, field, reflect.ValueOf(&got).Elem(), tt.stored)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Scan(%s=%q) = %q, want an error", tt.key, tt.stored, got.Value)
+			}
+			continue
+		}
+		if err != nil || got.Value != tt.want {
+			t.Errorf("Scan(%s=%q) = %q, %v; want %q", tt.key, tt.stored, got.Value, err, tt.want)
+		}
+	}
+
+	for _, setting := range []model.SystemSetting{
+		{Key: "smtp_pass", Value: "enc:v1:x"},
+		{Key: "smtp_pass", Value: "hunter2"},
+		{Key: "banner", Value: "hello"},
+		{Key: "banner", Value: "enc:v1:x"},
+		{Key: "banner", Value: "plain:x"},
+		{Key: "banner", Value: ""},
+	} {
+		v, err := field.Serializer.Value(ctx, field, reflect.ValueOf(&setting).Elem(), setting.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := v.(string)
+		if isSecret := model.SecretSettingKeys[setting.Key]; isSecret != secret.IsSealed(stored) {
+			t.Errorf("Value(%s=%q) = %q, want sealed %v", setting.Key, setting.Value, stored, isSecret)
+		}
+		var back model.SystemSetting
+		if err := field.Serializer.Scan(ctx, field, reflect.ValueOf(&back).Elem(), stored); err != nil || back.Value != setting.Value {
+			t.Errorf("Scan(Value(%s=%q)) = %q, %v; want it back", setting.Key, setting.Value, back.Value, err)
+		}
+	}
+}
+
+func TestRedactLogger(t *testing.T) {
+	kms, err := secret.NewLocalKMS(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.SetKMS(kms)
+	sealed, err := secret.Seal(context.Background(), "sealed-elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	db, err := gorm.Open(postgres.Open("host=localhost"), &gorm.Config{
+		DryRun:                 true,
+		SkipDefaultTransaction: true,
+		DisableAutomaticPing:   true,
+		Logger:                 redactLogger{logger.New(log.New(&buf, "", 0), logger.Config{LogLevel: logger.Info})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		run    func(db *gorm.DB) *gorm.DB
+		hidden string
+		shown  string
+	}{
+		{
+			name: "private key",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Create(&model.WireGuardInterface{Name: "wg0", PrivateKey: "private-key-plaintext"})
+			},
+			hidden: "private-key-plaintext", shown: "wg0",
+		},
+		{
+			name:   "device password",
+			run:    func(db *gorm.DB) *gorm.DB { return db.Create(&model.DeviceCredential{Password: "device-password"}) },
+			hidden: "device-password",
+		},
+		{
+			name: "secret setting",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Create(&model.SystemSetting{Key: "smtp_pass", Value: "smtp-password"})
+			},
+			hidden: "smtp-password", shown: "smtp_pass",
+		},
+		{
+			name: "plain setting",
+			run: func(db *gorm.DB) *gorm.DB {
+				return db.Create(&model.SystemSetting{Key: "smtp_host", Value: "mail.example.com"})
+			},
+			shown: "mail.example.com",
+		},
+		{
+			name:   "sealed query value",
+			run:    func(db *gorm.DB) *gorm.DB { return db.Where("password = ?", sealed).Find(&[]model.DeviceCredential{}) },
+			hidden: sealed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			if err := tt.run(db).Error; err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			if !strings.Contains(out, "[redacted]") && tt.hidden != "" {
+				t.Errorf("logged %q, want a redacted value", out)
+			}
+			if tt.hidden != "" && strings.Contains(out, tt.hidden) || strings.Contains(out, "enc:v1:") {
+				t.Errorf("logged %q, want no secret", out)
+			}
+			if !strings.Contains(out, tt.shown) {
+				t.Errorf("logged %q, want %q", out, tt.shown)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Capabilities describes optional database features detected at startup.
+type Capabilities struct {
+	// Timescale is true when device_metrics is a TimescaleDB hypertable with
+	// continuous aggregates device_metrics_1m, _1h and _1d.
+	Timescale        bool
+	TimescaleVersion string
+}
+
+// minTimescaleVersion is the first release with hierarchical continuous aggregates.
+const minTimescaleVersion = "2.9"
+
+// DetectCapabilities checks whether TimescaleDB is installed (creating the
+// extension when it is available) and recent enough. mode "off" disables
+// the check.
+func DetectCapabilities(db *gorm.DB, mode string) Capabilities {
+	var caps Capabilities
+	if mode == "off" {
+		return caps
+	}
+
+	var available int64
+	db.Raw("SELECT count(*) FROM pg_available_extensions WHERE name = 'timescaledb'").Scan(&available)
+	if available == 0 {
+		return caps
+	}
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS timescaledb").Error; err != nil {
+		log.Printf("warning: timescaledb extension not enabled, using plain Postgres: %v", err)
+		return caps
+	}
+
+	db.Raw("SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'").Scan(&caps.TimescaleVersion)
+	if !versionAtLeast(caps.TimescaleVersion, minTimescaleVersion) {
+		log.Printf("warning: timescaledb %s is older than %s, using plain Postgres", caps.TimescaleVersion, minTimescaleVersion)
+		return caps
+	}
+	caps.Timescale = true
+	return caps
+}
+
+// isHypertable reports whether table is a TimescaleDB hypertable. The
+// extension may be installed while caps.Timescale is off, so this does not
+// depend on the detected capabilities.
+func isHypertable(db *gorm.DB, table string) bool {
+	var installed int64
+	db.Raw("SELECT count(*) FROM pg_extension WHERE extname = 'timescaledb'").Scan(&installed)
+	if installed == 0 {
+		return false
+	}
+	var n int64
+	db.Raw("SELECT count(*) FROM timescaledb_information.hypertables WHERE hypertable_name = ?", table).Scan(&n)
+	return n > 0
+}
+
+func versionAtLeast(version, min string) bool {
+	v := strings.Split(version, ".")
+	m := strings.Split(min, ".")
+	for i := range m {
+		if i >= len(v) {
+			return false
+		}
+		a, _ := strconv.Atoi(v[i])
+		b, _ := strconv.Atoi(m[i])
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// metricsAggregate is one continuous aggregate of device_metrics. Each has
+// the same columns as model.DeviceMetricsRollup (without id and resolution).
+type metricsAggregate struct {
+	name     string
+	source   string
+	bucket   string
+	start    string // refresh policy start_offset
+	end      string // refresh policy end_offset
+	schedule string
+}
+
+var metricsAggregates = []metricsAggregate{
+	{"1m", "device_metrics", "1 minute", "1 hour", "1 minute", "1 minute"},
+	{"1h", "device_metrics_1m", "1 hour", "3 hours", "1 hour", "5 minutes"},
+	{"1d", "device_metrics_1h", "1 day", "3 days", "1 day", "1 hour"},
+}
+
+// SetupTimescale converts device_metrics into a compressed hypertable and
+// creates the continuous aggregates. It is idempotent and runs after
+// AutoMigrate. Retention policies are set by ApplyTimescaleRetention.
+func SetupTimescale(db *gorm.DB) error {
+	if !isHypertable(db, "device_metrics") {
+		// Unique constraints on a hypertable must include the time column
+		if err := db.Exec("ALTER TABLE device_metrics DROP CONSTRAINT IF EXISTS device_metrics_pkey").Error; err != nil {
+			return err
+		}
+		if err := db.Exec("SELECT create_hypertable('device_metrics', 'collected_at', chunk_time_interval => INTERVAL '1 day', migrate_data => true)").Error; err != nil {
+			return fmt.Errorf("create hypertable: %w", err)
+		}
+		log.Println("device_metrics converted to a TimescaleDB hypertable")
+	}
+
+	var compressed bool
+	db.Raw("SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_name = 'device_metrics'").Scan(&compressed)
+	if !compressed {
+		if err := db.Exec("ALTER TABLE device_metrics SET (timescaledb.compress, timescaledb.compress_segmentby = 'device_id', timescaledb.compress_orderby = 'collected_at DESC')").Error; err != nil {
+			return fmt.Errorf("enable compression: %w", err)
+		}
+	}
+	if err := db.Exec("SELECT add_compression_policy('device_metrics', INTERVAL '1 day', if_not_exists => true)").Error; err != nil {
+		return fmt.Errorf("add compression policy: %w", err)
+	}
+
+	for _, a := range metricsAggregates {
+		if err := createMetricsAggregate(db, a); err != nil {
+			return fmt.Errorf("continuous aggregate device_metrics_%s: %w", a.name, err)
+		}
+	}
+	return nil
+}
+
+func createMetricsAggregate(db *gorm.DB, a metricsAggregate) error {
+	view := "device_metrics_" + a.name
+	var exists int64
+	db.Raw("SELECT count(*) FROM timescaledb_information.continuous_aggregates WHERE view_name = ?", view).Scan(&exists)
+	if exists > 0 {
+		return nil
+	}
+
+	var selects []string
+	if a.source == "device_metrics" {
+		selects = []string{
+			"device_id",
+			fmt.Sprintf("time_bucket(INTERVAL '%s', collected_at) AS bucket_start", a.bucket),
+			"count(*) AS samples",
+		}
+		for _, g := range [][2]string{{"cpu", "cpu_usage"}, {"mem", "mem_usage"}, {"conntrack", "conntrack"}} {
+			selects = append(selects,
+				fmt.Sprintf("min(%s)::float8 AS %s_min", g[1], g[0]),
+				fmt.Sprintf("avg(%s)::float8 AS %s_avg", g[1], g[0]),
+				fmt.Sprintf("max(%s)::float8 AS %s_max", g[1], g[0]),
+				fmt.Sprintf("last(%s, collected_at)::float8 AS %s_last", g[1], g[0]))
+		}
+		for _, c := range []string{"rx_bytes", "tx_bytes", "mem_total", "mem_free", "uptime_secs"} {
+			selects = append(selects, fmt.Sprintf("last(%s, collected_at) AS %s", c, c))
+		}
+	} else {
+		selects = []string{
+			"device_id",
+			fmt.Sprintf("time_bucket(INTERVAL '%s', bucket_start) AS bucket_start", a.bucket),
+			"sum(samples)::bigint AS samples",
+		}
+		for _, g := range []string{"cpu", "mem", "conntrack"} {
+			selects = append(selects,
+				fmt.Sprintf("min(%s_min) AS %s_min", g, g),
+				fmt.Sprintf("sum(%s_avg * samples) / NULLIF(sum(samples), 0) AS %s_avg", g, g),
+				fmt.Sprintf("max(%s_max) AS %s_max", g, g),
+				fmt.Sprintf("last(%s_last, bucket_start) AS %s_last", g, g))
+		}
+		for _, c := range []string{"rx_bytes", "tx_bytes", "mem_total", "mem_free", "uptime_secs"} {
+			selects = append(selects, fmt.Sprintf("last(%s, bucket_start) AS %s", c, c))
+		}
+	}
+
+	timeCol := "bucket_start"
+	where := ""
+	if a.source == "device_metrics" {
+		timeCol = "collected_at"
+		where = " WHERE device_id <> 0"
+	}
+	sql := fmt.Sprintf(
+		"CREATE MATERIALIZED VIEW %s WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS "+
+			"SELECT %s FROM %s%s GROUP BY device_id, time_bucket(INTERVAL '%s', %s) WITH NO DATA",
+		view, strings.Join(selects, ", "), a.source, where, a.bucket, timeCol)
+	if err := db.Exec(sql).Error; err != nil {
+		return err
+	}
+	if err := db.Exec(fmt.Sprintf(
+		"SELECT add_continuous_aggregate_policy('%s', start_offset => INTERVAL '%s', end_offset => INTERVAL '%s', schedule_interval => INTERVAL '%s', if_not_exists => true)",
+		view, a.start, a.end, a.schedule)).Error; err != nil {
+		return err
+	}
+	// Materialize existing history once; the policy only covers recent buckets
+	if err := db.Exec(fmt.Sprintf("CALL refresh_continuous_aggregate('%s', NULL, now() - INTERVAL '%s')", view, a.end)).Error; err != nil {
+		return err
+	}
+	log.Printf("continuous aggregate %s created", view)
+	return nil
+}
+
+// ApplyTimescaleRetention (re)sets the retention policies of device_metrics
+// and its continuous aggregates. Keys are "raw", "1m", "1h" and "1d".
+func ApplyTimescaleRetention(db *gorm.DB, retention map[string]time.Duration) {
+	for name, d := range retention {
+		relation := "device_metrics"
+		if name != "raw" {
+			relation += "_" + name
+		}
+		interval := fmt.Sprintf("%d seconds", int64(d.Seconds()))
+
+		var current string
+		db.Raw("SELECT config->>'drop_after' FROM timescaledb_information.jobs WHERE proc_name = 'policy_retention' AND hypertable_name = ?", relationHypertable(db, relation)).
+			Scan(&current)
+		if current != "" && intervalEquals(db, current, interval) {
+			continue
+		}
+		db.Exec("SELECT remove_retention_policy(?, if_exists => true)", relation)
+		if err := db.Exec(fmt.Sprintf("SELECT add_retention_policy('%s', INTERVAL '%s')", relation, interval)).Error; err != nil {
+			log.Printf("warning: failed to set retention policy on %s: %v", relation, err)
+			continue
+		}
+		log.Printf("retention policy on %s set to %s", relation, d)
+	}
+}
+
+// relationHypertable returns the hypertable backing a relation: itself for
+// device_metrics, the materialization hypertable for continuous aggregates.
+func relationHypertable(db *gorm.DB, relation string) string {
+	if relation == "device_metrics" {
+		return relation
+	}
+	var name string
+	db.Raw("SELECT materialization_hypertable_name FROM timescaledb_information.continuous_aggregates WHERE view_name = ?", relation).Scan(&name)
+	return name
+}
+
+func intervalEquals(db *gorm.DB, a, b string) bool {
+	var equal bool
+	db.Raw("SELECT ?::interval = ?::interval", a, b).Scan(&equal)
+	return equal
+}
@@ -0,0 +1,198 @@
+// Package syslog parses syslog messages (RFC 5424, RFC 3164 and OpenWrt
+// logread output) and runs the UDP/TCP receiver devices forward their logs to.
+package syslog
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a parsed syslog entry.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	Text      string
+}
+
+// Severities by keyword, as used by syslog priorities ("daemon.warn").
+var severityNames = map[string]int{
+	"emerg": 0, "panic": 0, "alert": 1, "crit": 2, "err": 3, "error": 3,
+	"warn": 4, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+var facilityNames = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseSeverity accepts a severity keyword ("warning") or number ("4").
+func ParseSeverity(s string) (int, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+		return n, true
+	}
+	n, ok := severityNames[s]
+	return n, ok
+}
+
+var errNoPriority = errors.New("missing <PRI>")
+
+// Parse parses one syslog message in RFC 5424 or RFC 3164 format. Messages
+// without a timestamp, or with an unparsable one, get received. RFC 3164
+// timestamps carry no year or zone; they are read in UTC in the year of
+// received.
+func Parse(b []byte, received time.Time) (Message, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+	if len(s) < 3 || s[0] != '<' {
+		return Message{}, errNoPriority
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return Message{}, errNoPriority
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || strings.Trim(s[1:end], "0123456789") != "" || pri > 191 {
+		return Message{}, errors.New("invalid <PRI>")
+	}
+	m := Message{Facility: pri / 8, Severity: pri % 8, Timestamp: received}
+	s = s[end+1:]
+
+	if strings.HasPrefix(s, "1 ") {
+		parse5424(&m, s[2:])
+	} else {
+		parse3164(&m, s, received)
+	}
+	return m, nil
+}
+
+// parse5424 reads "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG".
+func parse5424(m *Message, s string) {
+	fields := strings.SplitN(s, " ", 6)
+	nilValue := func(v string) string {
+		if v == "-" {
+			return ""
+		}
+		return v
+	}
+	if len(fields) > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+			m.Timestamp = t
+		}
+	}
+	if len(fields) > 1 {
+		m.Hostname = nilValue(fields[1])
+	}
+	if len(fields) > 2 {
+		m.AppName = nilValue(fields[2])
+	}
+	if len(fields) > 3 {
+		m.ProcID = nilValue(fields[3])
+	}
+	if len(fields) > 5 {
+		m.Text = skipStructuredData(fields[5])
+	}
+}
+
+// skipStructuredData drops the SD-ELEMENTs ("-" or "[id k="v"]...") in
+// front of the message text.
+func skipStructuredData(s string) string {
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	}
+	for strings.HasPrefix(s, "[") {
+		end := sdElementEnd(s)
+		if end < 0 {
+			return ""
+		}
+		s = s[end+1:]
+	}
+	s = strings.TrimPrefix(s, " ")
+	return strings.TrimPrefix(s, "\ufeff") // BOM of a UTF-8 MSG
+}
+
+// sdElementEnd returns the index of the "]" closing the SD-ELEMENT at the
+// start of s, skipping quoted and escaped characters, or -1.
+func sdElementEnd(s string) int {
+	inQuote, escaped := false, false
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+		case c == ']' && !inQuote:
+			return i
+		}
+	}
+	return -1
+}
+
+// parse3164 reads "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". Senders that
+// omit the timestamp or hostname (as some embedded loggers do) are handled
+// by falling back to treating the rest as TAG: MSG.
+func parse3164(m *Message, s string, received time.Time) {
+	if len(s) >= 16 && s[15] == ' ' {
+		if t, err := time.Parse(time.Stamp, s[:15]); err == nil {
+			m.Timestamp = time.Date(received.UTC().Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+			// A December entry received in January belongs to last year
+			if m.Timestamp.After(received.Add(24 * time.Hour)) {
+				m.Timestamp = m.Timestamp.AddDate(-1, 0, 0)
+			}
+			s = s[16:]
+			if host, rest, ok := strings.Cut(s, " "); ok && !strings.HasSuffix(host, ":") && !strings.Contains(host, "[") {
+				m.Hostname, s = host, rest
+			}
+		}
+	}
+	m.AppName, m.ProcID, m.Text = splitTag(s)
+}
+
+// splitTag splits "tag[pid]: text" (pid and tag optional).
+func splitTag(s string) (tag, pid, text string) {
+	head, rest, ok := strings.Cut(s, ": ")
+	if !ok || len(head) > 64 || strings.ContainsAny(head, " \t") {
+		return "", "", s
+	}
+	if i := strings.IndexByte(head, '['); i > 0 && strings.HasSuffix(head, "]") {
+		return head[:i], head[i+1 : len(head)-1], rest
+	}
+	return head, "", rest
+}
+
+// ParseLogread parses one line of OpenWrt `logread` output:
+// "Thu Oct 19 10:00:00 2026 daemon.notice nexusgate[123]: message".
+// The device's local time is taken as UTC.
+func ParseLogread(line string) (Message, bool) {
+	const layout = "Mon Jan _2 15:04:05 2006"
+	if len(line) < len(layout)+2 {
+		return Message{}, false
+	}
+	t, err := time.Parse(layout, line[:len(layout)])
+	if err != nil {
+		return Message{}, false
+	}
+	rest := strings.TrimPrefix(line[len(layout):], " ")
+	prio, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return Message{}, false
+	}
+	facility, severity, ok := strings.Cut(prio, ".")
+	if !ok {
+		return Message{}, false
+	}
+	m := Message{Timestamp: t, Facility: facilityNames[facility], Severity: severityNames[severity]}
+	if _, known := severityNames[severity]; !known {
+		m.Severity = 6
+	}
+	m.AppName, m.ProcID, m.Text = splitTag(rest)
+	return m, true
+}
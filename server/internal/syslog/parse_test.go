@@ -0,0 +1,203 @@
+package syslog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	received := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		input string
+		want  Message
+	}{
+		{
+			name:  "RFC 5424",
+			input: "<165>1 2026-10-19T10:14:15.003Z gw-01 dropbear 1234 ID47 - Password auth succeeded for 'root'",
+			want: Message{Facility: 20, Severity: 5, Timestamp: time.Date(2026, 10, 19, 10, 14, 15, 3000000, time.UTC),
+				Hostname: "gw-01", AppName: "dropbear", ProcID: "1234", Text: "Password auth succeeded for 'root'"},
+		},
+		{
+			name:  "RFC 5424 with offset, structured data and BOM",
+			input: "<30>1 2026-10-19T12:14:15+02:00 gw-01 netifd - - [meta sequenceId=\"1\"][origin ip=\"10.0.0.1\" x=\"a\\\"]b\"] \ufeffInterface 'wan' is now up\n",
+			want: Message{Facility: 3, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 14, 15, 0, time.UTC),
+				Hostname: "gw-01", AppName: "netifd", Text: "Interface 'wan' is now up"},
+		},
+		{
+			name:  "RFC 5424 with nil values",
+			input: "<14>1 - - - - - -",
+			want:  Message{Facility: 1, Severity: 6, Timestamp: received},
+		},
+		{
+			name:  "RFC 5424 without message",
+			input: "<14>1 2026-10-19T10:00:00Z gw-01 app - -",
+			want:  Message{Facility: 1, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), Hostname: "gw-01", AppName: "app"},
+		},
+		{
+			name:  "RFC 5424 with unterminated structured data",
+			input: "<14>1 2026-10-19T10:00:00Z gw-01 app - - [meta x=\"1\" text",
+			want:  Message{Facility: 1, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), Hostname: "gw-01", AppName: "app"},
+		},
+		{
+			name:  "RFC 5424 with an invalid timestamp",
+			input: "<14>1 yesterday gw-01 app - - - hello",
+			want:  Message{Facility: 1, Severity: 6, Timestamp: received, Hostname: "gw-01", AppName: "app", Text: "hello"},
+		},
+		{
+			name:  "RFC 3164",
+			input: "<38>Oct 19 10:01:02 gw-01 dropbear[1234]: Exit (root): Disconnect received",
+			want: Message{Facility: 4, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 1, 2, 0, time.UTC),
+				Hostname: "gw-01", AppName: "dropbear", ProcID: "1234", Text: "Exit (root): Disconnect received"},
+		},
+		{
+			name:  "RFC 3164 with a space-padded day",
+			input: "<86>Oct  9 08:00:00 gw-01 cron: job done",
+			want: Message{Facility: 10, Severity: 6, Timestamp: time.Date(2026, 10, 9, 8, 0, 0, 0, time.UTC),
+				Hostname: "gw-01", AppName: "cron", Text: "job done"},
+		},
+		{
+			name:  "RFC 3164 without hostname",
+			input: "<30>Oct 19 10:01:02 dnsmasq[812]: query[A] example.com from 192.168.1.20",
+			want: Message{Facility: 3, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 1, 2, 0, time.UTC),
+				AppName: "dnsmasq", ProcID: "812", Text: "query[A] example.com from 192.168.1.20"},
+		},
+		{
+			name:  "RFC 3164 without timestamp",
+			input: "<27>kernel: [ 12.345678] eth0: link down",
+			want:  Message{Facility: 3, Severity: 3, Timestamp: received, AppName: "kernel", Text: "[ 12.345678] eth0: link down"},
+		},
+		{
+			name:  "RFC 3164 without timestamp or tag",
+			input: "<13>something happened on the device",
+			want:  Message{Facility: 1, Severity: 5, Timestamp: received, Text: "something happened on the device"},
+		},
+		{
+			name:  "RFC 3164 with a malformed timestamp",
+			input: "<13>Foo 99 99:99:99 gw-01 app: text",
+			want:  Message{Facility: 1, Severity: 5, Timestamp: received, Text: "Foo 99 99:99:99 gw-01 app: text"},
+		},
+		{
+			name:  "RFC 3164 December entry received in January",
+			input: "<13>Dec 31 23:59:58 gw-01 app: late",
+			want: Message{Facility: 1, Severity: 5, Timestamp: time.Date(2025, 12, 31, 23, 59, 58, 0, time.UTC),
+				Hostname: "gw-01", AppName: "app", Text: "late"},
+		},
+		{
+			name:  "lowest and highest priority",
+			input: "<0>Oct 19 10:00:00 gw-01 kernel: panic",
+			want:  Message{Facility: 0, Severity: 0, Timestamp: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), Hostname: "gw-01", AppName: "kernel", Text: "panic"},
+		},
+		{
+			name:  "priority 191",
+			input: "<191>local7 debug",
+			want:  Message{Facility: 23, Severity: 7, Timestamp: received, Text: "local7 debug"},
+		},
+		{
+			name:  "trailing CRLF and NUL",
+			input: "<13>app: text\r\n\x00",
+			want:  Message{Facility: 1, Severity: 5, Timestamp: received, AppName: "app", Text: "text"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv := received
+			if tt.want.Timestamp.Year() == 2025 {
+				recv = time.Date(2026, 1, 1, 0, 0, 5, 0, time.UTC)
+			}
+			got, err := Parse([]byte(tt.input), recv)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !got.Timestamp.Equal(tt.want.Timestamp) {
+				t.Errorf("Timestamp = %s, want %s", got.Timestamp, tt.want.Timestamp)
+			}
+			got.Timestamp, tt.want.Timestamp = time.Time{}, time.Time{}
+			if got != tt.want {
+				t.Errorf("Parse() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInvalidPriority(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"<",
+		"<>",
+		"<1",
+		"no priority",
+		" <13>leading space",
+		"<abc>text",
+		"<-1>text",
+		"<192>text",
+		"<1000>text",
+		"<0013>text",
+		"13>text",
+	} {
+		if m, err := Parse([]byte(input), time.Now()); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", input, m)
+		}
+	}
+}
+
+func TestParseLogread(t *testing.T) {
+	tests := []struct {
+		line string
+		want Message
+		ok   bool
+	}{
+		{
+			line: "Mon Oct 19 10:00:00 2026 daemon.notice nexusgate[123]: agent started",
+			want: Message{Facility: 3, Severity: 5, Timestamp: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), AppName: "nexusgate", ProcID: "123", Text: "agent started"},
+			ok:   true,
+		},
+		{
+			line: "Fri Oct  9 08:01:02 2026 kern.warn kernel: [ 5.123] eth1: link up",
+			want: Message{Facility: 0, Severity: 4, Timestamp: time.Date(2026, 10, 9, 8, 1, 2, 0, time.UTC), AppName: "kernel", Text: "[ 5.123] eth1: link up"},
+			ok:   true,
+		},
+		{
+			line: "Mon Oct 19 10:00:00 2026 user.bogus app: unknown severity",
+			want: Message{Facility: 1, Severity: 6, Timestamp: time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), AppName: "app", Text: "unknown severity"},
+			ok:   true,
+		},
+		{line: "Mon Oct 19 10:00:00 2026"},
+		{line: "Mon Oct 19 10:00:00 2026 daemon"},
+		{line: "2026-10-19 10:00:00 daemon.notice app: text"},
+		{line: ""},
+	}
+	for _, tt := range tests {
+		got, ok := ParseLogread(tt.line)
+		if ok != tt.ok {
+			t.Errorf("ParseLogread(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("ParseLogread(%q) =\n%+v\nwant\n%+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"warning", 4, true},
+		{"WARN", 4, true},
+		{" err ", 3, true},
+		{"0", 0, true},
+		{"7", 7, true},
+		{"8", 0, false},
+		{"-1", 0, false},
+		{"loud", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseSeverity(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseSeverity(%q) = %d, %v; want %d, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package syslog
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+const (
+	maxMessageSize = 64 * 1024
+	maxTextLength  = 8 * 1024
+	tcpIdleTimeout = 10 * time.Minute
+	deviceCacheTTL = time.Minute
+)
+
+// Options configures the receiver. An empty address disables that listener.
+type Options struct {
+	UDPAddr       string // e.g. ":514"
+	TCPAddr       string
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+func (o *Options) setDefaults() {
+	if o.QueueSize <= 0 {
+		o.QueueSize = 10000
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 500
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = time.Second
+	}
+}
+
+// DeviceLog converts a parsed message to a stored entry.
+func (m Message) DeviceLog(deviceID uint, source, sourceIP string, received time.Time) model.DeviceLog {
+	text := m.Text
+	if len(text) > maxTextLength {
+		text = text[:maxTextLength]
+	}
+	return model.DeviceLog{
+		DeviceID:   deviceID,
+		Source:     source,
+		SourceIP:   sourceIP,
+		Hostname:   truncate(m.Hostname, 255),
+		Facility:   m.Facility,
+		Severity:   m.Severity,
+		Tag:        truncate(m.AppName, 64),
+		PID:        truncate(m.ProcID, 32),
+		Message:    text,
+		LoggedAt:   m.Timestamp,
+		ReceivedAt: received,
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Receiver accepts syslog over UDP (one message per datagram) and TCP
+// (octet-counted or newline-delimited framing, RFC 6587), attaches each
+// entry to the device whose IP address or name matches the sender, and
+// stores entries in batches. Like the heartbeat pipeline it never blocks
+// senders: entries are dropped and counted when the queue is full.
+type Receiver struct {
+	db    *gorm.DB
+	opts  Options
+	queue chan model.DeviceLog
+
+	udp      net.PacketConn
+	tcp      net.Listener
+	wg       sync.WaitGroup // listeners and connections
+	writerWg sync.WaitGroup
+
+	connMu sync.Mutex
+	conns  map[net.Conn]struct{}
+
+	// Device lookup, only used by the writer goroutine
+	byIP     map[string]uint
+	byName   map[string]uint
+	loadedAt time.Time
+
+	received  *prometheus.CounterVec
+	dropped   *prometheus.CounterVec
+	stored    prometheus.Counter
+	unmatched prometheus.Counter
+}
+
+// NewReceiver creates a receiver; Start opens the listeners.
+func NewReceiver(db *gorm.DB, opts Options) *Receiver {
+	opts.setDefaults()
+	r := &Receiver{
+		db:    db,
+		opts:  opts,
+		queue: make(chan model.DeviceLog, opts.QueueSize),
+		conns: make(map[net.Conn]struct{}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nexusgate_syslog_messages_received_total", Help: "Syslog messages received",
+		}, []string{"transport"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nexusgate_syslog_messages_dropped_total", Help: "Syslog messages dropped, by reason (parse, queue_full, store)",
+		}, []string{"reason"}),
+		stored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nexusgate_syslog_messages_stored_total", Help: "Syslog messages stored",
+		}),
+		unmatched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nexusgate_syslog_messages_unmatched_total", Help: "Stored syslog messages whose sender matched no device",
+		}),
+	}
+	for _, t := range []string{"udp", "tcp"} {
+		r.received.WithLabelValues(t)
+	}
+	for _, reason := range []string{"parse", "queue_full", "store"} {
+		r.dropped.WithLabelValues(reason)
+	}
+	return r
+}
+
+// Start opens the configured listeners and starts the writer.
+func (r *Receiver) Start() error {
+	if r.opts.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", r.opts.UDPAddr)
+		if err != nil {
+			return err
+		}
+		r.udp = conn
+		r.wg.Add(1)
+		go r.serveUDP()
+		log.Printf("syslog receiver listening on udp %s", r.opts.UDPAddr)
+	}
+	if r.opts.TCPAddr != "" {
+		ln, err := net.Listen("tcp", r.opts.TCPAddr)
+		if err != nil {
+			if r.udp != nil {
+				r.udp.Close()
+			}
+			return err
+		}
+		r.tcp = ln
+		r.wg.Add(1)
+		go r.serveTCP()
+		log.Printf("syslog receiver listening on tcp %s", r.opts.TCPAddr)
+	}
+	r.writerWg.Add(1)
+	go r.writer()
+	return nil
+}
+
+// Stop closes the listeners and connections and flushes queued entries.
+func (r *Receiver) Stop() {
+	if r.udp != nil {
+		r.udp.Close()
+	}
+	if r.tcp != nil {
+		r.tcp.Close()
+	}
+	r.connMu.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.connMu.Unlock()
+	r.wg.Wait()
+	close(r.queue)
+	r.writerWg.Wait()
+}
+
+func (r *Receiver) serveUDP() {
+	defer r.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := r.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		r.received.WithLabelValues("udp").Inc()
+		r.handle(buf[:n], hostOf(addr))
+	}
+}
+
+func (r *Receiver) serveTCP() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		r.connMu.Lock()
+		r.conns[conn] = struct{}{}
+		r.connMu.Unlock()
+		r.wg.Add(1)
+		go r.serveConn(conn)
+	}
+}
+
+func (r *Receiver) serveConn(conn net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		conn.Close()
+		r.connMu.Lock()
+		delete(r.conns, conn)
+		r.connMu.Unlock()
+	}()
+
+	source := hostOf(conn.RemoteAddr())
+	br := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readFrame(br)
+		if len(msg) > 0 {
+			r.received.WithLabelValues("tcp").Inc()
+			r.handle(msg, source)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readFrame reads one message: "<len> <msg>" with octet counting, otherwise
+// up to the next newline.
+func readFrame(br *bufio.Reader) ([]byte, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		prefix, err := br.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(prefix))
+		if err != nil || n > maxMessageSize {
+			return nil, errors.New("invalid octet count")
+		}
+		msg := make([]byte, n)
+		read, err := io.ReadFull(br, msg)
+		return msg[:read], err
+	}
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// Oversized line: keep the start, skip the rest
+		msg := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = br.ReadSlice('\n')
+		}
+		return msg, err
+	}
+	return append([]byte(nil), line...), err
+}
+
+func (r *Receiver) handle(b []byte, source string) {
+	now := time.Now()
+	m, err := Parse(b, now)
+	if err != nil {
+		r.dropped.WithLabelValues("parse").Inc()
+		return
+	}
+	select {
+	case r.queue <- m.DeviceLog(0, "syslog", source, now):
+	default:
+		r.dropped.WithLabelValues("queue_full").Inc()
+	}
+}
+
+func (r *Receiver) writer() {
+	defer r.writerWg.Done()
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]model.DeviceLog, 0, r.opts.BatchSize)
+	for {
+		select {
+		case entry, ok := <-r.queue:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= r.opts.BatchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+func (r *Receiver) flush(batch []model.DeviceLog) {
+	if len(batch) == 0 {
+		return
+	}
+	r.loadDevices()
+	for i := range batch {
+		e := &batch[i]
+		if id, ok := r.byIP[e.SourceIP]; ok {
+			e.DeviceID = id
+		} else if id, ok := r.byName[strings.ToLower(e.Hostname)]; ok && e.Hostname != "" {
+			e.DeviceID = id
+		} else {
+			r.unmatched.Inc()
+		}
+	}
+	if err := r.db.CreateInBatches(batch, r.opts.BatchSize).Error; err != nil {
+		r.dropped.WithLabelValues("store").Add(float64(len(batch)))
+		log.Printf("failed to store %d syslog entries: %v", len(batch), err)
+		return
+	}
+	r.stored.Add(float64(len(batch)))
+}
+
+// loadDevices refreshes the sender → device lookup once it is older than
+// deviceCacheTTL.
+func (r *Receiver) loadDevices() {
+	if time.Since(r.loadedAt) < deviceCacheTTL {
+		return
+	}
+	var devices []model.Device
+	if err := r.db.Select("id, name, ip_address").Find(&devices).Error; err != nil {
+		log.Printf("syslog receiver: failed to load devices: %v", err)
+		return
+	}
+	r.byIP = make(map[string]uint, len(devices))
+	r.byName = make(map[string]uint, len(devices))
+	for _, d := range devices {
+		if d.IPAddress != "" {
+			r.byIP[d.IPAddress] = d.ID
+		}
+		if d.Name != "" {
+			r.byName[strings.ToLower(d.Name)] = d.ID
+		}
+	}
+	r.loadedAt = time.Now()
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (r *Receiver) Describe(ch chan<- *prometheus.Desc) {
+	r.received.Describe(ch)
+	r.dropped.Describe(ch)
+	r.stored.Describe(ch)
+	r.unmatched.Describe(ch)
+}
+
+func (r *Receiver) Collect(ch chan<- prometheus.Metric) {
+	r.received.Collect(ch)
+	r.dropped.Collect(ch)
+	r.stored.Collect(ch)
+	r.unmatched.Collect(ch)
+}
@@ -0,0 +1,253 @@
+package syslog
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReadFrame(t *testing.T) {
+	long := "<13>" + strings.Repeat("x", maxMessageSize+100)
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr error // error after the last frame; nil means io.EOF
+	}{
+		{
+			name:  "octet counted",
+			input: "11 <13>hello a",
+			want:  []string{"<13>hello a"},
+		},
+		{
+			name:  "octet counted, back to back",
+			input: "11 <13>hello a12 <13>hello bb",
+			want:  []string{"<13>hello a", "<13>hello bb"},
+		},
+		{
+			name:  "octet counted with embedded newlines",
+			input: "20 <13>multi\nline\nentry15 <13>next\nframe.",
+			want:  []string{"<13>multi\nline\nentry", "<13>next\nframe."},
+		},
+		{
+			name:  "newline delimited",
+			input: "<13>first\n<13>second\n",
+			want:  []string{"<13>first\n", "<13>second\n"},
+		},
+		{
+			name:  "newline delimited without final newline",
+			input: "<13>first\n<13>last",
+			want:  []string{"<13>first\n", "<13>last"},
+		},
+		{
+			name:  "mixed framing",
+			input: "<13>plain\n9 <13>count<13>plain again\n",
+			want:  []string{"<13>plain\n", "<13>count", "<13>plain again\n"},
+		},
+		{
+			name:    "short octet counted frame",
+			input:   "50 <13>cut off",
+			want:    []string{"<13>cut off"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "octet count over the limit",
+			input:   "99999999 <13>x",
+			wantErr: errors.New("invalid octet count"),
+		},
+		{
+			name:    "octet count without space",
+			input:   "12",
+			wantErr: io.EOF,
+		},
+		{
+			name:  "oversized line keeps its start",
+			input: long + "\n<13>next\n",
+			want:  []string{long[:maxMessageSize], "<13>next\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(strings.NewReader(tt.input), maxMessageSize)
+			var got []string
+			var err error
+			for {
+				var msg []byte
+				msg, err = readFrame(br)
+				if len(msg) > 0 {
+					got = append(got, string(msg))
+				}
+				if err != nil {
+					break
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("frames = %q, want %q", truncateAll(got), truncateAll(tt.want))
+			}
+			wantErr := tt.wantErr
+			if wantErr == nil {
+				wantErr = io.EOF
+			}
+			if err == nil || (!errors.Is(err, wantErr) && err.Error() != wantErr.Error()) {
+				t.Errorf("error = %v, want %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func truncateAll(frames []string) []string {
+	out := make([]string, len(frames))
+	for i, f := range frames {
+		out[i] = truncate(f, 40)
+	}
+	return out
+}
+
+// startListeners opens loopback listeners on r without the writer, so
+// tests read the parsed entries from the queue.
+func startListeners(t *testing.T, r *Receiver) {
+	t.Helper()
+	var err error
+	if r.udp, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if r.tcp, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	r.wg.Add(2)
+	go r.serveUDP()
+	go r.serveTCP()
+	t.Cleanup(func() {
+		r.udp.Close()
+		r.tcp.Close()
+		r.connMu.Lock()
+		for c := range r.conns {
+			c.Close()
+		}
+		r.connMu.Unlock()
+		r.wg.Wait()
+	})
+}
+
+func nextEntry(t *testing.T, r *Receiver) model.DeviceLog {
+	t.Helper()
+	select {
+	case e := <-r.queue:
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no entry received")
+		return model.DeviceLog{}
+	}
+}
+
+func TestReceiverTCP(t *testing.T) {
+	r := NewReceiver(nil, Options{})
+	startListeners(t, r)
+
+	conn, err := net.Dial("tcp", r.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "<30>Oct 19 10:01:02 gw-01 dnsmasq[812]: plain\n"+
+		"not syslog\n"+
+		"68 <165>1 2026-10-19T10:14:15Z gw-01 dropbear 1234 - - counted\nand more")
+
+	e := nextEntry(t, r)
+	if e.Source != "syslog" || e.SourceIP != "127.0.0.1" || e.Hostname != "gw-01" || e.Tag != "dnsmasq" || e.PID != "812" || e.Message != "plain" || e.Severity != 6 {
+		t.Errorf("first entry = %+v", e)
+	}
+	e = nextEntry(t, r)
+	if e.Tag != "dropbear" || e.Facility != 20 || e.Severity != 5 || e.Message != "counted\nand more" ||
+		!e.LoggedAt.Equal(time.Date(2026, 10, 19, 10, 14, 15, 0, time.UTC)) {
+		t.Errorf("second entry = %+v", e)
+	}
+	if got := counterValue(t, r.dropped.WithLabelValues("parse")); got != 1 {
+		t.Errorf("parse drops = %v, want 1", got)
+	}
+}
+
+func TestReceiverTCPInvalidOctetCount(t *testing.T) {
+	r := NewReceiver(nil, Options{})
+	startListeners(t, r)
+
+	conn, err := net.Dial("tcp", r.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "99999999 <13>x")
+
+	// The receiver gives up on the stream and closes it
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read after an invalid frame = %v, want EOF", err)
+	}
+	select {
+	case e := <-r.queue:
+		t.Errorf("entry queued from an invalid frame: %+v", e)
+	default:
+	}
+}
+
+func TestReceiverUDP(t *testing.T) {
+	r := NewReceiver(nil, Options{})
+	startListeners(t, r)
+
+	conn, err := net.Dial("udp", r.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// One message per datagram, newlines included
+	io.WriteString(conn, "<11>netifd: first\nsecond line\n")
+
+	e := nextEntry(t, r)
+	if e.Tag != "netifd" || e.Severity != 3 || e.Message != "first\nsecond line" || e.SourceIP != "127.0.0.1" {
+		t.Errorf("entry = %+v", e)
+	}
+}
+
+func TestReceiverQueueFull(t *testing.T) {
+	r := NewReceiver(nil, Options{QueueSize: 1})
+	r.handle([]byte("<13>one"), "10.0.0.1")
+	r.handle([]byte("<13>two"), "10.0.0.1")
+	r.handle([]byte("garbage"), "10.0.0.1")
+
+	if e := <-r.queue; e.Message != "one" {
+		t.Errorf("queued %q, want the first message", e.Message)
+	}
+	if got := counterValue(t, r.dropped.WithLabelValues("queue_full")); got != 1 {
+		t.Errorf("queue_full drops = %v, want 1", got)
+	}
+	if got := counterValue(t, r.dropped.WithLabelValues("parse")); got != 1 {
+		t.Errorf("parse drops = %v, want 1", got)
+	}
+}
+
+func TestDeviceLogTruncates(t *testing.T) {
+	m := Message{Hostname: strings.Repeat("h", 300), AppName: strings.Repeat("a", 100), ProcID: strings.Repeat("1", 40), Text: strings.Repeat("t", maxTextLength+1)}
+	e := m.DeviceLog(7, "syslog", "10.0.0.1", time.Now())
+	if len(e.Hostname) != 255 || len(e.Tag) != 64 || len(e.PID) != 32 || len(e.Message) != maxTextLength || e.DeviceID != 7 {
+		t.Errorf("DeviceLog() lengths = %d/%d/%d/%d", len(e.Hostname), len(e.Tag), len(e.PID), len(e.Message))
+	}
+}
+
+// counterValue reads the value of a counter through a registry.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil || len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("gather counter: %v", err)
+	}
+	return families[0].GetMetric()[0].GetCounter().GetValue()
+}
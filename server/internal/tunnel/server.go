@@ -0,0 +1,563 @@
+// Package tunnel runs the reverse-tunnel endpoint that agents behind NAT dial
+// out to. An agent connects with dropbear's dbclient, authenticates with the
+// key it registered and requests remote forwards of device-local ports; the
+// server reaches those ports by opening forwarded-tcpip channels back over
+// the agent's connection.
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/model"
+	"github.com/nexusgate/nexusgate/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// Ports are the device-local ports an agent may forward.
+var Ports = []int{22, 80, 443}
+
+// ErrNotConnected is returned by Dial when the device has no tunnel
+// forwarding the requested port.
+var ErrNotConnected = errors.New("device tunnel not connected")
+
+// Options configures the server.
+type Options struct {
+	Addr        string        // listen address, e.g. ":2222"
+	PublicAddr  string        // host:port agents dial, sent in tunnel_open
+	HostKeyFile string        // ed25519 host key, generated on first start
+	IdleTimeout time.Duration // close tunnels without open channels after this long
+
+	// Server ports handed out to sessions, and the address they listen on
+	SessionPortMin  int
+	SessionPortMax  int
+	SessionBindAddr string
+}
+
+func (o *Options) setDefaults() {
+	if o.HostKeyFile == "" {
+		o.HostKeyFile = "./data/tunnel_host_ed25519"
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 10 * time.Minute
+	}
+	if o.SessionPortMin <= 0 || o.SessionPortMax < o.SessionPortMin {
+		o.SessionPortMin, o.SessionPortMax = 20000, 20099
+	}
+}
+
+// agentConn is the SSH connection of one agent.
+type agentConn struct {
+	conn        *ssh.ServerConn
+	forwards    map[uint32]string // device port -> bind address the agent requested
+	channels    int
+	lastActive  time.Time
+	connectedAt time.Time
+}
+
+// Server accepts agent connections and dials device ports through them.
+type Server struct {
+	db       *gorm.DB
+	opts     Options
+	config   *ssh.ServerConfig
+	listener net.Listener
+	done     chan struct{}
+
+	mu        sync.Mutex
+	agents    map[string]*agentConn // by device MAC
+	changed   chan struct{}         // closed and replaced whenever agents change
+	exposures map[uint]*Exposure    // by session ID
+
+	connected prometheus.GaugeFunc
+	dials     *prometheus.CounterVec
+	sessions  prometheus.GaugeFunc
+	accepted  *prometheus.CounterVec
+}
+
+// NewServer loads (or creates) the host key; Start opens the listener.
+func NewServer(db *gorm.DB, opts Options) (*Server, error) {
+	opts.setDefaults()
+	signer, err := loadHostKey(opts.HostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		db:        db,
+		opts:      opts,
+		done:      make(chan struct{}),
+		agents:    make(map[string]*agentConn),
+		changed:   make(chan struct{}),
+		exposures: make(map[uint]*Exposure),
+		dials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nexusgate_tunnel_dials_total", Help: "Connections to device ports through agent tunnels, by result",
+		}, []string{"result"}),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "nexusgate_tunnel_session_connections_total", Help: "Client connections to tunnel session ports, by result (relayed, denied, failed)",
+		}, []string{"result"}),
+	}
+	s.connected = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nexusgate_tunnel_connected_agents", Help: "Agents with an open reverse tunnel",
+	}, func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.agents))
+	})
+	s.sessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "nexusgate_tunnel_sessions_active", Help: "Tunnel sessions with a listening server port",
+	}, func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.exposures))
+	})
+	for _, r := range []string{"ok", "not_connected", "failed"} {
+		s.dials.WithLabelValues(r)
+	}
+	for _, r := range []string{"relayed", "denied", "failed"} {
+		s.accepted.WithLabelValues(r)
+	}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	s.config.AddHostKey(signer)
+	return s, nil
+}
+
+// loadHostKey reads the host key, generating an ed25519 key if the file
+// does not exist.
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "nexusgate-tunnel")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("tunnel: generated host key %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel host key %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// User is the SSH user name an agent logs in as: its MAC without colons.
+func User(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(mac, ":", ""))
+}
+
+// authenticate accepts the key the device registered with.
+func (s *Server) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var device model.Device
+	if err := s.db.Where("REPLACE(LOWER(mac), ':', '') = ?", meta.User()).First(&device).Error; err != nil {
+		return nil, fmt.Errorf("unknown device %q", meta.User())
+	}
+	registered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(device.TunnelKey))
+	if err != nil || !bytes.Equal(registered.Marshal(), key.Marshal()) {
+		return nil, fmt.Errorf("key not registered for device %q", meta.User())
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"mac": device.MAC}}, nil
+}
+
+// Start opens the listener and serves agents until Stop.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("tunnel listen %s: %w", s.opts.Addr, err)
+	}
+	s.listener = l
+	log.Printf("tunnel: listening on %s", l.Addr())
+
+	// Session listeners do not survive a restart
+	now := time.Now()
+	s.db.Model(&model.TunnelSession{}).Where("status = ?", model.TunnelSessionActive).
+		Updates(map[string]any{"status": model.TunnelSessionClosed, "close_reason": CloseShutdown, "closed_at": &now})
+
+	go s.accept()
+	go s.reapIdle()
+	return nil
+}
+
+// Stop closes the listener, all sessions and all agent connections.
+func (s *Server) Stop() {
+	close(s.done)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, e := range s.Exposures() {
+		e.Close(CloseShutdown)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.agents {
+		a.conn.Close()
+	}
+}
+
+// PublicAddr is the address agents are told to dial.
+func (s *Server) PublicAddr() string {
+	return s.opts.PublicAddr
+}
+
+func (s *Server) accept() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Printf("tunnel: accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.serve(nc)
+	}
+}
+
+func (s *Server) serve(nc net.Conn) {
+	nc.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		log.Printf("tunnel: handshake from %s: %v", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+	nc.SetDeadline(time.Time{})
+	mac := conn.Permissions.Extensions["mac"]
+	now := time.Now()
+	a := &agentConn{conn: conn, forwards: make(map[uint32]string), lastActive: now, connectedAt: now}
+
+	s.mu.Lock()
+	if old := s.agents[mac]; old != nil {
+		old.conn.Close()
+	}
+	s.agents[mac] = a
+	s.notifyLocked()
+	s.mu.Unlock()
+	log.Printf("tunnel: device %s connected from %s", mac, conn.RemoteAddr())
+
+	// Agents only forward ports; they have no business opening channels.
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "channels are opened by the server")
+		}
+	}()
+	for req := range reqs {
+		s.handleRequest(a, req)
+	}
+
+	s.mu.Lock()
+	if s.agents[mac] == a {
+		delete(s.agents, mac)
+		s.notifyLocked()
+	}
+	s.mu.Unlock()
+	log.Printf("tunnel: device %s disconnected", mac)
+}
+
+// forwardRequest is the payload of tcpip-forward and cancel-tcpip-forward
+// (RFC 4254 section 7.1).
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+func (s *Server) handleRequest(a *agentConn, req *ssh.Request) {
+	switch req.Type {
+	case "tcpip-forward", "cancel-tcpip-forward":
+		var fwd forwardRequest
+		if err := ssh.Unmarshal(req.Payload, &fwd); err != nil || !allowedPort(fwd.Port) {
+			req.Reply(false, nil)
+			return
+		}
+		s.mu.Lock()
+		if req.Type == "tcpip-forward" {
+			a.forwards[fwd.Port] = fwd.Addr
+		} else {
+			delete(a.forwards, fwd.Port)
+		}
+		s.notifyLocked()
+		s.mu.Unlock()
+		req.Reply(true, nil)
+	default:
+		// keepalive@openssh.com and friends: any reply will do
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func allowedPort(port uint32) bool {
+	for _, p := range Ports {
+		if uint32(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// reapIdle closes tunnels that carried no channel for IdleTimeout and have
+// no session exposing their ports, which makes the agent's dbclient exit.
+func (s *Server) reapIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		exposed := make(map[string]bool, len(s.exposures))
+		for _, e := range s.exposures {
+			exposed[e.MAC] = true
+		}
+		for mac, a := range s.agents {
+			if a.channels == 0 && !exposed[mac] && time.Since(a.lastActive) > s.opts.IdleTimeout {
+				log.Printf("tunnel: closing idle tunnel of device %s", mac)
+				a.conn.Close()
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Connected reports whether the device's tunnel is up and forwards the
+// port; port 0 matches any tunnel.
+func (s *Server) Connected(mac string, port int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwardsLocked(mac, port)
+}
+
+func (s *Server) forwardsLocked(mac string, port int) bool {
+	a := s.agents[mac]
+	if a == nil {
+		return false
+	}
+	if port == 0 {
+		return true
+	}
+	_, ok := a.forwards[uint32(port)]
+	return ok
+}
+
+// Info describes an open tunnel.
+type Info struct {
+	MAC         string    `json:"mac"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Forwards    []int     `json:"forwards"`
+	Channels    int       `json:"channels"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastActive  time.Time `json:"last_active"`
+}
+
+func (a *agentConn) info(mac string) Info {
+	forwards := make([]int, 0, len(a.forwards))
+	for p := range a.forwards {
+		forwards = append(forwards, int(p))
+	}
+	sort.Ints(forwards)
+	return Info{
+		MAC:         mac,
+		RemoteAddr:  a.conn.RemoteAddr().String(),
+		Forwards:    forwards,
+		Channels:    a.channels,
+		ConnectedAt: a.connectedAt,
+		LastActive:  a.lastActive,
+	}
+}
+
+// Tunnel returns the tunnel of a device, if it is connected.
+func (s *Server) Tunnel(mac string) (Info, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.agents[mac]
+	if a == nil {
+		return Info{}, false
+	}
+	return a.info(mac), true
+}
+
+// Tunnels lists the open tunnels.
+func (s *Server) Tunnels() []Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Info, 0, len(s.agents))
+	for mac, a := range s.agents {
+		out = append(out, a.info(mac))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+// Disconnect closes the device's tunnel; the agent's dbclient exits.
+func (s *Server) Disconnect(mac string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.agents[mac]
+	if a == nil {
+		return false
+	}
+	a.conn.Close()
+	return true
+}
+
+// Open asks the device's agent to open its tunnel with the tunnel_open
+// command, unless it is already up, and waits until it forwards port (any
+// port for 0).
+func (s *Server) Open(ctx context.Context, client pahomqtt.Client, device model.Device, port int) error {
+	if s.Connected(device.MAC, port) {
+		return nil
+	}
+	if s.opts.PublicAddr == "" {
+		return errors.New("tunnel public address not configured")
+	}
+	host, portStr, err := net.SplitHostPort(s.opts.PublicAddr)
+	if err != nil {
+		return fmt.Errorf("tunnel public address: %w", err)
+	}
+	sshPort, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("tunnel public address: invalid port %q", portStr)
+	}
+	if err := protocol.PublishCommand(client, device, "tunnel_open", map[string]any{
+		"host":     host,
+		"port":     sshPort,
+		"user":     User(device.MAC),
+		"forwards": Ports,
+	}); err != nil {
+		return err
+	}
+	return s.wait(ctx, device.MAC, port)
+}
+
+// wait blocks until the device's tunnel forwards port.
+func (s *Server) wait(ctx context.Context, mac string, port int) error {
+	for {
+		s.mu.Lock()
+		if s.forwardsLocked(mac, port) {
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for device tunnel: %w", ctx.Err())
+		case <-changed:
+		}
+	}
+}
+
+// Dial connects to a device-local port through the device's tunnel.
+func (s *Server) Dial(mac string, port int) (net.Conn, error) {
+	s.mu.Lock()
+	a := s.agents[mac]
+	var addr string
+	ok := false
+	if a != nil {
+		addr, ok = a.forwards[uint32(port)]
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.dials.WithLabelValues("not_connected").Inc()
+		return nil, ErrNotConnected
+	}
+
+	// RFC 4254 section 7.2: the connected address must match the forward
+	// the agent requested so that dbclient finds the local target.
+	payload := ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{addr, uint32(port), "127.0.0.1", 0})
+	ch, reqs, err := a.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		s.dials.WithLabelValues("failed").Inc()
+		return nil, fmt.Errorf("open tunnel channel: %w", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	s.dials.WithLabelValues("ok").Inc()
+
+	s.mu.Lock()
+	a.channels++
+	a.lastActive = time.Now()
+	s.mu.Unlock()
+	return &channelConn{Channel: ch, agent: a, server: s}, nil
+}
+
+// channelConn adapts a forwarded-tcpip channel to net.Conn. Deadlines are
+// not supported; callers bound their work by closing the connection.
+type channelConn struct {
+	ssh.Channel
+	agent  *agentConn
+	server *Server
+	once   sync.Once
+}
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		c.server.mu.Lock()
+		c.agent.channels--
+		c.agent.lastActive = time.Now()
+		c.server.mu.Unlock()
+	})
+	return c.Channel.Close()
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.agent.conn.LocalAddr() }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.agent.conn.RemoteAddr() }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (s *Server) Describe(ch chan<- *prometheus.Desc) {
+	s.connected.Describe(ch)
+	s.dials.Describe(ch)
+	s.sessions.Describe(ch)
+	s.accepted.Describe(ch)
+}
+
+func (s *Server) Collect(ch chan<- prometheus.Metric) {
+	s.connected.Collect(ch)
+	s.dials.Collect(ch)
+	s.sessions.Collect(ch)
+	s.accepted.Collect(ch)
+}
@@ -0,0 +1,253 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nexusgate/nexusgate/internal/model"
+)
+
+// Reasons a session ends.
+const (
+	CloseRequested    = "closed"
+	CloseExpired      = "expired"
+	CloseTunnelClosed = "tunnel_closed"
+	CloseShutdown     = "shutdown"
+)
+
+// ErrNoFreePort is returned by Expose when every session port is in use.
+var ErrNoFreePort = errors.New("no free tunnel session port")
+
+// ErrNotAllowed is reported to ExposeOptions.OnConnect for connections from
+// an address other than the session's.
+var ErrNotAllowed = errors.New("client address not allowed for this session")
+
+// ExposeOptions describes a session.
+type ExposeOptions struct {
+	SessionID uint
+	Device    model.Device
+	Port      int    // device-local port
+	AllowedIP string // only connections from this address are relayed
+	TTL       time.Duration
+
+	// Client reopens the tunnel with tunnel_open when a connection arrives
+	// while the agent is disconnected.
+	Client pahomqtt.Client
+
+	// OnConnect is called for every client connection, with a nil error
+	// once it is relayed. OnClose is called once when the session ends.
+	OnConnect func(e *Exposure, remoteIP string, err error)
+	OnClose   func(e *Exposure, reason string)
+}
+
+// Exposure relays a server port to a device-local port through the device's
+// tunnel for the lifetime of a session.
+type Exposure struct {
+	SessionID  uint
+	MAC        string
+	Port       int
+	ListenPort int
+	AllowedIP  string
+	ExpiresAt  time.Time
+
+	server   *Server
+	opts     ExposeOptions
+	listener net.Listener
+	once     sync.Once
+
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{} // closed by Close
+	conns map[net.Conn]struct{}
+
+	connections atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+}
+
+// Stats returns the relayed connections and bytes (client to device, device
+// to client).
+func (e *Exposure) Stats() (connections, bytesIn, bytesOut int64) {
+	return e.connections.Load(), e.bytesIn.Load(), e.bytesOut.Load()
+}
+
+// Expose reserves a session port and starts relaying it.
+func (s *Server) Expose(opts ExposeOptions) (*Exposure, error) {
+	if !allowedPort(uint32(opts.Port)) {
+		return nil, fmt.Errorf("port %d cannot be forwarded (allowed: %v)", opts.Port, Ports)
+	}
+	e := &Exposure{
+		SessionID: opts.SessionID,
+		MAC:       opts.Device.MAC,
+		Port:      opts.Port,
+		AllowedIP: opts.AllowedIP,
+		ExpiresAt: time.Now().Add(opts.TTL),
+		server:    s,
+		opts:      opts,
+		done:      make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used := make(map[int]bool, len(s.exposures))
+	for _, x := range s.exposures {
+		used[x.ListenPort] = true
+	}
+	for p := s.opts.SessionPortMin; p <= s.opts.SessionPortMax && e.listener == nil; p++ {
+		if used[p] {
+			continue
+		}
+		if l, err := net.Listen("tcp", net.JoinHostPort(s.opts.SessionBindAddr, strconv.Itoa(p))); err == nil {
+			e.listener, e.ListenPort = l, p
+		}
+	}
+	if e.listener == nil {
+		return nil, ErrNoFreePort
+	}
+	s.exposures[e.SessionID] = e
+	e.mu.Lock()
+	e.timer = time.AfterFunc(opts.TTL, func() { e.Close(CloseExpired) })
+	e.mu.Unlock()
+	go e.accept()
+	log.Printf("tunnel: session %d exposes port %d of device %s on %d", e.SessionID, e.Port, e.MAC, e.ListenPort)
+	return e, nil
+}
+
+// Exposures lists the active sessions.
+func (s *Server) Exposures() []*Exposure {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*Exposure, 0, len(s.exposures))
+	for _, e := range s.exposures {
+		out = append(out, e)
+	}
+	return out
+}
+
+// Exposure returns an active session.
+func (s *Server) Exposure(sessionID uint) (*Exposure, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.exposures[sessionID]
+	return e, ok
+}
+
+// Close stops the session and drops its connections.
+func (e *Exposure) Close(reason string) {
+	e.once.Do(func() {
+		e.listener.Close()
+		e.mu.Lock()
+		e.timer.Stop()
+		close(e.done)
+		for c := range e.conns {
+			c.Close()
+		}
+		e.mu.Unlock()
+
+		e.server.mu.Lock()
+		delete(e.server.exposures, e.SessionID)
+		e.server.mu.Unlock()
+		log.Printf("tunnel: session %d closed (%s)", e.SessionID, reason)
+		if e.opts.OnClose != nil {
+			e.opts.OnClose(e, reason)
+		}
+	})
+}
+
+func (e *Exposure) accept() {
+	for {
+		nc, err := e.listener.Accept()
+		if err != nil {
+			return
+		}
+		ip, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+		if e.AllowedIP != "" && ip != e.AllowedIP {
+			nc.Close()
+			e.server.accepted.WithLabelValues("denied").Inc()
+			e.connected(ip, ErrNotAllowed)
+			continue
+		}
+		go e.relay(nc, ip)
+	}
+}
+
+func (e *Exposure) connected(ip string, err error) {
+	if e.opts.OnConnect != nil {
+		e.opts.OnConnect(e, ip, err)
+	}
+}
+
+// track registers a connection to drop on Close; false if already closed.
+func (e *Exposure) track(c net.Conn) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.done:
+		return false
+	default:
+	}
+	e.conns[c] = struct{}{}
+	return true
+}
+
+func (e *Exposure) untrack(c net.Conn) {
+	e.mu.Lock()
+	delete(e.conns, c)
+	e.mu.Unlock()
+	c.Close()
+}
+
+func (e *Exposure) relay(client net.Conn, ip string) {
+	if !e.track(client) {
+		client.Close()
+		return
+	}
+	defer e.untrack(client)
+
+	if !e.server.Connected(e.MAC, e.Port) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := e.server.Open(ctx, e.opts.Client, e.opts.Device, e.Port)
+		cancel()
+		if err != nil {
+			e.server.accepted.WithLabelValues("failed").Inc()
+			e.connected(ip, err)
+			return
+		}
+	}
+	device, err := e.server.Dial(e.MAC, e.Port)
+	if err != nil {
+		e.server.accepted.WithLabelValues("failed").Inc()
+		e.connected(ip, err)
+		return
+	}
+	if !e.track(device) {
+		device.Close()
+		return
+	}
+	defer e.untrack(device)
+	e.server.accepted.WithLabelValues("relayed").Inc()
+	e.connections.Add(1)
+	e.connected(ip, nil)
+
+	done := make(chan struct{})
+	go func() {
+		n, _ := io.Copy(device, client)
+		e.bytesIn.Add(n)
+		device.Close()
+		close(done)
+	}()
+	n, _ := io.Copy(client, device)
+	e.bytesOut.Add(n)
+	client.Close()
+	<-done
+}
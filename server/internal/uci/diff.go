@@ -0,0 +1,165 @@
+package uci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Change ops.
+const (
+	OpAdd     = "add"     // section added
+	OpDelete  = "delete"  // section removed
+	OpSet     = "set"     // option added or changed
+	OpUnset   = "unset"   // option removed
+	OpReorder = "reorder" // sections of a type in a different order
+)
+
+// Change is one difference between two versions of a package.
+type Change struct {
+	Op      string   `json:"op"`
+	Section string   `json:"section"` // firewall.lan, firewall.@rule[2]; firewall.@rule for reorder
+	Type    string   `json:"type"`
+	Option  string   `json:"option,omitempty"`
+	Old     []string `json:"old,omitempty"` // option values; section keys for reorder
+	New     []string `json:"new,omitempty"`
+}
+
+// String formats the change the way `uci changes` does.
+func (c Change) String() string {
+	switch c.Op {
+	case OpAdd:
+		return c.Section + "=" + c.Type
+	case OpDelete:
+		return "-" + c.Section
+	case OpSet:
+		quoted := make([]string, len(c.New))
+		for i, v := range c.New {
+			quoted[i] = Quote(v)
+		}
+		return c.Section + "." + c.Option + "=" + strings.Join(quoted, " ")
+	case OpUnset:
+		return "-" + c.Section + "." + c.Option
+	case OpReorder:
+		return fmt.Sprintf("~%s: %s -> %s", c.Section, strings.Join(c.Old, " "), strings.Join(c.New, " "))
+	}
+	return c.Op + " " + c.Section
+}
+
+// Diff compares two versions of a package semantically: sections are
+// matched by name, anonymous ones by their name option (firewall rules and
+// zones) or else by position among their type, and options are compared
+// by value regardless of their order or of option versus single-value
+// list. old may be nil. Added sections are followed by a set per option.
+func Diff(old, new *Package) []Change {
+	if old == nil {
+		old = &Package{Name: new.Name}
+	}
+	oldKeys, newKeys := sectionKeys(old), sectionKeys(new)
+	oldByKey := make(map[string]*Section, len(old.Sections))
+	for i, s := range old.Sections {
+		oldByKey[oldKeys[i]] = s
+	}
+	newByKey := make(map[string]*Section, len(new.Sections))
+	for i, s := range new.Sections {
+		newByKey[newKeys[i]] = s
+	}
+
+	var changes []Change
+	for i, s := range old.Sections {
+		if n := newByKey[oldKeys[i]]; n == nil || n.Type != s.Type {
+			changes = append(changes, Change{Op: OpDelete, Section: old.Path(s), Type: s.Type})
+		}
+	}
+	for i, s := range new.Sections {
+		path := new.Path(s)
+		prev := oldByKey[newKeys[i]]
+		if prev == nil || prev.Type != s.Type {
+			changes = append(changes, Change{Op: OpAdd, Section: path, Type: s.Type})
+			prev = &Section{}
+		}
+		for _, o := range prev.Options {
+			if s.Option(o.Name) == nil {
+				changes = append(changes, Change{Op: OpUnset, Section: path, Type: s.Type, Option: o.Name, Old: o.Values})
+			}
+		}
+		for _, o := range s.Options {
+			was := prev.Option(o.Name)
+			if was == nil {
+				changes = append(changes, Change{Op: OpSet, Section: path, Type: s.Type, Option: o.Name, New: o.Values})
+			} else if !equalValues(was.Values, o.Values) {
+				changes = append(changes, Change{Op: OpSet, Section: path, Type: s.Type, Option: o.Name, Old: was.Values, New: o.Values})
+			}
+		}
+	}
+
+	// Order matters for rules, so report sections kept in both versions
+	// that moved relative to each other.
+	for _, typ := range types(new) {
+		before := commonOrder(old, oldKeys, typ, newByKey)
+		after := commonOrder(new, newKeys, typ, oldByKey)
+		if !equalValues(before, after) {
+			changes = append(changes, Change{Op: OpReorder, Section: new.Name + ".@" + typ, Type: typ, Old: before, New: after})
+		}
+	}
+	return changes
+}
+
+// sectionKeys returns the key each section is matched on.
+func sectionKeys(p *Package) []string {
+	keys := make([]string, len(p.Sections))
+	seen := map[string]int{}
+	for i, s := range p.Sections {
+		switch name := s.Get("name"); {
+		case s.Name != "":
+			keys[i] = s.Name
+		case name != "":
+			keys[i] = "@" + s.Type + "[name=" + name + "]"
+		default:
+			keys[i] = fmt.Sprintf("@%s[%d]", s.Type, seen[s.Type])
+			seen[s.Type]++
+		}
+		// Repeated keys (two rules of one name) fall back to position.
+		for j := 0; j < i; j++ {
+			if keys[j] == keys[i] {
+				keys[i] = fmt.Sprintf("%s#%d", keys[i], i)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+func types(p *Package) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, s := range p.Sections {
+		if !seen[s.Type] {
+			seen[s.Type] = true
+			out = append(out, s.Type)
+		}
+	}
+	return out
+}
+
+// commonOrder lists the keys of p's sections of a type that other has too.
+func commonOrder(p *Package, keys []string, typ string, other map[string]*Section) []string {
+	var out []string
+	for i, s := range p.Sections {
+		if o := other[keys[i]]; s.Type == typ && o != nil && o.Type == typ {
+			out = append(out, keys[i])
+		}
+	}
+	return out
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+package uci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// MaxInput caps what Parse reads; a full `uci export` of a router is a few
+// hundred KiB at most.
+const MaxInput = 4 << 20
+
+var (
+	// Names as accepted by libuci: packages and section types may contain
+	// '-', section and option names may not.
+	packagePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	typePattern    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	namePattern    = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// SyntaxError reports malformed input.
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("uci: line %d: %s", e.Line, e.Msg)
+}
+
+// Parse reads the packages of `uci export` output (or of config files
+// prefixed with their `package` line). Values follow the shell-like quoting
+// libuci uses: 'single quoted', "double quoted" with backslash escapes, and
+// bare words, concatenated when adjacent. uci export writes a quote inside
+// a value as
+//
+//	option name 'it'\''s'
+//
+// which reads back as it's. Setting an option twice keeps the last value;
+// `list` appends.
+func Parse(r io.Reader) ([]*Package, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxInput+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxInput {
+		return nil, errors.New("uci: input too large")
+	}
+
+	p := &parser{src: string(data), line: 1}
+	var pkgs []*Package
+	var pkg *Package
+	var sec *Section
+	for {
+		line := p.line
+		words, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		if words == nil {
+			return pkgs, nil
+		}
+		if len(words) == 0 {
+			continue
+		}
+		fail := func(format string, args ...any) ([]*Package, error) {
+			return nil, &SyntaxError{Line: line, Msg: fmt.Sprintf(format, args...)}
+		}
+
+		switch words[0] {
+		case "package":
+			if len(words) != 2 || !packagePattern.MatchString(words[1]) {
+				return fail("expected package <name>")
+			}
+			if Find(pkgs, words[1]) != nil {
+				return fail("package %s appears twice", words[1])
+			}
+			pkg = &Package{Name: words[1]}
+			pkgs = append(pkgs, pkg)
+			sec = nil
+		case "config":
+			if pkg == nil {
+				return fail("config before package")
+			}
+			if len(words) < 2 || len(words) > 3 || !typePattern.MatchString(words[1]) {
+				return fail("expected config <type> [<name>]")
+			}
+			sec = &Section{Type: words[1]}
+			if len(words) == 3 {
+				if !namePattern.MatchString(words[2]) {
+					return fail("invalid section name %q", words[2])
+				}
+				if pkg.Section(words[2]) != nil {
+					return fail("section %s.%s appears twice", pkg.Name, words[2])
+				}
+				sec.Name = words[2]
+			}
+			pkg.Sections = append(pkg.Sections, sec)
+		case "option", "list":
+			if sec == nil {
+				return fail("%s outside of a config section", words[0])
+			}
+			if len(words) != 3 || !namePattern.MatchString(words[1]) {
+				return fail("expected %s <name> <value>", words[0])
+			}
+			o := sec.Option(words[1])
+			switch {
+			case o == nil:
+				sec.Options = append(sec.Options, &Option{Name: words[1], Values: []string{words[2]}, List: words[0] == "list"})
+			case words[0] == "list":
+				o.Values = append(o.Values, words[2])
+				o.List = true
+			default:
+				o.Values = []string{words[2]}
+				o.List = false
+			}
+		default:
+			return fail("unknown keyword %q", words[0])
+		}
+	}
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+}
+
+// statement returns the words of the next line, an empty slice for blank
+// and comment lines and nil at the end of input. Quoted values may span
+// lines.
+func (p *parser) statement() ([]string, error) {
+	if p.pos >= len(p.src) {
+		return nil, nil
+	}
+	words := []string{}
+	for {
+		// Skip blanks between words.
+		for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\r') {
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return words, nil
+		}
+		switch p.src[p.pos] {
+		case '\n':
+			p.pos++
+			p.line++
+			return words, nil
+		case '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		case '\\':
+			if strings.HasPrefix(p.src[p.pos:], "\\\n") {
+				p.pos += 2
+				p.line++
+				continue
+			}
+		}
+		word, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, word)
+	}
+}
+
+// word reads one word made of adjacent quoted and unquoted parts.
+func (p *parser) word() (string, error) {
+	var b strings.Builder
+	start := p.line
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			return b.String(), nil
+		case ch == '\'':
+			end := strings.IndexByte(p.src[p.pos+1:], '\'')
+			if end < 0 {
+				return "", &SyntaxError{Line: start, Msg: "unterminated '"}
+			}
+			part := p.src[p.pos+1 : p.pos+1+end]
+			p.line += strings.Count(part, "\n")
+			b.WriteString(part)
+			p.pos += end + 2
+		case ch == '"':
+			p.pos++
+			for {
+				if p.pos >= len(p.src) {
+					return "", &SyntaxError{Line: start, Msg: `unterminated "`}
+				}
+				ch = p.src[p.pos]
+				if ch == '"' {
+					p.pos++
+					break
+				}
+				if ch == '\\' && p.pos+1 < len(p.src) {
+					p.pos++
+					ch = p.src[p.pos]
+				}
+				if ch == '\n' {
+					p.line++
+				}
+				b.WriteByte(ch)
+				p.pos++
+			}
+		case ch == '\\':
+			p.pos++
+			if p.pos >= len(p.src) {
+				return b.String(), nil
+			}
+			if p.src[p.pos] == '\n' {
+				// Line continuation.
+				p.line++
+			} else {
+				b.WriteByte(p.src[p.pos])
+			}
+			p.pos++
+		default:
+			b.WriteByte(ch)
+			p.pos++
+		}
+	}
+	return b.String(), nil
+}
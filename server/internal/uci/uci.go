@@ -0,0 +1,132 @@
+// Package uci models OpenWrt UCI configuration: packages made of typed,
+// optionally named sections holding options and lists. It parses `uci
+// export` output, renders packages in the form `uci import` reads and
+// compares two versions of a package.
+package uci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Package is one UCI config file, e.g. /etc/config/firewall.
+type Package struct {
+	Name     string
+	Sections []*Section
+}
+
+// Section is a `config <type> ['<name>']` block. Anonymous sections have
+// an empty Name.
+type Section struct {
+	Type    string
+	Name    string
+	Options []*Option // in file order
+}
+
+// Option is an `option` (one value) or a `list` (any number of values).
+type Option struct {
+	Name   string
+	Values []string
+	List   bool
+}
+
+// Find returns the package with the given name, or nil.
+func Find(pkgs []*Package, name string) *Package {
+	for _, p := range pkgs {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Section returns the named section, or nil.
+func (p *Package) Section(name string) *Section {
+	for _, s := range p.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// OfType returns the sections of a type in file order.
+func (p *Package) OfType(typ string) []*Section {
+	var out []*Section
+	for _, s := range p.Sections {
+		if s.Type == typ {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Path names a section the way uci does: firewall.lan for named sections
+// and firewall.@rule[2] for anonymous ones.
+func (p *Package) Path(s *Section) string {
+	if s.Name != "" {
+		return p.Name + "." + s.Name
+	}
+	i := 0
+	for _, o := range p.Sections {
+		if o == s {
+			break
+		}
+		if o.Type == s.Type {
+			i++
+		}
+	}
+	return fmt.Sprintf("%s.@%s[%d]", p.Name, s.Type, i)
+}
+
+// Option returns the option or list with the given name, or nil.
+func (s *Section) Option(name string) *Option {
+	for _, o := range s.Options {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// Get returns the value of an option; for a list, its values joined by
+// spaces.
+func (s *Section) Get(name string) string {
+	o := s.Option(name)
+	if o == nil {
+		return ""
+	}
+	return strings.Join(o.Values, " ")
+}
+
+// Has reports whether the section sets the option or list.
+func (s *Section) Has(name string) bool {
+	return s.Option(name) != nil
+}
+
+// Bool interprets an option the way OpenWrt's config_get_bool does, with
+// fallback when it is unset or not a boolean.
+func (s *Section) Bool(name string, fallback bool) bool {
+	switch strings.ToLower(s.Get(name)) {
+	case "1", "on", "true", "yes", "enabled":
+		return true
+	case "0", "off", "false", "no", "disabled":
+		return false
+	}
+	return fallback
+}
+
+// Values returns the values of a list, or of an option holding a
+// space-separated list (`option network 'lan guest'`), which OpenWrt
+// accepts in place of a list for many settings.
+func (s *Section) Values(name string) []string {
+	o := s.Option(name)
+	if o == nil {
+		return nil
+	}
+	var out []string
+	for _, v := range o.Values {
+		out = append(out, strings.Fields(v)...)
+	}
+	return out
+}
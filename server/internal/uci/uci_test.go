@@ -0,0 +1,179 @@
+package uci
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got with testdata/name, or rewrites the file with
+// -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs (run go test -update to rewrite it):\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// escapingPackage holds values that need quoting in every way a UCI file
+// allows.
+func escapingPackage() *Package {
+	pkg := NewPackage("escaping")
+	pkg.Add("values", "quotes").
+		Set("single", "it's").
+		Set("only_quote", "'").
+		Set("quoted_word", "'quoted'").
+		Set("double", `say "hi"`).
+		Set("mixed", `'"'"`)
+	pkg.Add("values", "shell").
+		Set("dollar", "$HOME ${PATH}").
+		Set("backtick", "`reboot`").
+		Set("semicolon", "a; reboot").
+		Set("backslash", `C:\temp\`).
+		Set("escaped_quote", `\'`).
+		Set("comment", "# not a comment").
+		Set("tabs", "a\tb  c").
+		Set("empty", "").
+		Set("unicode", "办公室 Wi-Fi ✓")
+	pkg.Add("values", "").
+		Append("list", "one", "two words", "it's", " trimmed ", "").
+		Set("option_after_list", "x")
+	pkg.Add("values-with-dash", "")
+	return pkg
+}
+
+func TestRoundTrip(t *testing.T) {
+	pkg := escapingPackage()
+	if err := pkg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	out := pkg.Export()
+	checkGolden(t, "escaping.golden", out)
+
+	pkgs, err := Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(pkgs) != 1 || !reflect.DeepEqual(pkgs[0], pkg) {
+		t.Fatalf("Parse(Export()) =\n%s\nwant\n%s", pkgs[0].Export(), out)
+	}
+	if changes := Diff(pkg, pkgs[0]); len(changes) != 0 {
+		t.Errorf("Diff() after a round trip = %v", changes)
+	}
+	if got := pkgs[0].Section("quotes").Get("single"); got != "it's" {
+		t.Errorf("single = %q", got)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", "''"},
+		{"lan", "'lan'"},
+		{"it's", `'it'\''s'`},
+		{"''", `''\'''\'''`},
+		{`a\b`, `'a\b'`},
+	}
+	for _, tt := range tests {
+		if got := Quote(tt.in); got != tt.want {
+			t.Errorf("Quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := `package network
+
+# comment line
+config interface 'lan'   # trailing comment
+	option proto static
+	option ipaddr "192.168.1.1"
+	option name "say \"hi\" \\ \$x"
+	option concat 'it'\''s'" and "bare
+	option multi 'first
+second'
+	option continued long\
+value
+	list dns '1.1.1.1'
+	list dns 8.8.8.8
+	option proto 'dhcp'
+
+config "device"
+	option name 'br-lan'
+`
+	pkgs, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := &Package{Name: "network", Sections: []*Section{
+		{Type: "interface", Name: "lan", Options: []*Option{
+			{Name: "proto", Values: []string{"dhcp"}},
+			{Name: "ipaddr", Values: []string{"192.168.1.1"}},
+			{Name: "name", Values: []string{`say "hi" \ $x`}},
+			{Name: "concat", Values: []string{"it's and bare"}},
+			{Name: "multi", Values: []string{"first\nsecond"}},
+			{Name: "continued", Values: []string{"longvalue"}},
+			{Name: "dns", Values: []string{"1.1.1.1", "8.8.8.8"}, List: true},
+		}},
+		{Type: "device", Options: []*Option{{Name: "name", Values: []string{"br-lan"}}}},
+	}}
+	if len(pkgs) != 1 || !reflect.DeepEqual(pkgs[0], want) {
+		t.Errorf("Parse() =\n%s\nwant\n%s", pkgs[0].Export(), want.Export())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"config interface lan\n", "uci: line 1: config before package"},
+		{"package net\noption proto static\n", "uci: line 2: option outside of a config section"},
+		{"package net\nconfig interface 'la-n'\n", `uci: line 2: invalid section name "la-n"`},
+		{"package net\nconfig interface lan\nconfig device lan\n", "uci: line 3: section net.lan appears twice"},
+		{"package net\nconfig interface lan\n\toption ipaddr '10.0.0.1\n", "uci: line 3: unterminated '"},
+		{"package net\nconfig interface lan\n\toption name \"x\n", `uci: line 3: unterminated "`},
+		{"package net\nconfig interface lan\n\toption a b c\n", "uci: line 3: expected option <name> <value>"},
+		{"package net\nconfig interface lan\n\tset a b\n", `uci: line 3: unknown keyword "set"`},
+		{"package net\npackage net\n", "uci: line 2: package net appears twice"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(strings.NewReader(tt.input)); err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q) error = %v, want %s", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		pkg  *Package
+		want string
+	}{
+		{&Package{Name: "fire wall"}, `invalid package name "fire wall"`},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "rule", Name: "Allow-SSH"}}}, `firewall: invalid section name "Allow-SSH" (letters, digits and '_' only)`},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "zone", Name: "lan"}, {Type: "zone", Name: "lan"}}}, "firewall: section lan appears twice"},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "rule", Options: []*Option{{Name: "dest-port", Values: []string{"22"}}}}}}, `firewall.@rule[0]: invalid option name "dest-port"`},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "rule", Options: []*Option{{Name: "name", Values: []string{"a", "b"}}}}}}, "firewall.@rule[0].name: an option has exactly one value"},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "rule", Options: []*Option{{Name: "name", Values: []string{"a\nb"}}}}}}, "firewall.@rule[0].name: value contains a line break"},
+		{&Package{Name: "firewall", Sections: []*Section{{Type: "rule", Options: []*Option{{Name: "name", Values: []string{"a\x00"}}}}}}, "firewall.@rule[0].name: value contains a line break"},
+	}
+	for _, tt := range tests {
+		if err := tt.pkg.Validate(); err == nil || err.Error() != tt.want {
+			t.Errorf("Validate() = %v, want %s", err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package uci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewPackage returns an empty package.
+func NewPackage(name string) *Package {
+	return &Package{Name: name}
+}
+
+// Add appends a section; name is empty for an anonymous section.
+func (p *Package) Add(typ, name string) *Section {
+	s := &Section{Type: typ, Name: name}
+	p.Sections = append(p.Sections, s)
+	return s
+}
+
+// Set sets an option, replacing a previous option or list of that name.
+func (s *Section) Set(name, value string) *Section {
+	if o := s.Option(name); o != nil {
+		o.Values = []string{value}
+		o.List = false
+		return s
+	}
+	s.Options = append(s.Options, &Option{Name: name, Values: []string{value}})
+	return s
+}
+
+// Append adds values to a list, turning an option of that name into a
+// list. Empty values are skipped, so that comma-separated model fields can
+// be passed through strings.Split.
+func (s *Section) Append(name string, values ...string) *Section {
+	o := s.Option(name)
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if o == nil {
+			o = &Option{Name: name}
+			s.Options = append(s.Options, o)
+		}
+		o.Values = append(o.Values, v)
+		o.List = true
+	}
+	return s
+}
+
+// Export renders the package as `uci export` prints it, which is what
+// `uci import` reads.
+func (p *Package) Export() string {
+	return "package " + p.Name + "\n\n" + p.File()
+}
+
+// File renders the sections the way /etc/config files are written, without
+// the package line.
+func (p *Package) File() string {
+	var b strings.Builder
+	for _, s := range p.Sections {
+		b.WriteString("config " + s.Type)
+		if s.Name != "" {
+			b.WriteString(" " + Quote(s.Name))
+		}
+		b.WriteString("\n")
+		for _, o := range s.Options {
+			keyword := "option"
+			if o.List {
+				keyword = "list"
+			}
+			for _, v := range o.Values {
+				fmt.Fprintf(&b, "\t%s %s %s\n", keyword, o.Name, Quote(v))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Quote single-quotes a value for a UCI file. A quote inside the value
+// ends the quoted string, is escaped and reopens it, as uci export does.
+func Quote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
+// ValidName reports whether s may name a section or option.
+func ValidName(s string) bool {
+	return namePattern.MatchString(s)
+}
+
+// Validate checks that uci import accepts the package: valid package,
+// type, section and option names, section names used once, and values
+// without line breaks or NUL bytes. Any other character is escaped by
+// Export.
+func (p *Package) Validate() error {
+	if !packagePattern.MatchString(p.Name) {
+		return fmt.Errorf("invalid package name %q", p.Name)
+	}
+	names := map[string]bool{}
+	for _, s := range p.Sections {
+		if !typePattern.MatchString(s.Type) {
+			return fmt.Errorf("%s: invalid section type %q", p.Name, s.Type)
+		}
+		if s.Name != "" {
+			if !namePattern.MatchString(s.Name) {
+				return fmt.Errorf("%s: invalid section name %q (letters, digits and '_' only)", p.Name, s.Name)
+			}
+			if names[s.Name] {
+				return fmt.Errorf("%s: section %s appears twice", p.Name, s.Name)
+			}
+			names[s.Name] = true
+		}
+		for _, o := range s.Options {
+			if !namePattern.MatchString(o.Name) {
+				return fmt.Errorf("%s: invalid option name %q", p.Path(s), o.Name)
+			}
+			if !o.List && len(o.Values) != 1 {
+				return fmt.Errorf("%s.%s: an option has exactly one value", p.Path(s), o.Name)
+			}
+			for _, v := range o.Values {
+				if strings.ContainsAny(v, "\n\r\x00") {
+					return fmt.Errorf("%s.%s: value contains a line break", p.Path(s), o.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
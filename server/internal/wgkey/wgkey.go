@@ -0,0 +1,78 @@
+// Package wgkey generates and parses WireGuard keys: Curve25519 private
+// keys, the public keys derived from them and preshared keys. Keys travel
+// in base64, as wg(8) prints them.
+package wgkey
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Size is the length of every WireGuard key in bytes.
+const Size = 32
+
+// Key is a private, public or preshared key.
+type Key [Size]byte
+
+// ErrInvalid is returned by Parse for anything but 32 bytes in base64.
+var ErrInvalid = errors.New("not a base64 WireGuard key")
+
+// Generate returns a new private key, clamped like wg genkey.
+func Generate() (Key, error) {
+	k, err := random()
+	if err != nil {
+		return Key{}, err
+	}
+	k[0] &= 248
+	k[31] = k[31]&127 | 64
+	return k, nil
+}
+
+// GeneratePreshared returns a new preshared key, like wg genpsk.
+func GeneratePreshared() (Key, error) {
+	return random()
+}
+
+func random() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Parse decodes a base64 key.
+func Parse(s string) (Key, error) {
+	var k Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != Size {
+		return Key{}, ErrInvalid
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// PublicKey derives the public key of a private key, like wg pubkey.
+func (k Key) PublicKey() Key {
+	var pub Key
+	// X25519 only fails for low-order points, which the base point is not.
+	b, _ := curve25519.X25519(k[:], curve25519.Basepoint)
+	copy(pub[:], b)
+	return pub
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// PublicKeyOf derives the base64 public key of a base64 private key.
+func PublicKeyOf(privateKey string) (string, error) {
+	k, err := Parse(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return k.PublicKey().String(), nil
+}
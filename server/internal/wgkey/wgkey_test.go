@@ -0,0 +1,129 @@
+package wgkey
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func fromHex(t *testing.T, s string) Key {
+	t.Helper()
+	var k Key
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != Size {
+		t.Fatalf("bad test key %s", s)
+	}
+	copy(k[:], b)
+	return k
+}
+
+// The X25519 key pairs of RFC 7748, section 6.1.
+func TestPublicKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		private string
+		public  string
+	}{
+		{
+			name:    "alice",
+			private: "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+			public:  "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+		},
+		{
+			name:    "bob",
+			private: "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+			public:  "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			private, public := fromHex(t, tt.private), fromHex(t, tt.public)
+			if got := private.PublicKey(); got != public {
+				t.Errorf("PublicKey() = %x, want %s", got, tt.public)
+			}
+			got, err := PublicKeyOf(private.String())
+			if err != nil || got != public.String() {
+				t.Errorf("PublicKeyOf(%s) = %s, %v; want %s", private, got, err, public)
+			}
+		})
+	}
+}
+
+// wg pubkey clamps the private key before deriving, so a key that was not
+// clamped has the same public key as its clamped form.
+func TestPublicKeyClamps(t *testing.T) {
+	var unclamped, clamped Key
+	for i := range unclamped {
+		unclamped[i], clamped[i] = 0xff, 0xff
+	}
+	clamped[0] &= 248
+	clamped[31] = clamped[31]&127 | 64
+	if unclamped.PublicKey() != clamped.PublicKey() {
+		t.Errorf("PublicKey() of an unclamped key = %s, want %s", unclamped.PublicKey(), clamped.PublicKey())
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	seen := map[Key]bool{}
+	for i := 0; i < 64; i++ {
+		k, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+			t.Fatalf("Generate() = %x, not clamped", k)
+		}
+		if seen[k] {
+			t.Fatalf("Generate() returned %s twice", k)
+		}
+		seen[k] = true
+		if k.PublicKey() == (Key{}) {
+			t.Fatalf("PublicKey() of %s is zero", k)
+		}
+	}
+
+	psk, err := GeneratePreshared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psk == (Key{}) {
+		t.Error("GeneratePreshared() returned a zero key")
+	}
+}
+
+func TestParse(t *testing.T) {
+	valid := "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="
+	tests := []struct {
+		name    string
+		in      string
+		wantErr bool
+	}{
+		{name: "valid", in: valid},
+		{name: "empty", in: "", wantErr: true},
+		{name: "unpadded", in: strings.TrimSuffix(valid, "="), wantErr: true},
+		{name: "url encoding", in: base64.URLEncoding.EncodeToString([]byte{0xfb, 0xff, 31: 0}), wantErr: true},
+		{name: "short", in: base64.StdEncoding.EncodeToString(make([]byte, Size-1)), wantErr: true},
+		{name: "long", in: base64.StdEncoding.EncodeToString(make([]byte, Size+1)), wantErr: true},
+		{name: "hex", in: "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a", wantErr: true},
+		{name: "whitespace", in: " " + valid, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Parse(tt.in)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("Parse(%q) = %s, %v; want ErrInvalid", tt.in, k, err)
+				}
+				if _, err := PublicKeyOf(tt.in); !errors.Is(err, ErrInvalid) {
+					t.Errorf("PublicKeyOf(%q) = %v, want ErrInvalid", tt.in, err)
+				}
+				return
+			}
+			if err != nil || k.String() != tt.in {
+				t.Errorf("Parse(%q) = %s, %v; want it back", tt.in, k, err)
+			}
+		})
+	}
+}
@@ -101,14 +101,63 @@ export const deleteDevice = (id: number) =>
 export const rebootDevice = (id: number) =>
   api.post(`/devices/${id}/reboot`)
 
+export const pingDevice = (id: number, timeout?: number) =>
+  api.post(`/devices/${id}/ping`, null, { params: { timeout } })
+
+export const getDeviceSystemInfo = (id: number, timeout?: number) =>
+  api.get(`/devices/${id}/system-info`, { params: { timeout } })
+
+export const runDiagnostic = (
+  id: number,
+  data: { action: string; target?: string; count?: number; server?: string; port?: number; duration?: number; reverse?: boolean; url?: string; record_type?: string },
+  wait = false,
+) => api.post(`/devices/${id}/diagnostics`, data, { params: wait ? { wait: true } : undefined })
+
+export const getDiagnostics = (id: number, params?: { action?: string; page?: number; page_size?: number }) =>
+  api.get(`/devices/${id}/diagnostics`, { params })
+
+export const getDiagnostic = (id: number, diagId: number) =>
+  api.get(`/devices/${id}/diagnostics/${diagId}`)
+
+export interface LogQuery {
+  device_id?: number
+  source?: 'logread' | 'syslog'
+  tag?: string
+  severity?: string
+  hostname?: string
+  q?: string
+  from?: string
+  to?: string
+  page?: number
+  page_size?: number
+}
+
+export const fetchDeviceLogs = (id: number, data: { lines?: number; tag?: string; priority?: string } = {}) =>
+  api.post(`/devices/${id}/logs/fetch`, data)
+
+export const setLogForwarding = (id: number, data: { enabled: boolean; host?: string; port?: number; proto?: 'udp' | 'tcp' }) =>
+  api.put(`/devices/${id}/logs/forwarding`, data)
+
+export const getDeviceLogs = (id: number, params?: Omit<LogQuery, 'device_id'>) =>
+  api.get(`/devices/${id}/logs`, { params })
+
+export const searchLogs = (params?: LogQuery) =>
+  api.get('/logs', { params })
+
 export const bulkDeleteDevices = (ids: number[]) =>
   api.post('/devices/bulk/delete', { ids })
 
 export const bulkRebootDevices = (ids: number[]) =>
   api.post('/devices/bulk/reboot', { ids })
 
-export const getDeviceMetrics = (id: number) =>
-  api.get(`/devices/${id}/metrics`)
+export const getDeviceMetrics = (id: number, params?: { hours?: number; from?: string; to?: string; step?: string; agg?: string }) =>
+  api.get(`/devices/${id}/metrics`, { params })
+
+export const getDeviceDetailMetrics = (
+  id: number,
+  kind: 'interfaces' | 'filesystems' | 'thermal' | 'wireless',
+  params?: { hours?: number; from?: string; to?: string; interface?: string; mount?: string; zone?: string; latest?: boolean },
+) => api.get(`/devices/${id}/metrics/${kind}`, { params })
 
 export const exportDevicesCSV = (params?: Record<string, string>) =>
   api.get('/devices/export', { params, responseType: 'blob' })
@@ -129,9 +178,15 @@ export const deleteTemplate = (id: number) =>
 export const pushConfig = (deviceId: number, data: { template_id?: number; content?: string }) =>
   api.post(`/devices/${deviceId}/config/push`, data)
 
+export const importConfig = (deviceId: number, data: { content?: string; packages?: string[]; dry_run?: boolean; overwrite?: boolean }) =>
+  api.post(`/devices/${deviceId}/config/import`, data)
+
 export const getConfigHistory = (deviceId: number) =>
   api.get(`/devices/${deviceId}/config/history`)
 
+export const validateConfig = (deviceId: number, source?: string) =>
+  api.get(`/devices/${deviceId}/config/validate`, { params: source ? { source } : {} })
+
 // Dashboard
 export const getDashboardSummary = () =>
   api.get('/dashboard/summary')
@@ -147,6 +202,62 @@ export const deleteUser = (id: number) => api.delete(`/users/${id}`)
 // Audit
 export const getAuditLogs = (params?: Record<string, string | number>) => api.get('/audit-logs', { params })
 
+// Web terminal (admin)
+export const getSSHCredential = (id: number) => api.get(`/devices/${id}/ssh-credential`)
+export const setSSHCredential = (id: number, data: { username: string; password?: string; port?: number }) =>
+  api.put(`/devices/${id}/ssh-credential`, data)
+export const deleteSSHCredential = (id: number) => api.delete(`/devices/${id}/ssh-credential`)
+export const resetTunnelKey = (id: number) => api.delete(`/devices/${id}/tunnel-key`)
+export const getShellSessions = (params?: { device_id?: number; username?: string; page?: number; page_size?: number }) =>
+  api.get('/shell-sessions', { params })
+export const getShellRecording = (sessionId: number) =>
+  api.get(`/shell-sessions/${sessionId}/recording`, { responseType: 'text' })
+export const getSSHPublicKey = () => api.get('/ssh/public-key')
+export const deploySSHKey = (id: number, data: { remove_password?: boolean } = {}) =>
+  api.post(`/devices/${id}/ssh-credential/deploy-key`, data)
+export const resetSSHHostKey = (id: number) => api.delete(`/devices/${id}/ssh-host-key`)
+export const downloadDeviceFile = (id: number, path: string) =>
+  api.get(`/devices/${id}/files`, { params: { path }, responseType: 'blob' })
+export const uploadDeviceFile = (id: number, path: string, data: Blob, mode?: string) =>
+  api.put(`/devices/${id}/files`, data, { params: { path, mode }, headers: { 'Content-Type': 'application/octet-stream' } })
+export const getTunnels = () => api.get('/tunnels')
+export const getDeviceTunnel = (id: number) => api.get(`/devices/${id}/tunnel`)
+export const openTunnel = (id: number) => api.post(`/devices/${id}/tunnel`)
+export const closeTunnel = (id: number) => api.delete(`/devices/${id}/tunnel`)
+export const createTunnelSession = (id: number, data: { port: number; ttl_minutes?: number; allowed_ip?: string }) =>
+  api.post(`/devices/${id}/tunnel/sessions`, data)
+export const getTunnelSessions = (params?: { device_id?: number; status?: string; page?: number; page_size?: number }) =>
+  api.get('/tunnel-sessions', { params })
+export const closeTunnelSession = (sessionId: number) => api.delete(`/tunnel-sessions/${sessionId}`)
+
+// Agentless onboarding over SSH (admin)
+export const createOnboardingJob = (data: {
+  target: string
+  username?: string
+  password?: string
+  use_key?: boolean
+  port?: number
+  server_url?: string
+  mqtt_broker?: string
+  mqtt_port?: number
+  heartbeat_interval?: number
+  package?: string
+  device_name?: string
+}) => api.post('/onboarding', data)
+export const getOnboardingJobs = (params?: { status?: string; page?: number; page_size?: number }) =>
+  api.get('/onboarding', { params })
+export const getOnboardingJob = (id: number) => api.get(`/onboarding/${id}`)
+export const cancelOnboardingJob = (id: number) => api.delete(`/onboarding/${id}`)
+
+// WebSocket URL of a terminal session; see specs/03-devices.md for the frame protocol
+export const shellSocketURL = (id: number, opts: { transport?: 'auto' | 'ssh' | 'tunnel'; cols?: number; rows?: number } = {}) => {
+  const proto = location.protocol === 'https:' ? 'wss:' : 'ws:'
+  const params = new URLSearchParams({ token: localStorage.getItem('token') || '', transport: opts.transport || 'auto' })
+  if (opts.cols) params.set('cols', String(opts.cols))
+  if (opts.rows) params.set('rows', String(opts.rows))
+  return `${proto}//${location.host}/ws/devices/${id}/shell?${params}`
+}
+
 // Firewall
 export const getFirewallZones = (deviceId?: number) =>
   api.get('/firewall/zones', { params: deviceId ? { device_id: deviceId } : {} })
@@ -158,6 +269,7 @@ export const getFirewallRules = (deviceId?: number) =>
 export const createFirewallRule = (data: any) => api.post('/firewall/rules', data)
 export const updateFirewallRule = (id: number, data: any) => api.put(`/firewall/rules/${id}`, data)
 export const deleteFirewallRule = (id: number) => api.delete(`/firewall/rules/${id}`)
+export const previewFirewall = (deviceId: number) => api.get(`/firewall/preview/${deviceId}`)
 export const applyFirewall = (deviceId: number) => api.post(`/firewall/apply/${deviceId}`)
 
 // VPN
@@ -166,12 +278,34 @@ export const getVPNInterfaces = (deviceId?: number) =>
 export const createVPNInterface = (data: any) => api.post('/vpn/interfaces', data)
 export const updateVPNInterface = (id: number, data: any) => api.put(`/vpn/interfaces/${id}`, data)
 export const deleteVPNInterface = (id: number) => api.delete(`/vpn/interfaces/${id}`)
+// Answers 202 at once; poll getVPNKeyRotation until the status is no longer "running".
+export const rotateVPNInterfaceKey = (id: number, force = false) =>
+  api.post(`/vpn/interfaces/${id}/rotate-key`, null, { params: force ? { force: true } : {} })
+export const getVPNKeyRotation = (id: number) => api.get(`/vpn/key-rotations/${id}`)
 export const getVPNPeers = (interfaceId?: number) =>
   api.get('/vpn/peers', { params: interfaceId ? { interface_id: interfaceId } : {} })
-export const createVPNPeer = (data: any) => api.post('/vpn/peers', data)
-export const updateVPNPeer = (id: number, data: any) => api.put(`/vpn/peers/${id}`, data)
+export const createVPNPeer = (data: any, allocateAddress = false, generatePSK = false) =>
+  api.post('/vpn/peers', data, {
+    params: { ...(allocateAddress ? { allocate_address: true } : {}), ...(generatePSK ? { generate_psk: true } : {}) },
+  })
+export const updateVPNPeer = (id: number, data: any, generatePSK = false) =>
+  api.put(`/vpn/peers/${id}`, data, { params: generatePSK ? { generate_psk: true } : {} })
 export const deleteVPNPeer = (id: number) => api.delete(`/vpn/peers/${id}`)
+export const previewVPN = (deviceId: number) => api.get(`/vpn/preview/${deviceId}`)
 export const applyVPN = (deviceId: number) => api.post(`/vpn/apply/${deviceId}`)
+export const getVPNNetworks = () => api.get('/vpn/networks')
+export const getVPNNetwork = (id: number) => api.get(`/vpn/networks/${id}`)
+export const createVPNNetwork = (data: any) => api.post('/vpn/networks', data)
+export const updateVPNNetwork = (id: number, data: any, apply = true) =>
+  api.put(`/vpn/networks/${id}`, data, { params: apply ? {} : { apply: false } })
+export const deleteVPNNetwork = (id: number) => api.delete(`/vpn/networks/${id}`)
+export const applyVPNNetwork = (id: number) => api.post(`/vpn/networks/${id}/apply`)
+export const addVPNNetworkMember = (id: number, data: any, apply = true) =>
+  api.post(`/vpn/networks/${id}/members`, data, { params: apply ? {} : { apply: false } })
+export const updateVPNNetworkMember = (id: number, memberId: number, data: any, apply = true) =>
+  api.put(`/vpn/networks/${id}/members/${memberId}`, data, { params: apply ? {} : { apply: false } })
+export const removeVPNNetworkMember = (id: number, memberId: number, apply = true) =>
+  api.delete(`/vpn/networks/${id}/members/${memberId}`, { params: apply ? {} : { apply: false } })
 
 // Firmware
 export const getFirmwares = (target?: string) =>
@@ -203,6 +337,7 @@ export const getMWANRules = (deviceId?: number) =>
 export const createMWANRule = (data: any) => api.post('/network/mwan/rules', data)
 export const updateMWANRule = (id: number, data: any) => api.put(`/network/mwan/rules/${id}`, data)
 export const deleteMWANRule = (id: number) => api.delete(`/network/mwan/rules/${id}`)
+export const previewMWAN = (deviceId: number) => api.get(`/network/mwan/preview/${deviceId}`)
 export const applyMWAN = (deviceId: number) => api.post(`/network/mwan/apply/${deviceId}`)
 
 // DHCP
@@ -216,6 +351,7 @@ export const getStaticLeases = (deviceId?: number) =>
 export const createStaticLease = (data: any) => api.post('/network/dhcp/leases', data)
 export const updateStaticLease = (id: number, data: any) => api.put(`/network/dhcp/leases/${id}`, data)
 export const deleteStaticLease = (id: number) => api.delete(`/network/dhcp/leases/${id}`)
+export const previewDHCP = (deviceId: number) => api.get(`/network/dhcp/preview/${deviceId}`)
 export const applyDHCP = (deviceId: number) => api.post(`/network/dhcp/apply/${deviceId}`)
 
 // VLAN
@@ -224,8 +360,26 @@ export const getVLANs = (deviceId?: number) =>
 export const createVLAN = (data: any) => api.post('/network/vlans', data)
 export const updateVLAN = (id: number, data: any) => api.put(`/network/vlans/${id}`, data)
 export const deleteVLAN = (id: number) => api.delete(`/network/vlans/${id}`)
+export const previewVLAN = (deviceId: number) => api.get(`/network/vlans/preview/${deviceId}`)
 export const applyVLAN = (deviceId: number) => api.post(`/network/vlans/apply/${deviceId}`)
 
+// IPAM
+export const getIPPools = () => api.get('/ipam/pools')
+export const createIPPool = (data: any) => api.post('/ipam/pools', data)
+export const updateIPPool = (id: number, data: any) => api.put(`/ipam/pools/${id}`, data)
+export const deleteIPPool = (id: number) => api.delete(`/ipam/pools/${id}`)
+export const getIPAllocations = (params?: { pool_id?: number; device_id?: number }) =>
+  api.get('/ipam/allocations', { params })
+export const allocateSubnet = (poolId: number, data: any) => api.post(`/ipam/pools/${poolId}/allocations`, data)
+export const releaseSubnet = (id: number) => api.delete(`/ipam/allocations/${id}`)
+export const getIPAMUtilization = () => api.get('/ipam/utilization')
+export const getIPAMOverlaps = () => api.get('/ipam/overlaps')
+// Number a new VLAN or WireGuard interface from a pool instead of ip_addr/address.
+export const createVLANFromPool = (data: any, poolId: number, prefixLen?: number) =>
+  api.post('/network/vlans', data, { params: { ipam_pool: poolId, prefix_len: prefixLen } })
+export const createVPNInterfaceFromPool = (data: any, poolId: number, prefixLen?: number) =>
+  api.post('/vpn/interfaces', data, { params: { ipam_pool: poolId, prefix_len: prefixLen } })
+
 // Settings
 export const getSettings = (category?: string) =>
   api.get('/settings', { params: category ? { category } : {} })
@@ -241,6 +395,33 @@ export const getAlerts = (params?: Record<string, string>) =>
   api.get('/alerts', { params })
 export const getAlertSummary = () => api.get('/alerts/summary')
 export const resolveAlert = (id: number) => api.post(`/alerts/${id}/resolve`)
+export const ackAlert = (id: number, comment?: string) => api.post(`/alerts/${id}/ack`, { comment })
+export const getAlertSilences = (params?: Record<string, string>) =>
+  api.get('/alerts/silences', { params })
+export const createAlertSilence = (data: any) => api.post('/alerts/silences', data)
+export const expireAlertSilence = (id: number) => api.delete(`/alerts/silences/${id}`)
+export const getAlertEscalations = (id: number) => api.get(`/alerts/${id}/escalations`)
+
+// Incidents
+export const getIncidents = (params?: Record<string, string>) =>
+  api.get('/incidents', { params })
+export const getIncident = (id: number) => api.get(`/incidents/${id}`)
+export const resolveIncident = (id: number) => api.post(`/incidents/${id}/resolve`)
+
+// Escalation & on-call
+export const getEscalationPolicies = () => api.get('/escalation/policies')
+export const createEscalationPolicy = (data: any) => api.post('/escalation/policies', data)
+export const updateEscalationPolicy = (id: number, data: any) => api.put(`/escalation/policies/${id}`, data)
+export const deleteEscalationPolicy = (id: number) => api.delete(`/escalation/policies/${id}`)
+export const getNotificationChannels = () => api.get('/escalation/channels')
+export const createNotificationChannel = (data: any) => api.post('/escalation/channels', data)
+export const updateNotificationChannel = (id: number, data: any) => api.put(`/escalation/channels/${id}`, data)
+export const deleteNotificationChannel = (id: number) => api.delete(`/escalation/channels/${id}`)
+export const getOnCallSchedules = () => api.get('/oncall/schedules')
+export const createOnCallSchedule = (data: any) => api.post('/oncall/schedules', data)
+export const updateOnCallSchedule = (id: number, data: any) => api.put(`/oncall/schedules/${id}`, data)
+export const deleteOnCallSchedule = (id: number) => api.delete(`/oncall/schedules/${id}`)
+export const getCurrentOnCall = (id: number) => api.get(`/oncall/schedules/${id}/current`)
 
 /** Extract error message from Axios error response, with fallback. */
 export function apiErr(e: any, fallback: string): string {